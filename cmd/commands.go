@@ -1,15 +1,23 @@
 package cmd
 
 import (
+	stdcontext "context"
 	"fmt"
+	"maps"
+	"math"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Lewis-404/axe/internal/agent"
 	"github.com/Lewis-404/axe/internal/commands"
+	"github.com/Lewis-404/axe/internal/config"
 	"github.com/Lewis-404/axe/internal/context"
 	"github.com/Lewis-404/axe/internal/git"
 	"github.com/Lewis-404/axe/internal/history"
@@ -47,11 +55,13 @@ var slashHandlers = map[string]cmdHandler{
 	"/diff":    cmdDiff,
 	"/retry":   cmdRetry,
 	"/export":  cmdExport,
-	"/init":    func(*cmdCtx) {},
+	"/init":    cmdInit,
 	"/git":     cmdGit,
 	"/context": cmdContext,
 	"/skills":  cmdSkills,
 	"/skill":   cmdSkill,
+	"/note":    cmdNote,
+	"/plan":    cmdPlan,
 	"/help":    cmdHelp,
 }
 
@@ -59,7 +69,7 @@ var slashHandlers = map[string]cmdHandler{
 func resumeConversation(ag *agent.Agent, path string, msgs []llm.Message, savePath *string, label string) {
 	ag.SetMessages(msgs)
 	dir, _ := os.Getwd()
-	ag.RefreshSystem(fmt.Sprintf(systemPrompt, context.Collect(dir)))
+	ag.SetProjectContext(context.Collect(dir))
 	*savePath = path
 	fmt.Printf("🔄 %s（%d 条消息）\n", label, len(msgs))
 	ui.PrintHistory(msgs)
@@ -84,6 +94,14 @@ func cmdClear(c *cmdCtx) {
 
 func cmdModel(c *cmdCtx) {
 	if len(c.parts) > 1 {
+		switch c.parts[1] {
+		case "list":
+			cmdModelList(c)
+			return
+		case "pull":
+			cmdModelPull(c)
+			return
+		}
 		if c.client.SwitchModel(c.parts[1]) {
 			fmt.Printf("✅ 模型已切换为: %s\n", c.parts[1])
 		} else {
@@ -93,6 +111,102 @@ func cmdModel(c *cmdCtx) {
 	} else {
 		fmt.Printf("当前模型: %s\n", c.client.ModelName())
 		fmt.Printf("可用模型: %s\n", strings.Join(c.client.ListModels(), ", "))
+		printRouteStatus(c.client.RouteStatus())
+	}
+}
+
+// printRouteStatus shows the routing policy and how each model has been
+// doing.
+func printRouteStatus(s llm.RouteStatus) {
+	fmt.Printf("路由策略: %s\n", s.Policy)
+	if len(s.Rules) > 0 {
+		tasks := slices.Sorted(maps.Keys(s.Rules))
+		var rules []string
+		for _, t := range tasks {
+			rules = append(rules, t+" → "+s.Rules[t])
+		}
+		fmt.Printf("任务规则: %s\n", strings.Join(rules, ", "))
+	}
+	for _, m := range s.Models {
+		line := "  " + m.Model
+		if !math.IsInf(m.Price, 1) {
+			line += fmt.Sprintf("  $%.2f/M", m.Price)
+		}
+		if m.Latency > 0 {
+			line += fmt.Sprintf("  ~%s", m.Latency.Round(100*time.Millisecond))
+		}
+		if !m.OpenUntil.IsZero() {
+			line += fmt.Sprintf("  🔴 熔断中（%s 后恢复）", time.Until(m.OpenUntil).Round(time.Second))
+		} else if m.Failures > 0 {
+			line += fmt.Sprintf("  连续失败 %d 次", m.Failures)
+		}
+		fmt.Println(line)
+	}
+	for _, e := range s.Recent {
+		fmt.Printf("最近路由: %s → %s（%s）\n", e.Task, e.Model, routeReasons[e.Reason])
+	}
+}
+
+// ollamaURL returns the server of the first configured ollama model, or
+// the default one.
+func ollamaURL(client *llm.Client) string {
+	for _, m := range client.ListModels() {
+		if mc := client.ConfigOf(m); mc != nil && mc.IsOllama() && mc.BaseURL != "" {
+			return mc.BaseURL
+		}
+	}
+	return config.OllamaHost()
+}
+
+func cmdModelList(c *cmdCtx) {
+	url := ollamaURL(c.client)
+	models, err := llm.OllamaList(stdcontext.Background(), url)
+	if err != nil {
+		ui.PrintError(err)
+		return
+	}
+	if len(models) == 0 {
+		fmt.Printf("Ollama (%s) 上没有本地模型，使用 /model pull <name> 下载\n", url)
+		return
+	}
+	fmt.Printf("Ollama 本地模型 (%s):\n", url)
+	for _, m := range models {
+		mark := " "
+		if c.client.ConfigOf(m.Name) != nil {
+			mark = "✓"
+		}
+		fmt.Printf("  %s %-30s %6.1f GB\n", mark, m.Name, float64(m.Size)/1e9)
+	}
+	fmt.Println("  ✓ = 已在配置中，可用 /model <name> 切换")
+}
+
+func cmdModelPull(c *cmdCtx) {
+	if len(c.parts) < 3 {
+		fmt.Println("用法: /model pull <name>，如 /model pull qwen3:8b")
+		return
+	}
+	name := c.parts[2]
+	ctx, stop := signal.NotifyContext(stdcontext.Background(), os.Interrupt)
+	defer stop()
+	last := ""
+	err := llm.OllamaPull(ctx, ollamaURL(c.client), name, func(p llm.PullProgress) {
+		line := p.Status
+		if p.Total > 0 {
+			line += fmt.Sprintf(" %d%%", p.Completed*100/p.Total)
+		}
+		if line != last {
+			fmt.Printf("\r\033[K⬇️  %s", line)
+			last = line
+		}
+	})
+	fmt.Println()
+	if err != nil {
+		ui.PrintError(err)
+		return
+	}
+	fmt.Printf("✅ 已下载 %s\n", name)
+	if c.client.ConfigOf(name) == nil {
+		fmt.Printf("   在配置中添加 provider: ollama, model: %s 后即可使用\n", name)
 	}
 }
 
@@ -154,25 +268,60 @@ func cmdResume(c *cmdCtx) {
 	}
 }
 
+var compactTierNames = map[string]string{
+	agent.TierElide: "省略旧工具输出",
+	agent.TierTurns: "摘要较早的轮次",
+	agent.TierFull:  "完整摘要",
+}
+
 func cmdCompact(c *cmdCtx) {
+	if len(c.parts) == 2 && c.parts[1] == "undo" {
+		if c.ag.RestoreCompacted() {
+			fmt.Println("🗜️ 已恢复压缩前的对话")
+		} else {
+			fmt.Println("🗜️ 当前对话未被压缩")
+		}
+		return
+	}
 	hint := ""
 	if len(c.parts) > 1 {
 		hint = strings.Join(c.parts[1:], " ")
 	}
-	if err := c.ag.Compact(hint); err != nil {
+	if err := c.ag.Compact(stdcontext.Background(), hint); err != nil {
 		ui.PrintError(err)
-	} else {
-		fmt.Println("🗜️ 对话上下文已压缩")
 	}
 }
 
 func cmdCost(c *cmdCtx) {
-	in, out := c.ag.TotalUsage()
-	cost := pricing.Cost(c.client.ModelName(), in, out)
+	byModel := c.ag.TotalUsage()
+	u := byModel.Total()
+	cost := usageCost(byModel)
 	if cost > 0 {
-		fmt.Printf("📊 累计: ↑%s ↓%s | 💰 $%.4f\n", ui.FmtTokens(in), ui.FmtTokens(out), cost)
+		fmt.Printf("📊 累计: ↑%s ↓%s%s | 💰 $%.4f\n", ui.FmtTokens(u.PromptTokens()), ui.FmtTokens(u.OutputTokens), ui.FmtUsageDetail(u), cost)
 	} else {
-		ui.PrintTotalUsage(in, out)
+		ui.PrintTotalUsage(u)
+	}
+	if len(byModel) < 2 {
+		return
+	}
+	models := make([]string, 0, len(byModel))
+	for m := range byModel {
+		models = append(models, m)
+	}
+	sort.Strings(models)
+	for _, m := range models {
+		mu := byModel[m]
+		label := m
+		if p := c.client.ProviderOf(m); p != "" {
+			label += " (" + p + ")"
+		}
+		line := fmt.Sprintf("  • %s: ↑%s ↓%s%s", label, ui.FmtTokens(mu.PromptTokens()), ui.FmtTokens(mu.OutputTokens), ui.FmtUsageDetail(mu))
+		if mc := usageCost(llm.UsageByModel{m: mu}); mc > 0 {
+			line += fmt.Sprintf(" | $%.4f", mc)
+		} else if _, ok := pricing.Lookup(m); !ok && c.client.ProviderOf(m) != "ollama" {
+			line += " | 未知价格"
+		}
+		fmt.Println(line)
 	}
 }
 
@@ -238,12 +387,30 @@ func cmdAsk(c *cmdCtx) {
 		return
 	}
 	fmt.Printf("🔄 临时使用 %s\n", modelName)
-	if err := c.ag.Run(prompt); err != nil {
+	if err := runAgent(c.ag, prompt, *c.savePath); err != nil {
 		ui.PrintError(err)
 	}
 	c.client.SwitchModel(origModel)
 }
 
+// initPrompt asks the agent to write CLAUDE.md, starting from an outline of
+// what the project looks like.
+const initPrompt = `Analyze this project and write a CLAUDE.md in its root directory for future coding sessions. Cover what the project does, its architecture and key directories, how to build, test and run it, and the conventions the code follows. Read the code rather than guessing, and keep it concise. If CLAUDE.md already exists, improve it instead of starting over.
+
+Start from this outline and fill in the placeholders:
+
+%s`
+
+func cmdInit(c *cmdCtx) {
+	dir, _ := os.Getwd()
+	fmt.Println("📝 正在分析项目并生成 CLAUDE.md...")
+	if err := runAgentTask(c.ag, llm.TaskInit, fmt.Sprintf(initPrompt, context.GenerateCLAUDEMD(dir)), *c.savePath); err != nil {
+		ui.PrintError(err)
+		return
+	}
+	c.ag.SetProjectContext(context.Collect(dir))
+}
+
 func cmdBudget(c *cmdCtx) {
 	if len(c.parts) < 2 {
 		fmt.Println("用法: /budget <美元金额>  (如 /budget 0.5)")
@@ -260,10 +427,7 @@ func cmdBudget(c *cmdCtx) {
 		fmt.Println("❌ 请输入有效金额")
 		return
 	}
-	model := c.client.ModelName()
-	c.ag.SetBudget(val, func(in, out int) float64 {
-		return pricing.Cost(model, in, out)
-	})
+	c.ag.SetBudget(val, usageCost)
 	fmt.Printf("💰 预算已设为 $%.2f\n", val)
 }
 
@@ -288,7 +452,7 @@ func cmdRetry(c *cmdCtx) {
 		fmt.Println("⚠️ 没有可重试的对话")
 	} else {
 		fmt.Println("🔄 重试上一轮...")
-		if err := c.ag.Run(last); err != nil {
+		if err := runAgent(c.ag, last, *c.savePath); err != nil {
 			ui.PrintError(err)
 		}
 	}
@@ -357,9 +521,42 @@ func cmdGit(c *cmdCtx) {
 }
 
 func cmdContext(c *cmdCtx) {
-	in, out := c.ag.TotalUsage()
+	b := c.ag.ContextBreakdown(stdcontext.Background())
 	msgs := c.ag.Messages()
-	fmt.Printf("📊 上下文: %d 条消息, ↑%s ↓%s\n", len(msgs), ui.FmtTokens(in), ui.FmtTokens(out))
+	how := "本地估算"
+	if b.Exact {
+		how = "API 精确计数"
+	}
+	fmt.Printf("📊 上下文: %s / %s tokens (%.1f%%, %s), %d 条消息\n",
+		ui.FmtTokens(b.Total), ui.FmtTokens(b.Window), percent(b.Total, b.Window), how, len(msgs))
+	for _, part := range []struct {
+		label string
+		n     int
+	}{
+		{"系统提示", b.System},
+		{"工具定义", b.Tools},
+		{"对话消息", b.History},
+		{"工具结果", b.ToolResults},
+	} {
+		fmt.Printf("  • %s %8s  %5.1f%%\n", part.label, ui.FmtTokens(part.n), percent(part.n, b.Window))
+		if part.label == "系统提示" {
+			for _, sk := range b.Skills {
+				fmt.Printf("      🧩 %s %s\n", sk.Name, ui.FmtTokens(sk.Tokens))
+			}
+			if n := len(c.ag.Notes()); n > 0 {
+				fmt.Printf("      📝 %d 条会话笔记\n", n)
+			}
+		}
+	}
+	u := c.ag.TotalUsage().Total()
+	fmt.Printf("  累计计费: ↑%s ↓%s%s\n", ui.FmtTokens(u.PromptTokens()), ui.FmtTokens(u.OutputTokens), ui.FmtUsageDetail(u))
+}
+
+func percent(n, of int) float64 {
+	if of <= 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(of)
 }
 
 func cmdSkills(c *cmdCtx) {
@@ -368,14 +565,48 @@ func cmdSkills(c *cmdCtx) {
 		return
 	}
 	fmt.Printf("📦 已加载 %d 个技能 (使用 /skill <name> 激活):\n", len(pkgSkills))
+	active := c.ag.ActiveSkills()
 	for _, s := range pkgSkills {
-		fmt.Printf("  • %s — %s\n", s.Name, s.Description)
+		mark := "•"
+		if slices.Contains(active, s.Name) {
+			mark = "✓"
+		}
+		fmt.Printf("  %s %s — %s\n", mark, s.Name, s.Description)
+	}
+}
+
+func cmdNote(c *cmdCtx) {
+	text := strings.TrimSpace(strings.TrimPrefix(strings.Join(c.parts, " "), c.parts[0]))
+	switch text {
+	case "":
+		notes := c.ag.Notes()
+		if len(notes) == 0 {
+			fmt.Println("📝 没有会话笔记（/note <text> 添加）")
+			return
+		}
+		for i, n := range notes {
+			fmt.Printf("  %d. %s\n", i+1, n)
+		}
+	case "clear":
+		c.ag.ClearNotes()
+		fmt.Println("📝 已清空会话笔记")
+	default:
+		c.ag.AddNote(text)
+		fmt.Println("📝 已添加会话笔记")
 	}
 }
 
 func cmdSkill(c *cmdCtx) {
 	if len(c.parts) < 2 {
-		fmt.Println("用法: /skill <name>")
+		fmt.Println("用法: /skill <name> | /skill off <name>")
+		return
+	}
+	if c.parts[1] == "off" && len(c.parts) == 3 {
+		if c.ag.DeactivateSkill(c.parts[2]) {
+			fmt.Printf("🧩 已停用技能: %s\n", c.parts[2])
+		} else {
+			fmt.Printf("❌ 技能未激活: %s\n", c.parts[2])
+		}
 		return
 	}
 	s := skills.FindSkill(pkgSkills, c.parts[1])
@@ -388,7 +619,7 @@ func cmdSkill(c *cmdCtx) {
 		ui.PrintError(err)
 		return
 	}
-	c.ag.InjectContext(fmt.Sprintf("[Skill: %s]\n%s", s.Name, content))
+	c.ag.ActivateSkill(s.Name, content)
 	fmt.Printf("🧩 已激活技能: %s\n", s.Name)
 }
 
@@ -396,12 +627,15 @@ func cmdHelp(c *cmdCtx) {
 	fmt.Println("可用命令:")
 	fmt.Println("  /clear          清空对话上下文")
 	fmt.Println("  /compact [hint]  压缩对话上下文")
+	fmt.Println("  /compact undo   恢复压缩前的对话")
 	fmt.Println("  /fork           从当前对话创建分支")
 	fmt.Println("  /init           为当前项目生成 CLAUDE.md")
 	fmt.Println("  /list           查看最近对话记录")
 	fmt.Println("  /resume         选择并恢复对话")
 	fmt.Println("  /model          显示当前和可用模型")
 	fmt.Println("  /model <name>   切换模型")
+	fmt.Println("  /model list     列出 Ollama 本地模型")
+	fmt.Println("  /model pull <name>  从 Ollama 下载模型")
 	fmt.Println("  /ask <m> <p>    临时用另一个模型回答")
 	fmt.Println("  /search <kw>    搜索历史对话")
 	fmt.Println("  /undo           撤销上一次 git commit")
@@ -413,6 +647,10 @@ func cmdHelp(c *cmdCtx) {
 	fmt.Println("  /budget <$>     设置费用上限 (off 关闭)")
 	fmt.Println("  /cost           显示累计 token 用量和费用")
 	fmt.Println("  /skills         列出已加载的技能")
+	fmt.Println("  /skill off <n>  停用已激活的技能")
+	fmt.Println("  /note <text>    添加会话笔记到系统提示 (clear 清空)")
+	fmt.Println("  /plan [task]    计划模式：只读调研，审批计划后再执行")
+	fmt.Println("  /plan status    查看计划进度 (off 退出计划模式)")
 	fmt.Println("  /exit           退出 Axe")
 	fmt.Println("  /help           显示此帮助")
 	fmt.Println("  💡 支持图片: 在 prompt 中直接写图片路径")
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	stdcontext "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/agent"
+	"github.com/Lewis-404/axe/internal/llm"
+)
+
+// Output formats for --output-format. Both imply --print.
+const (
+	formatText       = "text"
+	formatJSON       = "json"        // one result object at the end, events included
+	formatStreamJSON = "stream-json" // one JSON object per line as things happen
+)
+
+// Exit codes for single-shot runs, so scripts can tell why axe stopped.
+const (
+	exitError       = 1
+	exitBudget      = 2
+	exitLimit       = 3 // a loop limit: iterations, tool errors, repeats or time
+	exitInterrupted = 130
+)
+
+// jsonOutput is the agent sink for the JSON output formats.
+type jsonOutput struct {
+	w      io.Writer
+	stream bool
+
+	mu     sync.Mutex
+	text   strings.Builder // current assistant block
+	last   string          // last complete assistant block
+	events []map[string]any
+	total  llm.UsageByModel
+	plan   bool // a plan was submitted (plan mode)
+	start  time.Time
+}
+
+func newJSONOutput(w io.Writer, format string) *jsonOutput {
+	return &jsonOutput{w: w, stream: format == formatStreamJSON, start: time.Now()}
+}
+
+func (o *jsonOutput) Emit(e agent.Event) {
+	switch e.Type {
+	case agent.EventTextDelta:
+		o.text.WriteString(e.Text)
+	case agent.EventBlockDone:
+		if o.text.Len() == 0 {
+			return
+		}
+		o.last = o.text.String()
+		o.text.Reset()
+		o.write(map[string]any{"type": "assistant", "text": o.last})
+	case agent.EventToolStart:
+		o.write(map[string]any{"type": "tool_use", "id": e.Tool.ID, "name": e.Tool.Name, "input": e.Tool.Input})
+	case agent.EventToolEnd:
+		o.write(map[string]any{"type": "tool_result", "id": e.Tool.ID, "name": e.Tool.Name,
+			"content": e.Tool.Result, "is_error": e.Tool.IsError, "duration_ms": e.Tool.Duration.Milliseconds()})
+	case agent.EventUsage:
+		o.total = e.Usage.Total
+		o.write(map[string]any{"type": "usage", "round": e.Usage.Round, "total": e.Usage.Total, "total_cost_usd": usageCost(e.Usage.Total)})
+	case agent.EventNotice:
+		o.write(map[string]any{"type": "notice", "text": e.Text})
+	case agent.EventCompact:
+		o.write(map[string]any{"type": "compact", "before": e.Compact.Before, "after": e.Compact.After, "tier": e.Compact.Tier})
+	case agent.EventRetry:
+		o.write(map[string]any{"type": "retry", "model": e.Retry.Model, "attempt": e.Retry.Attempt,
+			"status": e.Retry.Status, "class": e.Retry.Class, "wait_ms": e.Retry.Wait.Milliseconds()})
+	case agent.EventFallback:
+		o.write(map[string]any{"type": "fallback", "from": e.Fallback.From, "to": e.Fallback.To, "error": e.Fallback.Err.Error()})
+	case agent.EventRecover:
+		o.write(map[string]any{"type": "recover", "model": e.Recovery.Model, "resumed": e.Recovery.Resumed, "error": e.Recovery.Err.Error()})
+	case agent.EventRoute:
+		o.write(map[string]any{"type": "route", "task": e.Route.Task, "model": e.Route.Model, "reason": e.Route.Reason, "skipped": e.Route.Skipped})
+	case agent.EventBudget:
+		o.write(map[string]any{"type": "budget_warning", "spent_usd": e.Budget.Spent, "limit_usd": e.Budget.Limit})
+	case agent.EventPlan:
+		o.plan = true
+		o.write(map[string]any{"type": "plan", "plan": e.Plan})
+	case agent.EventError:
+		o.write(map[string]any{"type": "error", "error": e.Err.Error()})
+	}
+}
+
+// commit reports an auto-commit made after the run.
+func (o *jsonOutput) commit(hash string) {
+	o.write(map[string]any{"type": "commit", "hash": hash})
+}
+
+// finish writes the final result for err (nil on success) and returns the
+// process exit code.
+func (o *jsonOutput) finish(err error) int {
+	reason, code := stopReason(err)
+	if err == nil && o.plan {
+		reason = "plan_submitted"
+	}
+	res := map[string]any{
+		"type":           "result",
+		"stop_reason":    reason,
+		"is_error":       err != nil,
+		"result":         o.last,
+		"total_cost_usd": usageCost(o.total),
+		"usage":          o.total,
+		"duration_ms":    time.Since(o.start).Milliseconds(),
+	}
+	if err != nil {
+		res["error"] = err.Error()
+	}
+	if !o.stream {
+		o.mu.Lock()
+		res["events"] = o.events
+		o.mu.Unlock()
+		o.stream = true // write the result itself straight out
+	}
+	o.write(res)
+	return code
+}
+
+func (o *jsonOutput) write(v map[string]any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.stream {
+		o.events = append(o.events, v)
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(map[string]any{"type": "error", "error": err.Error()})
+	}
+	fmt.Fprintf(o.w, "%s\n", data)
+}
+
+// stopReason classifies Run's error for the result object and exit code.
+func stopReason(err error) (string, int) {
+	switch {
+	case err == nil:
+		return "end_turn", 0
+	case errors.Is(err, agent.ErrBudgetExceeded):
+		return "budget_exceeded", exitBudget
+	case errors.Is(err, agent.ErrMaxIterations):
+		return "max_iterations", exitLimit
+	case errors.Is(err, agent.ErrToolErrors):
+		return "tool_errors", exitLimit
+	case errors.Is(err, agent.ErrRepeatedCalls):
+		return "repeated_calls", exitLimit
+	case errors.Is(err, agent.ErrTimeLimit):
+		return "time_limit", exitLimit
+	case errors.Is(err, stdcontext.Canceled):
+		return "interrupted", exitInterrupted
+	default:
+		return "error", exitError
+	}
+}
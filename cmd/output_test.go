@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/agent"
+	"github.com/Lewis-404/axe/internal/llm"
+)
+
+func TestParseFlags(t *testing.T) {
+	args, f, err := parseFlags([]string{"--output-format", "stream-json", "--auto", "--plan", "fix", "it"})
+	if err != nil || !f.print || !f.auto || !f.plan || f.format != formatStreamJSON || strings.Join(args, " ") != "fix it" {
+		t.Errorf("got %v %+v %v", args, f, err)
+	}
+	if _, f, _ = parseFlags([]string{"--output-format=json", "x"}); !f.print || f.format != formatJSON {
+		t.Errorf("--output-format=json: %+v", f)
+	}
+	if _, _, err = parseFlags([]string{"--output-format", "xml"}); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func emitTurn(o *jsonOutput) {
+	o.Emit(agent.Event{Type: agent.EventTextDelta, Text: "editing"})
+	o.Emit(agent.Event{Type: agent.EventBlockDone})
+	tool := &agent.ToolEvent{ID: "t1", Name: "write_file", Input: map[string]any{"path": "a.go"}}
+	o.Emit(agent.Event{Type: agent.EventToolStart, Tool: tool})
+	end := *tool
+	end.Result, end.Duration = "ok", 5*time.Millisecond
+	o.Emit(agent.Event{Type: agent.EventToolEnd, Tool: &end})
+	o.Emit(agent.Event{Type: agent.EventTextDelta, Text: "done"})
+	o.Emit(agent.Event{Type: agent.EventBlockDone})
+	total := llm.UsageByModel{"claude-sonnet-4": {InputTokens: 1000000}}
+	o.Emit(agent.Event{Type: agent.EventUsage, Usage: &agent.UsageEvent{Round: total, Total: total}})
+}
+
+func TestStreamJSONOutput(t *testing.T) {
+	var buf bytes.Buffer
+	o := newJSONOutput(&buf, formatStreamJSON)
+	emitTurn(o)
+	if code := o.finish(fmt.Errorf("%w: $3 >= $1 limit", agent.ErrBudgetExceeded)); code != exitBudget {
+		t.Errorf("exit code = %d, want %d", code, exitBudget)
+	}
+
+	var types []string
+	var last map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		last = nil
+		if err := json.Unmarshal([]byte(line), &last); err != nil {
+			t.Fatalf("bad line %q: %v", line, err)
+		}
+		types = append(types, last["type"].(string))
+	}
+	if got := strings.Join(types, ","); got != "assistant,tool_use,tool_result,assistant,usage,result" {
+		t.Errorf("types = %s", got)
+	}
+	if last["stop_reason"] != "budget_exceeded" || last["result"] != "done" || last["total_cost_usd"] != 3.0 {
+		t.Errorf("result = %v", last)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	var buf bytes.Buffer
+	o := newJSONOutput(&buf, formatJSON)
+	emitTurn(o)
+	if code := o.finish(nil); code != 0 {
+		t.Errorf("exit code = %d", code)
+	}
+	var res struct {
+		Type       string           `json:"type"`
+		StopReason string           `json:"stop_reason"`
+		Events     []map[string]any `json:"events"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &res); err != nil {
+		t.Fatalf("not a single JSON object: %v\n%s", err, buf.String())
+	}
+	if res.Type != "result" || res.StopReason != "end_turn" || len(res.Events) != 5 {
+		t.Errorf("result = %+v", res)
+	}
+}
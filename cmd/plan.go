@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Lewis-404/axe/internal/agent"
+	"github.com/Lewis-404/axe/internal/ui"
+)
+
+// planReview handles a plan submitted during a turn. It is nil in print
+// mode, where the plan is only reported.
+var planReview func(ag *agent.Agent, savePath string) error
+
+const planApprovedInput = "计划已批准，请按计划开始执行。"
+
+// reviewPlan lets the user approve, revise or reject the pending plan.
+func reviewPlan(ag *agent.Agent, savePath string) error {
+	p := ag.PendingPlan()
+	fmt.Printf("\n📋 计划:\n%s\n\n", p)
+	answer := ui.ReadLine("批准? [y]执行 / [e]修改 / [N]拒绝 ")
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		ag.ApprovePlan(p)
+		fmt.Println("✅ 计划已批准，切换到完整工具集")
+		return runAgent(ag, planApprovedInput, savePath)
+	case "e", "edit":
+		ag.RejectPlan()
+		feedback := ui.ReadLine("修改意见: ")
+		if strings.TrimSpace(feedback) == "" {
+			fmt.Println("❌ 计划已拒绝，仍处于计划模式（/plan off 退出）")
+			return nil
+		}
+		return runAgent(ag, "请根据以下意见修改计划并重新提交: "+feedback, savePath)
+	default:
+		ag.RejectPlan()
+		fmt.Println("❌ 计划已拒绝，仍处于计划模式（/plan off 退出）")
+		return nil
+	}
+}
+
+// autoApprovePlan is the --auto counterpart of reviewPlan.
+func autoApprovePlan(ag *agent.Agent, savePath string) error {
+	p := ag.PendingPlan()
+	fmt.Printf("\n📋 计划（自动批准）:\n%s\n\n", p)
+	ag.ApprovePlan(p)
+	return runAgent(ag, planApprovedInput, savePath)
+}
+
+func cmdPlan(c *cmdCtx) {
+	arg := ""
+	if len(c.parts) > 1 {
+		arg = c.parts[1]
+	}
+	switch arg {
+	case "":
+		if c.ag.InPlanMode() {
+			fmt.Println("📋 已处于计划模式（/plan off 退出）")
+			return
+		}
+		c.ag.EnterPlanMode()
+		fmt.Println("📋 已进入计划模式：只能使用只读工具，描述任务后 agent 会提交计划供你审批")
+	case "status":
+		printPlanStatus(c.ag)
+	case "off":
+		c.ag.ExitPlanMode()
+		c.ag.ClearPlan()
+		fmt.Println("📋 已退出计划模式")
+	default:
+		c.ag.EnterPlanMode()
+		task := strings.Join(c.parts[1:], " ")
+		if err := runAgent(c.ag, task, *c.savePath); err != nil {
+			ui.PrintError(err)
+		}
+	}
+}
+
+func printPlanStatus(ag *agent.Agent) {
+	if p := ag.Plan(); p != nil {
+		fmt.Printf("📋 计划进度 %d/%d:\n%s\n", p.Done(), len(p.Steps), p)
+		return
+	}
+	if p := ag.PendingPlan(); p != nil {
+		fmt.Printf("📋 待审批的计划:\n%s\n", p)
+		return
+	}
+	if ag.InPlanMode() {
+		fmt.Println("📋 计划模式中，尚未提交计划")
+		return
+	}
+	fmt.Println("📋 没有进行中的计划（/plan 进入计划模式）")
+}
@@ -2,13 +2,16 @@ package cmd
 
 import (
 	"bufio"
+	stdcontext "context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/Lewis-404/axe/internal/agent"
 	"github.com/Lewis-404/axe/internal/commands"
@@ -36,10 +39,7 @@ Rules:
 - When modifying files, use edit_file for surgical changes, write_file for new files
 - If a tool call fails, read the error carefully, fix the issue, and retry (max 3 retries per step)
 - After modifying code files, check compilation results in the tool output — fix any errors before moving on
-- Explain what you're doing briefly before doing it
-
-Project context:
-%s`
+- Explain what you're doing briefly before doing it`
 
 // appState holds all runtime state for an axe session.
 type appState struct {
@@ -51,6 +51,7 @@ type appState struct {
 	savePath  string
 	printMode bool
 	autoMode  bool
+	out       *jsonOutput // set for --output-format json|stream-json
 }
 
 func setupRegistry(perms *permissions.Store, printMode, autoMode bool) *tools.Registry {
@@ -60,6 +61,7 @@ func setupRegistry(perms *permissions.Store, printMode, autoMode bool) *tools.Re
 			Confirm:          func(string) bool { return true },
 			ConfirmOverwrite: func(string, int, int) bool { return true },
 			ConfirmEdit:      func(string, string, string) bool { return true },
+			ConfirmTool:      func(string, json.RawMessage) bool { return true },
 		}
 	} else {
 		opts = tools.RegistryOpts{
@@ -125,6 +127,26 @@ func setupRegistry(perms *permissions.Store, printMode, autoMode bool) *tools.Re
 					return false
 				}
 			},
+			ConfirmTool: func(name string, input json.RawMessage) bool {
+				if allowed, found := perms.Check(name, "*"); found {
+					if allowed {
+						fmt.Printf("\n🔧 %s %s \033[90m(auto-allowed)\033[0m\n", name, input)
+					}
+					return allowed
+				}
+				fmt.Printf("\n🔧 %s %s\n", name, input)
+				answer := ui.ReadLine("Allow? [y/N/A(lways)] ")
+				switch strings.ToLower(answer) {
+				case "a", "always":
+					perms.AddAllow(name, "*")
+					fmt.Printf("  ✅ 已记住: 始终允许 %s\n", name)
+					return true
+				case "y":
+					return true
+				default:
+					return false
+				}
+			},
 		}
 	}
 
@@ -151,6 +173,9 @@ func setupRegistry(perms *permissions.Store, printMode, autoMode bool) *tools.Re
 				if label == "" {
 					label = p.Command
 				}
+				if label == "" {
+					label = string(item.Input)
+				}
 				fmt.Printf("  - %s\n", label)
 			}
 			answer := ui.ReadLine("Allow all? [y/N/A(lways)] ")
@@ -174,7 +199,7 @@ func setupAutoVerify(registry *tools.Registry, cfg *config.Config) {
 	if cfg.AutoVerify != nil && !*cfg.AutoVerify {
 		return
 	}
-	registry.SetPostExecHook(func(name string, input json.RawMessage, result string) string {
+	registry.SetPostExecHook(func(ctx stdcontext.Context, name string, input json.RawMessage, result string) string {
 		if name != "write_file" && name != "edit_file" {
 			return ""
 		}
@@ -188,7 +213,7 @@ func setupAutoVerify(registry *tools.Registry, cfg *config.Config) {
 		switch ext {
 		case ".go":
 			buildDir := findProjectRoot(fileDir, "go.mod")
-			cmd := exec.Command("go", "build", "./...")
+			cmd := exec.CommandContext(ctx, "go", "build", "./...")
 			cmd.Dir = buildDir
 			out, err := cmd.CombinedOutput()
 			if err != nil {
@@ -196,7 +221,7 @@ func setupAutoVerify(registry *tools.Registry, cfg *config.Config) {
 			}
 			return "[Auto-verify] go build OK"
 		case ".py":
-			cmd := exec.Command("python3", "-m", "py_compile", params.Path)
+			cmd := exec.CommandContext(ctx, "python3", "-m", "py_compile", params.Path)
 			out, err := cmd.CombinedOutput()
 			if err != nil {
 				return fmt.Sprintf("[Auto-verify] python compile FAILED:\n%s", string(out))
@@ -204,7 +229,7 @@ func setupAutoVerify(registry *tools.Registry, cfg *config.Config) {
 			return "[Auto-verify] python syntax OK"
 		case ".rs":
 			buildDir := findProjectRoot(fileDir, "Cargo.toml")
-			cmd := exec.Command("cargo", "check", "--quiet")
+			cmd := exec.CommandContext(ctx, "cargo", "check", "--quiet")
 			cmd.Dir = buildDir
 			out, err := cmd.CombinedOutput()
 			if err != nil {
@@ -213,7 +238,7 @@ func setupAutoVerify(registry *tools.Registry, cfg *config.Config) {
 			return "[Auto-verify] cargo check OK"
 		case ".ts", ".tsx":
 			buildDir := findProjectRoot(fileDir, "tsconfig.json")
-			cmd := exec.Command("npx", "tsc", "--noEmit")
+			cmd := exec.CommandContext(ctx, "npx", "tsc", "--noEmit")
 			cmd.Dir = buildDir
 			out, err := cmd.CombinedOutput()
 			if err != nil {
@@ -237,19 +262,42 @@ func findProjectRoot(dir, marker string) string {
 	return dir
 }
 
-// parseFlags extracts --print/-p and --auto from args, returns cleaned args.
-func parseFlags(args []string) (cleaned []string, printMode, autoMode bool) {
-	cleaned = args
-	for i := len(cleaned) - 1; i >= 0; i-- {
-		switch cleaned[i] {
-		case "--print", "-p":
-			printMode = true
-			cleaned = append(cleaned[:i], cleaned[i+1:]...)
-		case "--auto":
-			autoMode = true
-			cleaned = append(cleaned[:i], cleaned[i+1:]...)
+// runFlags are the command-line flags parseFlags understands.
+type runFlags struct {
+	print  bool
+	auto   bool
+	plan   bool
+	format string
+}
+
+// parseFlags extracts --print/-p, --auto, --plan and --output-format from
+// args, returns cleaned args. A JSON output format implies --print.
+func parseFlags(args []string) (cleaned []string, f runFlags, err error) {
+	f.format = formatText
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == "--print" || a == "-p":
+			f.print = true
+		case a == "--auto":
+			f.auto = true
+		case a == "--plan":
+			f.plan = true
+		case a == "--output-format" && i+1 < len(args):
+			i++
+			f.format = args[i]
+		case strings.HasPrefix(a, "--output-format="):
+			f.format = strings.TrimPrefix(a, "--output-format=")
+		default:
+			cleaned = append(cleaned, a)
 		}
 	}
+	switch f.format {
+	case formatText:
+	case formatJSON, formatStreamJSON:
+		f.print = true
+	default:
+		err = fmt.Errorf("unknown --output-format %q (want text, json or stream-json)", f.format)
+	}
 	return
 }
 
@@ -268,8 +316,7 @@ func initSession(args []string, printMode, autoMode bool) (*appState, []*mcp.Cli
 		cfg.Merge(pc)
 	}
 
-	ctx := context.Collect(dir)
-	sys := fmt.Sprintf(systemPrompt, ctx)
+	sys := systemPrompt
 
 	perms := permissions.Load()
 	registry := setupRegistry(perms, printMode, autoMode)
@@ -306,7 +353,15 @@ func initSession(args []string, printMode, autoMode bool) (*appState, []*mcp.Cli
 	setupAutoVerify(registry, cfg)
 
 	client := llm.NewClient(cfg.Models, registry.Definitions())
+	client.SetRetryPolicy(cfg.Retry)
+	if err := client.SetRouting(cfg.Routing); err != nil {
+		fmt.Fprintf(os.Stderr, "⚠️ routing: %s\n", err)
+	}
 	ag := agent.New(client, registry, sys)
+	ag.SetProjectContext(context.Collect(dir))
+	ag.SetCompactConfig(cfg.Compact)
+	ag.SetLimits(cfg.Limits)
+	ag.EnableTasks()
 
 	return &appState{
 		cfg:       cfg,
@@ -319,35 +374,165 @@ func initSession(args []string, printMode, autoMode bool) (*appState, []*mcp.Cli
 	}, mcpClients
 }
 
+// confirmContinue asks whether to keep going after a loop limit.
+func confirmContinue(err error) bool {
+	fmt.Printf("\n⚠️ %s\n", err)
+	answer := ui.ReadLine("继续执行? [y/N] ")
+	return strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes")
+}
+
 // setupCallbacks wires up agent event handlers based on mode.
 func (s *appState) setupCallbacks() {
+	if s.out != nil {
+		s.ag.SetSink(s.out)
+		return
+	}
 	if s.printMode {
 		var output strings.Builder
-		s.ag.OnTextDelta(func(t string) { output.WriteString(t) })
-		s.ag.OnBlockDone(func() {
-			fmt.Print(output.String())
-			output.Reset()
-		})
-	} else {
-		s.ag.OnTextDelta(ui.PrintTextDelta)
-		s.ag.OnBlockDone(ui.PrintBlockDone)
-		s.ag.OnTool(ui.PrintTool)
-		s.ag.OnUsage(func(roundIn, roundOut, totalIn, totalOut int) {
-			model := s.client.ModelName()
-			roundCost := pricing.Cost(model, roundIn, roundOut)
-			totalCost := pricing.Cost(model, totalIn, totalOut)
+		s.ag.SetSink(agent.SinkFunc(func(e agent.Event) {
+			switch e.Type {
+			case agent.EventTextDelta:
+				output.WriteString(e.Text)
+			case agent.EventBlockDone:
+				fmt.Print(output.String())
+				output.Reset()
+			case agent.EventPlan:
+				fmt.Printf("\n📋 计划:\n%s\n", e.Plan)
+			default:
+				printStatusEvent(os.Stderr, e)
+			}
+		}))
+		return
+	}
+	s.ag.SetSink(agent.SinkFunc(func(e agent.Event) {
+		switch e.Type {
+		case agent.EventTextDelta:
+			ui.PrintTextDelta(e.Text)
+		case agent.EventThinkingDelta:
+			ui.PrintThinkingDelta(e.Text)
+		case agent.EventBlockDone:
+			ui.PrintBlockDone()
+		case agent.EventNotice:
+			fmt.Println(e.Text)
+		case agent.EventToolStart:
+			ui.PrintTool(e.Tool.Name, fmt.Sprintf("%v", e.Tool.Input))
+		case agent.EventUsage:
+			round, total := e.Usage.Round.Total(), e.Usage.Total.Total()
+			roundCost := usageCost(e.Usage.Round)
+			totalCost := usageCost(e.Usage.Total)
 			if totalCost > 0 {
-				fmt.Printf("📊 本轮: ↑%s ↓%s ($%.4f) | 累计: ↑%s ↓%s ($%.4f)\n",
-					ui.FmtTokens(roundIn), ui.FmtTokens(roundOut), roundCost,
-					ui.FmtTokens(totalIn), ui.FmtTokens(totalOut), totalCost)
+				fmt.Printf("📊 本轮: ↑%s ↓%s%s ($%.4f) | 累计: ↑%s ↓%s ($%.4f)\n",
+					ui.FmtTokens(round.PromptTokens()), ui.FmtTokens(round.OutputTokens), ui.FmtUsageDetail(round), roundCost,
+					ui.FmtTokens(total.PromptTokens()), ui.FmtTokens(total.OutputTokens), totalCost)
 			} else {
-				ui.PrintUsage(roundIn, roundOut, totalIn, totalOut)
+				ui.PrintUsage(round, total)
 			}
-		})
-		s.ag.OnCompact(func(before, after int) {
-			fmt.Printf("🗜️ 上下文已压缩: ~%dk → ~%dk tokens\n", before/1000, after/1000)
-		})
+		case agent.EventCompact:
+			fmt.Printf("🗜️ 上下文已压缩（%s）: ~%dk → ~%dk tokens\n", compactTierNames[e.Compact.Tier], e.Compact.Before/1000, e.Compact.After/1000)
+		default:
+			printStatusEvent(os.Stdout, e)
+		}
+	}))
+}
+
+// routeReasons names what chose a routed model.
+var routeReasons = map[string]string{
+	"rule":        "任务规则",
+	"cheapest":    "最便宜的可用模型",
+	"round-robin": "轮询",
+	"breaker":     "熔断",
+}
+
+// printStatusEvent prints the events that matter in every output mode.
+func printStatusEvent(w io.Writer, e agent.Event) {
+	switch e.Type {
+	case agent.EventRetry:
+		if e.Retry.Status > 0 {
+			fmt.Fprintf(w, "⏳ API %d (%s), retrying in %s...\n", e.Retry.Status, e.Retry.Class, e.Retry.Wait.Round(time.Millisecond))
+		} else {
+			fmt.Fprintf(w, "⏳ API %s, retrying in %s...\n", e.Retry.Class, e.Retry.Wait.Round(time.Millisecond))
+		}
+	case agent.EventFallback:
+		fmt.Fprintf(w, "🔀 %s 失败，切换到 %s: %s\n", e.Fallback.From, e.Fallback.To, e.Fallback.Err)
+	case agent.EventRecover:
+		// the stream broke off mid-line
+		if e.Recovery.Resumed {
+			fmt.Fprintf(w, "\n🔌 %s 响应中断（%s），从中断处继续...\n", e.Recovery.Model, e.Recovery.Err)
+		} else {
+			fmt.Fprintf(w, "\n🔌 %s 响应中断（%s），已丢弃部分输出，重新请求...\n", e.Recovery.Model, e.Recovery.Err)
+		}
+	case agent.EventRoute:
+		fmt.Fprintf(w, "🧭 %s → %s（%s", e.Route.Task, e.Route.Model, routeReasons[e.Route.Reason])
+		if len(e.Route.Skipped) > 0 {
+			fmt.Fprintf(w, "，跳过熔断中的 %s", strings.Join(e.Route.Skipped, ", "))
+		}
+		fmt.Fprintln(w, "）")
+	case agent.EventBudget:
+		fmt.Fprintf(w, "💰 已用 $%.4f，接近预算上限 $%.2f\n", e.Budget.Spent, e.Budget.Limit)
+	case agent.EventError:
+		fmt.Fprintf(w, "⚠️ %s\n", e.Err)
+	}
+}
+
+// runAgent runs one agent turn with Ctrl-C handling: the first interrupt
+// cancels the current stream or tool, a second one saves history and exits.
+func runAgent(ag *agent.Agent, input string, savePath string) error {
+	return runAgentTask(ag, "", input, savePath)
+}
+
+// runAgentTask is runAgent with the requests marked as being for task, for
+// routing rules; "" leaves them to the agent.
+func runAgentTask(ag *agent.Agent, task llm.Task, input string, savePath string) error {
+	ctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	defer cancel()
+	if task != "" {
+		ctx = llm.WithTask(ctx, task)
+	}
+	done := make(chan struct{})
+	defer close(done)
+
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt)
+	defer signal.Stop(sigCh)
+
+	go func() {
+		select {
+		case <-sigCh:
+		case <-done:
+			return
+		}
+		fmt.Fprintln(os.Stderr, "\n⏹️ 正在中断…（再按一次 Ctrl-C 退出）")
+		cancel()
+		select {
+		case <-sigCh:
+			if msgs := ag.Messages(); len(msgs) > 0 && savePath != "" {
+				history.SaveTo(savePath, msgs)
+			}
+			fmt.Fprintln(os.Stderr, "👋")
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+
+	start := time.Now()
+	err := ag.Run(ctx, input)
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "⏹️ 已中断（%s）\n", time.Since(start).Round(time.Second))
+	}
+	if err == nil && ag.PendingPlan() != nil && planReview != nil {
+		return planReview(ag, savePath)
+	}
+	return err
+}
+
+// usageCost prices each model's usage at its own rates, billing prompt-cache
+// tokens separately.
+func usageCost(byModel llm.UsageByModel) float64 {
+	var cost float64
+	for model, u := range byModel {
+		cost += pricing.CostWithCache(model, u.InputTokens, u.OutputTokens, u.CacheCreationInputTokens, u.CacheReadInputTokens)
 	}
+	return cost
 }
 
 func (s *appState) autoSave() {
@@ -361,7 +546,11 @@ func (s *appState) autoSave() {
 func (s *appState) autoCommit(input string) {
 	if git.IsRepo(s.dir) && git.HasChanges(s.dir) {
 		if hash, err := git.AutoCommit(s.dir, input); err == nil {
-			fmt.Printf("\n📦 Auto-commit: %s\n", hash)
+			if s.out != nil {
+				s.out.commit(hash)
+			} else {
+				fmt.Printf("\n📦 Auto-commit: %s\n", hash)
+			}
 		}
 	}
 }
@@ -395,7 +584,7 @@ func (s *appState) runInteractive() {
 					if c.Name == cmdName {
 						found = true
 						fmt.Printf("🔧 执行项目命令: %s\n", cmdName)
-						if err := s.ag.Run(c.Content); err != nil {
+						if err := runAgent(s.ag, c.Content, s.savePath); err != nil {
 							ui.PrintError(err)
 						}
 						s.autoCommit(c.Content)
@@ -414,14 +603,14 @@ func (s *appState) runInteractive() {
 				if err != nil {
 					ui.PrintError(err)
 				} else {
-					s.ag.InjectContext(fmt.Sprintf("[Skill: %s]\n%s", sk.Name, content))
+					s.ag.ActivateSkill(sk.Name, content)
 					fmt.Printf("🧩 已激活技能: %s\n", sk.Name)
 					rest := strings.TrimSpace(strings.TrimPrefix(input, "/"+cmdName))
 					if rest == "" {
 						rest = strings.TrimSpace(strings.TrimPrefix(input, "/"+sk.Name))
 					}
 					if rest != "" {
-						if err := s.ag.Run(rest); err != nil {
+						if err := runAgent(s.ag, rest, s.savePath); err != nil {
 							ui.PrintError(err)
 						}
 						s.autoCommit(rest)
@@ -433,7 +622,7 @@ func (s *appState) runInteractive() {
 			handleSlashCommand(input, s.ag, s.client, &s.savePath)
 			continue
 		}
-		if err := s.ag.Run(input); err != nil {
+		if err := runAgent(s.ag, input, s.savePath); err != nil {
 			ui.PrintError(err)
 		}
 		s.autoCommit(input)
@@ -471,7 +660,12 @@ func Run(args []string) {
 		}
 	}
 
-	args, printMode, autoMode := parseFlags(args)
+	args, flags, err := parseFlags(args)
+	if err != nil {
+		ui.PrintError(err)
+		os.Exit(exitError)
+	}
+	printMode, autoMode := flags.print, flags.auto
 
 	// pipe mode: read stdin
 	if !printMode {
@@ -491,7 +685,22 @@ func Run(args []string) {
 		}
 	}()
 
+	if flags.format != formatText {
+		state.out = newJSONOutput(os.Stdout, flags.format)
+	}
 	state.setupCallbacks()
+	switch {
+	case printMode:
+		// headless: report the plan and stop
+	case autoMode:
+		planReview = autoApprovePlan
+	default:
+		planReview = reviewPlan
+		state.ag.SetLimitHandler(confirmContinue)
+	}
+	if flags.plan {
+		state.ag.EnterPlanMode()
+	}
 
 	// --resume
 	resume := len(args) > 0 && args[0] == "--resume"
@@ -510,12 +719,21 @@ func Run(args []string) {
 	// single-shot mode
 	if len(args) > 0 {
 		prompt := strings.Join(args, " ")
-		if err := state.ag.Run(prompt); err != nil {
-			ui.PrintError(err)
-			os.Exit(1)
+		err := runAgent(state.ag, prompt, state.savePath)
+		if err == nil {
+			state.autoCommit(prompt)
 		}
-		state.autoCommit(prompt)
 		state.autoSave()
+		code := 0
+		if state.out != nil {
+			code = state.out.finish(err)
+		} else if err != nil {
+			ui.PrintError(err)
+			_, code = stopReason(err)
+		}
+		if code != 0 {
+			os.Exit(code)
+		}
 		return
 	}
 
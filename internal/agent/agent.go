@@ -1,11 +1,18 @@
 package agent
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/Lewis-404/axe/internal/config"
 	"github.com/Lewis-404/axe/internal/llm"
+	"github.com/Lewis-404/axe/internal/tokenizer"
 	"github.com/Lewis-404/axe/internal/tools"
 )
 
@@ -13,52 +20,54 @@ type Agent struct {
 	client      *llm.Client
 	registry    *tools.Registry
 	messages    []llm.Message
-	system      string
-	onTextDelta func(string)
-	onBlockDone func()
-	onTool      func(string, string)
-	onUsage     func(roundIn, roundOut, totalIn, totalOut int)
-	onCompact   func(before, after int)
-	totalIn     int
-	totalOut    int
-	maxContext  int     // max tokens before auto-compact, 0 = disabled
+	system      string         // base prompt
+	project     string         // project context layer
+	skills      []activeSkill  // active skills layer
+	notes       []string       // session notes layer
+	sink        EventSink
+	emitMu      sync.Mutex // serializes sink calls from concurrent tools
 	budgetMax   float64 // max cost in USD, 0 = unlimited
-	costFn      func(int, int) float64 // cost calculator
+	budgetWarned bool   // budget warning already emitted
+	costFn      func(llm.UsageByModel) float64 // cost calculator
+	planMode    bool        // read-only tools until a plan is approved
+	pending     *tools.Plan // submitted in plan mode, awaiting review
+	plan        *tools.Plan // approved plan and its progress
+	anchor      contextAnchor // last exact prompt size, see contextTokens
+	compactCfg  config.CompactConfig
+	limits      config.LoopLimits
+	onLimit     func(err error) bool // asked whether to go on past a limit
 }
 
 func New(client *llm.Client, registry *tools.Registry, systemPrompt string) *Agent {
-	return &Agent{
+	a := &Agent{
 		client:     client,
 		registry:   registry,
 		system:     systemPrompt,
-		maxContext:  100000, // default 100k
 	}
+	a.SetLimits(config.LoopLimits{})
+	client.SetPromptSizer(promptSizer(client))
+	return a
 }
 
-func (a *Agent) OnTextDelta(fn func(string))                     { a.onTextDelta = fn }
-func (a *Agent) OnBlockDone(fn func())                           { a.onBlockDone = fn }
-func (a *Agent) OnTool(fn func(string, string))                  { a.onTool = fn }
-func (a *Agent) OnUsage(fn func(int, int, int, int))             { a.onUsage = fn }
-func (a *Agent) OnCompact(fn func(int, int))                     { a.onCompact = fn }
-func (a *Agent) SetBudget(max float64, costFn func(int, int) float64) {
+func (a *Agent) SetBudget(max float64, costFn func(llm.UsageByModel) float64) {
 	a.budgetMax = max
 	a.costFn = costFn
-}
-func (a *Agent) RefreshSystem(s string)                           { a.system = s }
-func (a *Agent) InjectContext(text string) {
-	a.messages = append(a.messages, llm.Message{
-		Role:    llm.RoleUser,
-		Content: []llm.ContentBlock{{Type: "text", Text: text}},
-	})
-	a.messages = append(a.messages, llm.Message{
-		Role:    llm.RoleAssistant,
-		Content: []llm.ContentBlock{{Type: "text", Text: "已加载技能，我会按照其中的指导来工作。"}},
-	})
+	a.budgetWarned = false
 }
 func (a *Agent) Messages() []llm.Message                         { return a.messages }
-func (a *Agent) SetMessages(msgs []llm.Message)                  { a.messages = msgs }
-func (a *Agent) TotalUsage() (int, int)                          { return a.totalIn, a.totalOut }
-func (a *Agent) Reset()                                          { a.messages = nil; a.totalIn = 0; a.totalOut = 0 }
+func (a *Agent) SetMessages(msgs []llm.Message)                  { a.messages = msgs; a.resetAnchor() }
+// TotalUsage returns the session's usage per model, as recorded by the client.
+func (a *Agent) TotalUsage() llm.UsageByModel { return a.client.Usage() }
+// Reset starts a new conversation; plan mode stays on if it was.
+func (a *Agent) Reset() {
+	a.messages = nil
+	a.resetAnchor()
+	a.client.ResetUsage()
+	a.pending = nil
+	if a.plan != nil {
+		a.ClearPlan()
+	}
+}
 
 // PopLastRound removes the last user+assistant exchange and returns the user input
 func (a *Agent) PopLastRound() string {
@@ -68,6 +77,7 @@ func (a *Agent) PopLastRound() string {
 			for _, b := range a.messages[i].Content {
 				if b.Type == "text" && b.Text != "" {
 					a.messages = a.messages[:i]
+					a.resetAnchor()
 					return b.Text
 				}
 			}
@@ -76,89 +86,82 @@ func (a *Agent) PopLastRound() string {
 	return ""
 }
 
-// estimateTokens roughly estimates token count.
-// ASCII ~4 chars/token, CJK ~1.5 chars/token.
+// estimateTokens counts msgs with the local tokenizer.
 func estimateTokens(msgs []llm.Message) int {
-	ascii, nonASCII := 0, 0
-	for _, m := range msgs {
-		for _, b := range m.Content {
-			for _, r := range b.Text {
-				if r < 128 {
-					ascii++
-				} else {
-					nonASCII++
-				}
-			}
-			extra := b.Content + fmt.Sprintf("%v", b.Input)
-			ascii += len(extra)
-		}
-	}
-	return ascii/4 + nonASCII*2/3
+	return tokenizer.Messages(msgs)
 }
 
-// Compact compresses conversation history into a summary via LLM
-func (a *Agent) Compact(hint string) error {
-	if len(a.messages) < 4 {
-		return nil
-	}
-	before := estimateTokens(a.messages)
-
-	prompt := "请将以上对话历史压缩为一段简洁的摘要，保留：1) 用户的核心需求 2) 已完成的操作和关键决策 3) 当前进展状态 4) 重要的文件路径和代码上下文。用中文输出。"
-	if hint != "" {
-		prompt += "\n重点保留: " + hint
-	}
-
-	// build summary request with conversation as context
-	summaryMsgs := make([]llm.Message, len(a.messages))
-	copy(summaryMsgs, a.messages)
-	summaryMsgs = append(summaryMsgs, llm.Message{
-		Role:    llm.RoleUser,
-		Content: []llm.ContentBlock{{Type: "text", Text: prompt}},
-	})
-
-	resp, err := a.client.Send(a.system, summaryMsgs)
-	if err != nil {
-		return fmt.Errorf("compact: %w", err)
-	}
-
-	var summary string
-	for _, b := range resp.Content {
-		if b.Type == "text" {
-			summary += b.Text
-		}
-	}
+// Errors Run stops with when a limit is hit; callers can tell them apart
+// with errors.Is.
+var (
+	ErrBudgetExceeded = errors.New("budget exceeded")
+	ErrMaxIterations  = errors.New("reached max iterations")
+	ErrToolErrors     = errors.New("too many consecutive tool errors")
+	ErrRepeatedCalls  = errors.New("repeated identical tool calls")
+	ErrTimeLimit      = errors.New("turn time limit exceeded")
+)
 
-	a.totalIn += resp.Usage.InputTokens
-	a.totalOut += resp.Usage.OutputTokens
+// budgetWarnRatio is the share of the budget at which EventBudget fires.
+const budgetWarnRatio = 0.8
 
-	// replace all messages with the compacted summary
-	a.messages = []llm.Message{
-		{Role: llm.RoleUser, Content: []llm.ContentBlock{{Type: "text", Text: "[对话历史摘要]\n" + summary}}},
-		{Role: llm.RoleAssistant, Content: []llm.ContentBlock{{Type: "text", Text: "好的，我已了解之前的对话内容，请继续。"}}},
-	}
+// finishRound reports a turn's usage alongside the session total. The turn
+// is everything the ledger recorded since start, sub-agents included.
+func (a *Agent) finishRound(start llm.UsageByModel) {
+	total := a.client.Usage()
+	a.emit(Event{Type: EventUsage, Usage: &UsageEvent{Round: total.Since(start), Total: total}})
+}
 
-	after := estimateTokens(a.messages)
-	if a.onCompact != nil {
-		a.onCompact(before, after)
+// cancelledResult is the synthetic tool_result content for calls that were
+// skipped or aborted because the turn was interrupted.
+const cancelledResult = "cancelled by user (interrupted)"
+
+// interrupted records a cancelled stream as an assistant message so the
+// history stays alternating, and returns the error for Run to surface.
+func (a *Agent) interrupted(ctx context.Context, partial string) error {
+	text := strings.TrimSpace(partial)
+	if text != "" {
+		a.emit(Event{Type: EventBlockDone})
+		text += "\n\n"
 	}
-	return nil
+	a.messages = append(a.messages, llm.Message{
+		Role:    llm.RoleAssistant,
+		Content: []llm.ContentBlock{{Type: "text", Text: text + "[interrupted by user]"}},
+	})
+	return fmt.Errorf("interrupted: %w", ctx.Err())
 }
 
-func (a *Agent) autoCompact() {
-	if a.maxContext <= 0 || len(a.messages) < 6 {
-		return
+// cutToolPrompt tells the model its last tool call was dropped for hitting
+// max_tokens, so it continues instead of waiting for a result.
+const cutToolPrompt = "[Your response hit the output token limit while writing the input of a %s call, so that call was dropped and did not run. Continue from there and make the call again; if its input is large, split the work into several smaller calls.]"
+
+// cutToolCall removes the tool call the model was still writing when it hit
+// max_tokens: its input is incomplete and must not run. It returns the
+// removed call, or nil.
+func cutToolCall(resp *llm.Response) *llm.ContentBlock {
+	n := len(resp.Content)
+	if resp.StopReason != "max_tokens" || n == 0 || resp.Content[n-1].Type != "tool_use" {
+		return nil
 	}
-	est := estimateTokens(a.messages)
-	if est > a.maxContext*80/100 { // trigger at 80% capacity
-		a.Compact("")
+	cut := resp.Content[n-1]
+	resp.Content = resp.Content[:n-1]
+	for _, b := range resp.Content {
+		if b.Type == "text" || b.Type == "tool_use" {
+			return &cut
+		}
 	}
+	// the assistant turn needs something besides thinking
+	resp.Content = append(resp.Content, llm.ContentBlock{Type: "text", Text: "(cut off)"})
+	return &cut
 }
 
-const maxIterations = 40
-
-func (a *Agent) Run(userInput string) error {
+// Run executes one user turn. Cancelling ctx stops the current stream or
+// tool; the history is left consistent so the conversation can continue.
+func (a *Agent) Run(ctx context.Context, userInput string) error {
 	// expand @file references
-	userInput = llm.ExpandAtFiles(userInput)
+	userInput, refs := llm.ExpandAtFiles(userInput)
+	for _, ref := range refs {
+		a.emit(Event{Type: EventNotice, Text: fmt.Sprintf("📎 已引用 %s", ref)})
+	}
 	// parse image paths from input
 	imageBlocks, textOnly := llm.ParseImageBlocks(userInput)
 	var content []llm.ContentBlock
@@ -168,7 +171,7 @@ func (a *Agent) Run(userInput string) error {
 			textOnly = "请描述这张图片"
 		}
 		content = append(content, llm.ContentBlock{Type: "text", Text: textOnly})
-		fmt.Printf("🖼️ 已识别 %d 张图片\n", len(imageBlocks))
+		a.emit(Event{Type: EventNotice, Text: fmt.Sprintf("🖼️ 已识别 %d 张图片", len(imageBlocks))})
 	} else {
 		content = []llm.ContentBlock{{Type: "text", Text: userInput}}
 	}
@@ -178,59 +181,75 @@ func (a *Agent) Run(userInput string) error {
 	})
 
 	// check if we need to compact before sending
-	a.autoCompact()
-
-	var roundIn, roundOut int
-	var consecutiveErrors int
-
-	for iter := 0; iter < maxIterations; iter++ {
-		toolInputs := map[int]string{}
+	a.autoCompact(ctx)
+
+	usageAtStart := a.client.Usage()
+	guard := a.newLoopGuard()
+	// requests go out as edits once the turn has changed something, which
+	// routing rules can send to a stronger model
+	reqCtx := ctx
+
+	for {
+		if err := guard.beforeRequest(); err != nil && !a.continueAfter(err, guard) {
+			a.finishRound(usageAtStart)
+			return err
+		}
+		var streamed strings.Builder
 
 		cb := llm.StreamCallbacks{
-			OnTextDelta: a.onTextDelta,
+			OnTextDelta: func(text string) {
+				streamed.WriteString(text)
+				a.emit(Event{Type: EventTextDelta, Text: text})
+			},
+			OnThinkingDelta: func(text string) {
+				a.emit(Event{Type: EventThinkingDelta, Text: text})
+			},
 			OnBlockStop: func(index int) {
-				if a.onBlockDone != nil {
-					a.onBlockDone()
-				}
+				a.emit(Event{Type: EventBlockDone})
 			},
-			OnInputJSONDelta: func(index int, partial string) {
-				toolInputs[index] += partial
+			OnReset: func() {
+				streamed.Reset()
 			},
 		}
 
-		resp, err := a.client.SendStream(a.system, a.messages, cb)
+		resp, err := a.client.SendStream(reqCtx, a.systemPrompt(), a.messages, cb)
 		if err != nil {
+			// earlier rounds and the interrupted stream were billed
+			a.finishRound(usageAtStart)
+			if ctx.Err() != nil {
+				return a.interrupted(ctx, streamed.String())
+			}
 			return fmt.Errorf("llm: %w", err)
 		}
-
-		roundIn += resp.Usage.InputTokens
-		roundOut += resp.Usage.OutputTokens
+		if resp.EmulatedTools {
+			parseEmulatedToolCalls(resp)
+		}
 
 		// budget check
 		if a.budgetMax > 0 && a.costFn != nil {
-			totalCost := a.costFn(a.totalIn+roundIn, a.totalOut+roundOut)
+			// the client ledger already includes this round, across every
+			// model that served it
+			totalCost := a.costFn(a.client.Usage())
 			if totalCost >= a.budgetMax {
-				a.totalIn += roundIn
-				a.totalOut += roundOut
-				if a.onUsage != nil {
-					a.onUsage(roundIn, roundOut, a.totalIn, a.totalOut)
-				}
-				return fmt.Errorf("budget exceeded: $%.4f >= $%.4f limit", totalCost, a.budgetMax)
+				a.finishRound(usageAtStart)
+				return fmt.Errorf("%w: $%.4f >= $%.4f limit", ErrBudgetExceeded, totalCost, a.budgetMax)
+			}
+			if !a.budgetWarned && totalCost >= a.budgetMax*budgetWarnRatio {
+				a.budgetWarned = true
+				a.emit(Event{Type: EventBudget, Budget: &BudgetEvent{Spent: totalCost, Limit: a.budgetMax}})
 			}
 		}
 
-		for idx, raw := range toolInputs {
-			if idx < len(resp.Content) && resp.Content[idx].Type == "tool_use" {
-				var parsed any
-				if json.Unmarshal([]byte(raw), &parsed) == nil {
-					resp.Content[idx].Input = parsed
-				}
-			}
+		cut := cutToolCall(resp)
+		if cut != nil {
+			a.emit(Event{Type: EventNotice, Text: fmt.Sprintf("✂️ 输出达到 max_tokens 上限，%s 的参数被截断，已请模型继续", cut.Name)})
 		}
 
+		a.anchorUsage(resp.Usage)
 		a.messages = append(a.messages, llm.Message{
 			Role:    llm.RoleAssistant,
 			Content: resp.Content,
+			Tokens:  resp.Usage.OutputTokens,
 		})
 
 		// collect tool_use blocks
@@ -241,120 +260,100 @@ func (a *Agent) Run(userInput string) error {
 			}
 		}
 
-		// readonly tools can run in parallel
-		readOnly := map[string]bool{"read_file": true, "list_directory": true, "search_files": true, "glob": true, "think": true}
-		allReadOnly := true
-		for _, b := range toolBlocks {
-			if !readOnly[b.Name] {
-				allReadOnly = false
-				break
-			}
-		}
-
 		toolResults := make([]llm.ContentBlock, len(toolBlocks))
-		hasError := false
 
 		// batch confirm: group same-type confirmable tools
 		batchApproved := map[string]bool{} // toolName -> approved
-		if !allReadOnly {
-			groups := map[string][]int{} // toolName -> indices
-			for i, b := range toolBlocks {
-				if a.registry.NeedsConfirm(b.Name) {
-					groups[b.Name] = append(groups[b.Name], i)
+		groups := map[string][]int{}       // toolName -> indices
+		var groupOrder []string
+		for i, b := range toolBlocks {
+			if a.registry.NeedsConfirm(b.Name) {
+				if _, ok := groups[b.Name]; !ok {
+					groupOrder = append(groupOrder, b.Name)
 				}
+				groups[b.Name] = append(groups[b.Name], i)
 			}
-			for name, indices := range groups {
-				if len(indices) < 2 {
-					continue
-				}
-				var items []tools.BatchConfirmItem
-				for _, idx := range indices {
-					inputBytes, _ := json.Marshal(toolBlocks[idx].Input)
-					items = append(items, tools.BatchConfirmItem{Name: name, Input: inputBytes})
-				}
-				batchApproved[name] = a.registry.BatchConfirm(name, items)
+		}
+		for _, name := range groupOrder {
+			indices := groups[name]
+			if len(indices) < 2 {
+				continue
+			}
+			var items []tools.BatchConfirmItem
+			for _, idx := range indices {
+				inputBytes, _ := json.Marshal(toolBlocks[idx].Input)
+				items = append(items, tools.BatchConfirmItem{Name: name, Input: inputBytes})
 			}
+			batchApproved[name] = a.registry.BatchConfirm(name, items)
 		}
 
-		execOne := func(i int, block llm.ContentBlock) {
+		execOne := func(ctx context.Context, i int, block llm.ContentBlock) {
+			if ctx.Err() != nil {
+				toolResults[i] = llm.ContentBlock{Type: "tool_result", ToolID: block.ID, Content: cancelledResult, IsError: true}
+				return
+			}
 			// batch rejected: skip execution
 			if approved, ok := batchApproved[block.Name]; ok && !approved {
 				toolResults[i] = llm.ContentBlock{Type: "tool_result", ToolID: block.ID, Content: "用户取消（批量拒绝）"}
 				return
 			}
-			if a.onTool != nil {
-				a.onTool(block.Name, fmt.Sprintf("%v", block.Input))
-			}
-			// batch approved: skip individual confirm
-			if approved, ok := batchApproved[block.Name]; ok && approved {
-				a.registry.SetSkipConfirm(block.Name, true)
-			}
+			a.emit(Event{Type: EventToolStart, Tool: &ToolEvent{ID: block.ID, Name: block.Name, Input: block.Input}})
+			start := time.Now()
 			inputBytes, _ := json.Marshal(block.Input)
-			result, err := a.registry.Execute(block.Name, inputBytes)
-			a.registry.SetSkipConfirm(block.Name, false)
-			if err != nil {
-				hasError = true
+			res, err := a.registry.ExecuteResult(ctx, block.Name, inputBytes)
+			result := res.Text
+			if ctx.Err() != nil {
+				toolResults[i] = llm.ContentBlock{Type: "tool_result", ToolID: block.ID, Content: cancelledResult, IsError: true}
+			} else if err != nil {
 				toolResults[i] = llm.ContentBlock{Type: "tool_result", ToolID: block.ID, Content: fmt.Sprintf("Error: %s", err), IsError: true}
 			} else {
 				if len([]rune(result)) > 10000 {
 					result = string([]rune(result)[:10000]) + "\n... (truncated)"
 				}
-				toolResults[i] = llm.ContentBlock{Type: "tool_result", ToolID: block.ID, Content: result}
+				toolResults[i] = llm.ContentBlock{Type: "tool_result", ToolID: block.ID, Content: result, Parts: res.Parts}
 			}
+			a.emit(Event{Type: EventToolEnd, Tool: &ToolEvent{
+				ID: block.ID, Name: block.Name, Input: block.Input,
+				Result: toolResults[i].Content, IsError: toolResults[i].IsError, Duration: time.Since(start),
+			}})
 		}
 
-		if allReadOnly && len(toolBlocks) > 1 {
-			var wg sync.WaitGroup
-			for i, block := range toolBlocks {
-				wg.Add(1)
-				go func(i int, b llm.ContentBlock) {
-					defer wg.Done()
-					execOne(i, b)
-				}(i, block)
-			}
-			wg.Wait()
-		} else {
-			for i, block := range toolBlocks {
-				execOne(i, block)
-			}
+		a.execTools(ctx, toolBlocks, batchApproved, execOne)
+		if llm.TaskOf(reqCtx) == "" && slices.ContainsFunc(toolBlocks, func(b llm.ContentBlock) bool { return !a.registry.ReadOnly(b.Name) }) {
+			reqCtx = llm.WithTask(ctx, llm.TaskEdit)
 		}
 
-		if hasError {
-			consecutiveErrors++
-		} else {
-			consecutiveErrors = 0
-		}
-		if consecutiveErrors >= 3 {
-			a.totalIn += roundIn
-			a.totalOut += roundOut
-			if a.onUsage != nil {
-				a.onUsage(roundIn, roundOut, a.totalIn, a.totalOut)
-			}
-			return fmt.Errorf("3 consecutive tool errors, stopping to avoid loop")
+		if ctx.Err() != nil {
+			a.messages = append(a.messages, llm.Message{
+				Role:    llm.RoleUser,
+				Content: toolResults,
+			})
+			a.finishRound(usageAtStart)
+			return fmt.Errorf("interrupted: %w", ctx.Err())
 		}
 
-		if len(toolBlocks) == 0 {
-			a.totalIn += roundIn
-			a.totalOut += roundOut
-			if a.onUsage != nil {
-				a.onUsage(roundIn, roundOut, a.totalIn, a.totalOut)
-			}
+		if len(toolBlocks) == 0 && cut == nil {
+			a.finishRound(usageAtStart)
 			return nil
 		}
 
+		next := toolResults
+		if cut != nil {
+			next = append(next, llm.ContentBlock{Type: "text", Text: fmt.Sprintf(cutToolPrompt, cut.Name)})
+		}
 		a.messages = append(a.messages, llm.Message{
 			Role:    llm.RoleUser,
-			Content: toolResults,
+			Content: next,
 		})
 
-		// check context size mid-loop
-		a.autoCompact()
-	}
+		if len(toolBlocks) > 0 {
+			if err := guard.afterTools(toolBlocks, toolResults); err != nil && !a.continueAfter(err, guard) {
+				a.finishRound(usageAtStart)
+				return err
+			}
+		}
 
-	a.totalIn += roundIn
-	a.totalOut += roundOut
-	if a.onUsage != nil {
-		a.onUsage(roundIn, roundOut, a.totalIn, a.totalOut)
+		// check context size mid-loop
+		a.autoCompact(ctx)
 	}
-	return fmt.Errorf("reached max iterations (%d), task may be incomplete", maxIterations)
 }
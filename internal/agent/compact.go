@@ -0,0 +1,270 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Lewis-404/axe/internal/config"
+	"github.com/Lewis-404/axe/internal/llm"
+	"github.com/Lewis-404/axe/internal/tokenizer"
+)
+
+// Compaction tiers, cheapest first. CompactEvent.Tier is the last one run.
+const (
+	TierElide = "elide" // old tool output replaced by stubs
+	TierTurns = "turns" // older turns summarized, recent ones verbatim
+	TierFull  = "full"  // everything summarized
+)
+
+const (
+	defaultKeepTurns = 3
+	// elideMinTokens is the smallest tool result worth replacing by a stub.
+	elideMinTokens = 200
+)
+
+// compactText is the model-facing wording of a summary, per language.
+type compactText struct {
+	prompt  string // asks for the summary; %s is the output language
+	focus   string // prefixes the user's hint
+	header  string // starts the summary message
+	request string // introduces the last user request, quoted verbatim
+	ack     string // assistant reply that closes the summary exchange
+}
+
+var compactZH = compactText{
+	prompt:  "请将以上对话历史压缩为一段简洁的摘要，保留：1) 用户的核心需求 2) 已完成的操作和关键决策 3) 当前进展状态 4) 重要的文件路径和代码上下文。用%s输出。",
+	focus:   "\n重点保留: ",
+	header:  "[对话历史摘要]\n",
+	request: "\n\n[最近的用户请求]\n",
+	ack:     "好的，我已了解之前的对话内容，请继续。",
+}
+
+var compactEN = compactText{
+	prompt:  "Summarize the conversation above concisely. Keep: 1) the user's core requirements 2) actions taken and key decisions 3) current progress 4) important file paths and code context. Write the summary in %s.",
+	focus:   "\nFocus on: ",
+	header:  "[Conversation summary]\n",
+	request: "\n\n[Latest user request]\n",
+	ack:     "Understood, I have the context of the conversation so far. Please continue.",
+}
+
+// SetCompactConfig sets how many turns compaction keeps and the summary
+// language.
+func (a *Agent) SetCompactConfig(c config.CompactConfig) { a.compactCfg = c }
+
+func (a *Agent) keepTurns() int {
+	if a.compactCfg.KeepTurns > 0 {
+		return a.compactCfg.KeepTurns
+	}
+	return defaultKeepTurns
+}
+
+// compactWording returns the summary wording and output language.
+func (a *Agent) compactWording() (compactText, string) {
+	switch lang := a.compactCfg.Language; strings.ToLower(lang) {
+	case "", "zh", "chinese", "中文":
+		return compactZH, "中文"
+	default:
+		return compactEN, lang
+	}
+}
+
+// Compact shrinks the history on request. It elides old tool output and
+// summarizes all but the last turns, falling back to a full summary when
+// there are too few turns to split.
+func (a *Agent) Compact(ctx context.Context, hint string) error {
+	return a.compact(ctx, hint, 0)
+}
+
+// compact runs the tiers in order and stops as soon as the prompt fits in
+// target tokens (target 0: stop after the turn summary). The replaced
+// history is kept on the first message, see RestoreCompacted.
+func (a *Agent) compact(ctx context.Context, hint string, target int) error {
+	if len(a.messages) < 4 {
+		return nil
+	}
+	before := a.contextTokens()
+	orig := a.messages
+	over := func() bool { return target > 0 && a.contextTokens() > target }
+
+	tier := ""
+	if a.elideToolResults() {
+		tier = TierElide
+	}
+	var err error
+	if target == 0 || over() {
+		var split bool
+		if split, err = a.summarizeTurns(ctx, hint); split {
+			tier = TierTurns
+		}
+		if err == nil && (!split || over()) {
+			if err = a.summarizeAll(ctx, hint); err == nil {
+				tier = TierFull
+			}
+		}
+	}
+	if tier == "" {
+		return err
+	}
+	a.messages[0].Compacted = &llm.Compaction{Messages: orig, Count: len(a.messages)}
+	a.emit(Event{Type: EventCompact, Compact: &CompactEvent{Before: before, After: a.contextTokens(), Tier: tier}})
+	return err
+}
+
+func (a *Agent) autoCompact(ctx context.Context) {
+	threshold := a.compactThreshold()
+	if threshold <= 0 || len(a.messages) < 6 {
+		return
+	}
+	if a.contextTokens() > threshold {
+		// aim well below the threshold so the next turns don't compact again
+		if err := a.compact(ctx, "", threshold/2); err != nil && ctx.Err() == nil {
+			a.emit(Event{Type: EventError, Err: err})
+		}
+	}
+}
+
+// elideToolResults replaces large tool results by short stubs, except those
+// of the last keepTurns tool rounds. It reports whether anything changed;
+// the history is copied, never modified in place.
+func (a *Agent) elideToolResults() bool {
+	protect := len(a.messages) - 2*a.keepTurns()
+	var out []llm.Message
+	for i := 0; i < protect; i++ {
+		copied := false
+		for j, b := range a.messages[i].Content {
+			if b.Type != "tool_result" {
+				continue
+			}
+			n := tokenizer.Block(b)
+			if n < elideMinTokens {
+				continue
+			}
+			if out == nil {
+				out = slices.Clone(a.messages)
+			}
+			if !copied {
+				out[i].Content = slices.Clone(out[i].Content)
+				out[i].Tokens = 0
+				copied = true
+			}
+			out[i].Content[j].Content = fmt.Sprintf("[output elided during compaction: ~%d tokens. Run the tool again if it is still needed.]", n)
+			out[i].Content[j].Parts = nil
+		}
+	}
+	if out == nil {
+		return false
+	}
+	a.SetMessages(out)
+	return true
+}
+
+// turnStarts returns the indexes of user messages that start a turn, as
+// opposed to those carrying tool results.
+func turnStarts(msgs []llm.Message) []int {
+	var starts []int
+	for i, m := range msgs {
+		if m.Role != llm.RoleUser {
+			continue
+		}
+		for _, b := range m.Content {
+			if b.Type == "text" || b.Type == "image" {
+				starts = append(starts, i)
+				break
+			}
+		}
+	}
+	return starts
+}
+
+// summarizeTurns replaces all but the last keepTurns turns by a summary.
+// It reports false without calling the model if there are not enough turns.
+func (a *Agent) summarizeTurns(ctx context.Context, hint string) (bool, error) {
+	starts := turnStarts(a.messages)
+	if len(starts) <= a.keepTurns() {
+		return false, nil
+	}
+	cut := starts[len(starts)-a.keepTurns()]
+	summary, err := a.summarize(ctx, a.messages[:cut], hint)
+	if err != nil {
+		return false, err
+	}
+	w, _ := a.compactWording()
+	msgs := []llm.Message{
+		{Role: llm.RoleUser, Content: []llm.ContentBlock{{Type: "text", Text: w.header + summary}}},
+		{Role: llm.RoleAssistant, Content: []llm.ContentBlock{{Type: "text", Text: w.ack}}},
+	}
+	a.SetMessages(append(msgs, a.messages[cut:]...))
+	return true, nil
+}
+
+// summarizeAll replaces the whole history by a summary followed by the last
+// user request verbatim. Mid-turn (the history ends with tool results) the
+// summary is left as the last message so the model picks the task up.
+func (a *Agent) summarizeAll(ctx context.Context, hint string) error {
+	summary, err := a.summarize(ctx, a.messages, hint)
+	if err != nil {
+		return err
+	}
+	w, _ := a.compactWording()
+	text := w.header + summary
+	if starts := turnStarts(a.messages); len(starts) > 0 {
+		if req := messageText(a.messages[starts[len(starts)-1]]); req != "" {
+			text += w.request + req
+		}
+	}
+	msgs := []llm.Message{{Role: llm.RoleUser, Content: []llm.ContentBlock{{Type: "text", Text: text}}}}
+	if a.messages[len(a.messages)-1].Role == llm.RoleAssistant {
+		msgs = append(msgs, llm.Message{Role: llm.RoleAssistant, Content: []llm.ContentBlock{{Type: "text", Text: w.ack}}})
+	}
+	a.SetMessages(msgs)
+	return nil
+}
+
+// summarize asks the model for a summary of msgs.
+func (a *Agent) summarize(ctx context.Context, msgs []llm.Message, hint string) (string, error) {
+	w, lang := a.compactWording()
+	prompt := fmt.Sprintf(w.prompt, lang)
+	if hint != "" {
+		prompt += w.focus + hint
+	}
+	req := append(slices.Clone(msgs), llm.Message{
+		Role:    llm.RoleUser,
+		Content: []llm.ContentBlock{{Type: "text", Text: prompt}},
+	})
+	resp, err := a.client.Send(llm.WithTask(ctx, llm.TaskCompact), a.systemPrompt(), req)
+	if err != nil {
+		return "", fmt.Errorf("compact: %w", err)
+	}
+	var summary string
+	for _, b := range resp.Content {
+		if b.Type == "text" {
+			summary += b.Text
+		}
+	}
+	return summary, nil
+}
+
+func messageText(m llm.Message) string {
+	var parts []string
+	for _, b := range m.Content {
+		if b.Type == "text" && b.Text != "" {
+			parts = append(parts, b.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// RestoreCompacted undoes the last compaction: the history it replaced comes
+// back, followed by everything added since. It reports false if the history
+// is not compacted.
+func (a *Agent) RestoreCompacted() bool {
+	if len(a.messages) == 0 || a.messages[0].Compacted == nil {
+		return false
+	}
+	c := a.messages[0].Compacted
+	restored := append(slices.Clone(c.Messages), a.messages[min(c.Count, len(a.messages)):]...)
+	a.SetMessages(restored)
+	return true
+}
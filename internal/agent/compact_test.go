@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Lewis-404/axe/internal/config"
+	"github.com/Lewis-404/axe/internal/llm"
+)
+
+// summaryServer answers non-streaming requests with a fixed summary and
+// records how many messages each request carried.
+func summaryServer(t *testing.T, sizes *[]int) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req llm.Request
+		json.NewDecoder(r.Body).Decode(&req)
+		*sizes = append(*sizes, len(req.Messages))
+		json.NewEncoder(w).Encode(llm.Response{ID: "s", Role: "assistant", Content: []llm.ContentBlock{{Type: "text", Text: "SUMMARY"}}})
+	}))
+}
+
+func userText(s string) llm.Message {
+	return llm.Message{Role: llm.RoleUser, Content: []llm.ContentBlock{{Type: "text", Text: s}}}
+}
+
+func assistantText(s string) llm.Message {
+	return llm.Message{Role: llm.RoleAssistant, Content: []llm.ContentBlock{{Type: "text", Text: s}}}
+}
+
+// toolRound is an assistant tool call and its result.
+func toolRound(id, result string) []llm.Message {
+	return []llm.Message{
+		{Role: llm.RoleAssistant, Content: []llm.ContentBlock{{Type: "tool_use", ID: id, Name: "read_file", Input: map[string]any{}}}},
+		{Role: llm.RoleUser, Content: []llm.ContentBlock{{Type: "tool_result", ToolID: id, Content: result}}},
+	}
+}
+
+func TestCompactElidesOldToolResults(t *testing.T) {
+	var sizes []int
+	srv := summaryServer(t, &sizes)
+	defer srv.Close()
+	a := newTestAgent(t, srv.URL)
+
+	big := strings.Repeat("func main() {}\n", 200)
+	msgs := []llm.Message{userText("read the files")}
+	for _, id := range []string{"t1", "t2", "t3", "t4"} {
+		msgs = append(msgs, toolRound(id, big)...)
+	}
+	a.SetMessages(msgs)
+	if err := a.compact(context.Background(), "", 1000000); err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 0 {
+		t.Errorf("eliding alone should not call the model, made %d requests", len(sizes))
+	}
+	if len(a.messages) != len(msgs) {
+		t.Fatalf("elision changed the structure: %d messages", len(a.messages))
+	}
+	if got := a.messages[2].Content[0].Content; !strings.HasPrefix(got, "[output elided") {
+		t.Errorf("old result = %.40q, want a stub", got)
+	}
+	// the last keepTurns rounds stay verbatim
+	if got := a.messages[4].Content[0].Content; got != big {
+		t.Errorf("recent result was elided: %.40q", got)
+	}
+	if msgs[2].Content[0].Content != big {
+		t.Error("compaction modified the original history")
+	}
+
+	if !a.RestoreCompacted() || a.messages[2].Content[0].Content != big || a.messages[0].Compacted != nil {
+		t.Error("RestoreCompacted did not bring the original history back")
+	}
+}
+
+func TestCompactKeepsRecentTurns(t *testing.T) {
+	var sizes []int
+	srv := summaryServer(t, &sizes)
+	defer srv.Close()
+	a := newTestAgent(t, srv.URL)
+
+	var msgs []llm.Message
+	for _, s := range []string{"one", "two", "three", "four", "five"} {
+		msgs = append(msgs, userText(s), assistantText("ok "+s))
+	}
+	a.SetMessages(msgs)
+	var tiers []string
+	a.SetSink(SinkFunc(func(e Event) {
+		if e.Type == EventCompact {
+			tiers = append(tiers, e.Compact.Tier)
+		}
+	}))
+	if err := a.Compact(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	// summary of turns one and two (+ prompt), then three to five verbatim
+	if len(sizes) != 1 || sizes[0] != 5 {
+		t.Errorf("summary requests = %v, want one of 5 messages", sizes)
+	}
+	if len(a.messages) != 8 || messageText(a.messages[2]) != "three" {
+		t.Fatalf("history = %d messages starting %q", len(a.messages), messageText(a.messages[2]))
+	}
+	if !strings.Contains(messageText(a.messages[0]), "SUMMARY") || len(tiers) != 1 || tiers[0] != TierTurns {
+		t.Errorf("summary %q, tiers %v", messageText(a.messages[0]), tiers)
+	}
+
+	a.messages = append(a.messages, userText("six"), assistantText("ok six"))
+	if !a.RestoreCompacted() {
+		t.Fatal("nothing to restore")
+	}
+	if len(a.messages) != 12 || messageText(a.messages[10]) != "six" {
+		t.Errorf("restored %d messages, want the original 10 plus the new turn", len(a.messages))
+	}
+}
+
+func TestCompactFullSummaryMidTurn(t *testing.T) {
+	var sizes []int
+	srv := summaryServer(t, &sizes)
+	defer srv.Close()
+	a := newTestAgent(t, srv.URL)
+	a.SetCompactConfig(config.CompactConfig{Language: "English"})
+
+	msgs := []llm.Message{userText("fix the bug")}
+	msgs = append(msgs, toolRound("t1", "a")...)
+	msgs = append(msgs, toolRound("t2", "b")...)
+	a.SetMessages(msgs)
+	if err := a.Compact(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.messages) != 1 {
+		t.Fatalf("history = %d messages, want the summary alone so the turn continues", len(a.messages))
+	}
+	text := messageText(a.messages[0])
+	if !strings.HasPrefix(text, "[Conversation summary]") || !strings.HasSuffix(text, "fix the bug") {
+		t.Errorf("summary message = %q", text)
+	}
+	if c := a.messages[0].Compacted; c == nil || len(c.Messages) != 5 || c.Count != 1 {
+		t.Errorf("compaction record = %+v", c)
+	}
+}
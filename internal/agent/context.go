@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/config"
+	"github.com/Lewis-404/axe/internal/llm"
+	"github.com/Lewis-404/axe/internal/tokenizer"
+)
+
+// contextAnchor is the exact prompt size the provider reported for the last
+// request, which covered the first msgs messages.
+type contextAnchor struct {
+	tokens int
+	msgs   int
+}
+
+// ContextBreakdown splits the prompt the next request would send.
+type ContextBreakdown struct {
+	System      int
+	Tools       int
+	History     int // user and assistant messages, without tool results
+	ToolResults int
+	Total       int
+	Window      int         // context window being measured against
+	Exact       bool        // Total was counted by the provider
+	Skills      []SkillSize // active skills, part of System
+}
+
+// SkillSize is an active skill's share of the system prompt.
+type SkillSize struct {
+	Name   string
+	Tokens int
+}
+
+// ContextWindow returns the active model's context window. It follows the
+// client across /model switches and fallback.
+func (a *Agent) ContextWindow() int {
+	if m := a.client.Active(); m != nil {
+		return m.ContextLimit()
+	}
+	return config.DefaultContextWindow
+}
+
+// compactThreshold returns the prompt size that triggers auto-compaction for
+// the active model.
+func (a *Agent) compactThreshold() int {
+	if m := a.client.Active(); m != nil {
+		return m.CompactThreshold()
+	}
+	return int(config.DefaultContextWindow * config.DefaultCompactRatio)
+}
+
+// messageTokens returns message i's token count, counting it locally the
+// first time. Counts are stored on the message so they persist in history.
+func (a *Agent) messageTokens(i int) int {
+	if a.messages[i].Tokens == 0 {
+		a.messages[i].Tokens = tokenizer.Message(a.messages[i])
+	}
+	return a.messages[i].Tokens
+}
+
+// contextTokens returns the current prompt size: the last exact count from
+// the provider plus local counts for what was added since, or a local count
+// of everything when there is no usable anchor.
+func (a *Agent) contextTokens() int {
+	n, from := 0, 0
+	if a.anchor.tokens > 0 && a.anchor.msgs <= len(a.messages) {
+		n, from = a.anchor.tokens, a.anchor.msgs
+	} else {
+		n = tokenizer.Count(a.systemPrompt()) + tokenizer.Tools(a.client.Tools())
+	}
+	for i := from; i < len(a.messages); i++ {
+		n += a.messageTokens(i)
+	}
+	return n
+}
+
+// promptSizer sizes prompts for routing the way contextTokens does: counts
+// recorded on messages, the local tokenizer for the rest.
+func promptSizer(client *llm.Client) llm.PromptSizer {
+	return func(system string, msgs []llm.Message) int {
+		n := tokenizer.Count(system) + tokenizer.Tools(client.Tools())
+		for _, m := range msgs {
+			if m.Tokens > 0 {
+				n += m.Tokens
+			} else {
+				n += tokenizer.Message(m)
+			}
+		}
+		return n
+	}
+}
+
+// resetAnchor forgets the last exact count after history was rewritten.
+func (a *Agent) resetAnchor() { a.anchor = contextAnchor{} }
+
+// countTimeout bounds the count_tokens request /context makes.
+const countTimeout = 10 * time.Second
+
+// ContextBreakdown measures the next request's prompt. The parts are counted
+// locally; when the provider can count tokens the total is exact and the
+// parts are scaled to match it.
+func (a *Agent) ContextBreakdown(ctx context.Context) ContextBreakdown {
+	b := ContextBreakdown{
+		System: tokenizer.Count(a.systemPrompt()),
+		Tools:  tokenizer.Tools(a.client.Tools()),
+		Window: a.ContextWindow(),
+	}
+	for _, sk := range a.skills {
+		b.Skills = append(b.Skills, SkillSize{sk.name, tokenizer.Count(skillPrompt(sk))})
+	}
+	for i, m := range a.messages {
+		results := 0
+		for _, blk := range m.Content {
+			if blk.Type == "tool_result" {
+				results += tokenizer.Block(blk)
+			}
+		}
+		b.ToolResults += results
+		b.History += a.messageTokens(i) - results
+	}
+	b.Total = b.System + b.Tools + b.History + b.ToolResults
+
+	ctx, cancel := context.WithTimeout(ctx, countTimeout)
+	defer cancel()
+	exact, err := a.client.CountTokens(ctx, a.systemPrompt(), a.messages)
+	if err != nil || exact <= 0 || b.Total == 0 {
+		return b
+	}
+	scale := func(n int) int { return n * exact / b.Total }
+	b.System, b.Tools, b.ToolResults = scale(b.System), scale(b.Tools), scale(b.ToolResults)
+	for i := range b.Skills {
+		b.Skills[i].Tokens = scale(b.Skills[i].Tokens)
+	}
+	b.History = exact - b.System - b.Tools - b.ToolResults
+	b.Total, b.Exact = exact, true
+	return b
+}
+
+// anchorUsage records the provider's exact prompt size for the request that
+// was just answered. Call it before appending the reply.
+func (a *Agent) anchorUsage(u llm.Usage) {
+	a.anchor = contextAnchor{tokens: u.PromptTokens(), msgs: len(a.messages)}
+}
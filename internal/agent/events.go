@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/Lewis-404/axe/internal/llm"
+	"github.com/Lewis-404/axe/internal/tools"
+)
+
+// EventType identifies what an Event reports.
+type EventType string
+
+const (
+	EventTextDelta     EventType = "text_delta"     // Text: streamed assistant text
+	EventThinkingDelta EventType = "thinking_delta" // Text: streamed reasoning
+	EventBlockDone     EventType = "block_done"     // a streamed content block ended
+	EventNotice        EventType = "notice"         // Text: informational, e.g. attached images
+	EventToolStart     EventType = "tool_start"     // Tool: call about to run
+	EventToolEnd       EventType = "tool_end"       // Tool: call finished, with Result and Duration
+	EventUsage         EventType = "usage"          // Usage: a turn's usage and the session total
+	EventCompact       EventType = "compact"        // Compact: history was compacted
+	EventRetry         EventType = "retry"          // Retry: a provider is about to retry
+	EventFallback      EventType = "fallback"       // Fallback: switching to the next provider
+	EventRecover       EventType = "recover"        // Recovery: a broken stream is sent again
+	EventRoute         EventType = "route"          // Route: a request went to a model other than the active one
+	EventBudget        EventType = "budget_warning" // Budget: spend crossed the warning threshold
+	EventPlan          EventType = "plan"           // Plan: a plan was submitted in plan mode
+	EventError         EventType = "error"          // Err: a non-fatal error; fatal ones are returned by Run
+)
+
+// Event is one thing that happened while the agent worked. Only the field
+// matching Type is set.
+type Event struct {
+	Type     EventType
+	Text     string
+	Tool     *ToolEvent
+	Usage    *UsageEvent
+	Compact  *CompactEvent
+	Retry    *llm.RetryEvent
+	Fallback *llm.FallbackEvent
+	Recovery *llm.RecoveryEvent
+	Route    *llm.RouteEvent
+	Budget   *BudgetEvent
+	Plan     *tools.Plan
+	Err      error
+}
+
+type ToolEvent struct {
+	ID       string
+	Name     string
+	Input    any
+	Result   string        // tool_end only
+	IsError  bool          // tool_end only
+	Duration time.Duration // tool_end only
+}
+
+type UsageEvent struct {
+	Round llm.UsageByModel // this Run call
+	Total llm.UsageByModel // the whole session
+}
+
+type CompactEvent struct {
+	Before, After int    // estimated tokens
+	Tier          string // last tier run: TierElide, TierTurns or TierFull
+}
+
+type BudgetEvent struct {
+	Spent, Limit float64 // USD
+}
+
+// EventSink receives the agent's events. Tool calls run concurrently, but
+// the agent never calls Emit from two goroutines at once.
+type EventSink interface {
+	Emit(Event)
+}
+
+// SinkFunc adapts a function to EventSink.
+type SinkFunc func(Event)
+
+func (f SinkFunc) Emit(e Event) { f(e) }
+
+// SetSink routes the agent's and its client's events to s (nil discards them).
+func (a *Agent) SetSink(s EventSink) {
+	a.sink = s
+	a.client.OnRetry(func(e llm.RetryEvent) { a.emit(Event{Type: EventRetry, Retry: &e}) })
+	a.client.OnFallback(func(e llm.FallbackEvent) { a.emit(Event{Type: EventFallback, Fallback: &e}) })
+	a.client.OnRecover(func(e llm.RecoveryEvent) { a.emit(Event{Type: EventRecover, Recovery: &e}) })
+	a.client.OnRoute(func(e llm.RouteEvent) { a.emit(Event{Type: EventRoute, Route: &e}) })
+}
+
+func (a *Agent) emit(e Event) {
+	if a.sink == nil {
+		return
+	}
+	a.emitMu.Lock()
+	defer a.emitMu.Unlock()
+	a.sink.Emit(e)
+}
@@ -0,0 +1,296 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Lewis-404/axe/internal/config"
+	"github.com/Lewis-404/axe/internal/llm"
+	"github.com/Lewis-404/axe/internal/tools"
+)
+
+// scriptedServer answers each Anthropic streaming request with the next
+// script entry.
+func scriptedServer(t *testing.T, script ...[]string) *httptest.Server {
+	t.Helper()
+	n := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n >= len(script) {
+			t.Errorf("unexpected request #%d", n+1)
+			http.Error(w, "no more responses", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range script[n] {
+			fmt.Fprintf(w, "data: %s\n\n", e)
+		}
+		n++
+	}))
+}
+
+func newTestAgent(t *testing.T, url string) *Agent {
+	t.Helper()
+	client := llm.NewClient([]config.ModelConfig{{Provider: "anthropic", APIKey: "k", BaseURL: url, Model: "claude-sonnet-4", MaxTokens: 100}}, nil)
+	return New(client, tools.NewRegistry(tools.RegistryOpts{}), "sys")
+}
+
+func TestRunEvents(t *testing.T) {
+	srv := scriptedServer(t,
+		[]string{
+			`{"type":"message_start","message":{"id":"m1","role":"assistant","usage":{"input_tokens":10}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"t1","name":"think"}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"thought\":\"hm\"}"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":5}}`,
+		},
+		[]string{
+			`{"type":"message_start","message":{"id":"m2","role":"assistant","usage":{"input_tokens":20}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"done"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":3}}`,
+		},
+	)
+	defer srv.Close()
+
+	a := newTestAgent(t, srv.URL)
+	var events []Event
+	a.SetSink(SinkFunc(func(e Event) { events = append(events, e) }))
+	if err := a.Run(context.Background(), "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	var types []EventType
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	want := []EventType{EventBlockDone, EventToolStart, EventToolEnd, EventTextDelta, EventBlockDone, EventUsage}
+	if fmt.Sprint(types) != fmt.Sprint(want) {
+		t.Fatalf("events = %v, want %v", types, want)
+	}
+	end := events[2].Tool
+	if end.Name != "think" || end.ID != "t1" || end.IsError || end.Result == "" {
+		t.Errorf("tool_end = %+v", end)
+	}
+	if events[3].Text != "done" {
+		t.Errorf("text = %q", events[3].Text)
+	}
+	if got := events[5].Usage.Round["claude-sonnet-4"]; got.InputTokens != 30 || got.OutputTokens != 8 {
+		t.Errorf("round usage = %+v, want 30/8", got)
+	}
+}
+
+func TestBudgetWarning(t *testing.T) {
+	turn := []string{
+		`{"type":"message_start","message":{"id":"m","role":"assistant","usage":{"input_tokens":10}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"ok"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":1}}`,
+	}
+	srv := scriptedServer(t, turn, turn)
+	defer srv.Close()
+
+	a := newTestAgent(t, srv.URL)
+	var warnings []BudgetEvent
+	a.SetSink(SinkFunc(func(e Event) {
+		if e.Type == EventBudget {
+			warnings = append(warnings, *e.Budget)
+		}
+	}))
+	// each turn costs $0.85 of a $1.00 budget: warn once, then stop
+	a.SetBudget(1, func(u llm.UsageByModel) float64 { return 0.85 * float64(u.Total().InputTokens/10) })
+	if err := a.Run(context.Background(), "one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Run(context.Background(), "two"); err == nil {
+		t.Error("second turn should exceed the budget")
+	}
+	if len(warnings) != 1 || warnings[0].Limit != 1 {
+		t.Errorf("warnings = %+v, want one", warnings)
+	}
+}
+
+func TestContextTokensAnchoredOnUsage(t *testing.T) {
+	srv := scriptedServer(t, []string{
+		`{"type":"message_start","message":{"id":"m","role":"assistant","usage":{"input_tokens":100,"cache_read_input_tokens":900}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"ok"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":20}}`,
+	})
+	defer srv.Close()
+
+	a := newTestAgent(t, srv.URL)
+	if err := a.Run(context.Background(), "hi"); err != nil {
+		t.Fatal(err)
+	}
+	// exact prompt of the last request plus the reply's output tokens
+	if got := a.contextTokens(); got != 1020 {
+		t.Errorf("contextTokens = %d, want 1020", got)
+	}
+	if a.messages[1].Tokens != 20 {
+		t.Errorf("reply tokens = %d, want 20", a.messages[1].Tokens)
+	}
+	a.SetMessages(a.messages[:1])
+	if got := a.contextTokens(); got >= 1000 || got <= 0 {
+		t.Errorf("after rewrite contextTokens = %d, want a local count", got)
+	}
+}
+
+func TestToolCallCutByMaxTokens(t *testing.T) {
+	srv := scriptedServer(t,
+		[]string{
+			`{"type":"message_start","message":{"id":"m1","role":"assistant","usage":{"input_tokens":10}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Thinking it over."}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"t1","name":"think","input":{}}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"thought\":\"a very long"}}`,
+			`{"type":"content_block_stop","index":1}`,
+			`{"type":"message_delta","delta":{"stop_reason":"max_tokens"},"usage":{"output_tokens":100}}`,
+		},
+		[]string{
+			`{"type":"message_start","message":{"id":"m2","role":"assistant","usage":{"input_tokens":20}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"done"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":3}}`,
+		},
+	)
+	defer srv.Close()
+
+	a := newTestAgent(t, srv.URL)
+	var ran bool
+	a.SetSink(SinkFunc(func(e Event) { ran = ran || e.Type == EventToolStart }))
+	if err := a.Run(context.Background(), "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if ran {
+		t.Error("the truncated tool call ran")
+	}
+	msgs := a.Messages()
+	if len(msgs) != 4 {
+		t.Fatalf("history has %d messages, want 4", len(msgs))
+	}
+	if c := msgs[1].Content; len(c) != 1 || c[0].Type != "text" {
+		t.Errorf("assistant turn = %+v, want the text without the cut call", c)
+	}
+	if c := msgs[2].Content; len(c) != 1 || !strings.Contains(c[0].Text, "think call") {
+		t.Errorf("continue request = %+v", c)
+	}
+}
+
+func TestToolCallCutAfterCompleteCallOpenAI(t *testing.T) {
+	var bodies []map[string]any
+	script := [][]string{
+		{
+			`{"id":"c1","choices":[{"delta":{"tool_calls":[{"index":0,"id":"t1","type":"function","function":{"name":"think","arguments":"{\"thought\":\"hm\"}"}}]}}]}`,
+			`{"id":"c1","choices":[{"delta":{"tool_calls":[{"index":1,"id":"t2","type":"function","function":{"name":"think","arguments":"{\"thought\":\"a very long"}}]}}]}`,
+			`{"id":"c1","choices":[{"delta":{},"finish_reason":"length"}]}`,
+			`[DONE]`,
+		},
+		{
+			`{"id":"c2","choices":[{"delta":{"content":"done"},"finish_reason":"stop"}]}`,
+			`[DONE]`,
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+		if len(bodies) > len(script) {
+			http.Error(w, "no more responses", http.StatusBadRequest)
+			return
+		}
+		for _, e := range script[len(bodies)-1] {
+			fmt.Fprintf(w, "data: %s\n\n", e)
+		}
+	}))
+	defer srv.Close()
+
+	client := llm.NewClient([]config.ModelConfig{{Provider: "openai", APIKey: "k", BaseURL: srv.URL, Model: "gpt-4o", MaxTokens: 100}}, nil)
+	a := New(client, tools.NewRegistry(tools.RegistryOpts{}), "sys")
+	if err := a.Run(context.Background(), "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("%d requests, want 2", len(bodies))
+	}
+	sent := bodies[1]["messages"].([]any)
+	// system, user, assistant with the complete call, its result, the prompt
+	if len(sent) != 5 {
+		t.Fatalf("continuation sent %d messages, want 5: %v", len(sent), sent)
+	}
+	result, prompt := sent[3].(map[string]any), sent[4].(map[string]any)
+	if result["role"] != "tool" || result["tool_call_id"] != "t1" {
+		t.Errorf("tool result = %v", result)
+	}
+	if text, _ := prompt["content"].(string); prompt["role"] != "user" || !strings.Contains(text, "think call") {
+		t.Errorf("continue request = %v", prompt)
+	}
+}
+
+func TestCompactThresholdFollowsModel(t *testing.T) {
+	client := llm.NewClient([]config.ModelConfig{
+		{Provider: "anthropic", APIKey: "k", Model: "claude-sonnet-4", MaxTokens: 8192},
+		{Provider: "openai", APIKey: "k", Model: "local-32k", MaxTokens: 8192, ContextWindow: 32768},
+		{Provider: "openai", APIKey: "k", Model: "gpt-4o", MaxTokens: 8192, AutoCompactThreshold: 0.5},
+	}, nil)
+	a := New(client, tools.NewRegistry(tools.RegistryOpts{}), "sys")
+	cases := []struct {
+		model             string
+		window, threshold int
+	}{
+		{"claude-sonnet-4", 200000, 160000},
+		{"local-32k", 32768, 32768 - 8192}, // 80% would leave no room for the reply
+		{"gpt-4o", 128000, 64000},
+	}
+	for _, c := range cases {
+		client.SwitchModel(c.model)
+		if w, th := a.ContextWindow(), a.compactThreshold(); w != c.window || th != c.threshold {
+			t.Errorf("%s: window %d threshold %d, want %d %d", c.model, w, th, c.window, c.threshold)
+		}
+	}
+}
+
+func TestInterruptReportsUsage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range []string{
+			`{"type":"message_start","message":{"id":"m1","role":"assistant","usage":{"input_tokens":10}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Working"}}`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", e)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	a := newTestAgent(t, srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var usage *UsageEvent
+	a.SetSink(SinkFunc(func(e Event) {
+		switch e.Type {
+		case EventTextDelta:
+			cancel()
+		case EventUsage:
+			usage = e.Usage
+		}
+	}))
+	if err := a.Run(ctx, "go"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want an interruption", err)
+	}
+	if usage == nil || usage.Round["claude-sonnet-4"].InputTokens != 10 {
+		t.Errorf("usage = %+v, want the interrupted round's tokens", usage)
+	}
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/config"
+	"github.com/Lewis-404/axe/internal/llm"
+)
+
+// Defaults for config.LoopLimits fields left at zero.
+const (
+	defaultMaxIterations = 40
+	defaultMaxToolErrors = 3
+	defaultMaxRepeats    = 3
+)
+
+// SetLimits sets the per-turn loop limits.
+func (a *Agent) SetLimits(l config.LoopLimits) {
+	if l.MaxIterations <= 0 {
+		l.MaxIterations = defaultMaxIterations
+	}
+	if l.MaxConsecutiveErrors <= 0 {
+		l.MaxConsecutiveErrors = defaultMaxToolErrors
+	}
+	if l.MaxRepeatedCalls <= 0 {
+		l.MaxRepeatedCalls = defaultMaxRepeats
+	}
+	a.limits = l
+}
+
+// SetLimitHandler sets fn to be asked whether to keep going when a loop
+// limit is hit; the limit then starts counting afresh. Without a handler, or
+// when it returns false, Run stops with the limit's error.
+func (a *Agent) SetLimitHandler(fn func(err error) bool) { a.onLimit = fn }
+
+func (a *Agent) continueAfter(err error, g *loopGuard) bool {
+	if a.onLimit == nil || !a.onLimit(err) {
+		return false
+	}
+	g.reset()
+	return true
+}
+
+// loopGuard enforces the loop limits within one turn.
+type loopGuard struct {
+	limits  config.LoopLimits
+	iter    int
+	start   time.Time
+	errors  int              // consecutive rounds with a failed tool
+	repeats map[[32]byte]int // identical call and result -> times seen
+}
+
+func (a *Agent) newLoopGuard() *loopGuard {
+	g := &loopGuard{limits: a.limits}
+	g.reset()
+	return g
+}
+
+func (g *loopGuard) reset() {
+	g.iter, g.errors, g.start = 0, 0, time.Now()
+	g.repeats = map[[32]byte]int{}
+}
+
+// beforeRequest counts an iteration and checks the iteration and time limits.
+func (g *loopGuard) beforeRequest() error {
+	g.iter++
+	if g.iter > g.limits.MaxIterations {
+		return fmt.Errorf("%w (%d), task may be incomplete", ErrMaxIterations, g.limits.MaxIterations)
+	}
+	if max := g.limits.MaxTurnTime; max > 0 && time.Since(g.start) > max {
+		return fmt.Errorf("%w (%s), task may be incomplete", ErrTimeLimit, max)
+	}
+	return nil
+}
+
+// afterTools checks a round of tool results for consecutive errors and for
+// calls that keep getting the same answer, such as an edit_file retried with
+// an old_text that does not match.
+func (g *loopGuard) afterTools(calls, results []llm.ContentBlock) error {
+	failed, repeated := false, ""
+	for i, c := range calls {
+		failed = failed || results[i].IsError
+		input, _ := json.Marshal(c.Input)
+		key := sha256.Sum256([]byte(c.Name + "\x00" + string(input) + "\x00" + results[i].Content))
+		g.repeats[key]++
+		if g.repeats[key] >= g.limits.MaxRepeatedCalls && repeated == "" {
+			repeated = c.Name
+		}
+	}
+	if failed {
+		g.errors++
+	} else {
+		g.errors = 0
+	}
+	if g.errors >= g.limits.MaxConsecutiveErrors {
+		return fmt.Errorf("%w (%d), stopping to avoid loop", ErrToolErrors, g.errors)
+	}
+	if repeated != "" {
+		return fmt.Errorf("%w: %s called %d times with the same input and result", ErrRepeatedCalls, repeated, g.limits.MaxRepeatedCalls)
+	}
+	return nil
+}
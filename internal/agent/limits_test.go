@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/config"
+	"github.com/Lewis-404/axe/internal/llm"
+)
+
+// thinkTurn is a response that calls the think tool with the same input.
+var thinkTurn = []string{
+	`{"type":"message_start","message":{"id":"m","role":"assistant","usage":{"input_tokens":10}}}`,
+	`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"t","name":"think"}}`,
+	`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"thought\":\"again\"}"}}`,
+	`{"type":"content_block_stop","index":0}`,
+	`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":5}}`,
+}
+
+var doneTurn = []string{
+	`{"type":"message_start","message":{"id":"m","role":"assistant","usage":{"input_tokens":10}}}`,
+	`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+	`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"done"}}`,
+	`{"type":"content_block_stop","index":0}`,
+	`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":1}}`,
+}
+
+func TestRepeatedCallsStopTheLoop(t *testing.T) {
+	srv := scriptedServer(t, thinkTurn, thinkTurn, thinkTurn)
+	defer srv.Close()
+
+	a := newTestAgent(t, srv.URL)
+	err := a.Run(context.Background(), "go")
+	if !errors.Is(err, ErrRepeatedCalls) {
+		t.Fatalf("err = %v, want ErrRepeatedCalls", err)
+	}
+	// every tool_use is answered, so the conversation can go on
+	if last := a.messages[len(a.messages)-1]; last.Role != llm.RoleUser || last.Content[0].Type != "tool_result" {
+		t.Errorf("history ends with %+v", last)
+	}
+}
+
+func TestLimitHandlerContinues(t *testing.T) {
+	srv := scriptedServer(t, thinkTurn, thinkTurn, doneTurn)
+	defer srv.Close()
+
+	a := newTestAgent(t, srv.URL)
+	a.SetLimits(config.LoopLimits{MaxIterations: 2})
+	var asked []error
+	a.SetLimitHandler(func(err error) bool {
+		asked = append(asked, err)
+		return true
+	})
+	if err := a.Run(context.Background(), "go"); err != nil {
+		t.Fatal(err)
+	}
+	if len(asked) != 1 || !errors.Is(asked[0], ErrMaxIterations) {
+		t.Errorf("handler asked %v, want one ErrMaxIterations", asked)
+	}
+}
+
+func TestLoopGuardTimeLimit(t *testing.T) {
+	a := newTestAgent(t, "")
+	a.SetLimits(config.LoopLimits{MaxTurnTime: time.Minute})
+	g := a.newLoopGuard()
+	if err := g.beforeRequest(); err != nil {
+		t.Fatal(err)
+	}
+	g.start = g.start.Add(-2 * time.Minute)
+	if err := g.beforeRequest(); !errors.Is(err, ErrTimeLimit) {
+		t.Errorf("err = %v, want ErrTimeLimit", err)
+	}
+}
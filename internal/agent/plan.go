@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"github.com/Lewis-404/axe/internal/tools"
+)
+
+const planModePrompt = `
+
+You are in PLAN MODE. Only read-only tools are available: investigate the codebase, then call submit_plan with a concrete plan (steps, the files each step touches, the commands it runs). Do not attempt to modify anything. After submit_plan, stop and wait for the user.`
+
+const approvedPlanPrompt = `
+
+The user approved this plan. Follow it step by step; call update_plan to mark each step in_progress when you start it and done (or skipped) when it is finished.
+
+Approved plan:
+`
+
+// EnterPlanMode restricts the agent to read-only tools until a plan is
+// submitted and approved. Any previously approved plan is dropped.
+func (a *Agent) EnterPlanMode() {
+	a.planMode = true
+	a.pending = nil
+	a.plan = nil
+	a.registry.Unregister("update_plan")
+	a.registry.Register(&tools.SubmitPlan{OnSubmit: func(p *tools.Plan) {
+		a.pending = p
+		a.emit(Event{Type: EventPlan, Plan: p})
+	}})
+	a.registry.SetPlanMode(true)
+	a.syncTools()
+}
+
+// ExitPlanMode restores the full tool set without approving anything.
+func (a *Agent) ExitPlanMode() {
+	a.planMode = false
+	a.pending = nil
+	a.registry.Unregister("submit_plan")
+	a.registry.SetPlanMode(false)
+	a.syncTools()
+}
+
+func (a *Agent) InPlanMode() bool { return a.planMode }
+
+// PendingPlan returns the plan submitted in plan mode and awaiting review.
+func (a *Agent) PendingPlan() *tools.Plan { return a.pending }
+
+// RejectPlan discards the pending plan; the agent stays in plan mode so it
+// can be asked for a different one.
+func (a *Agent) RejectPlan() { a.pending = nil }
+
+// ApprovePlan leaves plan mode with p as the approved plan. The plan is kept
+// in the system prompt, so it survives compaction, and the agent reports
+// progress on it through update_plan.
+func (a *Agent) ApprovePlan(p *tools.Plan) {
+	a.ExitPlanMode()
+	a.plan = p
+	a.registry.Register(&tools.UpdatePlan{Plan: a.plan})
+	a.syncTools()
+}
+
+// Plan returns the approved plan with its progress, or nil.
+func (a *Agent) Plan() *tools.Plan { return a.plan }
+
+// ClearPlan drops the approved plan.
+func (a *Agent) ClearPlan() {
+	a.plan = nil
+	a.registry.Unregister("update_plan")
+	a.syncTools()
+}
+
+func (a *Agent) syncTools() {
+	a.client.SetTools(a.registry.Definitions())
+}
@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Lewis-404/axe/internal/config"
+	"github.com/Lewis-404/axe/internal/llm"
+	"github.com/Lewis-404/axe/internal/tools"
+)
+
+func TestPlanMode(t *testing.T) {
+	var bodies []map[string]any
+	n := 0
+	script := [][]string{
+		{
+			`{"type":"message_start","message":{"id":"m1","role":"assistant","usage":{"input_tokens":10}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"t1","name":"submit_plan"}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"summary\":\"s\",\"steps\":[{\"title\":\"edit a\",\"files\":[\"a.go\"]},{\"title\":\"test\",\"commands\":[\"go test\"]}]}"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":5}}`,
+		},
+		{
+			`{"type":"message_start","message":{"id":"m2","role":"assistant","usage":{"input_tokens":10}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"waiting"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":1}}`,
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		// plan, then plain text for every later request
+		for _, e := range script[min(n, len(script)-1)] {
+			fmt.Fprintf(w, "data: %s\n\n", e)
+		}
+		n++
+	}))
+	defer srv.Close()
+
+	reg := tools.NewRegistry(tools.RegistryOpts{})
+	client := llm.NewClient([]config.ModelConfig{{Provider: "anthropic", APIKey: "k", BaseURL: srv.URL, Model: "claude-sonnet-4", MaxTokens: 100}}, reg.Definitions())
+	a := New(client, reg, "sys")
+	a.EnterPlanMode()
+	if err := a.Run(context.Background(), "do it"); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(body map[string]any) string {
+		var out []string
+		for _, tl := range body["tools"].([]any) {
+			out = append(out, tl.(map[string]any)["name"].(string))
+		}
+		sort.Strings(out)
+		return strings.Join(out, ",")
+	}
+	if got := names(bodies[0]); got != "glob,list_directory,read_file,search_files,submit_plan,think" {
+		t.Errorf("plan mode tools = %s", got)
+	}
+	p := a.PendingPlan()
+	if p == nil || len(p.Steps) != 2 || p.Steps[0].Files[0] != "a.go" {
+		t.Fatalf("pending plan = %+v", p)
+	}
+	if _, err := reg.Execute(context.Background(), "write_file", []byte(`{"path":"x","content":""}`)); err == nil {
+		t.Error("write_file allowed in plan mode")
+	}
+
+	a.ApprovePlan(p)
+	if _, err := reg.Execute(context.Background(), "update_plan", []byte(`{"step":1,"status":"done"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if a.Plan().Done() != 1 || !strings.Contains(a.systemPrompt(), "1. [x] edit a") {
+		t.Errorf("progress not tracked:\n%s", a.systemPrompt())
+	}
+	bodies = nil
+	if err := a.Run(context.Background(), "go"); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(bodies[0]); !strings.Contains(got, "write_file") || !strings.Contains(got, "update_plan") || strings.Contains(got, "submit_plan") {
+		t.Errorf("tools after approval = %s", got)
+	}
+}
+
+func TestUpdatePlanBatch(t *testing.T) {
+	reg := tools.NewRegistry(tools.RegistryOpts{})
+	p := &tools.Plan{Steps: []tools.PlanStep{{Title: "a"}, {Title: "b"}}}
+	reg.Register(&tools.UpdatePlan{Plan: p})
+	a := &Agent{registry: reg}
+
+	blocks := []llm.ContentBlock{
+		{Type: "tool_use", ID: "t1", Name: "update_plan", Input: map[string]any{"step": 1, "status": "done"}},
+		{Type: "tool_use", ID: "t2", Name: "update_plan", Input: map[string]any{"step": 2, "status": "in_progress"}},
+		{Type: "tool_use", ID: "t3", Name: "read_file", Input: map[string]any{"path": "go.mod"}},
+	}
+	res := make([][]tools.Resource, len(blocks))
+	for i, b := range blocks {
+		res[i] = reg.Resources(b.Name, mustJSON(b.Input))
+	}
+	if deps := schedule(res); len(deps[1]) != 1 || len(deps[2]) != 0 {
+		t.Errorf("schedule = %v, want the plan updates in order", deps)
+	}
+
+	// rendering the plan while the batch runs must not race with the updates
+	stop := make(chan struct{})
+	rendered := make(chan struct{})
+	go func() {
+		defer close(rendered)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = p.String()
+			}
+		}
+	}()
+	a.execTools(context.Background(), blocks[:2], map[string]bool{}, func(ctx context.Context, i int, b llm.ContentBlock) {
+		if _, err := reg.Execute(ctx, b.Name, mustJSON(b.Input)); err != nil {
+			t.Error(err)
+		}
+	})
+	close(stop)
+	<-rendered
+	if p.Done() != 1 || p.Steps[1].Status != tools.StepInProgress {
+		t.Errorf("plan = %s", p)
+	}
+}
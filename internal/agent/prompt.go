@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"slices"
+	"strings"
+)
+
+// The system prompt is built from layers that are set independently: the
+// base prompt, project context, active skills, session notes and the plan
+// (see plan.go). Everything there survives compaction and /retry, unlike
+// context injected as messages.
+
+// activeSkill is a skill whose instructions are in the system prompt.
+type activeSkill struct {
+	name    string
+	content string
+}
+
+// SetProjectContext replaces the project context layer, e.g. after resuming
+// a conversation or when the working tree changed.
+func (a *Agent) SetProjectContext(text string) { a.project = text }
+
+// ActivateSkill adds a skill's instructions to the system prompt, replacing
+// them if the skill is already active.
+func (a *Agent) ActivateSkill(name, content string) {
+	for i := range a.skills {
+		if a.skills[i].name == name {
+			a.skills[i].content = content
+			return
+		}
+	}
+	a.skills = append(a.skills, activeSkill{name, content})
+}
+
+// DeactivateSkill removes a skill from the system prompt. It reports false
+// if the skill was not active.
+func (a *Agent) DeactivateSkill(name string) bool {
+	n := len(a.skills)
+	a.skills = slices.DeleteFunc(a.skills, func(s activeSkill) bool { return s.name == name })
+	return len(a.skills) < n
+}
+
+// ActiveSkills returns the names of the active skills in activation order.
+func (a *Agent) ActiveSkills() []string {
+	names := make([]string, len(a.skills))
+	for i, s := range a.skills {
+		names[i] = s.name
+	}
+	return names
+}
+
+// AddNote appends a session note to the system prompt.
+func (a *Agent) AddNote(text string) { a.notes = append(a.notes, text) }
+
+// Notes returns the session notes.
+func (a *Agent) Notes() []string { return a.notes }
+
+// ClearNotes removes all session notes.
+func (a *Agent) ClearNotes() { a.notes = nil }
+
+// skillPrompt renders one active skill as it appears in the system prompt.
+func skillPrompt(s activeSkill) string {
+	return "[Skill: " + s.name + "]\n" + s.content
+}
+
+// systemPrompt renders the layers, followed by the plan-mode instructions or
+// the approved plan, whichever applies.
+func (a *Agent) systemPrompt() string {
+	var sb strings.Builder
+	sb.WriteString(a.system)
+	if a.project != "" {
+		sb.WriteString("\n\nProject context:\n")
+		sb.WriteString(a.project)
+	}
+	if len(a.skills) > 0 {
+		sb.WriteString("\n\nActive skills (follow their instructions):")
+		for _, s := range a.skills {
+			sb.WriteString("\n\n" + skillPrompt(s))
+		}
+	}
+	if len(a.notes) > 0 {
+		sb.WriteString("\n\nSession notes from the user:")
+		for _, n := range a.notes {
+			sb.WriteString("\n- " + n)
+		}
+	}
+	switch {
+	case a.planMode:
+		sb.WriteString(planModePrompt)
+	case a.plan != nil:
+		sb.WriteString(approvedPlanPrompt + a.plan.String())
+	}
+	return sb.String()
+}
@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Lewis-404/axe/internal/llm"
+)
+
+func TestSystemPromptLayers(t *testing.T) {
+	a := newTestAgent(t, "")
+	a.SetProjectContext("go module axe")
+	a.ActivateSkill("review", "check error handling")
+	a.ActivateSkill("tdd", "write the test first")
+	a.AddNote("prefer table tests")
+
+	sys := a.systemPrompt()
+	for _, want := range []string{"sys", "Project context:\ngo module axe", "[Skill: review]\ncheck error handling", "[Skill: tdd]", "- prefer table tests"} {
+		if !strings.Contains(sys, want) {
+			t.Errorf("system prompt lacks %q:\n%s", want, sys)
+		}
+	}
+	if len(a.messages) != 0 {
+		t.Errorf("activating skills added %d messages", len(a.messages))
+	}
+
+	// skills live outside the history, so rewriting it keeps them
+	a.SetMessages([]llm.Message{userText("hi"), assistantText("hello")})
+	if a.PopLastRound() != "hi" || !strings.Contains(a.systemPrompt(), "[Skill: review]") {
+		t.Error("skill lost after PopLastRound")
+	}
+
+	b := a.ContextBreakdown(context.Background())
+	if len(b.Skills) != 2 || b.Skills[0].Name != "review" || b.Skills[0].Tokens <= 0 || b.System < b.Skills[0].Tokens+b.Skills[1].Tokens {
+		t.Errorf("breakdown skills = %+v (system %d)", b.Skills, b.System)
+	}
+
+	if !a.DeactivateSkill("review") || a.DeactivateSkill("review") {
+		t.Error("DeactivateSkill should succeed once")
+	}
+	if strings.Contains(a.systemPrompt(), "[Skill: review]") || strings.Join(a.ActiveSkills(), ",") != "tdd" {
+		t.Errorf("active skills = %v", a.ActiveSkills())
+	}
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/Lewis-404/axe/internal/llm"
+	"github.com/Lewis-404/axe/internal/tools"
+)
+
+// conflicts reports whether two calls touching a and b must not overlap.
+func conflicts(a, b []tools.Resource) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if !x.Write && !y.Write {
+				continue
+			}
+			if x.Key == y.Key || x.Key == tools.AnyResource || y.Key == tools.AnyResource {
+				return true
+			}
+			if (x.Key == tools.FilesResource && y.IsFile()) || (y.Key == tools.FilesResource && x.IsFile()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// schedule returns, for each call, the earlier calls it has to wait for.
+// Conflicting calls keep the order the model issued them in; independent
+// calls get no dependencies and may run concurrently.
+func schedule(res [][]tools.Resource) [][]int {
+	deps := make([][]int, len(res))
+	for i := range res {
+		for j := 0; j < i; j++ {
+			if conflicts(res[i], res[j]) {
+				deps[i] = append(deps[i], j)
+			}
+		}
+	}
+	return deps
+}
+
+// execTools runs one turn's tool calls according to schedule. Calls that
+// will prompt the user are chained with confirm gates so prompts appear one
+// at a time and in call order, even though execution is concurrent.
+// batchApproved holds the BatchConfirm decision per tool name.
+func (a *Agent) execTools(ctx context.Context, blocks []llm.ContentBlock, batchApproved map[string]bool, execOne func(ctx context.Context, i int, block llm.ContentBlock)) {
+	res := make([][]tools.Resource, len(blocks))
+	for i, b := range blocks {
+		input, _ := json.Marshal(b.Input)
+		res[i] = a.registry.Resources(b.Name, input)
+	}
+	deps := schedule(res)
+
+	done := make([]chan struct{}, len(blocks))
+	var prevGate <-chan struct{}
+	var wg sync.WaitGroup
+	for i, b := range blocks {
+		done[i] = make(chan struct{})
+		callCtx := ctx
+		release := func() {}
+		if approved, ok := batchApproved[b.Name]; ok {
+			if approved {
+				callCtx = tools.WithApproved(ctx)
+			}
+		} else if a.registry.NeedsConfirm(b.Name) {
+			gate := make(chan struct{})
+			wait := prevGate
+			var once sync.Once
+			// a gate opens only after its predecessor, so a call that
+			// finishes without prompting can't let a later prompt jump ahead
+			release = func() {
+				once.Do(func() {
+					go func() {
+						if wait != nil {
+							<-wait
+						}
+						close(gate)
+					}()
+				})
+			}
+			callCtx = tools.WithConfirmGate(ctx, wait, release)
+			prevGate = gate
+		}
+
+		wg.Add(1)
+		go func(i int, b llm.ContentBlock, callCtx context.Context, release func()) {
+			defer wg.Done()
+			defer close(done[i])
+			defer release()
+			for _, d := range deps[i] {
+				<-done[d]
+			}
+			execOne(callCtx, i, b)
+		}(i, b, callCtx, release)
+	}
+	wg.Wait()
+}
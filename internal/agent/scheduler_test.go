@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/llm"
+	"github.com/Lewis-404/axe/internal/tools"
+)
+
+func TestSchedule(t *testing.T) {
+	w := func(k string) []tools.Resource { return []tools.Resource{{Key: k, Write: true}} }
+	r := func(k string) []tools.Resource { return []tools.Resource{{Key: k}} }
+	res := [][]tools.Resource{
+		w("file:/a"),           // 0
+		r("file:/a"),           // 1: reads what 0 writes
+		w("file:/b"),           // 2: independent
+		w("shell"),             // 3
+		w("shell"),             // 4: second shell call waits for the first
+		r("file:/c"),           // 5
+		nil,                    // 6: read-only, touches nothing
+		r("file:/c"),           // 7: two reads don't conflict
+		w(tools.AnyResource),   // 8: conflicts with every declared resource
+		r(tools.FilesResource), // 9: reads every file, so waits for their writers
+	}
+	want := [][]int{nil, {0}, nil, nil, {3}, nil, nil, nil, {0, 1, 2, 3, 4, 5, 7}, {0, 2, 8}}
+	if got := schedule(res); !reflect.DeepEqual(got, want) {
+		t.Errorf("schedule = %v, want %v", got, want)
+	}
+}
+
+func TestScheduleShellAfterWrite(t *testing.T) {
+	reg := tools.NewRegistry(tools.RegistryOpts{})
+	calls := []struct {
+		name  string
+		input any
+	}{
+		{"write_file", map[string]any{"path": "main.go", "content": "package main\n"}},
+		{"execute_command", map[string]any{"command": "go build ./..."}},
+		{"read_file", map[string]any{"path": "go.mod"}},
+		{"bg_command", map[string]any{"action": "status"}},
+		{"edit_file", map[string]any{"path": "main_test.go", "old_string": "a", "new_string": "b"}},
+	}
+	var res [][]tools.Resource
+	for _, c := range calls {
+		res = append(res, reg.Resources(c.name, mustJSON(c.input)))
+	}
+	// the build waits for the write, the read for the build, and the edit
+	// for the build; checking on background jobs only waits for the shell
+	want := [][]int{nil, {0}, {1}, {1}, {1}}
+	if got := schedule(res); !reflect.DeepEqual(got, want) {
+		t.Errorf("schedule = %v, want %v", got, want)
+	}
+}
+
+func TestExecToolsConfirmOrder(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, []byte("old\n"), 0644)
+		paths = append(paths, p)
+	}
+
+	var mu sync.Mutex
+	var order []string
+	reg := tools.NewRegistry(tools.RegistryOpts{
+		ConfirmOverwrite: func(path string, _, _ int) bool {
+			mu.Lock()
+			order = append(order, path)
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			return true
+		},
+	})
+	a := &Agent{registry: reg}
+
+	var blocks []llm.ContentBlock
+	for i, p := range paths {
+		blocks = append(blocks, llm.ContentBlock{Type: "tool_use", ID: string(rune('0' + i)), Name: "write_file",
+			Input: map[string]any{"path": p, "content": "new\n"}})
+	}
+	a.execTools(context.Background(), blocks, map[string]bool{}, func(ctx context.Context, i int, b llm.ContentBlock) {
+		if _, err := reg.Execute(ctx, b.Name, mustJSON(b.Input)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if !reflect.DeepEqual(order, paths) {
+		t.Errorf("confirm order = %v, want %v", order, paths)
+	}
+	for _, p := range paths {
+		if data, _ := os.ReadFile(p); string(data) != "new\n" {
+			t.Errorf("%s not written: %q", p, data)
+		}
+	}
+}
+
+func mustJSON(v any) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
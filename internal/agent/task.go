@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/Lewis-404/axe/internal/llm"
+	"github.com/Lewis-404/axe/internal/tools"
+)
+
+const taskPrompt = `You are a sub-agent of Axe, a coding agent. You were given one self-contained task by the main agent. Use your tools to do it, then reply with a concise final report: what you found, with file paths and line numbers where relevant. Your final message is all the main agent will see, so make it complete but do not paste whole files.`
+
+// taskExcluded are read-only tools a sub-agent must not get: no nested
+// tasks, and plans belong to the main agent.
+var taskExcluded = []string{"task", "submit_plan", "update_plan"}
+
+// EnableTasks registers the task tool, which runs sub-agents.
+func (a *Agent) EnableTasks() {
+	a.registry.Register(&tools.Task{Run: a.runTask})
+	a.syncTools()
+}
+
+// taskTools resolves the tools a sub-agent may use: the requested ones,
+// which must be read-only, or every read-only tool.
+func (a *Agent) taskTools(requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		var names []string
+		for _, d := range a.registry.Definitions() {
+			if a.registry.ReadOnly(d.Name) && !slices.Contains(taskExcluded, d.Name) {
+				names = append(names, d.Name)
+			}
+		}
+		return names, nil
+	}
+	for _, n := range requested {
+		if !a.registry.Has(n) || slices.Contains(taskExcluded, n) {
+			return nil, fmt.Errorf("tool %q is not available to tasks", n)
+		}
+		if !a.registry.ReadOnly(n) {
+			return nil, fmt.Errorf("tool %q is not read-only; tasks may only use read-only tools", n)
+		}
+	}
+	return requested, nil
+}
+
+// runTask runs req on a child agent with its own history. The child shares
+// the client's usage ledger, so its tokens show up in this turn's usage and
+// count toward the budget.
+func (a *Agent) runTask(ctx context.Context, req tools.TaskRequest) (string, error) {
+	names, err := a.taskTools(req.Tools)
+	if err != nil {
+		return "", err
+	}
+	registry := a.registry.Subset(names)
+	client, err := a.client.Sub(req.Model, registry.Definitions())
+	if err != nil {
+		return "", err
+	}
+	child := New(client, registry, taskPrompt)
+	child.SetProjectContext(a.project)
+	child.SetLimits(a.limits)
+	child.SetBudget(a.budgetMax, a.costFn)
+	child.budgetWarned = a.budgetWarned
+	label := req.Description
+	if label == "" {
+		label = "task"
+	}
+	child.SetSink(SinkFunc(func(e Event) {
+		switch e.Type {
+		case EventToolStart:
+			a.emit(Event{Type: EventNotice, Text: fmt.Sprintf("  ↳ [%s] %s", label, e.Tool.Name)})
+		case EventRetry, EventFallback, EventRecover, EventRoute, EventError:
+			a.emit(e)
+		}
+	}))
+
+	runErr := child.Run(ctx, req.Prompt)
+	report := lastAssistantText(child.messages)
+	switch {
+	case runErr == nil:
+		return report, nil
+	case ctx.Err() != nil || errors.Is(runErr, ErrBudgetExceeded) || report == "":
+		return "", fmt.Errorf("task %q: %w", label, runErr)
+	default:
+		// a loop limit: the partial report is still worth having
+		return fmt.Sprintf("%s\n\n[task stopped early: %s]", report, runErr), nil
+	}
+}
+
+// lastAssistantText returns the text of the last assistant message that has
+// any.
+func lastAssistantText(msgs []llm.Message) string {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == llm.RoleAssistant {
+			if text := messageText(msgs[i]); text != "" {
+				return text
+			}
+		}
+	}
+	return ""
+}
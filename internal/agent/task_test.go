@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Lewis-404/axe/internal/config"
+	"github.com/Lewis-404/axe/internal/llm"
+	"github.com/Lewis-404/axe/internal/tokenizer"
+	"github.com/Lewis-404/axe/internal/tools"
+)
+
+// taskScript has the parent delegate to a task, the child report and the
+// parent answer.
+var taskScript = [][]string{
+	{ // parent delegates
+		`{"type":"message_start","message":{"id":"m1","role":"assistant","usage":{"input_tokens":100}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"t1","name":"task"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"description\":\"find callers\",\"prompt\":\"find all callers of Run\"}"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":10}}`,
+	},
+	{ // child reports
+		`{"type":"message_start","message":{"id":"c1","role":"assistant","usage":{"input_tokens":7}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"cmd/root.go:42 calls Run"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":3}}`,
+	},
+	{ // parent answers
+		`{"type":"message_start","message":{"id":"m2","role":"assistant","usage":{"input_tokens":120}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"one caller"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`,
+	},
+}
+
+func TestTaskRunsSubAgent(t *testing.T) {
+	script := taskScript
+	var requests []llm.Request
+	n := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req llm.Request
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range script[min(n, len(script)-1)] {
+			fmt.Fprintf(w, "data: %s\n\n", e)
+		}
+		n++
+	}))
+	defer srv.Close()
+
+	a := newTestAgent(t, srv.URL)
+	a.EnableTasks()
+	var usage *UsageEvent
+	a.SetSink(SinkFunc(func(e Event) {
+		if e.Type == EventUsage {
+			usage = e.Usage
+		}
+	}))
+	if err := a.Run(context.Background(), "who calls Run?"); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("made %d requests, want 3", len(requests))
+	}
+
+	child := requests[1]
+	if len(child.Messages) != 1 || !strings.Contains(child.System[0].Text, "sub-agent") {
+		t.Errorf("child should start fresh with its own prompt, got %d messages", len(child.Messages))
+	}
+	var childTools []string
+	for _, d := range child.Tools {
+		childTools = append(childTools, d.Name)
+	}
+	if slices.Contains(childTools, "task") || slices.Contains(childTools, "write_file") || !slices.Contains(childTools, "read_file") {
+		t.Errorf("child tools = %v, want read-only tools without task", childTools)
+	}
+
+	result := a.messages[2].Content[0]
+	if result.Type != "tool_result" || result.Content != "cmd/root.go:42 calls Run" {
+		t.Errorf("task result = %+v", result)
+	}
+	if got := usage.Round["claude-sonnet-4"]; got.InputTokens != 227 || got.OutputTokens != 15 {
+		t.Errorf("round usage = %+v, want the child's tokens included", got)
+	}
+}
+
+func TestTaskToolsMustBeReadOnly(t *testing.T) {
+	a := newTestAgent(t, "")
+	a.EnableTasks()
+	if _, err := a.taskTools([]string{"write_file"}); err == nil {
+		t.Error("write_file allowed in a task")
+	}
+	if _, err := a.taskTools([]string{"task"}); err == nil {
+		t.Error("nested task allowed")
+	}
+	if names, err := a.taskTools([]string{"search_files"}); err != nil || len(names) != 1 {
+		t.Errorf("taskTools(search_files) = %v, %v", names, err)
+	}
+}
+
+func TestTaskKeepsParentSizing(t *testing.T) {
+	var models []string
+	n := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req llm.Request
+		json.NewDecoder(r.Body).Decode(&req)
+		models = append(models, req.Model)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range taskScript[min(n, len(taskScript)-1)] {
+			fmt.Fprintf(w, "data: %s\n\n", e)
+		}
+		n++
+	}))
+	defer srv.Close()
+
+	// the cheap model's window fits the sub-agent's read-only tools, not the
+	// parent's full set
+	reg := tools.NewRegistry(tools.RegistryOpts{})
+	client := llm.NewClient([]config.ModelConfig{
+		{Provider: "anthropic", APIKey: "k", BaseURL: srv.URL, Model: "claude-sonnet-4", MaxTokens: 100},
+		{Provider: "anthropic", APIKey: "k", BaseURL: srv.URL, Model: "claude-3-haiku", MaxTokens: 100},
+	}, nil)
+	a := New(client, reg, "sys")
+	a.EnableTasks()
+	client.SetRouting(config.RoutingConfig{Policy: config.RouteCheapestCapable})
+	client.ConfigOf("claude-3-haiku").ContextWindow = tokenizer.Tools(client.Tools())
+
+	if err := a.Run(context.Background(), "who calls Run?"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"claude-sonnet-4", "claude-3-haiku", "claude-sonnet-4"}
+	if !slices.Equal(models, want) {
+		t.Errorf("served by %v, want %v", models, want)
+	}
+}
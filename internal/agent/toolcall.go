@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/llm"
+)
+
+// parseEmulatedToolCalls turns the tool calls a model wrote in the prompt
+// protocol (llm.ToolCallOpen ... llm.ToolCallClose) into tool_use blocks,
+// leaving the text around them. A call that isn't valid JSON becomes a call
+// to the nonexistent invalid_tool_call, so the model gets an error back and
+// can correct it.
+func parseEmulatedToolCalls(resp *llm.Response) {
+	var content []llm.ContentBlock
+	var calls []llm.ContentBlock
+	stamp := time.Now().UnixNano()
+	for _, b := range resp.Content {
+		if b.Type != "text" || !strings.Contains(b.Text, llm.ToolCallOpen) {
+			content = append(content, b)
+			continue
+		}
+		text, found := splitToolCalls(b.Text)
+		for _, raw := range found {
+			id := fmt.Sprintf("call_%x_%d", stamp, len(calls))
+			var call struct {
+				Name  string         `json:"name"`
+				Input map[string]any `json:"input"`
+			}
+			if err := json.Unmarshal([]byte(raw), &call); err != nil || call.Name == "" {
+				call.Name = "invalid_tool_call"
+				call.Input = map[string]any{"raw": raw}
+			}
+			if call.Input == nil {
+				call.Input = map[string]any{}
+			}
+			calls = append(calls, llm.ContentBlock{Type: "tool_use", ID: id, Name: call.Name, Input: call.Input})
+		}
+		if text != "" {
+			content = append(content, llm.ContentBlock{Type: "text", Text: text})
+		}
+	}
+	if len(calls) == 0 {
+		return
+	}
+	resp.Content = append(content, calls...)
+	resp.StopReason = "tool_use"
+}
+
+// splitToolCalls returns text with the tagged calls removed, and the body
+// of each call. An unclosed call at the end (the model ran out of tokens or
+// stopped early) still counts if it parses.
+func splitToolCalls(s string) (string, []string) {
+	var text strings.Builder
+	var calls []string
+	for {
+		i := strings.Index(s, llm.ToolCallOpen)
+		if i < 0 {
+			text.WriteString(s)
+			break
+		}
+		text.WriteString(s[:i])
+		s = s[i+len(llm.ToolCallOpen):]
+		j := strings.Index(s, llm.ToolCallClose)
+		if j < 0 {
+			calls = append(calls, strings.TrimSpace(s))
+			break
+		}
+		calls = append(calls, strings.TrimSpace(s[:j]))
+		s = s[j+len(llm.ToolCallClose):]
+	}
+	return strings.TrimSpace(text.String()), calls
+}
@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/Lewis-404/axe/internal/llm"
+)
+
+func TestParseEmulatedToolCalls(t *testing.T) {
+	resp := &llm.Response{StopReason: "end_turn", Content: []llm.ContentBlock{
+		{Type: "thinking", Thinking: "need files"},
+		{Type: "text", Text: "Reading both.\n<tool_call>\n{\"name\":\"read_file\",\"input\":{\"path\":\"a.go\"}}\n</tool_call>\n<tool_call>{\"name\":\"read_file\",\"input\":{\"path\":\"b.go\"}}"},
+	}}
+	parseEmulatedToolCalls(resp)
+	if resp.StopReason != "tool_use" || len(resp.Content) != 4 {
+		t.Fatalf("response = %+v", resp)
+	}
+	if resp.Content[1].Text != "Reading both." {
+		t.Errorf("text = %q", resp.Content[1].Text)
+	}
+	a, b := resp.Content[2], resp.Content[3]
+	if a.Name != "read_file" || a.Input.(map[string]any)["path"] != "a.go" || b.Input.(map[string]any)["path"] != "b.go" {
+		t.Errorf("calls = %+v, %+v", a, b)
+	}
+	if a.ID == "" || a.ID == b.ID {
+		t.Errorf("ids = %q, %q", a.ID, b.ID)
+	}
+
+	bad := &llm.Response{Content: []llm.ContentBlock{{Type: "text", Text: "<tool_call>{oops</tool_call>"}}}
+	parseEmulatedToolCalls(bad)
+	if len(bad.Content) != 1 || bad.Content[0].Name != "invalid_tool_call" {
+		t.Errorf("malformed call = %+v", bad.Content)
+	}
+
+	plain := &llm.Response{StopReason: "end_turn", Content: []llm.ContentBlock{{Type: "text", Text: "no tools needed"}}}
+	parseEmulatedToolCalls(plain)
+	if plain.StopReason != "end_turn" || len(plain.Content) != 1 {
+		t.Errorf("plain reply changed: %+v", plain)
+	}
+}
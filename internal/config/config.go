@@ -7,31 +7,245 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Lewis-404/axe/internal/pricing"
 	"gopkg.in/yaml.v3"
 )
 
 type ModelConfig struct {
-	Provider  string `yaml:"provider"`
-	APIKey    string `yaml:"api_key"`
-	BaseURL   string `yaml:"base_url"`
-	Model     string `yaml:"model"`
-	MaxTokens int    `yaml:"max_tokens"`
+	Provider    string `yaml:"provider"`
+	APIKey      string `yaml:"api_key"`
+	BaseURL     string `yaml:"base_url"`
+	Model       string `yaml:"model"`
+	MaxTokens   int    `yaml:"max_tokens"`
+	PromptCache *bool  `yaml:"prompt_cache,omitempty"` // Anthropic prompt caching, default on
+	// ThinkingBudget enables Anthropic extended thinking with this many
+	// tokens (0 = off). ReasoningEffort (low/medium/high) is passed to
+	// OpenAI reasoning models.
+	ThinkingBudget  int    `yaml:"thinking_budget,omitempty"`
+	ReasoningEffort string `yaml:"reasoning_effort,omitempty"`
+	// ContextWindow and MaxOutputTokens override the built-in limits for
+	// known models. AutoCompactThreshold is when history is compacted: a
+	// fraction of the window (0.8 = 80%) or, above 1, a token count.
+	ContextWindow        int     `yaml:"context_window,omitempty"`
+	MaxOutputTokens      int     `yaml:"max_output_tokens,omitempty"`
+	AutoCompactThreshold float64 `yaml:"auto_compact_threshold,omitempty"`
+	// Vision overrides whether the model takes image input.
+	Vision *bool `yaml:"vision,omitempty"`
+	// ToolMode is how an ollama model gets tools: "native" function
+	// calling, the "prompt" protocol, or empty to ask the server.
+	ToolMode string `yaml:"tool_mode,omitempty"`
+	// API selects the OpenAI endpoint: "chat" (chat completions, the
+	// default) or "responses" (the Responses API).
+	API string `yaml:"api,omitempty"`
+	// Region, ProjectID and CredentialsFile locate Claude on bedrock and
+	// vertex: the AWS or Google Cloud region, the Google Cloud project
+	// (default: the service account's), and the service-account JSON key
+	// (default: GOOGLE_APPLICATION_CREDENTIALS). AWSProfile picks a
+	// profile from ~/.aws/config and ~/.aws/credentials (default:
+	// AWS_PROFILE, else the usual AWS credential chain).
+	Region          string `yaml:"region,omitempty"`
+	ProjectID       string `yaml:"project_id,omitempty"`
+	CredentialsFile string `yaml:"credentials_file,omitempty"`
+	AWSProfile      string `yaml:"aws_profile,omitempty"`
 }
 
+// Tool modes for ModelConfig.ToolMode.
+const (
+	ToolModeNative = "native"
+	ToolModePrompt = "prompt"
+)
+
+// OpenAI APIs for ModelConfig.API.
+const (
+	APIChat      = "chat"
+	APIResponses = "responses"
+)
+
+// Fallbacks for models without configured or built-in limits.
+const (
+	DefaultContextWindow = 100000
+	DefaultCompactRatio  = 0.8
+)
+
 func (m *ModelConfig) IsOpenAI() bool {
 	return m.Provider == "openai"
 }
 
+// UsesResponses reports whether an openai model is reached through the
+// Responses API.
+func (m *ModelConfig) UsesResponses() bool {
+	return m.IsOpenAI() && m.API == APIResponses
+}
+
+func (m *ModelConfig) IsGemini() bool {
+	return m.Provider == "gemini"
+}
+
+func (m *ModelConfig) IsOllama() bool {
+	return m.Provider == "ollama"
+}
+
+// IsBedrock and IsVertex report whether the model is Claude on AWS Bedrock
+// or Google Cloud Vertex AI.
+func (m *ModelConfig) IsBedrock() bool {
+	return m.Provider == "bedrock"
+}
+
+func (m *ModelConfig) IsVertex() bool {
+	return m.Provider == "vertex"
+}
+
+// Usable reports whether the model is configured enough to be used. Local
+// ollama models need no API key, and bedrock and vertex use cloud
+// credentials instead.
+func (m *ModelConfig) Usable() bool {
+	return m.Model != "" && (m.APIKey != "" || m.IsOllama() || m.IsBedrock() || m.IsVertex())
+}
+
+// OllamaHost returns the Ollama server URL from OLLAMA_HOST, which may omit
+// the scheme, or the default local address.
+func OllamaHost() string {
+	host := os.Getenv("OLLAMA_HOST")
+	if host == "" {
+		return "http://localhost:11434"
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return strings.TrimRight(host, "/")
+}
+
+// ContextLimit returns the model's context window in tokens.
+func (m *ModelConfig) ContextLimit() int {
+	if m.ContextWindow > 0 {
+		return m.ContextWindow
+	}
+	if l, ok := pricing.LookupLimits(m.Model); ok {
+		return l.ContextWindow
+	}
+	return DefaultContextWindow
+}
+
+// OutputLimit returns the most tokens the model can generate per request,
+// or 0 when unknown.
+func (m *ModelConfig) OutputLimit() int {
+	if m.MaxOutputTokens > 0 {
+		return m.MaxOutputTokens
+	}
+	if l, ok := pricing.LookupLimits(m.Model); ok {
+		return l.MaxOutput
+	}
+	return 0
+}
+
+// ClampOutput caps a request's max_tokens at the model's output limit.
+func (m *ModelConfig) ClampOutput(n int) int {
+	if limit := m.OutputLimit(); limit > 0 && n > limit {
+		return limit
+	}
+	return n
+}
+
+// CompactThreshold returns the prompt size in tokens above which history is
+// auto-compacted. The default also keeps room for a full reply, so small
+// windows don't overflow before compaction kicks in.
+func (m *ModelConfig) CompactThreshold() int {
+	window := m.ContextLimit()
+	switch t := m.AutoCompactThreshold; {
+	case t > 1:
+		return min(int(t), window)
+	case t > 0:
+		return int(float64(window) * t)
+	}
+	return min(int(float64(window)*DefaultCompactRatio), window-m.ClampOutput(m.MaxTokens))
+}
+
+// SupportsVision reports whether images may be sent to the model. Unknown
+// models are assumed to take them and left to the API to refuse.
+func (m *ModelConfig) SupportsVision() bool {
+	if m.Vision != nil {
+		return *m.Vision
+	}
+	if v, ok := pricing.LookupVision(m.Model); ok {
+		return v
+	}
+	return true
+}
+
+// CacheEnabled reports whether prompt-cache breakpoints should be sent.
+func (m *ModelConfig) CacheEnabled() bool {
+	return m.PromptCache == nil || *m.PromptCache
+}
+
 type MCPServer struct {
 	Command string   `yaml:"command"`
 	Args    []string `yaml:"args,omitempty"`
 }
 
+// CompactConfig tunes history compaction.
+type CompactConfig struct {
+	KeepTurns int    `yaml:"keep_turns,omitempty"` // recent turns kept verbatim, default 3
+	Language  string `yaml:"language,omitempty"`   // summary language, default Chinese
+}
+
+// LoopLimits bound a single agent turn. Zero values use the defaults: 40
+// iterations, 3 consecutive tool errors, 3 identical calls with identical
+// results, and no time limit.
+type LoopLimits struct {
+	MaxIterations        int           `yaml:"max_iterations,omitempty"`
+	MaxConsecutiveErrors int           `yaml:"max_consecutive_errors,omitempty"`
+	MaxRepeatedCalls     int           `yaml:"max_repeated_calls,omitempty"`
+	MaxTurnTime          time.Duration `yaml:"max_turn_time,omitempty"` // e.g. 10m
+}
+
+// RetryPolicy is how failed API requests are retried before falling back
+// to the next model. Zero values use the defaults: 3 retries, waits from 2s
+// doubling up to 1m, and 20% jitter. A negative MaxRetries or Jitter turns
+// it off. A server asking to wait longer than MaxDelay is not retried.
+type RetryPolicy struct {
+	MaxRetries int           `yaml:"max_retries,omitempty"`
+	BaseDelay  time.Duration `yaml:"base_delay,omitempty"`
+	MaxDelay   time.Duration `yaml:"max_delay,omitempty"`
+	Jitter     float64       `yaml:"jitter,omitempty"` // fraction of the wait
+}
+
+// Routing policies for RoutingConfig.Policy.
+const (
+	RouteFallback        = "fallback"
+	RouteCheapestCapable = "cheapest-capable"
+	RouteRoundRobin      = "round-robin"
+)
+
+// RoutingConfig decides which model each request goes to. Policy orders the
+// models: fallback (the default) starts at the active model and keeps it,
+// cheapest-capable starts at the cheapest model that takes the request's
+// images and size (moving on if it still reports the prompt too long), and
+// round-robin rotates. Rules send a task (chat, edit,
+// compact, init) to a model first, falling back by the policy.
+type RoutingConfig struct {
+	Policy  string            `yaml:"policy,omitempty"`
+	Rules   map[string]string `yaml:"rules,omitempty"` // task -> model
+	Breaker BreakerConfig     `yaml:"breaker,omitempty"`
+}
+
+// BreakerConfig is the circuit breaker: a model that fails Failures times
+// in a row is skipped for Cooldown, then tried again. Zero values use the
+// defaults, 3 failures and 1m; a negative Failures turns it off.
+type BreakerConfig struct {
+	Failures int           `yaml:"failures,omitempty"`
+	Cooldown time.Duration `yaml:"cooldown,omitempty"`
+}
+
 type Config struct {
 	Models     []ModelConfig        `yaml:"models"`
 	MCPServers map[string]MCPServer `yaml:"mcp_servers,omitempty"`
 	AutoVerify *bool                `yaml:"auto_verify,omitempty"`
+	Compact    CompactConfig        `yaml:"compact,omitempty"`
+	Limits     LoopLimits           `yaml:"limits,omitempty"`
+	Retry      RetryPolicy          `yaml:"retry,omitempty"`
+	Routing    RoutingConfig        `yaml:"routing,omitempty"`
 }
 
 // ProjectConfig holds per-project overrides in .axe/settings.yaml
@@ -42,6 +256,10 @@ type ProjectConfig struct {
 	AutoVerify  *bool                `yaml:"auto_verify,omitempty"`
 	IgnoreFiles []string             `yaml:"ignore_files,omitempty"`
 	MCPServers  map[string]MCPServer `yaml:"mcp_servers,omitempty"`
+	Compact     CompactConfig        `yaml:"compact,omitempty"`
+	Limits      LoopLimits           `yaml:"limits,omitempty"`
+	Retry       RetryPolicy          `yaml:"retry,omitempty"`
+	Routing     RoutingConfig        `yaml:"routing,omitempty"`
 }
 
 func configDir() string {
@@ -71,14 +289,40 @@ func Load() (*Config, error) {
 	// env overrides: apply to matching provider entries
 	for i := range cfg.Models {
 		m := &cfg.Models[i]
-		if m.IsOpenAI() {
+		switch {
+		case m.IsOpenAI():
 			if key := os.Getenv("OPENAI_API_KEY"); key != "" && m.APIKey == "" {
 				m.APIKey = key
 			}
 			if url := os.Getenv("OPENAI_BASE_URL"); url != "" && m.BaseURL == "" {
 				m.BaseURL = url
 			}
-		} else {
+		case m.IsGemini():
+			if key := os.Getenv("GEMINI_API_KEY"); key != "" && m.APIKey == "" {
+				m.APIKey = key
+			}
+			if url := os.Getenv("GEMINI_BASE_URL"); url != "" && m.BaseURL == "" {
+				m.BaseURL = url
+			}
+		case m.IsOllama():
+			if m.BaseURL == "" {
+				m.BaseURL = OllamaHost()
+			}
+		case m.IsBedrock():
+			if m.Region == "" {
+				m.Region = firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+			}
+		case m.IsVertex():
+			if m.Region == "" {
+				m.Region = firstEnv("CLOUD_ML_REGION", "GOOGLE_CLOUD_REGION")
+			}
+			if m.ProjectID == "" {
+				m.ProjectID = firstEnv("ANTHROPIC_VERTEX_PROJECT_ID", "GOOGLE_CLOUD_PROJECT")
+			}
+			if m.CredentialsFile == "" {
+				m.CredentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+			}
+		default:
 			if key := os.Getenv("ANTHROPIC_API_KEY"); key != "" && m.APIKey == "" {
 				m.APIKey = key
 			}
@@ -95,10 +339,10 @@ func Load() (*Config, error) {
 		}
 	}
 
-	// validate: at least one model with api_key
+	// validate: at least one model with api_key (or a local one)
 	valid := 0
 	for _, m := range cfg.Models {
-		if m.APIKey != "" && m.Model != "" {
+		if m.Usable() {
 			valid++
 		}
 	}
@@ -109,6 +353,16 @@ func Load() (*Config, error) {
 	return cfg, nil
 }
 
+// firstEnv returns the first of the environment variables that is set.
+func firstEnv(keys ...string) string {
+	for _, k := range keys {
+		if v := os.Getenv(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
 func Init() error {
 	dir := configDir()
 	if err := os.MkdirAll(dir, 0700); err != nil {
@@ -138,17 +392,19 @@ func Init() error {
 	fmt.Println("🪓 Axe 配置向导")
 	fmt.Println()
 
-	provider := prompt("Provider (anthropic/openai)", "anthropic")
+	provider := prompt("Provider (anthropic/openai/gemini/ollama)", "anthropic")
 	apiKey := prompt("API Key", "")
 	baseURL := "https://api.anthropic.com"
-	if provider == "openai" {
-		baseURL = "https://api.openai.com"
-	}
-	baseURL = prompt("Base URL", baseURL)
 	model := "claude-sonnet-4-20250514"
-	if provider == "openai" {
-		model = "gpt-4o"
+	switch provider {
+	case "openai":
+		baseURL, model = "https://api.openai.com", "gpt-4o"
+	case "gemini":
+		baseURL, model = "https://generativelanguage.googleapis.com", "gemini-2.5-pro"
+	case "ollama":
+		baseURL, model = OllamaHost(), "qwen3"
 	}
+	baseURL = prompt("Base URL", baseURL)
 	model = prompt("Model", model)
 	maxTokensStr := prompt("Max Tokens", "8192")
 	maxTok := 8192
@@ -199,6 +455,51 @@ func (c *Config) Merge(pc *ProjectConfig) {
 	if len(pc.Models) > 0 {
 		c.Models = append(pc.Models, c.Models...)
 	}
+	if pc.Compact.KeepTurns > 0 {
+		c.Compact.KeepTurns = pc.Compact.KeepTurns
+	}
+	if pc.Compact.Language != "" {
+		c.Compact.Language = pc.Compact.Language
+	}
+	if pc.Limits.MaxIterations > 0 {
+		c.Limits.MaxIterations = pc.Limits.MaxIterations
+	}
+	if pc.Limits.MaxConsecutiveErrors > 0 {
+		c.Limits.MaxConsecutiveErrors = pc.Limits.MaxConsecutiveErrors
+	}
+	if pc.Limits.MaxRepeatedCalls > 0 {
+		c.Limits.MaxRepeatedCalls = pc.Limits.MaxRepeatedCalls
+	}
+	if pc.Limits.MaxTurnTime > 0 {
+		c.Limits.MaxTurnTime = pc.Limits.MaxTurnTime
+	}
+	if pc.Retry.MaxRetries != 0 {
+		c.Retry.MaxRetries = pc.Retry.MaxRetries
+	}
+	if pc.Retry.BaseDelay > 0 {
+		c.Retry.BaseDelay = pc.Retry.BaseDelay
+	}
+	if pc.Retry.MaxDelay > 0 {
+		c.Retry.MaxDelay = pc.Retry.MaxDelay
+	}
+	if pc.Retry.Jitter != 0 {
+		c.Retry.Jitter = pc.Retry.Jitter
+	}
+	if pc.Routing.Policy != "" {
+		c.Routing.Policy = pc.Routing.Policy
+	}
+	for task, model := range pc.Routing.Rules {
+		if c.Routing.Rules == nil {
+			c.Routing.Rules = make(map[string]string)
+		}
+		c.Routing.Rules[task] = model
+	}
+	if pc.Routing.Breaker.Failures != 0 {
+		c.Routing.Breaker.Failures = pc.Routing.Breaker.Failures
+	}
+	if pc.Routing.Breaker.Cooldown > 0 {
+		c.Routing.Breaker.Cooldown = pc.Routing.Breaker.Cooldown
+	}
 	if len(pc.MCPServers) > 0 {
 		if c.MCPServers == nil {
 			c.MCPServers = make(map[string]MCPServer)
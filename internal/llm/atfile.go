@@ -9,12 +9,14 @@ import (
 
 var atFileRe = regexp.MustCompile(`@(~?[\w./_-]+\.\w+)`)
 
-// ExpandAtFiles replaces @filepath references with file contents
-func ExpandAtFiles(input string) string {
+// ExpandAtFiles replaces @filepath references with file contents and
+// returns the paths it inlined.
+func ExpandAtFiles(input string) (string, []string) {
 	matches := atFileRe.FindAllStringSubmatch(input, -1)
 	if len(matches) == 0 {
-		return input
+		return input, nil
 	}
+	var refs []string
 	result := input
 	for _, m := range matches {
 		path := expandHome(m[1])
@@ -24,7 +26,7 @@ func ExpandAtFiles(input string) string {
 		}
 		replacement := fmt.Sprintf("\n<file path=%q>\n%s\n</file>", m[1], strings.TrimRight(string(data), "\n"))
 		result = strings.Replace(result, m[0], replacement, 1)
-		fmt.Printf("📎 已引用 %s\n", m[1])
+		refs = append(refs, m[1])
 	}
-	return result
+	return result, refs
 }
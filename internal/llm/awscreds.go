@@ -0,0 +1,533 @@
+package llm
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// awsDefaultRegion signs STS requests when no region is configured, against
+// the global endpoint.
+const awsDefaultRegion = "us-east-1"
+
+// awsCredentialSource resolves credentials the way the AWS SDKs' default
+// chain does. region is where STS is called for roles.
+type awsCredentialSource struct {
+	http   *http.Client
+	region string
+	config *awsConfig
+}
+
+// loadAWSCredentials finds credentials like the AWS CLI and SDKs do. A
+// profile chosen by aws_profile or AWS_PROFILE is used as is. Otherwise the
+// AWS_ACCESS_KEY_ID variables come first, then a web identity token
+// (AWS_WEB_IDENTITY_TOKEN_FILE with AWS_ROLE_ARN, as on EKS), then the
+// default profile, then an ECS or EKS container role and finally the EC2
+// instance role. A profile in ~/.aws/config or ~/.aws/credentials may hold
+// static keys, assume a role (role_arn with source_profile,
+// credential_source or web_identity_token_file), use an SSO login or run a
+// credential_process.
+func loadAWSCredentials(ctx context.Context, client *http.Client, profile, region string) (awsCredentials, error) {
+	s := &awsCredentialSource{http: client, region: region, config: readAWSConfig()}
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile != "" {
+		if _, ok := s.config.profiles[profile]; !ok {
+			return awsCredentials{}, fmt.Errorf("AWS profile %q not found in ~/.aws/config or ~/.aws/credentials", profile)
+		}
+		return s.fromProfile(ctx, profile, nil)
+	}
+	if creds, ok := envAWSCredentials(); ok {
+		return creds, nil
+	}
+	if file, role := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN"); file != "" && role != "" {
+		return s.webIdentity(ctx, role, os.Getenv("AWS_ROLE_SESSION_NAME"), file)
+	}
+	if _, ok := s.config.profiles["default"]; ok {
+		return s.fromProfile(ctx, "default", nil)
+	}
+	creds, err := s.roleCredentials(ctx)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, configure a profile in ~/.aws, or run with an instance or container role (%w)", err)
+	}
+	return creds, nil
+}
+
+func envAWSCredentials() (awsCredentials, bool) {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return awsCredentials{}, false
+	}
+	return awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, true
+}
+
+// fromProfile resolves the named profile. seen guards against source_profile
+// cycles.
+func (s *awsCredentialSource) fromProfile(ctx context.Context, name string, seen []string) (awsCredentials, error) {
+	if slices.Contains(seen, name) {
+		return awsCredentials{}, fmt.Errorf("AWS profile %q: source_profile loop (%s)", name, strings.Join(append(seen, name), " -> "))
+	}
+	seen = append(seen, name)
+	p := s.config.profiles[name]
+	role := p["role_arn"]
+	if role == "" {
+		if static := staticAWSCredentials(p); static != nil {
+			return *static, nil
+		}
+		switch {
+		case p["sso_account_id"] != "" || p["sso_session"] != "":
+			return s.sso(ctx, name, p)
+		case p["credential_process"] != "":
+			return s.process(ctx, p["credential_process"])
+		}
+		creds, err := s.roleCredentials(ctx)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("AWS profile %q has no credentials and no instance or container role was found (%w)", name, err)
+		}
+		return creds, nil
+	}
+
+	var base awsCredentials
+	var err error
+	switch src := p["source_profile"]; {
+	case p["web_identity_token_file"] != "":
+		return s.webIdentity(ctx, role, p["role_session_name"], p["web_identity_token_file"])
+	case src == name:
+		// a profile may assume a role with its own keys
+		static := staticAWSCredentials(p)
+		if static == nil {
+			return awsCredentials{}, fmt.Errorf("AWS profile %q is its own source_profile but has no keys", name)
+		}
+		base = *static
+	case src != "":
+		sp, ok := s.config.profiles[src]
+		if !ok {
+			return awsCredentials{}, fmt.Errorf("AWS profile %q: source_profile %q not found", name, src)
+		}
+		// a source profile with keys is used for them, not for its own role
+		if static := staticAWSCredentials(sp); static != nil {
+			base = *static
+		} else {
+			base, err = s.fromProfile(ctx, src, seen)
+		}
+	case p["credential_source"] != "":
+		base, err = s.credentialSource(ctx, p["credential_source"])
+	default:
+		return awsCredentials{}, fmt.Errorf("AWS profile %q: role_arn needs source_profile, credential_source or web_identity_token_file", name)
+	}
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	return s.assumeRole(ctx, base, role, p["role_session_name"], p["external_id"], p["duration_seconds"])
+}
+
+func staticAWSCredentials(p map[string]string) *awsCredentials {
+	if p["aws_access_key_id"] == "" || p["aws_secret_access_key"] == "" {
+		return nil
+	}
+	return &awsCredentials{AccessKeyID: p["aws_access_key_id"], SecretAccessKey: p["aws_secret_access_key"], SessionToken: p["aws_session_token"]}
+}
+
+// credentialSource resolves a profile's credential_source.
+func (s *awsCredentialSource) credentialSource(ctx context.Context, source string) (awsCredentials, error) {
+	switch source {
+	case "Environment":
+		if creds, ok := envAWSCredentials(); ok {
+			return creds, nil
+		}
+		return awsCredentials{}, errors.New("credential_source Environment: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY not set")
+	case "EcsContainer":
+		return s.container(ctx)
+	case "Ec2InstanceMetadata":
+		return s.instance(ctx)
+	}
+	return awsCredentials{}, fmt.Errorf("unknown credential_source %q", source)
+}
+
+// roleCredentials are the container's role where one is set up, else the
+// EC2 instance's.
+func (s *awsCredentialSource) roleCredentials(ctx context.Context) (awsCredentials, error) {
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		return s.container(ctx)
+	}
+	return s.instance(ctx)
+}
+
+// stsCredentials is the Credentials element of an STS response.
+type stsCredentials struct {
+	AccessKeyID     string    `xml:"AccessKeyId"`
+	SecretAccessKey string    `xml:"SecretAccessKey"`
+	SessionToken    string    `xml:"SessionToken"`
+	Expiration      time.Time `xml:"Expiration"`
+}
+
+// assumeRole calls sts:AssumeRole signed with base.
+func (s *awsCredentialSource) assumeRole(ctx context.Context, base awsCredentials, role, session, externalID, duration string) (awsCredentials, error) {
+	form := url.Values{"Action": {"AssumeRole"}, "Version": {"2011-06-15"}, "RoleArn": {role}, "RoleSessionName": {sessionName(session)}}
+	if externalID != "" {
+		form.Set("ExternalId", externalID)
+	}
+	if duration != "" {
+		form.Set("DurationSeconds", duration)
+	}
+	return s.sts(ctx, form, &base)
+}
+
+// webIdentity calls sts:AssumeRoleWithWebIdentity with the token in file,
+// which needs no credentials of its own.
+func (s *awsCredentialSource) webIdentity(ctx context.Context, role, session, file string) (awsCredentials, error) {
+	token, err := os.ReadFile(file)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("web identity token: %w", err)
+	}
+	form := url.Values{"Action": {"AssumeRoleWithWebIdentity"}, "Version": {"2011-06-15"}, "RoleArn": {role},
+		"RoleSessionName": {sessionName(session)}, "WebIdentityToken": {strings.TrimSpace(string(token))}}
+	return s.sts(ctx, form, nil)
+}
+
+func sessionName(name string) string {
+	if name != "" {
+		return name
+	}
+	return "axe-" + strconv.FormatInt(time.Now().Unix(), 10)
+}
+
+// sts posts an STS query, signed with creds unless nil. AWS_ENDPOINT_URL_STS
+// overrides the endpoint as in the SDKs.
+func (s *awsCredentialSource) sts(ctx context.Context, form url.Values, creds *awsCredentials) (awsCredentials, error) {
+	region, endpoint := s.region, os.Getenv("AWS_ENDPOINT_URL_STS")
+	if region == "" {
+		region = awsDefaultRegion
+		if endpoint == "" {
+			endpoint = "https://sts.amazonaws.com"
+		}
+	}
+	if endpoint == "" {
+		endpoint = "https://sts." + region + ".amazonaws.com"
+	}
+	body := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(endpoint, "/")+"/", strings.NewReader(string(body)))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if creds != nil {
+		signV4(req, body, *creds, region, "sts", time.Now())
+	}
+	data, err := s.fetch(req)
+	action := form.Get("Action")
+	if err != nil {
+		var e struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+			return awsCredentials{}, fmt.Errorf("sts %s %s: %s: %s", action, form.Get("RoleArn"), e.Code, e.Message)
+		}
+		return awsCredentials{}, fmt.Errorf("sts %s: %w", action, err)
+	}
+	// <AssumeRoleResponse><AssumeRoleResult><Credentials>, and likewise for
+	// the other actions
+	var out struct {
+		Result struct {
+			Credentials stsCredentials `xml:"Credentials"`
+		} `xml:",any"`
+	}
+	if err := xml.Unmarshal(data, &out); err != nil || out.Result.Credentials.AccessKeyID == "" {
+		return awsCredentials{}, fmt.Errorf("sts %s: unexpected response", action)
+	}
+	c := out.Result.Credentials
+	return awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expires: c.Expiration}, nil
+}
+
+// roleJSON is how the container and instance metadata endpoints and
+// credential_process return credentials.
+type roleJSON struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	SessionToken    string    `json:"SessionToken"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (r roleJSON) credentials(source string) (awsCredentials, error) {
+	if r.AccessKeyID == "" || r.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("%s: no credentials in response", source)
+	}
+	token := r.Token
+	if token == "" {
+		token = r.SessionToken
+	}
+	return awsCredentials{AccessKeyID: r.AccessKeyID, SecretAccessKey: r.SecretAccessKey, SessionToken: token, Expires: r.Expiration}, nil
+}
+
+// container fetches an ECS task role, or an EKS Pod Identity one.
+func (s *awsCredentialSource) container(ctx context.Context) (awsCredentials, error) {
+	u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		u = "http://169.254.170.2" + rel
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("container credentials: %w", err)
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("container credentials: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	data, err := s.fetch(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("container credentials: %w", err)
+	}
+	var r roleJSON
+	if err := json.Unmarshal(data, &r); err != nil {
+		return awsCredentials{}, fmt.Errorf("container credentials: %w", err)
+	}
+	return r.credentials("container credentials")
+}
+
+// imdsTimeout bounds each instance metadata request, so machines outside
+// EC2 don't wait long for an answer that won't come.
+const imdsTimeout = 2 * time.Second
+
+// instance fetches the EC2 instance role through IMDSv2, falling back to
+// IMDSv1 when no session token can be had.
+func (s *awsCredentialSource) instance(ctx context.Context) (awsCredentials, error) {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return awsCredentials{}, errors.New("instance metadata disabled by AWS_EC2_METADATA_DISABLED")
+	}
+	base := strings.TrimRight(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/")
+	if base == "" {
+		base = "http://169.254.169.254"
+	}
+	get := func(method, path string, header http.Header) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(ctx, imdsTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, method, base+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header
+		return s.fetch(req)
+	}
+	header := http.Header{}
+	if token, err := get("PUT", "/latest/api/token", http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"21600"}}); err == nil {
+		header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+	}
+	const path = "/latest/meta-data/iam/security-credentials/"
+	roles, err := get("GET", path, header)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("instance metadata: %w", err)
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(string(roles)), "\n")
+	if role == "" {
+		return awsCredentials{}, errors.New("instance metadata: no role attached to the instance")
+	}
+	data, err := get("GET", path+role, header)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("instance metadata: %w", err)
+	}
+	var r roleJSON
+	if err := json.Unmarshal(data, &r); err != nil {
+		return awsCredentials{}, fmt.Errorf("instance metadata: %w", err)
+	}
+	return r.credentials("instance metadata")
+}
+
+// sso exchanges the token cached by `aws sso login` for role credentials.
+// Expired tokens aren't refreshed: that takes another `aws sso login`.
+func (s *awsCredentialSource) sso(ctx context.Context, name string, p map[string]string) (awsCredentials, error) {
+	startURL, region, cacheKey := p["sso_start_url"], p["sso_region"], p["sso_start_url"]
+	if session := p["sso_session"]; session != "" {
+		sc, ok := s.config.ssoSessions[session]
+		if !ok {
+			return awsCredentials{}, fmt.Errorf("AWS profile %q: sso-session %q not found", name, session)
+		}
+		startURL, region, cacheKey = sc["sso_start_url"], sc["sso_region"], session
+	}
+	if startURL == "" || region == "" || p["sso_account_id"] == "" || p["sso_role_name"] == "" {
+		return awsCredentials{}, fmt.Errorf("AWS profile %q: incomplete SSO configuration", name)
+	}
+	home, _ := os.UserHomeDir()
+	sum := sha1.Sum([]byte(cacheKey))
+	data, err := os.ReadFile(filepath.Join(home, ".aws", "sso", "cache", hex.EncodeToString(sum[:])+".json"))
+	var cached struct {
+		AccessToken string    `json:"accessToken"`
+		ExpiresAt   time.Time `json:"expiresAt"`
+	}
+	if err != nil || json.Unmarshal(data, &cached) != nil || cached.AccessToken == "" || time.Now().After(cached.ExpiresAt) {
+		return awsCredentials{}, fmt.Errorf("AWS profile %q: SSO session missing or expired, run `aws sso login --profile %s`", name, name)
+	}
+
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_SSO")
+	if endpoint == "" {
+		endpoint = "https://portal.sso." + region + ".amazonaws.com"
+	}
+	q := url.Values{"account_id": {p["sso_account_id"]}, "role_name": {p["sso_role_name"]}}
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(endpoint, "/")+"/federation/credentials?"+q.Encode(), nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-Amz-Sso_bearer_token", cached.AccessToken)
+	if data, err = s.fetch(req); err != nil {
+		return awsCredentials{}, fmt.Errorf("sso credentials: %w", err)
+	}
+	var out struct {
+		RoleCredentials struct {
+			AccessKeyID     string `json:"accessKeyId"`
+			SecretAccessKey string `json:"secretAccessKey"`
+			SessionToken    string `json:"sessionToken"`
+			Expiration      int64  `json:"expiration"` // ms since the epoch
+		} `json:"roleCredentials"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil || out.RoleCredentials.AccessKeyID == "" {
+		return awsCredentials{}, errors.New("sso credentials: unexpected response")
+	}
+	rc := out.RoleCredentials
+	return awsCredentials{AccessKeyID: rc.AccessKeyID, SecretAccessKey: rc.SecretAccessKey, SessionToken: rc.SessionToken, Expires: time.UnixMilli(rc.Expiration)}, nil
+}
+
+// process runs a credential_process command, which prints credentials as
+// JSON.
+func (s *awsCredentialSource) process(ctx context.Context, command string) (awsCredentials, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("credential_process: %w", err)
+	}
+	var r roleJSON
+	if err := json.Unmarshal(out, &r); err != nil {
+		return awsCredentials{}, fmt.Errorf("credential_process: %w", err)
+	}
+	return r.credentials("credential_process")
+}
+
+// fetch does req and returns the body, which is also returned with the
+// error for a non-2xx status.
+func (s *awsCredentialSource) fetch(req *http.Request) ([]byte, error) {
+	client := s.http
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return data, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// awsConfig is the shared config and credentials files.
+type awsConfig struct {
+	profiles    map[string]map[string]string // credentials file keys win
+	ssoSessions map[string]map[string]string
+}
+
+// readAWSConfig reads ~/.aws/config and ~/.aws/credentials, or the files
+// AWS_CONFIG_FILE and AWS_SHARED_CREDENTIALS_FILE name. Missing files are
+// empty.
+func readAWSConfig() *awsConfig {
+	home, _ := os.UserHomeDir()
+	cfg := &awsConfig{profiles: map[string]map[string]string{}, ssoSessions: map[string]map[string]string{}}
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = filepath.Join(home, ".aws", "config")
+	}
+	for section, keys := range readINI(configFile) {
+		switch {
+		case section == "default":
+			cfg.profile("default", keys)
+		case strings.HasPrefix(section, "profile "):
+			cfg.profile(strings.TrimSpace(strings.TrimPrefix(section, "profile ")), keys)
+		case strings.HasPrefix(section, "sso-session "):
+			cfg.ssoSessions[strings.TrimSpace(strings.TrimPrefix(section, "sso-session "))] = keys
+		}
+	}
+	credentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	for section, keys := range readINI(credentialsFile) {
+		cfg.profile(section, keys)
+	}
+	return cfg
+}
+
+func (c *awsConfig) profile(name string, keys map[string]string) {
+	p := c.profiles[name]
+	if p == nil {
+		p = map[string]string{}
+		c.profiles[name] = p
+	}
+	for k, v := range keys {
+		p[k] = v
+	}
+}
+
+// readINI parses an AWS config file into its sections. Nested values (the
+// indented keys under s3 = and the like) are skipped.
+func readINI(path string) map[string]map[string]string {
+	sections := map[string]map[string]string{}
+	f, err := os.Open(path)
+	if err != nil {
+		return sections
+	}
+	defer f.Close()
+	var keys map[string]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if keys = sections[name]; keys == nil {
+				keys = map[string]string{}
+				sections[name] = keys
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || keys == nil || raw[0] == ' ' || raw[0] == '\t' {
+			continue
+		}
+		keys[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return sections
+}
@@ -0,0 +1,260 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// isolateAWS points the AWS config at empty files in a temporary home and
+// clears the environment, so tests see only what they set up.
+func isolateAWS(t *testing.T, config, credentials string) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	for _, k := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE",
+		"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_ROLE_SESSION_NAME", "AWS_ENDPOINT_URL_STS", "AWS_ENDPOINT_URL_SSO",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN", "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE", "AWS_EC2_METADATA_SERVICE_ENDPOINT"} {
+		t.Setenv(k, "")
+	}
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	configFile, credentialsFile := filepath.Join(home, "config"), filepath.Join(home, "credentials")
+	os.WriteFile(configFile, []byte(config), 0600)
+	os.WriteFile(credentialsFile, []byte(credentials), 0600)
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	return home
+}
+
+const stsResponse = `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%[1]sResult>
+    <Credentials>
+      <AccessKeyId>ASIAROLE</AccessKeyId>
+      <SecretAccessKey>rolesecret</SecretAccessKey>
+      <SessionToken>roletoken</SessionToken>
+      <Expiration>2030-01-02T03:04:05Z</Expiration>
+    </Credentials>
+  </%[1]sResult>
+</%[1]sResponse>`
+
+func TestAWSAssumeRoleFromSourceProfile(t *testing.T) {
+	isolateAWS(t, `
+[default]
+region = us-west-2
+
+[profile dev]
+role_arn = arn:aws:iam::123456789012:role/dev
+source_profile = base
+role_session_name = me
+s3 =
+  max_concurrent_requests = 20
+`, `
+[base]
+aws_access_key_id = AKIDBASE
+aws_secret_access_key = basesecret
+`)
+	var auth string
+	var form map[string][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		r.ParseForm()
+		form = r.PostForm
+		fmt.Fprintf(w, stsResponse, "AssumeRole")
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_ENDPOINT_URL_STS", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV") // a chosen profile wins over the environment
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "envsecret")
+
+	creds, err := loadAWSCredentials(context.Background(), nil, "dev", "eu-west-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDBASE/") || !strings.Contains(auth, "/eu-west-1/sts/aws4_request") {
+		t.Errorf("AssumeRole signed with %q", auth)
+	}
+	if form["Action"][0] != "AssumeRole" || form["RoleArn"][0] != "arn:aws:iam::123456789012:role/dev" || form["RoleSessionName"][0] != "me" {
+		t.Errorf("form = %v", form)
+	}
+	want := awsCredentials{AccessKeyID: "ASIAROLE", SecretAccessKey: "rolesecret", SessionToken: "roletoken", Expires: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)}
+	if creds != want {
+		t.Errorf("creds = %+v", creds)
+	}
+}
+
+func TestAWSSourceProfileLoop(t *testing.T) {
+	isolateAWS(t, `
+[profile a]
+role_arn = arn:aws:iam::1:role/a
+source_profile = b
+
+[profile b]
+role_arn = arn:aws:iam::1:role/b
+source_profile = a
+`, "")
+	if _, err := loadAWSCredentials(context.Background(), nil, "a", ""); err == nil || !strings.Contains(err.Error(), "loop") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestAWSWebIdentityFromEnv(t *testing.T) {
+	home := isolateAWS(t, "", "")
+	tokenFile := filepath.Join(home, "token")
+	os.WriteFile(tokenFile, []byte("eyJ.token\n"), 0600)
+	var auth, token string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		r.ParseForm()
+		token = r.PostForm.Get("WebIdentityToken")
+		fmt.Fprintf(w, stsResponse, "AssumeRoleWithWebIdentity")
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_ENDPOINT_URL_STS", srv.URL)
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/pod")
+
+	creds, err := loadAWSCredentials(context.Background(), nil, "", "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "" || token != "eyJ.token" || creds.AccessKeyID != "ASIAROLE" {
+		t.Errorf("auth %q, token %q, creds %+v", auth, token, creds)
+	}
+}
+
+func TestAWSSSO(t *testing.T) {
+	home := isolateAWS(t, `
+[profile sso]
+sso_session = corp
+sso_account_id = 123456789012
+sso_role_name = Developer
+
+[sso-session corp]
+sso_start_url = https://corp.awsapps.com/start
+sso_region = us-east-1
+`, "")
+	sum := sha1.Sum([]byte("corp"))
+	cache := filepath.Join(home, ".aws", "sso", "cache")
+	os.MkdirAll(cache, 0700)
+	os.WriteFile(filepath.Join(cache, hex.EncodeToString(sum[:])+".json"),
+		[]byte(`{"accessToken":"ssotoken","expiresAt":"`+time.Now().Add(time.Hour).UTC().Format(time.RFC3339)+`"}`), 0600)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/federation/credentials" || r.Header.Get("X-Amz-Sso_bearer_token") != "ssotoken" ||
+			q.Get("account_id") != "123456789012" || q.Get("role_name") != "Developer" {
+			http.Error(w, "bad request", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"roleCredentials":{"accessKeyId":"ASIASSO","secretAccessKey":"s","sessionToken":"t","expiration":1893456000000}}`)
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_ENDPOINT_URL_SSO", srv.URL)
+
+	creds, err := loadAWSCredentials(context.Background(), nil, "sso", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "ASIASSO" || creds.SessionToken != "t" || !creds.Expires.Equal(time.UnixMilli(1893456000000)) {
+		t.Errorf("creds = %+v", creds)
+	}
+
+	os.RemoveAll(cache)
+	if _, err := loadAWSCredentials(context.Background(), nil, "sso", ""); err == nil || !strings.Contains(err.Error(), "aws sso login") {
+		t.Errorf("without a cached token: err = %v", err)
+	}
+}
+
+func TestAWSCredentialProcess(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no sh")
+	}
+	isolateAWS(t, `
+[default]
+credential_process = printf '{"Version":1,"AccessKeyId":"AKIDPROC","SecretAccessKey":"procsecret","SessionToken":"proctoken"}'
+`, "")
+	creds, err := loadAWSCredentials(context.Background(), nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "AKIDPROC" || creds.SessionToken != "proctoken" {
+		t.Errorf("creds = %+v", creds)
+	}
+}
+
+func TestAWSContainerCredentials(t *testing.T) {
+	home := isolateAWS(t, "", "")
+	tokenFile := filepath.Join(home, "eks-token")
+	os.WriteFile(tokenFile, []byte("podtoken"), 0600)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "podtoken" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"AccessKeyId":"ASIAPOD","SecretAccessKey":"s","Token":"t","Expiration":"2030-01-01T00:00:00Z"}`)
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", srv.URL+"/v1/credentials")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE", tokenFile)
+
+	creds, err := loadAWSCredentials(context.Background(), nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "ASIAPOD" || creds.SessionToken != "t" || creds.Expires.Year() != 2030 {
+		t.Errorf("creds = %+v", creds)
+	}
+}
+
+func TestAWSInstanceMetadata(t *testing.T) {
+	isolateAWS(t, "[default]\nregion = us-west-2\n", "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/latest/api/token" {
+			fmt.Fprint(w, "imdstoken")
+			return
+		}
+		if r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imdstoken" {
+			http.Error(w, "no token", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "web-role\n")
+		case "/latest/meta-data/iam/security-credentials/web-role":
+			fmt.Fprint(w, `{"Code":"Success","AccessKeyId":"ASIAEC2","SecretAccessKey":"s","Token":"t","Expiration":"2030-01-01T00:00:00Z"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "")
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", srv.URL)
+
+	// the default profile only sets the region, so the instance role is used
+	creds, err := loadAWSCredentials(context.Background(), nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "ASIAEC2" || creds.SessionToken != "t" {
+		t.Errorf("creds = %+v", creds)
+	}
+}
+
+func TestAWSNoCredentials(t *testing.T) {
+	isolateAWS(t, "", "")
+	_, err := loadAWSCredentials(context.Background(), nil, "", "")
+	if err == nil || !strings.Contains(err.Error(), "no AWS credentials") {
+		t.Errorf("err = %v", err)
+	}
+	if _, err := loadAWSCredentials(context.Background(), nil, "missing", ""); err == nil || !strings.Contains(err.Error(), `"missing" not found`) {
+		t.Errorf("unknown profile: err = %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/config"
+)
+
+// bedrockTransport reaches Claude through AWS Bedrock's InvokeModel API,
+// which takes the Messages API body and streams the same events wrapped in
+// AWS event-stream frames.
+type bedrockTransport struct {
+	model *config.ModelConfig
+	http  *http.Client
+
+	mu    sync.Mutex
+	creds awsCredentials // the last credentials found, while they last
+}
+
+func (t *bedrockTransport) request(ctx context.Context, req Request, stream bool) (*http.Request, error) {
+	region := t.model.Region
+	if region == "" {
+		return nil, errors.New("bedrock: region not set (config region or AWS_REGION)")
+	}
+	body, err := platformBody(req, "bedrock-2023-05-31", false)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	action := "invoke"
+	if stream {
+		action = "invoke-with-response-stream"
+	}
+	base := strings.TrimRight(t.model.BaseURL, "/")
+	if base == "" {
+		base = "https://bedrock-runtime." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("bedrock base url: %w", err)
+	}
+	// model IDs hold ':' and inference profile ARNs hold '/', so the path
+	// is escaped by hand
+	rawBase := strings.TrimRight(u.EscapedPath(), "/")
+	u.Path = strings.TrimRight(u.Path, "/") + "/model/" + t.model.Model + "/" + action
+	u.RawPath = rawBase + "/model/" + awsEscape(t.model.Model, true) + "/" + action
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json")
+
+	// Bedrock API keys are bearer tokens; otherwise sign with IAM credentials
+	token := t.model.APIKey
+	if token == "" {
+		token = os.Getenv("AWS_BEARER_TOKEN_BEDROCK")
+	}
+	if token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+		return httpReq, nil
+	}
+	creds, err := t.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	signV4(httpReq, body, creds, region, "bedrock", time.Now())
+	return httpReq, nil
+}
+
+// credentials returns the credentials to sign with. Temporary ones (roles,
+// SSO) are reused until five minutes before they expire; static keys are
+// looked up again each time, so edits to ~/.aws take effect.
+func (t *bedrockTransport) credentials(ctx context.Context) (awsCredentials, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.creds.Expires.IsZero() && time.Until(t.creds.Expires) > 5*time.Minute {
+		return t.creds, nil
+	}
+	creds, err := loadAWSCredentials(ctx, t.http, t.model.AWSProfile, t.model.Region)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	t.creds = creds
+	return creds, nil
+}
+
+func (t *bedrockTransport) events(r io.Reader, fn func(data []byte) error) error {
+	for {
+		msg, err := readEventMessage(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return networkError("read stream", err)
+		}
+		switch msg.headers[":message-type"] {
+		case "event":
+			if msg.headers[":event-type"] != "chunk" {
+				continue
+			}
+			var chunk struct {
+				Bytes string `json:"bytes"`
+			}
+			if err := json.Unmarshal(msg.payload, &chunk); err != nil {
+				return fmt.Errorf("bedrock chunk: %w", err)
+			}
+			data, err := base64.StdEncoding.DecodeString(chunk.Bytes)
+			if err != nil {
+				return fmt.Errorf("bedrock chunk: %w", err)
+			}
+			if err := fn(data); err != nil {
+				return err
+			}
+		case "exception":
+			var e struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal(msg.payload, &e)
+			kind := msg.headers[":exception-type"]
+			return &APIError{Class: classify(0, kind, e.Message), Message: kind + ": " + e.Message}
+		case "error":
+			kind, text := msg.headers[":error-code"], msg.headers[":error-message"]
+			return &APIError{Class: classify(0, kind, text), Message: kind + ": " + text}
+		}
+	}
+}
+
+// eventMessage is one frame of the AWS event-stream encoding. Only string
+// header values are kept.
+type eventMessage struct {
+	headers map[string]string
+	payload []byte
+}
+
+// readEventMessage reads one frame: total length, headers length and a CRC
+// of the two, then headers, payload and a CRC of the whole message.
+func readEventMessage(r io.Reader) (*eventMessage, error) {
+	var prelude [12]byte
+	if _, err := io.ReadFull(r, prelude[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("event stream: truncated frame")
+		}
+		return nil, err
+	}
+	total := binary.BigEndian.Uint32(prelude[0:4])
+	headersLen := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return nil, errors.New("event stream: prelude checksum mismatch")
+	}
+	if total < 16 || headersLen > total-16 || total > 16<<20 {
+		return nil, fmt.Errorf("event stream: bad frame length %d", total)
+	}
+	frame := make([]byte, total)
+	copy(frame, prelude[:])
+	if _, err := io.ReadFull(r, frame[12:]); err != nil {
+		return nil, errors.New("event stream: truncated frame")
+	}
+	if crc32.ChecksumIEEE(frame[:total-4]) != binary.BigEndian.Uint32(frame[total-4:]) {
+		return nil, errors.New("event stream: message checksum mismatch")
+	}
+
+	msg := &eventMessage{headers: map[string]string{}, payload: frame[12+headersLen : total-4]}
+	h := frame[12 : 12+headersLen]
+	for len(h) > 0 {
+		n := int(h[0])
+		if len(h) < 2+n {
+			return nil, errors.New("event stream: bad header")
+		}
+		name, typ := string(h[1:1+n]), h[1+n]
+		h = h[2+n:]
+		size := 0
+		switch typ {
+		case 0, 1: // bool true, false
+		case 2:
+			size = 1
+		case 3:
+			size = 2
+		case 4:
+			size = 4
+		case 5, 8: // int64, timestamp
+			size = 8
+		case 9: // uuid
+			size = 16
+		case 6, 7: // bytes, string
+			if len(h) < 2 {
+				return nil, errors.New("event stream: bad header")
+			}
+			size = 2 + int(binary.BigEndian.Uint16(h))
+		default:
+			return nil, fmt.Errorf("event stream: unknown header type %d", typ)
+		}
+		if len(h) < size {
+			return nil, errors.New("event stream: bad header")
+		}
+		if typ == 7 {
+			msg.headers[name] = string(h[2:size])
+		}
+		h = h[size:]
+	}
+	return msg, nil
+}
@@ -3,74 +3,264 @@ package llm
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Lewis-404/axe/internal/config"
 )
 
 // Provider is the interface both Anthropic and OpenAI backends implement.
+// Cancelling ctx aborts the in-flight request, including any retry wait.
+// When a stream breaks off, SendStream returns what it had assembled so far
+// along with the error.
 type Provider interface {
-	Send(system string, messages []Message) (*Response, error)
-	SendStream(system string, messages []Message, cb StreamCallbacks) (*Response, error)
+	Send(ctx context.Context, system string, messages []Message) (*Response, error)
+	SendStream(ctx context.Context, system string, messages []Message, cb StreamCallbacks) (*Response, error)
 	ModelName() string
 }
 
-// Client wraps multiple Providers with fallback support.
+// Client wraps multiple Providers with fallback support. It also keeps the
+// session's usage ledger, attributed to the model that actually served each
+// request, so fallback and /model switches are priced correctly.
 type Client struct {
 	providers []Provider
+	configs   []*config.ModelConfig // parallel to providers
 	activeIdx int
+
+	ledger *ledger
+	retry  *retrier // shared by the providers
+	router *router
+	pinned bool        // a sub-client started at a chosen model, which routing keeps
+	sizer  PromptSizer // sizes prompts for cheapest-capable, nil for approxTokens
+
+	onRetry    func(RetryEvent)
+	onFallback func(FallbackEvent)
+	onRecover  func(RecoveryEvent)
+	onRoute    func(RouteEvent)
+}
+
+// ledger is the session's usage per model. Sub-clients share their parent's.
+type ledger struct {
+	mu    sync.Mutex
+	usage UsageByModel
 }
 
 func NewClient(models []config.ModelConfig, tools []ToolDef) *Client {
-	var providers []Provider
+	c := &Client{ledger: &ledger{usage: UsageByModel{}}, router: newRouter()}
+	c.retry = &retrier{report: c.retried}
 	for i := range models {
 		m := &models[i]
-		if m.APIKey == "" || m.Model == "" {
+		if !m.Usable() {
 			continue
 		}
-		if m.IsOpenAI() {
-			providers = append(providers, NewOpenAIClient(m, tools))
-		} else {
-			providers = append(providers, NewAnthropicClient(m, tools))
+		c.add(m, tools)
+	}
+	return c
+}
+
+// add appends a provider for m.
+func (c *Client) add(m *config.ModelConfig, tools []ToolDef) {
+	switch {
+	case m.IsOpenAI():
+		p := NewOpenAIClient(m, tools)
+		p.retry = c.retry
+		c.providers = append(c.providers, p)
+	case m.IsGemini():
+		p := NewGeminiClient(m, tools)
+		p.retry = c.retry
+		c.providers = append(c.providers, p)
+	case m.IsOllama():
+		p := NewOllamaClient(m, tools)
+		p.retry = c.retry
+		c.providers = append(c.providers, p)
+	default:
+		p := NewAnthropicClient(m, tools)
+		p.retry = c.retry
+		c.providers = append(c.providers, p)
+	}
+	c.configs = append(c.configs, m)
+}
+
+// Sub returns a client for a sub-agent: the same models with their own tool
+// list, starting at model ("" = the active one). It records usage in this
+// client's ledger, so sub-agents count toward the session and its budget,
+// and retries, routes and reports events as this client does. A sub-agent
+// given a model sticks to it rather than following the routing policy.
+func (c *Client) Sub(model string, tools []ToolDef) (*Client, error) {
+	sub := &Client{ledger: c.ledger, retry: c.retry, router: c.router, activeIdx: c.activeIdx,
+		onFallback: c.fellBackTo, onRecover: c.recovered, onRoute: c.routed}
+	for _, m := range c.configs {
+		sub.add(m, tools)
+	}
+	if model != "" && !sub.SwitchModel(model) {
+		return nil, fmt.Errorf("unknown model %q (available: %s)", model, strings.Join(c.ListModels(), ", "))
+	}
+	sub.pinned = model != ""
+	return sub, nil
+}
+
+// record attributes a successful response to the provider that served it.
+func (c *Client) record(idx int, resp *Response) {
+	resp.Model = c.providers[idx].ModelName()
+	c.ledger.mu.Lock()
+	c.ledger.usage.Add(resp.Model, resp.Usage)
+	c.ledger.mu.Unlock()
+}
+
+// Usage returns a snapshot of the session's usage per model.
+func (c *Client) Usage() UsageByModel {
+	c.ledger.mu.Lock()
+	defer c.ledger.mu.Unlock()
+	out := UsageByModel{}
+	out.Merge(c.ledger.usage)
+	return out
+}
+
+// ResetUsage clears the usage ledger (e.g. on /clear).
+func (c *Client) ResetUsage() {
+	c.ledger.mu.Lock()
+	c.ledger.usage = UsageByModel{}
+	c.ledger.mu.Unlock()
+}
+
+// ConfigOf returns the configuration of model, or nil.
+func (c *Client) ConfigOf(model string) *config.ModelConfig {
+	for _, m := range c.configs {
+		if m.Model == model {
+			return m
 		}
 	}
-	return &Client{providers: providers}
+	return nil
 }
 
-func (c *Client) Send(system string, messages []Message) (*Response, error) {
+// ProviderOf returns the configured provider name for model, or "".
+func (c *Client) ProviderOf(model string) string {
+	for _, m := range c.configs {
+		if m.Model == model {
+			return m.Provider
+		}
+	}
+	return ""
+}
+
+// Send sends a request to the model routing picks, falling back to the
+// others in the routing order on errors another model might not have.
+func (c *Client) Send(ctx context.Context, system string, messages []Message) (*Response, error) {
+	if len(c.providers) == 0 {
+		return nil, errNoModels
+	}
 	var lastErr error
-	for i := 0; i < len(c.providers); i++ {
-		idx := (c.activeIdx + i) % len(c.providers)
-		resp, err := c.providers[idx].Send(system, messages)
+	order, sticky := c.route(ctx, system, messages)
+	for i, idx := range order {
+		start := time.Now()
+		resp, err := c.providers[idx].Send(ctx, system, messages)
 		if err == nil {
-			c.activeIdx = idx
+			c.served(idx, time.Since(start))
+			if sticky {
+				c.activeIdx = idx
+			}
+			c.record(idx, resp)
 			return resp, nil
 		}
+		// a cancelled request must not fall through to the next provider
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		c.failed(idx, err)
+		if !canFallBack(err) && !c.outgrew(err) {
+			return nil, err
+		}
 		lastErr = err
+		c.fellBack(order, i, err)
 	}
 	return nil, lastErr
 }
 
-func (c *Client) SendStream(system string, messages []Message, cb StreamCallbacks) (*Response, error) {
+// SendStream streams a response, falling back like Send. A stream that
+// breaks off after output was passed on is recovered rather than replayed
+// from scratch; see streamFrom.
+func (c *Client) SendStream(ctx context.Context, system string, messages []Message, cb StreamCallbacks) (*Response, error) {
+	if len(c.providers) == 0 {
+		return nil, errNoModels
+	}
 	var lastErr error
-	for i := 0; i < len(c.providers); i++ {
-		idx := (c.activeIdx + i) % len(c.providers)
-		resp, err := c.providers[idx].SendStream(system, messages, cb)
+	var kept []ContentBlock // text already passed on by streams that broke off
+	order, sticky := c.route(ctx, system, messages)
+	for i, idx := range order {
+		start := time.Now()
+		resp, err := c.streamFrom(ctx, idx, system, messages, &kept, cb)
 		if err == nil {
-			c.activeIdx = idx
+			c.served(idx, time.Since(start))
+			if sticky {
+				c.activeIdx = idx
+			}
+			c.record(idx, resp)
 			return resp, nil
 		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		c.failed(idx, err)
+		if !canFallBack(err) && !c.outgrew(err) {
+			return nil, err
+		}
 		lastErr = err
+		c.fellBack(order, i, err)
 	}
 	return nil, lastErr
 }
 
+// outgrew reports whether err says the prompt didn't fit the model's
+// context window, which under the cheapest-capable policy means the prompt
+// was sized too small and a model further down the order may take it.
+func (c *Client) outgrew(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Class == ClassContextLength && c.sizesPrompts()
+}
+
+// errNoModels is returned by a client without a usable model.
+var errNoModels = errors.New("no usable model configured")
+
+// fellBack reports that order[i] failed, if there is another one to try.
+func (c *Client) fellBack(order []int, i int, err error) {
+	if c.onFallback == nil || i+1 >= len(order) {
+		return
+	}
+	c.onFallback(FallbackEvent{From: c.providers[order[i]].ModelName(), To: c.providers[order[i+1]].ModelName(), Err: err})
+}
+
+// fellBackTo forwards a sub-client's fallback to this client's hook.
+func (c *Client) fellBackTo(e FallbackEvent) {
+	if c.onFallback != nil {
+		c.onFallback(e)
+	}
+}
+
+// SetRetryPolicy sets how failed requests are retried, for every model.
+func (c *Client) SetRetryPolicy(p config.RetryPolicy) { c.retry.setPolicy(p) }
+
+// toolSetter is implemented by providers whose tool list can be replaced.
+type toolSetter interface {
+	setTools([]ToolDef)
+}
+
+// SetTools replaces the tool definitions sent with every request, e.g. when
+// plan mode hides the mutating tools.
+func (c *Client) SetTools(tools []ToolDef) {
+	for _, p := range c.providers {
+		if ts, ok := p.(toolSetter); ok {
+			ts.setTools(tools)
+		}
+	}
+}
+
 func (c *Client) ModelName() string {
 	if len(c.providers) == 0 {
 		return "none"
@@ -78,6 +268,15 @@ func (c *Client) ModelName() string {
 	return c.providers[c.activeIdx].ModelName()
 }
 
+// Active returns the config of the model requests currently go to, which
+// changes on /model switches and fallback. Nil when no model is usable.
+func (c *Client) Active() *config.ModelConfig {
+	if len(c.configs) == 0 {
+		return nil
+	}
+	return c.configs[c.activeIdx]
+}
+
 func (c *Client) SwitchModel(name string) bool {
 	for i, p := range c.providers {
 		if p.ModelName() == name {
@@ -96,153 +295,323 @@ func (c *Client) ListModels() []string {
 	return names
 }
 
-// AnthropicClient implements Provider for the Anthropic API.
+// AnthropicClient implements Provider for the Anthropic API, reached
+// directly or through Bedrock or Vertex.
 type AnthropicClient struct {
-	model *config.ModelConfig
-	http  *http.Client
-	tools []ToolDef
+	model     *config.ModelConfig
+	http      *http.Client
+	tools     []ToolDef
+	retry     *retrier
+	transport anthropicTransport
 }
 
+func (c *AnthropicClient) setTools(tools []ToolDef) { c.tools = tools }
+
 func NewAnthropicClient(m *config.ModelConfig, tools []ToolDef) *AnthropicClient {
-	return &AnthropicClient{model: m, http: &http.Client{Timeout: 5 * time.Minute}, tools: tools}
+	c := &AnthropicClient{model: m, http: &http.Client{Timeout: 5 * time.Minute}, tools: tools}
+	switch {
+	case m.IsBedrock():
+		c.transport = &bedrockTransport{model: m, http: c.http}
+	case m.IsVertex():
+		c.transport = &vertexTransport{model: m, http: c.http}
+	default:
+		c.transport = directTransport{model: m}
+	}
+	return c
 }
 
-func (c *AnthropicClient) ModelName() string { return c.model.Model }
+// anthropicTransport is how a Messages API call reaches Claude. Bedrock and
+// Vertex take the same request and stream the same events, but address,
+// authenticate and frame them differently.
+type anthropicTransport interface {
+	// request builds the HTTP request for req.
+	request(ctx context.Context, req Request, stream bool) (*http.Request, error)
+	// events calls fn with the JSON of each stream event in r, stopping at
+	// the first error fn returns.
+	events(r io.Reader, fn func(data []byte) error) error
+}
 
-func (c *AnthropicClient) Send(system string, messages []Message) (*Response, error) {
-	req := Request{
-		Model:     c.model.Model,
-		MaxTokens: c.model.MaxTokens,
-		System:    system,
-		Messages:  messages,
-		Tools:     c.tools,
-	}
+// directTransport talks to the Anthropic API with an API key.
+type directTransport struct {
+	model *config.ModelConfig
+}
 
-	body, err := json.Marshal(req)
+func (t directTransport) request(ctx context.Context, req Request, stream bool) (*http.Request, error) {
+	body, err := json.Marshal(struct {
+		Request
+		Stream bool `json:"stream,omitempty"`
+	}{req, stream})
 	if err != nil {
 		return nil, fmt.Errorf("marshal request: %w", err)
 	}
-
-	url := strings.TrimRight(c.model.BaseURL, "/") + "/v1/messages"
-	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	url := strings.TrimRight(t.model.BaseURL, "/") + "/v1/messages"
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("create request: %w", err)
 	}
-
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("x-api-key", c.model.APIKey)
+	httpReq.Header.Set("x-api-key", t.model.APIKey)
 	httpReq.Header.Set("anthropic-version", "2023-06-01")
+	return httpReq, nil
+}
 
-	resp, err := c.http.Do(httpReq)
-	if err != nil {
-		return nil, fmt.Errorf("send request: %w", err)
+func (directTransport) events(r io.Reader, fn func(data []byte) error) error { return sseEvents(r, fn) }
+
+// sseEvents calls fn with the data of each server-sent event in r.
+func sseEvents(r io.Reader, fn func(data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data: ") {
+			if err := fn([]byte(strings.TrimPrefix(line, "data: "))); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return networkError("read stream", err)
 	}
-	defer resp.Body.Close()
+	return nil
+}
 
-	data, err := io.ReadAll(resp.Body)
+// platformBody converts a Messages API request for Bedrock and Vertex: the
+// model is in the URL, and the API version in the body.
+func platformBody(req Request, version string, stream bool) ([]byte, error) {
+	data, err := json.Marshal(req)
 	if err != nil {
-		return nil, fmt.Errorf("read response: %w", err)
+		return nil, err
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		var errResp ErrorResponse
-		if json.Unmarshal(data, &errResp) == nil && errResp.Error.Message != "" {
-			return nil, fmt.Errorf("API error (%d): %s", resp.StatusCode, errResp.Error.Message)
-		}
-		return nil, fmt.Errorf("API error (%d): %s", resp.StatusCode, string(data))
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
 	}
-
-	var result Response
-	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, fmt.Errorf("parse response: %w", err)
+	delete(fields, "model")
+	fields["anthropic_version"], _ = json.Marshal(version)
+	if stream {
+		fields["stream"] = json.RawMessage("true")
 	}
-	return &result, nil
+	return json.Marshal(fields)
 }
 
-func (c *AnthropicClient) SendStream(system string, messages []Message, cb StreamCallbacks) (*Response, error) {
-	req := struct {
-		Request
-		Stream bool `json:"stream"`
-	}{
-		Request: Request{
-			Model:     c.model.Model,
-			MaxTokens: c.model.MaxTokens,
-			System:    system,
-			Messages:  messages,
-			Tools:     c.tools,
-		},
-		Stream: true,
-	}
-
-	body, err := json.Marshal(req)
+// do sends req through the transport. A failing status is returned as an
+// APIError, with the body closed.
+func (c *AnthropicClient) do(ctx context.Context, req Request, stream bool) (*http.Response, error) {
+	httpReq, err := c.transport.request(ctx, req, stream)
 	if err != nil {
-		return nil, fmt.Errorf("marshal request: %w", err)
+		return nil, err
 	}
+	return doHTTP(c.http, httpReq)
+}
 
-	url := strings.TrimRight(c.model.BaseURL, "/") + "/v1/messages"
-	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(body))
+// doHTTP sends req, turning transport failures and failing statuses into
+// APIErrors.
+func doHTTP(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
+		return nil, networkError("send request", err)
 	}
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, newAPIError(resp.StatusCode, resp.Header, data)
+	}
+	return resp, nil
+}
 
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("x-api-key", c.model.APIKey)
-	httpReq.Header.Set("anthropic-version", "2023-06-01")
+func (c *AnthropicClient) ModelName() string { return c.model.Model }
 
-	resp, err := c.http.Do(httpReq)
-	if err != nil {
-		return nil, fmt.Errorf("send request: %w", err)
+// buildRequest assembles a Messages API request. With prompt caching on it
+// places breakpoints on the system prompt, the last tool definition and the
+// rolling conversation prefix (the last two user turns), so each iteration
+// of the agent loop only pays full price for the newly appended messages.
+func (c *AnthropicClient) buildRequest(system string, messages []Message) Request {
+	messages = wireMessages(messages)
+	req := Request{
+		Model:     c.model.Model,
+		MaxTokens: c.model.ClampOutput(c.model.MaxTokens),
+		Messages:  messages,
+		Tools:     c.tools,
+	}
+	if system != "" {
+		req.System = []SystemBlock{{Type: "text", Text: system}}
+	}
+	if budget := c.model.ThinkingBudget; budget > 0 {
+		req.Thinking = &ThinkingConfig{Type: "enabled", BudgetTokens: budget}
+		// max_tokens must leave room for the answer on top of the budget
+		if req.MaxTokens <= budget {
+			req.MaxTokens = c.model.ClampOutput(budget + c.model.MaxTokens)
+		}
+	} else {
+		req.Messages = stripThinking(messages)
+	}
+	if !c.model.CacheEnabled() {
+		return req
+	}
+	if len(req.System) > 0 {
+		req.System[0].CacheControl = ephemeral
+	}
+	if n := len(c.tools); n > 0 {
+		req.Tools = make([]ToolDef, n)
+		copy(req.Tools, c.tools)
+		req.Tools[n-1].CacheControl = ephemeral
 	}
+	req.Messages = withCacheBreakpoints(req.Messages, 2)
+	return req
+}
 
-	// retry on rate limit (429) or server error (529/500)
-	if resp.StatusCode == 429 || resp.StatusCode == 529 || resp.StatusCode == 500 {
-		resp.Body.Close()
-		for retry := 0; retry < 3; retry++ {
-			wait := time.Duration(2<<retry) * time.Second
-			fmt.Fprintf(os.Stderr, "⏳ API %d, retrying in %s...\n", resp.StatusCode, wait)
-			time.Sleep(wait)
-			httpReq2, _ := http.NewRequest("POST", url, bytes.NewReader(body))
-			httpReq2.Header.Set("Content-Type", "application/json")
-			httpReq2.Header.Set("x-api-key", c.model.APIKey)
-			httpReq2.Header.Set("anthropic-version", "2023-06-01")
-			resp, err = c.http.Do(httpReq2)
-			if err != nil {
-				return nil, fmt.Errorf("send request: %w", err)
-			}
-			if resp.StatusCode == 200 {
-				break
+// wireMessages returns messages without local bookkeeping (Tokens, Compacted)
+// and without other providers' state: signatures on text and tool_use blocks
+// (Gemini thought signatures) and reasoning items (OpenAI Responses API).
+// Text blocks left empty, which only carried a signature, are dropped since
+// the API rejects empty text. It copies only if there is something to clear.
+func wireMessages(messages []Message) []Message {
+	for i := range messages {
+		if messages[i].Tokens == 0 && messages[i].Compacted == nil && !hasForeignState(messages[i].Content) {
+			continue
+		}
+		out := make([]Message, len(messages))
+		copy(out, messages)
+		for j := range out {
+			out[j].Tokens, out[j].Compacted = 0, nil
+			if hasForeignState(out[j].Content) {
+				var content []ContentBlock
+				for _, b := range out[j].Content {
+					if b.Type == "reasoning" || b.Type == "text" && b.Text == "" {
+						continue
+					}
+					if !isThinking(b.Type) {
+						b.Signature = ""
+					}
+					content = append(content, b)
+				}
+				if len(content) == 0 {
+					content = []ContentBlock{{Type: "text", Text: "(thinking)"}}
+				}
+				out[j].Content = content
 			}
-			resp.Body.Close()
 		}
-		if resp.StatusCode != 200 {
-			return nil, fmt.Errorf("API error (%d) after retries", resp.StatusCode)
+		return out
+	}
+	return messages
+}
+
+// hasForeignState reports whether a non-thinking block has a signature, or
+// there is a reasoning item.
+func hasForeignState(blocks []ContentBlock) bool {
+	for _, b := range blocks {
+		if b.Signature != "" && !isThinking(b.Type) || b.Type == "reasoning" {
+			return true
 		}
 	}
-	defer resp.Body.Close()
+	return false
+}
 
-	if resp.StatusCode != http.StatusOK {
-		data, _ := io.ReadAll(resp.Body)
-		var errResp ErrorResponse
-		if json.Unmarshal(data, &errResp) == nil && errResp.Error.Message != "" {
-			return nil, fmt.Errorf("API error (%d): %s", resp.StatusCode, errResp.Error.Message)
+// stripThinking drops thinking blocks, which the API rejects when thinking
+// is disabled (e.g. after switching to a model without a thinking budget).
+func stripThinking(messages []Message) []Message {
+	out := messages
+	copied := false
+	for i, m := range messages {
+		if m.Role != RoleAssistant || !hasThinking(m.Content) {
+			continue
+		}
+		if !copied {
+			out = make([]Message, len(messages))
+			copy(out, messages)
+			copied = true
+		}
+		var content []ContentBlock
+		for _, b := range m.Content {
+			if !isThinking(b.Type) {
+				content = append(content, b)
+			}
 		}
-		return nil, fmt.Errorf("API error (%d): %s", resp.StatusCode, string(data))
+		if len(content) == 0 {
+			content = []ContentBlock{{Type: "text", Text: "(thinking)"}}
+		}
+		out[i].Content = content
 	}
+	return out
+}
 
-	var result Response
-	scanner := bufio.NewScanner(resp.Body)
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+func isThinking(blockType string) bool {
+	return blockType == "thinking" || blockType == "redacted_thinking"
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
+func hasThinking(blocks []ContentBlock) bool {
+	for _, b := range blocks {
+		if isThinking(b.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCacheBreakpoints returns a copy of messages with a cache breakpoint on
+// the last block of the final n user messages. The input is not modified.
+func withCacheBreakpoints(messages []Message, n int) []Message {
+	out := make([]Message, len(messages))
+	copy(out, messages)
+	for i := len(out) - 1; i >= 0 && n > 0; i-- {
+		m := out[i]
+		if m.Role != RoleUser || len(m.Content) == 0 {
 			continue
 		}
-		data := []byte(strings.TrimPrefix(line, "data: "))
+		content := make([]ContentBlock, len(m.Content))
+		copy(content, m.Content)
+		content[len(content)-1].CacheControl = ephemeral
+		out[i].Content = content
+		n--
+	}
+	return out
+}
+
+func (c *AnthropicClient) Send(ctx context.Context, system string, messages []Message) (*Response, error) {
+	req := c.buildRequest(system, messages)
+	return retryCall(ctx, c.retry, c.model.Model, nil, func() (*Response, error) {
+		resp, err := c.do(ctx, req, false)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
 
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, networkError("read response", err)
+		}
+		var result Response
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("parse response: %w", err)
+		}
+		return &result, nil
+	})
+}
+
+func (c *AnthropicClient) SendStream(ctx context.Context, system string, messages []Message, cb StreamCallbacks) (*Response, error) {
+	req := c.buildRequest(system, messages)
+	cb, started := watchStream(cb)
+	return retryCall(ctx, c.retry, c.model.Model, started, func() (*Response, error) {
+		resp, err := c.do(ctx, req, true)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return c.readStream(resp.Body, cb)
+	})
+}
+
+// readStream assembles a response from the Messages API stream events. A
+// stream that ends before the stop reason was cut off; the partial response
+// is returned with the error.
+func (c *AnthropicClient) readStream(body io.Reader, cb StreamCallbacks) (*Response, error) {
+	var result Response
+	inputs := map[int]string{} // tool_use input JSON by block index
+	done := false
+	err := c.transport.events(body, func(data []byte) error {
 		var ev StreamEvent
 		if json.Unmarshal(data, &ev) != nil {
-			continue
+			return nil
 		}
 
 		switch ev.Type {
@@ -275,35 +644,89 @@ func (c *AnthropicClient) SendStream(system string, messages []Message, cb Strea
 						cb.OnTextDelta(e.Delta.Text)
 					}
 				case "input_json_delta":
+					inputs[e.Index] += e.Delta.PartialJSON
 					if cb.OnInputJSONDelta != nil {
 						cb.OnInputJSONDelta(e.Index, e.Delta.PartialJSON)
 					}
+				case "thinking_delta":
+					if e.Index < len(result.Content) {
+						result.Content[e.Index].Thinking += e.Delta.Thinking
+					}
+					if cb.OnThinkingDelta != nil {
+						cb.OnThinkingDelta(e.Delta.Thinking)
+					}
+				case "signature_delta":
+					if e.Index < len(result.Content) {
+						result.Content[e.Index].Signature += e.Delta.Signature
+					}
 				}
 			}
 		case "content_block_stop":
+			var e struct {
+				Index int `json:"index"`
+			}
+			if json.Unmarshal(data, &e) != nil {
+				return nil
+			}
+			// input cut off by max_tokens doesn't parse and keeps the
+			// placeholder from content_block_start
+			var input any
+			if raw, ok := inputs[e.Index]; ok && e.Index < len(result.Content) && json.Unmarshal([]byte(raw), &input) == nil {
+				result.Content[e.Index].Input = input
+			}
 			if cb.OnBlockStop != nil {
-				var e struct {
-					Index int `json:"index"`
-				}
-				if json.Unmarshal(data, &e) == nil {
-					cb.OnBlockStop(e.Index)
-				}
+				cb.OnBlockStop(e.Index)
 			}
 		case "message_delta":
 			var e MessageDeltaEvent
 			if json.Unmarshal(data, &e) == nil {
 				result.StopReason = e.Delta.StopReason
+				mergeDeltaUsage(&result.Usage, e.Usage)
+				// all content is in once the stop reason is
+				done = done || e.Delta.StopReason != ""
 			}
 		case "message_stop":
+			done = true
 			if cb.OnMessageDone != nil {
 				cb.OnMessageDone(&result)
 			}
+		case "error":
+			// e.g. overloaded_error after the request was accepted
+			if err := streamError(data); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err == nil && !done {
+		err = truncated()
 	}
+	return &result, err
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("read stream: %w", err)
+// mergeDeltaUsage applies the cumulative usage of a message_delta event on
+// top of the counts reported by message_start.
+func mergeDeltaUsage(u *Usage, d Usage) {
+	u.OutputTokens = d.OutputTokens
+	if d.InputTokens > 0 {
+		u.InputTokens = d.InputTokens
+	}
+	if d.CacheCreationInputTokens > 0 {
+		u.CacheCreationInputTokens = d.CacheCreationInputTokens
+	}
+	if d.CacheReadInputTokens > 0 {
+		u.CacheReadInputTokens = d.CacheReadInputTokens
 	}
+}
 
-	return &result, nil
+// sleepCtx waits for d or until ctx is cancelled, whichever comes first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,270 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Lewis-404/axe/internal/config"
+)
+
+// sseServer replays events as an SSE stream and records the last request body.
+func sseServer(t *testing.T, events []string, body *map[string]any) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body != nil {
+			json.NewDecoder(r.Body).Decode(body)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range events {
+			fmt.Fprintf(w, "data: %s\n\n", e)
+		}
+	}))
+}
+
+func TestAnthropicStreamUsage(t *testing.T) {
+	srv := sseServer(t, []string{
+		`{"type":"message_start","message":{"id":"m1","role":"assistant","usage":{"input_tokens":10,"output_tokens":1,"cache_read_input_tokens":900,"cache_creation_input_tokens":50}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"hi"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":42}}`,
+		`{"type":"message_stop"}`,
+	}, nil)
+	defer srv.Close()
+
+	c := NewAnthropicClient(&config.ModelConfig{BaseURL: srv.URL, Model: "claude-sonnet-4", MaxTokens: 100}, nil)
+	resp, err := c.SendStream(context.Background(), "sys", []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hello"}}}}, StreamCallbacks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Usage{InputTokens: 10, OutputTokens: 42, CacheReadInputTokens: 900, CacheCreationInputTokens: 50}
+	if resp.Usage != want {
+		t.Errorf("usage = %+v, want %+v", resp.Usage, want)
+	}
+}
+
+func TestOpenAIStreamUsage(t *testing.T) {
+	var body map[string]any
+	srv := sseServer(t, []string{
+		`{"id":"c1","choices":[{"delta":{"content":"hi"},"finish_reason":null}]}`,
+		`{"id":"c1","choices":[{"delta":{},"finish_reason":"stop"}]}`,
+		`{"id":"c1","choices":[],"usage":{"prompt_tokens":100,"completion_tokens":20,"prompt_tokens_details":{"cached_tokens":60},"completion_tokens_details":{"reasoning_tokens":5}}}`,
+		`[DONE]`,
+	}, &body)
+	defer srv.Close()
+
+	c := NewOpenAIClient(&config.ModelConfig{Provider: "openai", BaseURL: srv.URL, Model: "gpt-4o", MaxTokens: 100}, nil)
+	resp, err := c.SendStream(context.Background(), "", []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hello"}}}}, StreamCallbacks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, _ := body["stream_options"].(map[string]any)
+	if opts["include_usage"] != true {
+		t.Errorf("stream_options.include_usage not requested: %v", body["stream_options"])
+	}
+	want := Usage{InputTokens: 40, OutputTokens: 20, CacheReadInputTokens: 60, ReasoningTokens: 5}
+	if resp.Usage != want {
+		t.Errorf("usage = %+v, want %+v", resp.Usage, want)
+	}
+	if !strings.Contains(resp.Content[0].Text, "hi") {
+		t.Errorf("content = %+v", resp.Content)
+	}
+}
+
+func TestClientUsageFollowsFallback(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, 529)
+	}))
+	defer bad.Close()
+	good := sseServer(t, []string{
+		`{"id":"c1","choices":[{"delta":{"content":"ok"},"finish_reason":"stop"}]}`,
+		`{"id":"c1","choices":[],"usage":{"prompt_tokens":7,"completion_tokens":3}}`,
+		`[DONE]`,
+	}, nil)
+	defer good.Close()
+
+	c := NewClient([]config.ModelConfig{
+		{Provider: "anthropic", APIKey: "k", BaseURL: bad.URL, Model: "claude-sonnet-4", MaxTokens: 100},
+		{Provider: "openai", APIKey: "k", BaseURL: good.URL, Model: "gpt-4o", MaxTokens: 100},
+	}, nil)
+	c.SetRetryPolicy(config.RetryPolicy{MaxRetries: -1})
+	msgs := []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hi"}}}}
+	if _, err := c.SendStream(context.Background(), "", msgs, StreamCallbacks{}); err != nil {
+		t.Fatal(err)
+	}
+	usage := c.Usage()
+	if _, ok := usage["claude-sonnet-4"]; ok {
+		t.Errorf("failed provider should not be billed: %+v", usage)
+	}
+	if got := usage["gpt-4o"]; got.InputTokens != 7 || got.OutputTokens != 3 {
+		t.Errorf("gpt-4o usage = %+v, want 7/3", got)
+	}
+	if c.ProviderOf("gpt-4o") != "openai" {
+		t.Errorf("ProviderOf(gpt-4o) = %q", c.ProviderOf("gpt-4o"))
+	}
+	if m := c.Active(); m == nil || m.Model != "gpt-4o" {
+		t.Errorf("active model after fallback = %+v", m)
+	}
+}
+
+func TestMaxTokensClampedToOutputLimit(t *testing.T) {
+	c := NewAnthropicClient(&config.ModelConfig{Model: "claude-3-5-haiku", MaxTokens: 16000}, nil)
+	if got := c.buildRequest("", nil).MaxTokens; got != 8192 {
+		t.Errorf("max_tokens = %d, want the built-in 8192 limit", got)
+	}
+	c = NewAnthropicClient(&config.ModelConfig{Model: "claude-sonnet-4", MaxTokens: 8192, ThinkingBudget: 10000, MaxOutputTokens: 12000}, nil)
+	if got := c.buildRequest("", nil).MaxTokens; got != 12000 {
+		t.Errorf("thinking max_tokens = %d, want the configured 12000 limit", got)
+	}
+}
+
+func TestAnthropicCountTokens(t *testing.T) {
+	var path string
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+		fmt.Fprint(w, `{"input_tokens":1234}`)
+	}))
+	defer srv.Close()
+
+	c := NewClient([]config.ModelConfig{{Provider: "anthropic", APIKey: "k", BaseURL: srv.URL, Model: "claude-sonnet-4", MaxTokens: 100}},
+		[]ToolDef{{Name: "think", InputSchema: map[string]any{"type": "object"}}})
+	msgs := []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hi"}}, Tokens: 7}}
+	n, err := c.CountTokens(context.Background(), "sys", msgs)
+	if err != nil || n != 1234 {
+		t.Fatalf("CountTokens = %d, %v", n, err)
+	}
+	if path != "/v1/messages/count_tokens" {
+		t.Errorf("path = %s", path)
+	}
+	if _, ok := body["max_tokens"]; ok {
+		t.Error("count_tokens request must not carry max_tokens")
+	}
+	if body["tools"] == nil || body["system"] == nil {
+		t.Errorf("system and tools must be counted: %v", body)
+	}
+	if m := body["messages"].([]any)[0].(map[string]any); m["tokens"] != nil {
+		t.Errorf("local token bookkeeping leaked to the API: %v", m)
+	}
+
+	oai := NewClient([]config.ModelConfig{{Provider: "openai", APIKey: "k", BaseURL: srv.URL, Model: "gpt-4o"}}, nil)
+	if _, err := oai.CountTokens(context.Background(), "", msgs); err != ErrCountUnsupported {
+		t.Errorf("openai CountTokens err = %v, want ErrCountUnsupported", err)
+	}
+}
+
+func TestThinkingAlwaysMarshalled(t *testing.T) {
+	data, err := json.Marshal(ContentBlock{Type: "thinking", Signature: "sig"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"thinking","signature":"sig","thinking":""}`; string(data) != want {
+		t.Errorf("marshal:\n got %s\nwant %s", data, want)
+	}
+	var back ContentBlock
+	if err := json.Unmarshal(data, &back); err != nil || back.Type != "thinking" || back.Signature != "sig" {
+		t.Errorf("round trip = %+v, %v", back, err)
+	}
+	if data, _ := json.Marshal(ContentBlock{Type: "text", Text: "hi"}); strings.Contains(string(data), "thinking") {
+		t.Errorf("text block = %s", data)
+	}
+}
+
+func TestToolResultParts(t *testing.T) {
+	img := ImageBlock("image/png", []byte("png"))
+	b := ContentBlock{Type: "tool_result", ToolID: "t1", Content: "Image a.png", Parts: []ContentBlock{img}}
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"tool_result","tool_use_id":"t1","content":[{"type":"text","text":"Image a.png"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"cG5n"}}]}`
+	if string(data) != want {
+		t.Errorf("marshal:\n got %s\nwant %s", data, want)
+	}
+	var back ContentBlock
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Content != b.Content || len(back.Parts) != 1 || back.Parts[0].Source.Data != "cG5n" {
+		t.Errorf("round trip = %+v", back)
+	}
+	if data, _ := json.Marshal(ContentBlock{Type: "tool_result", ToolID: "t1", Content: "ok"}); !strings.Contains(string(data), `"content":"ok"`) {
+		t.Errorf("text-only result = %s", data)
+	}
+
+	c := NewOpenAIClient(&config.ModelConfig{Provider: "openai", Model: "gpt-4o"}, nil)
+	out := c.convertMessages("", []Message{{Role: RoleUser, Content: []ContentBlock{b}}})
+	if len(out) != 2 || out[0].Role != "tool" || out[0].Content != "Image a.png" || out[1].Role != "user" {
+		t.Fatalf("openai messages = %+v", out)
+	}
+	parts, _ := out[1].Content.([]oaiContentPart)
+	if len(parts) != 2 || parts[1].ImageURL == nil || parts[1].ImageURL.URL != "data:image/png;base64,cG5n" {
+		t.Errorf("openai image parts = %+v", out[1].Content)
+	}
+}
+
+func TestOpenAIImageInput(t *testing.T) {
+	blocks, text := ParseImageBlocks("what is in https://example.com/cat.png?size=2 please")
+	if len(blocks) != 1 || blocks[0].Source.Type != "url" || blocks[0].Source.URL != "https://example.com/cat.png?size=2" {
+		t.Fatalf("blocks = %+v", blocks)
+	}
+	if text != "what is in  please" {
+		t.Errorf("remaining text = %q", text)
+	}
+	msgs := []Message{{Role: RoleUser, Content: []ContentBlock{ImageBlock("image/png", []byte("png")), blocks[0], {Type: "text", Text: "compare"}}}}
+
+	c := NewOpenAIClient(&config.ModelConfig{Provider: "openai", Model: "gpt-4o"}, nil)
+	out := c.convertMessages("", msgs)
+	parts, ok := out[0].Content.([]oaiContentPart)
+	if !ok || len(parts) != 3 {
+		t.Fatalf("user content = %+v, want three parts", out[0].Content)
+	}
+	if parts[0].ImageURL.URL != "data:image/png;base64,cG5n" || parts[1].ImageURL.URL != "https://example.com/cat.png?size=2" || parts[2].Text != "compare" {
+		t.Errorf("parts = %+v", parts)
+	}
+
+	c = NewOpenAIClient(&config.ModelConfig{Provider: "openai", Model: "deepseek-chat"}, nil)
+	if _, err := c.Send(context.Background(), "", msgs); !errors.Is(err, ErrNoVision) {
+		t.Errorf("deepseek-chat with images: err = %v, want ErrNoVision", err)
+	}
+	vision := true
+	c = NewOpenAIClient(&config.ModelConfig{Provider: "openai", Model: "deepseek-chat", Vision: &vision}, nil)
+	if _, err := c.checkVision(msgs); err != nil {
+		t.Errorf("vision override ignored: %v", err)
+	}
+}
+
+func TestOldImagesForNonVision(t *testing.T) {
+	msgs := []Message{
+		{Role: RoleUser, Content: []ContentBlock{ImageBlock("image/png", []byte("png")), {Type: "text", Text: "what is this?"}}},
+		{Role: RoleAssistant, Content: []ContentBlock{{Type: "tool_use", ID: "t1", Name: "read_file"}}},
+		{Role: RoleUser, Content: []ContentBlock{{Type: "tool_result", ToolID: "t1", Content: "read", Parts: []ContentBlock{ImageBlock("image/png", []byte("png"))}}}},
+		{Role: RoleAssistant, Content: []ContentBlock{{Type: "text", Text: "A cat."}}},
+		{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "now fix the bug"}}},
+	}
+	c := NewOpenAIClient(&config.ModelConfig{Provider: "openai", Model: "deepseek-chat"}, nil)
+	out, err := c.checkVision(msgs)
+	if err != nil {
+		t.Fatalf("images from earlier turns: %v", err)
+	}
+	if b := out[0].Content[0]; b.Type != "text" || b.Text != imageOmitted {
+		t.Errorf("old image = %+v, want a placeholder", b)
+	}
+	if b := out[2].Content[0]; b.Parts != nil || b.Content != "read\n"+imageOmitted {
+		t.Errorf("old tool result = %+v", b)
+	}
+	if msgs[0].Content[0].Type != "image" || msgs[2].Content[0].Parts == nil {
+		t.Error("history was modified")
+	}
+
+	if _, err := c.checkVision(msgs[:3]); !errors.Is(err, ErrNoVision) {
+		t.Errorf("image in the last message: err = %v, want ErrNoVision", err)
+	}
+}
@@ -0,0 +1,206 @@
+package llm
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/config"
+)
+
+var cloudEvents = []string{
+	`{"type":"message_start","message":{"id":"m1","role":"assistant","usage":{"input_tokens":10,"output_tokens":1}}}`,
+	`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+	`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"hi"}}`,
+	`{"type":"content_block_stop","index":0}`,
+	`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":5}}`,
+	`{"type":"message_stop"}`,
+}
+
+func TestSignV4(t *testing.T) {
+	// get-vanilla from the AWS SigV4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signV4(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// eventFrame encodes payload as an event-stream message with string headers.
+func eventFrame(headers map[string]string, payload []byte) []byte {
+	var h []byte
+	for k, v := range headers {
+		h = append(h, byte(len(k)))
+		h = append(h, k...)
+		h = append(h, 7)
+		h = binary.BigEndian.AppendUint16(h, uint16(len(v)))
+		h = append(h, v...)
+	}
+	total := 16 + len(h) + len(payload)
+	b := binary.BigEndian.AppendUint32(nil, uint32(total))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(h)))
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	b = append(append(b, h...), payload...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+func TestBedrockStream(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+	t.Setenv("AWS_BEARER_TOKEN_BEDROCK", "")
+
+	var path, auth, token string
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, auth, token = r.URL.EscapedPath(), r.Header.Get("Authorization"), r.Header.Get("X-Amz-Security-Token")
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+		for _, e := range cloudEvents {
+			chunk, _ := json.Marshal(map[string]string{"bytes": base64.StdEncoding.EncodeToString([]byte(e))})
+			w.Write(eventFrame(map[string]string{":message-type": "event", ":event-type": "chunk"}, chunk))
+		}
+	}))
+	defer srv.Close()
+
+	m := &config.ModelConfig{Provider: "bedrock", BaseURL: srv.URL, Region: "us-west-2", Model: "us.anthropic.claude-sonnet-4-20250514-v1:0", MaxTokens: 100}
+	c := NewAnthropicClient(m, nil)
+	var text string
+	resp, err := c.SendStream(context.Background(), "sys", []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hello"}}}}, StreamCallbacks{
+		OnTextDelta: func(s string) { text += s },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/model/us.anthropic.claude-sonnet-4-20250514-v1%3A0/invoke-with-response-stream" {
+		t.Errorf("path = %s", path)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-west-2/bedrock/aws4_request") || token != "session" {
+		t.Errorf("auth = %q, token = %q", auth, token)
+	}
+	if body["anthropic_version"] != "bedrock-2023-05-31" || body["model"] != nil || body["stream"] != nil {
+		t.Errorf("body = %v", body)
+	}
+	if text != "hi" || resp.StopReason != "end_turn" || resp.Usage.OutputTokens != 5 {
+		t.Errorf("text = %q, response = %+v", text, resp)
+	}
+}
+
+func TestBedrockStreamException(t *testing.T) {
+	var stream []byte
+	stream = append(stream, eventFrame(map[string]string{":message-type": "exception", ":exception-type": "throttlingException"}, []byte(`{"message":"slow down"}`))...)
+	err := (&bedrockTransport{}).events(strings.NewReader(string(stream)), func([]byte) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "throttlingException: slow down") {
+		t.Errorf("err = %v", err)
+	}
+
+	frame := eventFrame(map[string]string{":message-type": "event"}, []byte("x"))
+	frame[len(frame)-1] ^= 1
+	if _, err := readEventMessage(strings.NewReader(string(frame))); err == nil {
+		t.Error("corrupt frame accepted")
+	}
+}
+
+func TestVertexStream(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	var tokens int
+	var path, auth string
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokens++
+			r.ParseForm()
+			if err := verifyJWT(r.Form.Get("assertion"), &key.PublicKey); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"ya29.test","expires_in":3600,"token_type":"Bearer"}`)
+			return
+		}
+		path, auth = r.URL.Path, r.Header.Get("Authorization")
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &body)
+		for _, e := range cloudEvents {
+			fmt.Fprintf(w, "event: x\ndata: %s\n\n", e)
+		}
+	}))
+	defer srv.Close()
+
+	sa, _ := json.Marshal(serviceAccount{
+		Type:        "service_account",
+		ProjectID:   "my-project",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ClientEmail: "axe@my-project.iam.gserviceaccount.com",
+		TokenURI:    srv.URL + "/token",
+	})
+	file := filepath.Join(t.TempDir(), "sa.json")
+	os.WriteFile(file, sa, 0600)
+
+	m := &config.ModelConfig{Provider: "vertex", BaseURL: srv.URL, Region: "us-east5", CredentialsFile: file, Model: "claude-sonnet-4@20250514", MaxTokens: 100}
+	c := NewAnthropicClient(m, nil)
+	msgs := []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hello"}}}}
+	for i := 0; i < 2; i++ {
+		resp, err := c.SendStream(context.Background(), "sys", msgs, StreamCallbacks{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Content[0].Text != "hi" || resp.StopReason != "end_turn" {
+			t.Errorf("response = %+v", resp)
+		}
+	}
+	if tokens != 1 {
+		t.Errorf("token minted %d times, want once", tokens)
+	}
+	if path != "/v1/projects/my-project/locations/us-east5/publishers/anthropic/models/claude-sonnet-4@20250514:streamRawPredict" || auth != "Bearer ya29.test" {
+		t.Errorf("request to %s with %q", path, auth)
+	}
+	if body["anthropic_version"] != "vertex-2023-10-16" || body["model"] != nil || body["stream"] != true {
+		t.Errorf("body = %v", body)
+	}
+	if _, err := c.CountTokens(context.Background(), "", msgs); err != ErrCountUnsupported {
+		t.Errorf("CountTokens err = %v, want ErrCountUnsupported", err)
+	}
+}
+
+func verifyJWT(jwt string, key *rsa.PublicKey) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed jwt")
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return err
+	}
+	data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]any
+	json.Unmarshal(data, &claims)
+	if claims["scope"] != vertexScope || claims["iss"] != "axe@my-project.iam.gserviceaccount.com" {
+		return fmt.Errorf("claims = %v", claims)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrCountUnsupported is returned by Client.CountTokens when the active
+// provider can't count tokens server-side.
+var ErrCountUnsupported = errors.New("token counting not supported by provider")
+
+// TokenCounter is implemented by providers that can count a prompt's input
+// tokens exactly, without running the model.
+type TokenCounter interface {
+	CountTokens(ctx context.Context, system string, messages []Message) (int, error)
+}
+
+// CountTokens returns the exact input token count of system, the tools and
+// messages for the active provider.
+func (c *Client) CountTokens(ctx context.Context, system string, messages []Message) (int, error) {
+	if len(c.providers) == 0 {
+		return 0, ErrCountUnsupported
+	}
+	tc, ok := c.providers[c.activeIdx].(TokenCounter)
+	if !ok {
+		return 0, ErrCountUnsupported
+	}
+	return tc.CountTokens(ctx, system, messages)
+}
+
+// Tools returns the tool definitions sent with each request.
+func (c *Client) Tools() []ToolDef {
+	if len(c.providers) == 0 {
+		return nil
+	}
+	if t, ok := c.providers[c.activeIdx].(interface{ toolDefs() []ToolDef }); ok {
+		return t.toolDefs()
+	}
+	return nil
+}
+
+func (c *AnthropicClient) toolDefs() []ToolDef { return c.tools }
+func (c *OpenAIClient) toolDefs() []ToolDef    { return c.tools }
+
+// CountTokens uses the Messages API's count_tokens endpoint.
+func (c *AnthropicClient) CountTokens(ctx context.Context, system string, messages []Message) (int, error) {
+	if _, ok := c.transport.(directTransport); !ok {
+		return 0, ErrCountUnsupported
+	}
+	req := c.buildRequest(system, messages)
+	body, err := json.Marshal(struct {
+		Model    string          `json:"model"`
+		System   []SystemBlock   `json:"system,omitempty"`
+		Messages []Message       `json:"messages"`
+		Tools    []ToolDef       `json:"tools,omitempty"`
+		Thinking *ThinkingConfig `json:"thinking,omitempty"`
+	}{req.Model, req.System, req.Messages, req.Tools, req.Thinking})
+	if err != nil {
+		return 0, fmt.Errorf("marshal request: %w", err)
+	}
+
+	url := strings.TrimRight(c.model.BaseURL, "/") + "/v1/messages/count_tokens"
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", c.model.APIKey)
+	httpReq.Header.Set("anthropic-version", "2023-06-01")
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("count_tokens error (%d): %s", resp.StatusCode, string(data))
+	}
+	var result struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return 0, fmt.Errorf("parse response: %w", err)
+	}
+	return result.InputTokens, nil
+}
@@ -0,0 +1,73 @@
+package llm
+
+import "time"
+
+// RetryEvent is reported before a provider waits to retry a failed request.
+type RetryEvent struct {
+	Model   string
+	Attempt int        // 1-based
+	Status  int        // HTTP status that triggered the retry, 0 for network and stream errors
+	Class   ErrorClass // what failed
+	Wait    time.Duration
+}
+
+// FallbackEvent is reported when a provider fails and the client moves on
+// to the next one.
+type FallbackEvent struct {
+	From string
+	To   string
+	Err  error
+}
+
+// RecoveryEvent is reported when a stream breaks off after output was passed
+// on, before the request is sent again to the same model.
+type RecoveryEvent struct {
+	Model string
+	// Resumed is set when the model is asked to continue after the text
+	// passed on so far; otherwise that output is discarded and the request
+	// starts over.
+	Resumed bool
+	Err     error
+}
+
+// RouteEvent is reported when a request is routed to a model other than
+// the active one, or past models whose circuit breaker is open.
+type RouteEvent struct {
+	Task  Task
+	Model string
+	// Reason is what chose Model: "rule", "cheapest", "round-robin", or
+	// "breaker" when the active model was skipped.
+	Reason  string
+	Skipped []string // models skipped because their breaker is open
+}
+
+// OnRetry registers a hook called whenever any provider retries.
+func (c *Client) OnRetry(fn func(RetryEvent)) { c.onRetry = fn }
+
+// OnFallback registers a hook called when a request falls back to another provider.
+func (c *Client) OnFallback(fn func(FallbackEvent)) { c.onFallback = fn }
+
+func (c *Client) retried(e RetryEvent) {
+	if c.onRetry != nil {
+		c.onRetry(e)
+	}
+}
+
+// OnRecover registers a hook called when a broken stream is recovered.
+func (c *Client) OnRecover(fn func(RecoveryEvent)) { c.onRecover = fn }
+
+func (c *Client) recovered(e RecoveryEvent) {
+	if c.onRecover != nil {
+		c.onRecover(e)
+	}
+}
+
+// OnRoute registers a hook called when routing sends a request to a model
+// other than the active one.
+func (c *Client) OnRoute(fn func(RouteEvent)) { c.onRoute = fn }
+
+func (c *Client) routed(e RouteEvent) {
+	if c.onRoute != nil {
+		c.onRoute(e)
+	}
+}
@@ -0,0 +1,490 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/config"
+)
+
+// GeminiBaseURL is used when a gemini model has no base_url.
+const GeminiBaseURL = "https://generativelanguage.googleapis.com"
+
+// Gemini wire types
+
+type gemContent struct {
+	Role  string    `json:"role,omitempty"` // "user" or "model"
+	Parts []gemPart `json:"parts"`
+}
+
+type gemPart struct {
+	Text             string               `json:"text,omitempty"`
+	Thought          bool                 `json:"thought,omitempty"`
+	InlineData       *gemBlob             `json:"inlineData,omitempty"`
+	FileData         *gemFileData         `json:"fileData,omitempty"`
+	FunctionCall     *gemFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *gemFunctionResponse `json:"functionResponse,omitempty"`
+	// ThoughtSignature must be echoed back on the same part for the model
+	// to keep its reasoning across a tool loop.
+	ThoughtSignature string `json:"thoughtSignature,omitempty"`
+}
+
+type gemBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type gemFileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+type gemFunctionCall struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+	Args any    `json:"args,omitempty"`
+}
+
+type gemFunctionResponse struct {
+	ID       string         `json:"id,omitempty"`
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type gemTool struct {
+	FunctionDeclarations []gemFunctionDecl `json:"functionDeclarations"`
+}
+
+// gemFunctionDecl takes the schema as plain JSON Schema; the older
+// "parameters" field only accepts an OpenAPI subset.
+type gemFunctionDecl struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  any    `json:"parametersJsonSchema,omitempty"`
+}
+
+type gemThinkingConfig struct {
+	ThinkingBudget  int  `json:"thinkingBudget"`
+	IncludeThoughts bool `json:"includeThoughts"`
+}
+
+type gemGenerationConfig struct {
+	MaxOutputTokens int                `json:"maxOutputTokens,omitempty"`
+	ThinkingConfig  *gemThinkingConfig `json:"thinkingConfig,omitempty"`
+}
+
+type gemRequest struct {
+	Contents          []gemContent        `json:"contents"`
+	SystemInstruction *gemContent         `json:"systemInstruction,omitempty"`
+	Tools             []gemTool           `json:"tools,omitempty"`
+	GenerationConfig  gemGenerationConfig `json:"generationConfig"`
+}
+
+type gemUsage struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+}
+
+// toUsage converts to Usage. Gemini counts cached tokens inside the prompt
+// and thoughts outside the candidates; thoughts are billed as output.
+func (u gemUsage) toUsage() Usage {
+	return Usage{
+		InputTokens:          u.PromptTokenCount - u.CachedContentTokenCount,
+		OutputTokens:         u.CandidatesTokenCount + u.ThoughtsTokenCount,
+		CacheReadInputTokens: u.CachedContentTokenCount,
+		ReasoningTokens:      u.ThoughtsTokenCount,
+	}
+}
+
+type gemResponse struct {
+	ResponseID string `json:"responseId"`
+	Candidates []struct {
+		Content      gemContent `json:"content"`
+		FinishReason string     `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata *gemUsage `json:"usageMetadata"`
+}
+
+// Gemini client
+
+// GeminiClient implements Provider for the Gemini generateContent API.
+type GeminiClient struct {
+	model *config.ModelConfig
+	http  *http.Client
+	tools []ToolDef
+	retry *retrier
+}
+
+func NewGeminiClient(m *config.ModelConfig, tools []ToolDef) *GeminiClient {
+	return &GeminiClient{model: m, http: &http.Client{Timeout: 5 * time.Minute}, tools: tools}
+}
+
+func (c *GeminiClient) setTools(tools []ToolDef) { c.tools = tools }
+func (c *GeminiClient) toolDefs() []ToolDef      { return c.tools }
+
+func (c *GeminiClient) ModelName() string { return c.model.Model }
+
+func (c *GeminiClient) convertTools() []gemTool {
+	if len(c.tools) == 0 {
+		return nil
+	}
+	decls := make([]gemFunctionDecl, len(c.tools))
+	for i, t := range c.tools {
+		decls[i] = gemFunctionDecl{Name: t.Name, Description: t.Description, Parameters: t.InputSchema}
+	}
+	return []gemTool{{FunctionDeclarations: decls}}
+}
+
+// gemImagePart converts an image: inline data, or a file reference for URLs.
+func gemImagePart(src *ImageSource) gemPart {
+	if src.Type == "url" {
+		mime, _ := ImageMediaType(strings.SplitN(src.URL, "?", 2)[0])
+		return gemPart{FileData: &gemFileData{MimeType: mime, FileURI: src.URL}}
+	}
+	return gemPart{InlineData: &gemBlob{MimeType: src.MediaType, Data: src.Data}}
+}
+
+// convertMessages maps the history onto Gemini contents. Function responses
+// are matched to their calls by name, so the tool_use names are looked up by
+// ID. Thinking blocks are not sent back; their effect is carried by the
+// thought signatures on the parts that follow them.
+func (c *GeminiClient) convertMessages(messages []Message) []gemContent {
+	toolNames := map[string]string{}
+	var out []gemContent
+	for _, m := range messages {
+		content := gemContent{Role: "user"}
+		if m.Role == RoleAssistant {
+			content.Role = "model"
+		}
+		var images []gemPart // images in tool results go after the responses
+		for _, b := range m.Content {
+			switch b.Type {
+			case "text":
+				// a signature may stand alone in an empty part and must still go back
+				if b.Text != "" || b.Signature != "" {
+					content.Parts = append(content.Parts, gemPart{Text: b.Text, ThoughtSignature: b.Signature})
+				}
+			case "image":
+				if b.Source != nil {
+					content.Parts = append(content.Parts, gemImagePart(b.Source))
+				}
+			case "tool_use":
+				toolNames[b.ID] = b.Name
+				content.Parts = append(content.Parts, gemPart{
+					FunctionCall:     &gemFunctionCall{Name: b.Name, Args: b.Input},
+					ThoughtSignature: b.Signature,
+				})
+			case "tool_result":
+				resp := map[string]any{"output": b.Content}
+				if b.IsError {
+					resp = map[string]any{"error": b.Content}
+				}
+				content.Parts = append(content.Parts, gemPart{FunctionResponse: &gemFunctionResponse{Name: toolNames[b.ToolID], Response: resp}})
+				for _, p := range b.Parts {
+					if p.Type == "image" && p.Source != nil {
+						images = append(images, gemImagePart(p.Source))
+					}
+				}
+			}
+		}
+		content.Parts = append(content.Parts, images...)
+		if len(content.Parts) > 0 {
+			out = append(out, content)
+		}
+	}
+	return out
+}
+
+func (c *GeminiClient) newRequest(system string, messages []Message) gemRequest {
+	req := gemRequest{
+		Contents: c.convertMessages(messages),
+		Tools:    c.convertTools(),
+		GenerationConfig: gemGenerationConfig{
+			MaxOutputTokens: c.model.ClampOutput(c.model.MaxTokens),
+		},
+	}
+	if system != "" {
+		req.SystemInstruction = &gemContent{Parts: []gemPart{{Text: system}}}
+	}
+	if budget := c.model.ThinkingBudget; budget > 0 {
+		req.GenerationConfig.ThinkingConfig = &gemThinkingConfig{ThinkingBudget: budget, IncludeThoughts: true}
+		if req.GenerationConfig.MaxOutputTokens <= budget {
+			req.GenerationConfig.MaxOutputTokens = c.model.ClampOutput(budget + c.model.MaxTokens)
+		}
+	}
+	return req
+}
+
+// url returns the endpoint for method, e.g. "generateContent".
+func (c *GeminiClient) url(method string) string {
+	base := c.model.BaseURL
+	if base == "" {
+		base = GeminiBaseURL
+	}
+	return strings.TrimRight(base, "/") + "/v1beta/models/" + c.model.Model + ":" + method
+}
+
+func (c *GeminiClient) doRequest(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", c.model.APIKey)
+	return doHTTP(c.http, req)
+}
+
+// convertFinishReason maps Gemini's finish reasons onto Anthropic's stop
+// reasons. Gemini says STOP after function calls too.
+func convertFinishReason(reason string, hasToolUse bool) string {
+	switch {
+	case hasToolUse:
+		return "tool_use"
+	case reason == "STOP":
+		return "end_turn"
+	case reason == "MAX_TOKENS":
+		return "max_tokens"
+	default:
+		return strings.ToLower(reason)
+	}
+}
+
+// toolCallID returns an ID for a function call that came without one. IDs
+// only need to be unique within the history.
+func toolCallID(responseID string, i int) string {
+	if responseID == "" {
+		responseID = fmt.Sprint(time.Now().UnixNano())
+	}
+	return fmt.Sprintf("call_%s_%d", responseID, i)
+}
+
+func (c *GeminiClient) parseResponse(gr *gemResponse) *Response {
+	resp := &Response{ID: gr.ResponseID, Role: RoleAssistant}
+	if gr.UsageMetadata != nil {
+		resp.Usage = gr.UsageMetadata.toUsage()
+	}
+	if len(gr.Candidates) == 0 {
+		return resp
+	}
+	cand := gr.Candidates[0]
+	hasToolUse := false
+	for _, p := range cand.Content.Parts {
+		switch {
+		case p.FunctionCall != nil:
+			hasToolUse = true
+			id := p.FunctionCall.ID
+			if id == "" {
+				id = toolCallID(gr.ResponseID, len(resp.Content))
+			}
+			resp.Content = append(resp.Content, ContentBlock{Type: "tool_use", ID: id, Name: p.FunctionCall.Name, Input: p.FunctionCall.Args, Signature: p.ThoughtSignature})
+		case p.Thought:
+			resp.Content = append(resp.Content, ContentBlock{Type: "thinking", Thinking: p.Text})
+		case p.Text != "" || p.ThoughtSignature != "":
+			// a lone signature belongs to the text before it, as in readStream
+			if n := len(resp.Content); p.Text == "" && n > 0 && resp.Content[n-1].Type == "text" && resp.Content[n-1].Signature == "" {
+				resp.Content[n-1].Signature = p.ThoughtSignature
+				continue
+			}
+			resp.Content = append(resp.Content, ContentBlock{Type: "text", Text: p.Text, Signature: p.ThoughtSignature})
+		}
+	}
+	resp.StopReason = convertFinishReason(cand.FinishReason, hasToolUse)
+	return resp
+}
+
+// checkVision refuses images for models known not to take them; see
+// visionMessages.
+func (c *GeminiClient) checkVision(messages []Message) ([]Message, error) {
+	return visionMessages(c.model.Model, c.model.SupportsVision(), messages)
+}
+
+func (c *GeminiClient) Send(ctx context.Context, system string, messages []Message) (*Response, error) {
+	messages, err := c.checkVision(messages)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(c.newRequest(system, messages))
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+	return retryCall(ctx, c.retry, c.model.Model, nil, func() (*Response, error) {
+		resp, err := c.doRequest(ctx, c.url("generateContent"), body)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, networkError("read response", err)
+		}
+		var gr gemResponse
+		if err := json.Unmarshal(data, &gr); err != nil {
+			return nil, fmt.Errorf("parse response: %w", err)
+		}
+		return c.parseResponse(&gr), nil
+	})
+}
+
+func (c *GeminiClient) SendStream(ctx context.Context, system string, messages []Message, cb StreamCallbacks) (*Response, error) {
+	messages, err := c.checkVision(messages)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(c.newRequest(system, messages))
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+	url := c.url("streamGenerateContent") + "?alt=sse"
+	cb, started := watchStream(cb)
+	return retryCall(ctx, c.retry, c.model.Model, started, func() (*Response, error) {
+		resp, err := c.doRequest(ctx, url, body)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return c.readStream(resp.Body, cb)
+	})
+}
+
+// readStream assembles a response from streamed generateContent chunks.
+func (c *GeminiClient) readStream(body io.Reader, cb StreamCallbacks) (*Response, error) {
+	result := &Response{Role: RoleAssistant}
+	// text and thoughts arrive in pieces and are merged into the open
+	// block of the same kind; function calls arrive whole.
+	open := -1
+	closeOpen := func() {
+		if open >= 0 && cb.OnBlockStop != nil {
+			cb.OnBlockStop(open)
+		}
+		open = -1
+	}
+	startBlock := func(b ContentBlock) int {
+		closeOpen()
+		idx := len(result.Content)
+		result.Content = append(result.Content, b)
+		if cb.OnBlockStart != nil {
+			cb.OnBlockStart(idx, b)
+		}
+		return idx
+	}
+	finishReason := ""
+	hasToolUse := false
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		data := []byte(strings.TrimPrefix(line, "data: "))
+		if err := streamError(data); err != nil {
+			return result, err
+		}
+		var chunk gemResponse
+		if json.Unmarshal(data, &chunk) != nil {
+			continue
+		}
+		if result.ID == "" {
+			result.ID = chunk.ResponseID
+		}
+		if chunk.UsageMetadata != nil {
+			result.Usage = chunk.UsageMetadata.toUsage()
+		}
+		if len(chunk.Candidates) == 0 {
+			continue
+		}
+		cand := chunk.Candidates[0]
+		if cand.FinishReason != "" {
+			finishReason = cand.FinishReason
+		}
+		for _, p := range cand.Content.Parts {
+			switch {
+			case p.FunctionCall != nil:
+				hasToolUse = true
+				id := p.FunctionCall.ID
+				if id == "" {
+					id = toolCallID(result.ID, len(result.Content))
+				}
+				idx := startBlock(ContentBlock{Type: "tool_use", ID: id, Name: p.FunctionCall.Name, Input: p.FunctionCall.Args, Signature: p.ThoughtSignature})
+				if cb.OnInputJSONDelta != nil {
+					args, _ := json.Marshal(p.FunctionCall.Args)
+					cb.OnInputJSONDelta(idx, string(args))
+				}
+				open = idx
+				closeOpen()
+			case p.Thought:
+				if open < 0 || result.Content[open].Type != "thinking" {
+					open = startBlock(ContentBlock{Type: "thinking"})
+				}
+				result.Content[open].Thinking += p.Text
+				if cb.OnThinkingDelta != nil && p.Text != "" {
+					cb.OnThinkingDelta(p.Text)
+				}
+			case p.Text != "" || p.ThoughtSignature != "":
+				if open < 0 || result.Content[open].Type != "text" {
+					open = startBlock(ContentBlock{Type: "text"})
+				}
+				result.Content[open].Text += p.Text
+				if p.ThoughtSignature != "" {
+					result.Content[open].Signature = p.ThoughtSignature
+				}
+				if cb.OnTextDelta != nil && p.Text != "" {
+					cb.OnTextDelta(p.Text)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, networkError("read stream", err)
+	}
+	// the last chunk carries the finish reason
+	if finishReason == "" {
+		return result, truncated()
+	}
+	closeOpen()
+	result.StopReason = convertFinishReason(finishReason, hasToolUse)
+
+	if cb.OnMessageDone != nil {
+		cb.OnMessageDone(result)
+	}
+	return result, nil
+}
+
+// CountTokens uses the countTokens endpoint.
+func (c *GeminiClient) CountTokens(ctx context.Context, system string, messages []Message) (int, error) {
+	req := c.newRequest(system, messages)
+	body, err := json.Marshal(map[string]any{"generateContentRequest": struct {
+		Model string `json:"model"`
+		gemRequest
+	}{"models/" + c.model.Model, req}})
+	if err != nil {
+		return 0, fmt.Errorf("marshal request: %w", err)
+	}
+	resp, err := c.doRequest(ctx, c.url("countTokens"), body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("read response: %w", err)
+	}
+	var out struct {
+		TotalTokens int `json:"totalTokens"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return 0, fmt.Errorf("parse response: %w", err)
+	}
+	return out.TotalTokens, nil
+}
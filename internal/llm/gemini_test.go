@@ -0,0 +1,197 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Lewis-404/axe/internal/config"
+)
+
+// geminiServer serves canned responses and records the last request.
+type geminiServer struct {
+	*httptest.Server
+	path, key, query string
+	body             map[string]any
+}
+
+func newGeminiServer(t *testing.T, events []string) *geminiServer {
+	t.Helper()
+	s := &geminiServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.path, s.key, s.query = r.URL.Path, r.Header.Get("x-goog-api-key"), r.URL.RawQuery
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &s.body)
+		if r.URL.Query().Get("alt") != "sse" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, events[len(events)-1])
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range events {
+			fmt.Fprintf(w, "data: %s\r\n\r\n", e)
+		}
+	}))
+	return s
+}
+
+func TestGeminiStream(t *testing.T) {
+	srv := newGeminiServer(t, []string{
+		`{"responseId":"r1","candidates":[{"content":{"role":"model","parts":[{"text":"checking the ","thought":true}]}}]}`,
+		`{"responseId":"r1","candidates":[{"content":{"role":"model","parts":[{"text":"file","thought":true}]}}]}`,
+		`{"responseId":"r1","candidates":[{"content":{"role":"model","parts":[{"text":"Let me "},{"text":"look."}]}}]}`,
+		`{"responseId":"r1","candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"read_file","args":{"path":"go.mod"}},"thoughtSignature":"sig1"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":120,"candidatesTokenCount":30,"cachedContentTokenCount":100,"thoughtsTokenCount":12}}`,
+	})
+	defer srv.Close()
+
+	tools := []ToolDef{{Name: "read_file", Description: "Read a file", InputSchema: map[string]any{"type": "object"}}}
+	c := NewGeminiClient(&config.ModelConfig{Provider: "gemini", APIKey: "k", BaseURL: srv.URL, Model: "gemini-2.5-pro", MaxTokens: 100}, tools)
+	var text, thinking string
+	var inputs []string
+	resp, err := c.SendStream(context.Background(), "sys", []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hi"}}}}, StreamCallbacks{
+		OnTextDelta:      func(s string) { text += s },
+		OnThinkingDelta:  func(s string) { thinking += s },
+		OnInputJSONDelta: func(idx int, s string) { inputs = append(inputs, fmt.Sprint(idx, s)) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.path != "/v1beta/models/gemini-2.5-pro:streamGenerateContent" || srv.query != "alt=sse" || srv.key != "k" {
+		t.Errorf("request to %s?%s with key %q", srv.path, srv.query, srv.key)
+	}
+	if text != "Let me look." || thinking != "checking the file" {
+		t.Errorf("text = %q, thinking = %q", text, thinking)
+	}
+	if len(resp.Content) != 3 || resp.Content[0].Type != "thinking" || resp.Content[1].Text != "Let me look." {
+		t.Fatalf("content = %+v", resp.Content)
+	}
+	call := resp.Content[2]
+	if call.Type != "tool_use" || call.Name != "read_file" || call.ID == "" || call.Signature != "sig1" || call.Input.(map[string]any)["path"] != "go.mod" {
+		t.Errorf("tool_use = %+v", call)
+	}
+	if len(inputs) != 1 || inputs[0] != `2{"path":"go.mod"}` {
+		t.Errorf("input deltas = %v", inputs)
+	}
+	if resp.StopReason != "tool_use" {
+		t.Errorf("stop reason = %q", resp.StopReason)
+	}
+	want := Usage{InputTokens: 20, OutputTokens: 42, CacheReadInputTokens: 100, ReasoningTokens: 12}
+	if resp.Usage != want {
+		t.Errorf("usage = %+v, want %+v", resp.Usage, want)
+	}
+
+	sys, _ := srv.body["systemInstruction"].(map[string]any)
+	if parts, _ := sys["parts"].([]any); len(parts) != 1 {
+		t.Errorf("systemInstruction = %v", srv.body["systemInstruction"])
+	}
+	decls := srv.body["tools"].([]any)[0].(map[string]any)["functionDeclarations"].([]any)
+	if decl := decls[0].(map[string]any); decl["name"] != "read_file" || decl["parametersJsonSchema"] == nil {
+		t.Errorf("function declaration = %v", decl)
+	}
+}
+
+func TestGeminiToolLoop(t *testing.T) {
+	srv := newGeminiServer(t, []string{
+		`{"responseId":"r2","candidates":[{"content":{"role":"model","parts":[{"text":"It is a Go module."}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":50,"candidatesTokenCount":6}}`,
+	})
+	defer srv.Close()
+
+	c := NewGeminiClient(&config.ModelConfig{Provider: "gemini", APIKey: "k", BaseURL: srv.URL, Model: "gemini-2.5-flash", MaxTokens: 100}, nil)
+	msgs := []Message{
+		{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "what is this?"}}},
+		{Role: RoleAssistant, Content: []ContentBlock{
+			{Type: "thinking", Thinking: "look first"},
+			{Type: "tool_use", ID: "call_1", Name: "read_file", Input: map[string]any{"path": "go.mod"}, Signature: "sig1"},
+		}},
+		{Role: RoleUser, Content: []ContentBlock{
+			{Type: "tool_result", ToolID: "call_1", Content: "module x", Parts: []ContentBlock{ImageBlock("image/png", []byte("png"))}},
+		}},
+	}
+	resp, err := c.Send(context.Background(), "", msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.path != "/v1beta/models/gemini-2.5-flash:generateContent" {
+		t.Errorf("path = %s", srv.path)
+	}
+	if resp.StopReason != "end_turn" || resp.Content[0].Text != "It is a Go module." || resp.Usage.InputTokens != 50 {
+		t.Errorf("response = %+v", resp)
+	}
+
+	contents := srv.body["contents"].([]any)
+	if len(contents) != 3 {
+		t.Fatalf("contents = %v", contents)
+	}
+	model := contents[1].(map[string]any)
+	if model["role"] != "model" {
+		t.Errorf("assistant role = %v", model["role"])
+	}
+	modelParts := model["parts"].([]any)
+	if len(modelParts) != 1 {
+		t.Fatalf("thinking should not be sent back: %v", modelParts)
+	}
+	if p := modelParts[0].(map[string]any); p["thoughtSignature"] != "sig1" || p["functionCall"].(map[string]any)["name"] != "read_file" {
+		t.Errorf("function call part = %v", p)
+	}
+	parts := contents[2].(map[string]any)["parts"].([]any)
+	fr := parts[0].(map[string]any)["functionResponse"].(map[string]any)
+	if fr["name"] != "read_file" || fr["response"].(map[string]any)["output"] != "module x" {
+		t.Errorf("function response = %v", fr)
+	}
+	if img, _ := parts[1].(map[string]any)["inlineData"].(map[string]any); img["mimeType"] != "image/png" || img["data"] != "cG5n" {
+		t.Errorf("tool image = %v", parts[1])
+	}
+}
+
+func TestAnthropicDropsForeignSignatures(t *testing.T) {
+	msgs := []Message{{Role: RoleAssistant, Content: []ContentBlock{
+		{Type: "thinking", Thinking: "t", Signature: "anthropic"},
+		{Type: "tool_use", ID: "call_1", Name: "x", Signature: "gemini"},
+	}}}
+	out := wireMessages(msgs)
+	if out[0].Content[0].Signature != "anthropic" || out[0].Content[1].Signature != "" {
+		t.Errorf("wire blocks = %+v", out[0].Content)
+	}
+	if msgs[0].Content[1].Signature != "gemini" {
+		t.Error("history was modified")
+	}
+}
+
+func TestGeminiLoneSignature(t *testing.T) {
+	srv := newGeminiServer(t, []string{
+		`{"responseId":"r3","candidates":[{"content":{"role":"model","parts":[{"text":"Done."},{"thoughtSignature":"sig2"}]},"finishReason":"STOP"}]}`,
+	})
+	defer srv.Close()
+	c := NewGeminiClient(&config.ModelConfig{Provider: "gemini", APIKey: "k", BaseURL: srv.URL, Model: "gemini-2.5-pro", MaxTokens: 100}, nil)
+	user := Message{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "go"}}}
+	resp, err := c.Send(context.Background(), "", []Message{user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Content) != 1 || resp.Content[0].Text != "Done." || resp.Content[0].Signature != "sig2" {
+		t.Fatalf("content = %+v, want the signature on the text", resp.Content)
+	}
+
+	// a signature after a call has no text to join, and still goes back
+	history := []Message{user, {Role: RoleAssistant, Content: []ContentBlock{
+		{Type: "tool_use", ID: "call_1", Name: "x", Input: map[string]any{}},
+		{Type: "text", Signature: "sig3"},
+	}}}
+	if _, err := c.Send(context.Background(), "", history); err != nil {
+		t.Fatal(err)
+	}
+	parts := srv.body["contents"].([]any)[1].(map[string]any)["parts"].([]any)
+	if len(parts) != 2 || parts[1].(map[string]any)["thoughtSignature"] != "sig3" {
+		t.Errorf("model parts = %v", parts)
+	}
+
+	// Anthropic gets neither the signature nor the empty text
+	out := wireMessages(history)
+	if len(out[1].Content) != 1 || out[1].Content[0].Type != "tool_use" {
+		t.Errorf("wire blocks = %+v", out[1].Content)
+	}
+}
@@ -2,6 +2,8 @@ package llm
 
 import (
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -16,6 +18,100 @@ var imageExts = map[string]string{
 	".webp": "image/webp",
 }
 
+// MaxImageBytes is the largest image the providers accept (Anthropic: 5 MB).
+const MaxImageBytes = 5 << 20
+
+// ImageMediaType returns the media type of an image file by extension.
+func ImageMediaType(path string) (string, bool) {
+	mime, ok := imageExts[strings.ToLower(filepath.Ext(path))]
+	return mime, ok
+}
+
+// ImageBlock returns an image content block with data inlined as base64.
+func ImageBlock(mediaType string, data []byte) ContentBlock {
+	return ContentBlock{
+		Type: "image",
+		Source: &ImageSource{
+			Type:      "base64",
+			MediaType: mediaType,
+			Data:      base64.StdEncoding.EncodeToString(data),
+		},
+	}
+}
+
+// DataURL returns src as a data: URL, the form OpenAI takes inline images
+// in, or the URL of a remote image.
+func (src *ImageSource) DataURL() string {
+	if src.Type == "url" {
+		return src.URL
+	}
+	return "data:" + src.MediaType + ";base64," + src.Data
+}
+
+// ErrNoVision is returned when images are sent to a model without vision.
+var ErrNoVision = errors.New("model does not support image input")
+
+// hasImages reports whether any message carries an image, directly or in a
+// tool result.
+func hasImages(messages []Message) bool {
+	for _, m := range messages {
+		for _, b := range m.Content {
+			if b.Type == "image" || len(b.Parts) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newImages reports whether the last message, the one a request is about,
+// carries an image.
+func newImages(messages []Message) bool {
+	return len(messages) > 0 && hasImages(messages[len(messages)-1:])
+}
+
+// imageOmitted stands in for an earlier image sent to a model without vision.
+const imageOmitted = "[image omitted: this model cannot view images]"
+
+// visionMessages prepares messages for a model, refusing images in the last
+// message, the one the request is about, when the model has no vision.
+// Images earlier in the history are replaced with imageOmitted instead, so
+// one old screenshot doesn't shut non-vision models out of the session.
+func visionMessages(model string, vision bool, messages []Message) ([]Message, error) {
+	if vision || !hasImages(messages) {
+		return messages, nil
+	}
+	if newImages(messages) {
+		return nil, fmt.Errorf("%w: %s (switch to a vision model with /model, or set vision: true in its config)", ErrNoVision, model)
+	}
+	return withoutImages(messages), nil
+}
+
+// withoutImages returns a copy of messages with images, and those in tool
+// results, replaced by imageOmitted.
+func withoutImages(messages []Message) []Message {
+	out := make([]Message, len(messages))
+	copy(out, messages)
+	for i, m := range out {
+		if !hasImages(out[i : i+1]) {
+			continue
+		}
+		content := make([]ContentBlock, 0, len(m.Content))
+		for _, b := range m.Content {
+			switch {
+			case b.Type == "image":
+				b = ContentBlock{Type: "text", Text: imageOmitted}
+			case len(b.Parts) > 0:
+				b.Parts = nil
+				b.Content += "\n" + imageOmitted
+			}
+			content = append(content, b)
+		}
+		out[i].Content = content
+	}
+	return out
+}
+
 func expandHome(path string) string {
 	if strings.HasPrefix(path, "~/") {
 		if home, err := os.UserHomeDir(); err == nil {
@@ -29,10 +125,14 @@ func expandHome(path string) string {
 // Uses .+? (non-greedy) to support spaces, CJK chars, parens, etc.
 var imagePathRe = regexp.MustCompile(`(?:\./|~?/).+?\.(?:png|jpg|jpeg|gif|webp)\b`)
 
-// ParseImageBlocks extracts image file paths from input, returns image blocks + remaining text
+// imageURLRe matches http(s) URLs of images, with an optional query string.
+var imageURLRe = regexp.MustCompile(`https?://[^\s"'<>]+?\.(?:png|jpg|jpeg|gif|webp)(?:\?[^\s"'<>]*)?\b`)
+
+// ParseImageBlocks extracts image file paths and URLs from input, returns image blocks + remaining text
 func ParseImageBlocks(input string) ([]ContentBlock, string) {
 	locs := imagePathRe.FindAllStringIndex(input, -1)
-	if len(locs) == 0 {
+	urls := imageURLRe.FindAllString(input, -1)
+	if len(locs) == 0 && len(urls) == 0 {
 		return nil, input
 	}
 
@@ -49,21 +149,17 @@ func ParseImageBlocks(input string) ([]ContentBlock, string) {
 		if err != nil {
 			continue
 		}
-		ext := strings.ToLower(filepath.Ext(m))
-		mime, ok := imageExts[ext]
+		mime, ok := ImageMediaType(m)
 		if !ok {
 			continue
 		}
-		blocks = append(blocks, ContentBlock{
-			Type: "image",
-			Source: &ImageSource{
-				Type:      "base64",
-				MediaType: mime,
-				Data:      base64.StdEncoding.EncodeToString(data),
-			},
-		})
+		blocks = append(blocks, ImageBlock(mime, data))
 		remaining = strings.Replace(remaining, m, "", 1)
 	}
+	for _, u := range urls {
+		blocks = append(blocks, ContentBlock{Type: "image", Source: &ImageSource{Type: "url", URL: u}})
+		remaining = strings.Replace(remaining, u, "", 1)
+	}
 
 	remaining = strings.TrimSpace(remaining)
 	return blocks, remaining
@@ -0,0 +1,602 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/config"
+)
+
+// Prompt-based tool protocol, for models without native function calling.
+// The model is told to write each call as a JSON object between these tags;
+// the agent turns them into tool_use blocks (Response.EmulatedTools), and
+// past calls and results are replayed to the model in the same form.
+const (
+	ToolCallOpen  = "<tool_call>"
+	ToolCallClose = "</tool_call>"
+)
+
+const toolProtocolPrompt = `
+
+# Tools
+
+You can call the tools below. To call one, write a JSON object with "name" and "input" between <tool_call> and </tool_call> tags, for example:
+
+<tool_call>
+{"name": "read_file", "input": {"path": "main.go"}}
+</tool_call>
+
+You may make several calls in one reply. After your calls, stop and wait: the results come back in <tool_result> tags in the next message. Never write <tool_result> yourself. If you do not need a tool, just answer.
+
+Available tools:
+`
+
+// Ollama wire types
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Thinking  string           `json:"thinking,omitempty"`
+	Images    []string         `json:"images,omitempty"` // base64
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string `json:"name"`
+		Arguments any    `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Tools    []oaiTool       `json:"tools,omitempty"`
+	Stream   bool            `json:"stream"`
+	Think    bool            `json:"think,omitempty"`
+	Options  map[string]any  `json:"options,omitempty"`
+}
+
+type ollamaResponse struct {
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+// Ollama client
+
+// OllamaClient implements Provider for a local Ollama server's /api/chat.
+// Models without the "tools" capability get the prompt-based protocol.
+type OllamaClient struct {
+	model *config.ModelConfig
+	http  *http.Client
+	tools []ToolDef
+	retry *retrier
+
+	capsOnce sync.Once
+	caps     []string // from /api/show; nil if unknown
+	emulate  bool     // set once a native request was refused
+}
+
+func NewOllamaClient(m *config.ModelConfig, tools []ToolDef) *OllamaClient {
+	return &OllamaClient{model: m, http: &http.Client{Timeout: 10 * time.Minute}, tools: tools}
+}
+
+func (c *OllamaClient) setTools(tools []ToolDef) { c.tools = tools }
+func (c *OllamaClient) toolDefs() []ToolDef      { return c.tools }
+
+func (c *OllamaClient) ModelName() string { return c.model.Model }
+
+func (c *OllamaClient) baseURL() string {
+	if c.model.BaseURL != "" {
+		return strings.TrimRight(c.model.BaseURL, "/")
+	}
+	return config.OllamaHost()
+}
+
+// capabilities asks the server what the model can do, once.
+func (c *OllamaClient) capabilities(ctx context.Context) []string {
+	c.capsOnce.Do(func() {
+		body, _ := json.Marshal(map[string]string{"model": c.model.Model})
+		req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL()+"/api/show", bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		var show struct {
+			Capabilities []string `json:"capabilities"`
+		}
+		if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&show) == nil {
+			c.caps = show.Capabilities
+		}
+	})
+	return c.caps
+}
+
+// emulateTools reports whether tools go through the prompt protocol:
+// tool_mode "prompt", or auto with a model that lacks the tools capability.
+func (c *OllamaClient) emulateTools(ctx context.Context) bool {
+	switch c.model.ToolMode {
+	case config.ToolModeNative:
+		return false
+	case config.ToolModePrompt:
+		return true
+	}
+	if c.emulate {
+		return true
+	}
+	caps := c.capabilities(ctx)
+	return caps != nil && !slices.Contains(caps, "tools")
+}
+
+func (c *OllamaClient) checkVision(ctx context.Context, messages []Message) ([]Message, error) {
+	if !hasImages(messages) {
+		return messages, nil
+	}
+	supported := c.model.SupportsVision()
+	if c.model.Vision == nil {
+		if caps := c.capabilities(ctx); caps != nil {
+			supported = slices.Contains(caps, "vision")
+		}
+	}
+	return visionMessages(c.model.Model, supported, messages)
+}
+
+// ollamaImages returns the base64 data of inline images; Ollama takes no URLs.
+func ollamaImages(blocks []ContentBlock) (images []string, notes []string) {
+	for _, b := range blocks {
+		if b.Type != "image" || b.Source == nil {
+			continue
+		}
+		if b.Source.Type == "url" {
+			notes = append(notes, "[image not sent, remote URLs are not supported: "+b.Source.URL+"]")
+		} else {
+			images = append(images, b.Source.Data)
+		}
+	}
+	return images, notes
+}
+
+// formatToolCall renders a call in the prompt protocol.
+func formatToolCall(b ContentBlock) string {
+	call, _ := json.Marshal(map[string]any{"name": b.Name, "input": b.Input})
+	return ToolCallOpen + "\n" + string(call) + "\n" + ToolCallClose
+}
+
+// formatToolResult renders a result in the prompt protocol.
+func formatToolResult(name string, b ContentBlock) string {
+	attrs := fmt.Sprintf("name=%q", name)
+	if b.IsError {
+		attrs += ` error="true"`
+	}
+	return "<tool_result " + attrs + ">\n" + b.Content + "\n</tool_result>"
+}
+
+func (c *OllamaClient) convertMessages(system string, messages []Message, emulate bool) []ollamaMessage {
+	var out []ollamaMessage
+	if emulate && len(c.tools) > 0 {
+		system += toolProtocolPrompt
+		for _, t := range c.tools {
+			schema, _ := json.Marshal(t.InputSchema)
+			system += fmt.Sprintf("\n- %s: %s\n  input schema: %s", t.Name, t.Description, schema)
+		}
+	}
+	if system != "" {
+		out = append(out, ollamaMessage{Role: "system", Content: system})
+	}
+	toolNames := map[string]string{}
+	for _, m := range messages {
+		msg := ollamaMessage{Role: string(m.Role)}
+		var text []string
+		var resultImages []ContentBlock
+		for _, b := range m.Content {
+			switch b.Type {
+			case "text":
+				if b.Text != "" {
+					text = append(text, b.Text)
+				}
+			case "thinking":
+				msg.Thinking += b.Thinking
+			case "tool_use":
+				toolNames[b.ID] = b.Name
+				if emulate {
+					text = append(text, formatToolCall(b))
+					continue
+				}
+				var call ollamaToolCall
+				call.Function.Name, call.Function.Arguments = b.Name, b.Input
+				msg.ToolCalls = append(msg.ToolCalls, call)
+			case "tool_result":
+				resultImages = append(resultImages, b.Parts...)
+				if emulate {
+					text = append(text, formatToolResult(toolNames[b.ToolID], b))
+					continue
+				}
+				out = append(out, ollamaMessage{Role: "tool", Content: b.Content, ToolName: toolNames[b.ToolID]})
+			}
+		}
+		images, notes := ollamaImages(m.Content)
+		msg.Images = images
+		msg.Content = strings.Join(append(text, notes...), "\n\n")
+		if msg.Content != "" || msg.Thinking != "" || len(msg.Images) > 0 || len(msg.ToolCalls) > 0 {
+			out = append(out, msg)
+		}
+		// tool messages carry no images: they follow as a user message
+		if images, notes := ollamaImages(resultImages); len(images)+len(notes) > 0 {
+			out = append(out, ollamaMessage{Role: "user", Content: strings.Join(append([]string{"Images from the tool results above."}, notes...), "\n"), Images: images})
+		}
+	}
+	return out
+}
+
+func (c *OllamaClient) newRequest(system string, messages []Message, stream, emulate bool) ollamaRequest {
+	req := ollamaRequest{
+		Model:    c.model.Model,
+		Messages: c.convertMessages(system, messages, emulate),
+		Stream:   stream,
+		Think:    c.model.ThinkingBudget > 0,
+		Options:  map[string]any{"num_predict": c.model.ClampOutput(c.model.MaxTokens)},
+	}
+	// Ollama's default context is small and silently truncates the prompt;
+	// a configured window is passed on, the built-in default is not.
+	if c.model.ContextWindow > 0 {
+		req.Options["num_ctx"] = c.model.ContextWindow
+	}
+	if !emulate {
+		req.Tools = oaiTools(c.tools)
+	}
+	return req
+}
+
+// errToolsUnsupported matches Ollama's refusal of tools for a model.
+func errToolsUnsupported(status int, body string) bool {
+	return status == http.StatusBadRequest && strings.Contains(body, "does not support tools")
+}
+
+// post sends the chat request, switching to the prompt protocol once if
+// the server refuses native tools for this model.
+func (c *OllamaClient) post(ctx context.Context, system string, messages []Message, stream bool) (*http.Response, bool, error) {
+	emulate := c.emulateTools(ctx)
+	for {
+		body, err := json.Marshal(c.newRequest(system, messages, stream, emulate))
+		if err != nil {
+			return nil, false, fmt.Errorf("marshal request: %w", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL()+"/api/chat", bytes.NewReader(body))
+		if err != nil {
+			return nil, false, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, false, networkError("send request", err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, emulate, nil
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !emulate && len(c.tools) > 0 && c.model.ToolMode == "" && errToolsUnsupported(resp.StatusCode, string(data)) {
+			c.emulate, emulate = true, true
+			continue
+		}
+		return nil, false, newAPIError(resp.StatusCode, resp.Header, data)
+	}
+}
+
+func (c *OllamaClient) usage(r *ollamaResponse) Usage {
+	return Usage{InputTokens: r.PromptEvalCount, OutputTokens: r.EvalCount}
+}
+
+func ollamaStopReason(reason string, hasToolUse bool) string {
+	switch {
+	case hasToolUse:
+		return "tool_use"
+	case reason == "length":
+		return "max_tokens"
+	default:
+		return "end_turn"
+	}
+}
+
+func (c *OllamaClient) toolUses(calls []ollamaToolCall, first int) []ContentBlock {
+	var blocks []ContentBlock
+	for i, tc := range calls {
+		blocks = append(blocks, ContentBlock{Type: "tool_use", ID: toolCallID("", first+i), Name: tc.Function.Name, Input: tc.Function.Arguments})
+	}
+	return blocks
+}
+
+func (c *OllamaClient) Send(ctx context.Context, system string, messages []Message) (*Response, error) {
+	messages, err := c.checkVision(ctx, messages)
+	if err != nil {
+		return nil, err
+	}
+	return retryCall(ctx, c.retry, c.model.Model, nil, func() (*Response, error) {
+		resp, emulate, err := c.post(ctx, system, messages, false)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, networkError("read response", err)
+		}
+		return c.parseResponse(data, emulate)
+	})
+}
+
+func (c *OllamaClient) parseResponse(data []byte, emulate bool) (*Response, error) {
+	if err := streamError(data); err != nil {
+		return nil, err
+	}
+	var or ollamaResponse
+	if err := json.Unmarshal(data, &or); err != nil {
+		return nil, fmt.Errorf("parse response: %w", err)
+	}
+	result := &Response{Role: RoleAssistant, Usage: c.usage(&or), EmulatedTools: emulate}
+	if or.Message.Thinking != "" {
+		result.Content = append(result.Content, ContentBlock{Type: "thinking", Thinking: or.Message.Thinking})
+	}
+	if or.Message.Content != "" {
+		result.Content = append(result.Content, ContentBlock{Type: "text", Text: or.Message.Content})
+	}
+	result.Content = append(result.Content, c.toolUses(or.Message.ToolCalls, len(result.Content))...)
+	result.StopReason = ollamaStopReason(or.DoneReason, len(or.Message.ToolCalls) > 0)
+	return result, nil
+}
+
+func (c *OllamaClient) SendStream(ctx context.Context, system string, messages []Message, cb StreamCallbacks) (*Response, error) {
+	messages, err := c.checkVision(ctx, messages)
+	if err != nil {
+		return nil, err
+	}
+	cb, started := watchStream(cb)
+	return retryCall(ctx, c.retry, c.model.Model, started, func() (*Response, error) {
+		resp, emulate, err := c.post(ctx, system, messages, true)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return c.readStream(resp.Body, emulate, cb)
+	})
+}
+
+// readStream assembles a response from streamed /api/chat chunks.
+func (c *OllamaClient) readStream(body io.Reader, emulate bool, cb StreamCallbacks) (*Response, error) {
+	result := &Response{Role: RoleAssistant, EmulatedTools: emulate}
+	// emulated calls are parsed by the agent from the full text; they are
+	// not echoed while streaming
+	onText := cb.OnTextDelta
+	var hide *tagFilter
+	if emulate && onText != nil {
+		hide = &tagFilter{tag: ToolCallOpen, emit: onText}
+		onText = hide.write
+	}
+	open := -1
+	closeOpen := func() {
+		if open >= 0 && cb.OnBlockStop != nil {
+			cb.OnBlockStop(open)
+		}
+		open = -1
+	}
+	appendTo := func(kind string) int {
+		if open >= 0 && result.Content[open].Type == kind {
+			return open
+		}
+		closeOpen()
+		open = len(result.Content)
+		result.Content = append(result.Content, ContentBlock{Type: kind})
+		if cb.OnBlockStart != nil {
+			cb.OnBlockStart(open, result.Content[open])
+		}
+		return open
+	}
+	var calls []ollamaToolCall
+	done := false
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var chunk ollamaResponse
+		if json.Unmarshal(scanner.Bytes(), &chunk) != nil {
+			continue
+		}
+		if err := streamError(scanner.Bytes()); err != nil {
+			return result, err
+		}
+		if t := chunk.Message.Thinking; t != "" {
+			idx := appendTo("thinking")
+			result.Content[idx].Thinking += t
+			if cb.OnThinkingDelta != nil {
+				cb.OnThinkingDelta(t)
+			}
+		}
+		if t := chunk.Message.Content; t != "" {
+			idx := appendTo("text")
+			result.Content[idx].Text += t
+			if onText != nil {
+				onText(t)
+			}
+		}
+		calls = append(calls, chunk.Message.ToolCalls...)
+		if chunk.Done {
+			result.Usage = c.usage(&chunk)
+			result.StopReason = chunk.DoneReason
+			done = true
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, networkError("read stream", err)
+	}
+	if !done {
+		return result, truncated()
+	}
+	if hide != nil {
+		hide.flush()
+	}
+	closeOpen()
+	for _, b := range c.toolUses(calls, len(result.Content)) {
+		idx := len(result.Content)
+		result.Content = append(result.Content, b)
+		if cb.OnBlockStart != nil {
+			cb.OnBlockStart(idx, b)
+		}
+		if cb.OnInputJSONDelta != nil {
+			args, _ := json.Marshal(b.Input)
+			cb.OnInputJSONDelta(idx, string(args))
+		}
+		if cb.OnBlockStop != nil {
+			cb.OnBlockStop(idx)
+		}
+	}
+	result.StopReason = ollamaStopReason(result.StopReason, len(calls) > 0)
+
+	if cb.OnMessageDone != nil {
+		cb.OnMessageDone(result)
+	}
+	return result, nil
+}
+
+// tagFilter passes streamed text through until tag appears, then drops the
+// rest. A possible start of the tag is held back until it is decided.
+type tagFilter struct {
+	tag     string
+	emit    func(string)
+	pending string
+	hidden  bool
+}
+
+func (f *tagFilter) write(s string) {
+	if f.hidden {
+		return
+	}
+	s = f.pending + s
+	f.pending = ""
+	if i := strings.Index(s, f.tag); i >= 0 {
+		f.hidden = true
+		if i > 0 {
+			f.emit(s[:i])
+		}
+		return
+	}
+	// hold back the longest suffix that could begin the tag
+	for n := min(len(f.tag)-1, len(s)); n > 0; n-- {
+		if strings.HasPrefix(f.tag, s[len(s)-n:]) {
+			f.pending = s[len(s)-n:]
+			s = s[:len(s)-n]
+			break
+		}
+	}
+	if s != "" {
+		f.emit(s)
+	}
+}
+
+// flush emits held-back text that turned out not to be the tag.
+func (f *tagFilter) flush() {
+	if !f.hidden && f.pending != "" {
+		f.emit(f.pending)
+	}
+	f.pending = ""
+}
+
+// OllamaModel is a model installed on an Ollama server.
+type OllamaModel struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// OllamaList returns the models installed on the server at baseURL.
+func OllamaList(ctx context.Context, baseURL string) ([]OllamaModel, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(baseURL, "/")+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ollama: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("ollama: API error (%d): %s", resp.StatusCode, data)
+	}
+	var tags struct {
+		Models []OllamaModel `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, fmt.Errorf("ollama: parse response: %w", err)
+	}
+	return tags.Models, nil
+}
+
+// PullProgress is one status update of OllamaPull.
+type PullProgress struct {
+	Status    string `json:"status"`
+	Total     int64  `json:"total"`
+	Completed int64  `json:"completed"`
+	Error     string `json:"error"`
+}
+
+// OllamaPull downloads model to the server at baseURL, reporting progress
+// as the server streams it.
+func OllamaPull(ctx context.Context, baseURL, model string, progress func(PullProgress)) error {
+	body, _ := json.Marshal(map[string]any{"model": model, "stream": true})
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(baseURL, "/")+"/api/pull", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("ollama: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("ollama: API error (%d): %s", resp.StatusCode, data)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	last := ""
+	for scanner.Scan() {
+		var p PullProgress
+		if json.Unmarshal(scanner.Bytes(), &p) != nil {
+			continue
+		}
+		if p.Error != "" {
+			return fmt.Errorf("ollama: %s", p.Error)
+		}
+		last = p.Status
+		if progress != nil {
+			progress(p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("ollama: %w", err)
+	}
+	if last != "success" {
+		return errors.New("ollama: pull ended without success")
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Lewis-404/axe/internal/config"
+)
+
+// ollamaServer is a fake Ollama: /api/show reports caps, /api/chat replays
+// lines as NDJSON and records the request.
+func ollamaServer(t *testing.T, caps []string, lines []string, chat *[]map[string]any) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			json.NewEncoder(w).Encode(map[string]any{"capabilities": caps})
+		case "/api/chat":
+			var body map[string]any
+			json.NewDecoder(r.Body).Decode(&body)
+			*chat = append(*chat, body)
+			if body["tools"] != nil && !slices.Contains(caps, "tools") {
+				http.Error(w, `{"error":"registry.ollama.ai/library/x does not support tools"}`, http.StatusBadRequest)
+				return
+			}
+			for _, l := range lines {
+				fmt.Fprintln(w, l)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+var ollamaTools = []ToolDef{{Name: "read_file", Description: "Read a file", InputSchema: map[string]any{"type": "object"}}}
+
+func TestOllamaNativeTools(t *testing.T) {
+	var chat []map[string]any
+	srv := ollamaServer(t, []string{"completion", "tools"}, []string{
+		`{"message":{"role":"assistant","content":"Reading"},"done":false}`,
+		`{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"read_file","arguments":{"path":"go.mod"}}}]},"done":false}`,
+		`{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":30,"eval_count":8}`,
+	}, &chat)
+	defer srv.Close()
+
+	c := NewOllamaClient(&config.ModelConfig{Provider: "ollama", BaseURL: srv.URL, Model: "qwen3", MaxTokens: 100}, ollamaTools)
+	resp, err := c.SendStream(context.Background(), "sys", []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hi"}}}}, StreamCallbacks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.EmulatedTools || chat[0]["tools"] == nil {
+		t.Errorf("model with the tools capability should use native tools")
+	}
+	if len(resp.Content) != 2 || resp.Content[1].Type != "tool_use" || resp.Content[1].Name != "read_file" || resp.Content[1].ID == "" {
+		t.Fatalf("content = %+v", resp.Content)
+	}
+	if resp.StopReason != "tool_use" || resp.Usage != (Usage{InputTokens: 30, OutputTokens: 8}) {
+		t.Errorf("stop = %q, usage = %+v", resp.StopReason, resp.Usage)
+	}
+}
+
+func TestOllamaPromptTools(t *testing.T) {
+	var chat []map[string]any
+	srv := ollamaServer(t, nil, []string{
+		`{"message":{"role":"assistant","content":"Let me check.\n<tool"},"done":false}`,
+		`{"message":{"role":"assistant","content":"_call>\n{\"name\":\"read_file\",\"input\":{\"path\":\"go.mod\"}}\n</tool_call>"},"done":false}`,
+		`{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":30,"eval_count":8}`,
+	}, &chat)
+	defer srv.Close()
+
+	c := NewOllamaClient(&config.ModelConfig{Provider: "ollama", BaseURL: srv.URL, Model: "gemma", MaxTokens: 100}, ollamaTools)
+	history := []Message{
+		{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "what is this?"}}},
+		{Role: RoleAssistant, Content: []ContentBlock{{Type: "tool_use", ID: "c1", Name: "read_file", Input: map[string]any{"path": "README.md"}}}},
+		{Role: RoleUser, Content: []ContentBlock{{Type: "tool_result", ToolID: "c1", Content: "# axe"}}},
+	}
+	var shown strings.Builder
+	resp, err := c.SendStream(context.Background(), "sys", history, StreamCallbacks{OnTextDelta: func(s string) { shown.WriteString(s) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// capabilities are unknown, so native tools are tried first and refused
+	if len(chat) != 2 || chat[1]["tools"] != nil {
+		t.Fatalf("requests = %v", chat)
+	}
+	if !resp.EmulatedTools || !strings.Contains(resp.Content[0].Text, ToolCallOpen) {
+		t.Errorf("response = %+v", resp)
+	}
+	if shown.String() != "Let me check.\n" {
+		t.Errorf("streamed text = %q, want the tool call hidden", shown.String())
+	}
+
+	msgs := chat[1]["messages"].([]any)
+	if sys := msgs[0].(map[string]any)["content"].(string); !strings.Contains(sys, "<tool_call>") || !strings.Contains(sys, "- read_file: Read a file") {
+		t.Errorf("system prompt lacks the tool protocol:\n%s", sys)
+	}
+	if call := msgs[2].(map[string]any)["content"].(string); !strings.Contains(call, `{"input":{"path":"README.md"},"name":"read_file"}`) {
+		t.Errorf("past call = %q", call)
+	}
+	if result := msgs[3].(map[string]any); result["role"] != "user" || result["content"] != "<tool_result name=\"read_file\">\n# axe\n</tool_result>" {
+		t.Errorf("past result = %v", result)
+	}
+}
+
+func TestOllamaRetries(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			http.NotFound(w, r)
+			return
+		}
+		calls++
+		if calls == 1 {
+			http.Error(w, `{"error":"server busy, please try again. maximum pending requests exceeded"}`, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"hi"},"done":true,"done_reason":"stop"}`)
+	}))
+	defer srv.Close()
+
+	c := NewClient([]config.ModelConfig{{Provider: "ollama", BaseURL: srv.URL, Model: "qwen3", MaxTokens: 100}}, nil)
+	c.SetRetryPolicy(fastRetry)
+	var retries []RetryEvent
+	c.OnRetry(func(e RetryEvent) { retries = append(retries, e) })
+	msgs := []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hi"}}}}
+	for _, stream := range []bool{true, false} {
+		calls, retries = 0, nil
+		var resp *Response
+		var err error
+		if stream {
+			resp, err = c.SendStream(context.Background(), "", msgs, StreamCallbacks{})
+		} else {
+			resp, err = c.Send(context.Background(), "", msgs)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Content[0].Text != "hi" || calls != 2 {
+			t.Errorf("stream %v: response %+v after %d calls", stream, resp, calls)
+		}
+		if len(retries) != 1 || retries[0].Status != 503 || retries[0].Class != ClassOverloaded {
+			t.Errorf("stream %v: retries = %+v", stream, retries)
+		}
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	var out strings.Builder
+	f := &tagFilter{tag: "<tool_call>", emit: func(s string) { out.WriteString(s) }}
+	for _, s := range []string{"a <", "b <to", "ol_call> hidden"} {
+		f.write(s)
+	}
+	f.flush()
+	if out.String() != "a <b " {
+		t.Errorf("got %q", out.String())
+	}
+}
+
+func TestOllamaListAndPull(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			fmt.Fprint(w, `{"models":[{"name":"qwen3:8b","size":5200000000}]}`)
+		case "/api/pull":
+			fmt.Fprintln(w, `{"status":"pulling manifest"}`)
+			fmt.Fprintln(w, `{"status":"downloading","total":100,"completed":50}`)
+			fmt.Fprintln(w, `{"status":"success"}`)
+		}
+	}))
+	defer srv.Close()
+
+	models, err := OllamaList(context.Background(), srv.URL)
+	if err != nil || len(models) != 1 || models[0].Name != "qwen3:8b" {
+		t.Fatalf("list = %+v, %v", models, err)
+	}
+	var statuses []string
+	if err := OllamaPull(context.Background(), srv.URL, "qwen3:8b", func(p PullProgress) { statuses = append(statuses, p.Status) }); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(statuses, ",") != "pulling manifest,downloading,success" {
+		t.Errorf("progress = %v", statuses)
+	}
+}
@@ -3,11 +3,11 @@ package llm
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
@@ -23,6 +23,21 @@ type oaiMessage struct {
 	ToolCallID string        `json:"tool_call_id,omitempty"`
 }
 
+// oaiContentPart is one part of a multi-part message content.
+type oaiContentPart struct {
+	Type     string       `json:"type"`
+	Text     string       `json:"text,omitempty"`
+	ImageURL *oaiImageURL `json:"image_url,omitempty"`
+}
+
+type oaiImageURL struct {
+	URL string `json:"url"`
+}
+
+func oaiImagePart(src *ImageSource) oaiContentPart {
+	return oaiContentPart{Type: "image_url", ImageURL: &oaiImageURL{URL: src.DataURL()}}
+}
+
 type oaiToolCall struct {
 	ID       string `json:"id"`
 	Type     string `json:"type"`
@@ -49,6 +64,43 @@ type oaiRequest struct {
 	Tools     []oaiTool    `json:"tools,omitempty"`
 	MaxTokens int          `json:"max_tokens,omitempty"`
 	Stream    bool         `json:"stream,omitempty"`
+	// reasoning models take max_completion_tokens instead of max_tokens
+	MaxCompletionTokens int    `json:"max_completion_tokens,omitempty"`
+	ReasoningEffort     string `json:"reasoning_effort,omitempty"`
+	// without include_usage streamed responses carry no token counts
+	StreamOptions *oaiStreamOptions `json:"stream_options,omitempty"`
+}
+
+type oaiStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type oaiUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	CompletionTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details"`
+	// DeepSeek reports cache hits at the top level instead
+	PromptCacheHitTokens int `json:"prompt_cache_hit_tokens"`
+}
+
+// toUsage converts to Usage. OpenAI counts cached tokens inside
+// prompt_tokens; they are split out so InputTokens means uncached input.
+func (u oaiUsage) toUsage() Usage {
+	cached := u.PromptTokensDetails.CachedTokens
+	if cached == 0 {
+		cached = u.PromptCacheHitTokens
+	}
+	return Usage{
+		InputTokens:          u.PromptTokens - cached,
+		OutputTokens:         u.CompletionTokens,
+		CacheReadInputTokens: cached,
+		ReasoningTokens:      u.CompletionTokensDetails.ReasoningTokens,
+	}
 }
 
 type oaiChoice struct {
@@ -57,24 +109,23 @@ type oaiChoice struct {
 }
 
 type oaiRespMessage struct {
-	Role      string        `json:"role"`
-	Content   string        `json:"content"`
-	ToolCalls []oaiToolCall `json:"tool_calls,omitempty"`
+	Role             string        `json:"role"`
+	Content          string        `json:"content"`
+	ReasoningContent string        `json:"reasoning_content,omitempty"` // DeepSeek and compatible servers
+	ToolCalls        []oaiToolCall `json:"tool_calls,omitempty"`
 }
 
 type oaiResponse struct {
 	ID      string      `json:"id"`
 	Choices []oaiChoice `json:"choices"`
-	Usage   struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-	} `json:"usage"`
+	Usage   oaiUsage    `json:"usage"`
 }
 
 type oaiStreamDelta struct {
-	Role      string             `json:"role,omitempty"`
-	Content   string             `json:"content,omitempty"`
-	ToolCalls []oaiStreamToolDelta `json:"tool_calls,omitempty"`
+	Role             string               `json:"role,omitempty"`
+	Content          string               `json:"content,omitempty"`
+	ReasoningContent string               `json:"reasoning_content,omitempty"`
+	ToolCalls        []oaiStreamToolDelta `json:"tool_calls,omitempty"`
 }
 
 type oaiStreamToolDelta struct {
@@ -93,10 +144,7 @@ type oaiStreamChunk struct {
 		Delta        oaiStreamDelta `json:"delta"`
 		FinishReason *string        `json:"finish_reason"`
 	} `json:"choices"`
-	Usage *struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-	} `json:"usage,omitempty"`
+	Usage *oaiUsage `json:"usage,omitempty"`
 }
 
 // OpenAI client
@@ -105,20 +153,28 @@ type OpenAIClient struct {
 	model *config.ModelConfig
 	http  *http.Client
 	tools []ToolDef
+	retry *retrier
+	chain responsesChain // with api: responses
 }
 
+func (c *OpenAIClient) setTools(tools []ToolDef) { c.tools = tools }
+
 func NewOpenAIClient(m *config.ModelConfig, tools []ToolDef) *OpenAIClient {
 	return &OpenAIClient{model: m, http: &http.Client{Timeout: 5 * time.Minute}, tools: tools}
 }
 
 func (c *OpenAIClient) ModelName() string { return c.model.Model }
 
-func (c *OpenAIClient) convertTools() []oaiTool {
-	if len(c.tools) == 0 {
+func (c *OpenAIClient) convertTools() []oaiTool { return oaiTools(c.tools) }
+
+// oaiTools converts tool definitions to function tools, the format shared
+// by OpenAI-compatible servers and Ollama.
+func oaiTools(tools []ToolDef) []oaiTool {
+	if len(tools) == 0 {
 		return nil
 	}
-	out := make([]oaiTool, len(c.tools))
-	for i, t := range c.tools {
+	out := make([]oaiTool, len(tools))
+	for i, t := range tools {
 		out[i] = oaiTool{
 			Type: "function",
 			Function: oaiFunction{
@@ -139,12 +195,35 @@ func (c *OpenAIClient) convertMessages(system string, messages []Message) []oaiM
 	for _, m := range messages {
 		// check if this is a tool_result message
 		if len(m.Content) > 0 && m.Content[0].Type == "tool_result" {
+			// tool messages are text-only: images, and text sent along with
+			// the results, follow in a user message
+			var images []oaiContentPart
+			var texts []string
 			for _, b := range m.Content {
+				if b.Type != "tool_result" {
+					if b.Type == "text" && b.Text != "" {
+						texts = append(texts, b.Text)
+					}
+					continue
+				}
 				out = append(out, oaiMessage{
 					Role:       "tool",
 					Content:    b.Content,
 					ToolCallID: b.ToolID,
 				})
+				for _, p := range b.Parts {
+					if p.Type == "image" && p.Source != nil {
+						images = append(images, oaiContentPart{Type: "text", Text: "Image from tool call " + b.ToolID + ":"}, oaiImagePart(p.Source))
+					}
+				}
+			}
+			if len(images) > 0 {
+				for _, t := range texts {
+					images = append(images, oaiContentPart{Type: "text", Text: t})
+				}
+				out = append(out, oaiMessage{Role: "user", Content: images})
+			} else if len(texts) > 0 {
+				out = append(out, oaiMessage{Role: "user", Content: strings.Join(texts, "\n")})
 			}
 			continue
 		}
@@ -152,11 +231,17 @@ func (c *OpenAIClient) convertMessages(system string, messages []Message) []oaiM
 		// check for tool_use blocks (assistant with tool calls)
 		var textParts []string
 		var toolCalls []oaiToolCall
+		var parts []oaiContentPart // text and images, in order, once there is an image
 		for _, b := range m.Content {
 			switch b.Type {
 			case "text":
 				if b.Text != "" {
 					textParts = append(textParts, b.Text)
+					parts = append(parts, oaiContentPart{Type: "text", Text: b.Text})
+				}
+			case "image":
+				if b.Source != nil {
+					parts = append(parts, oaiImagePart(b.Source))
 				}
 			case "tool_use":
 				args, _ := json.Marshal(b.Input)
@@ -170,7 +255,9 @@ func (c *OpenAIClient) convertMessages(system string, messages []Message) []oaiM
 				})
 			}
 		}
-		if len(textParts) > 0 {
+		if len(parts) > len(textParts) {
+			msg.Content = parts
+		} else if len(textParts) > 0 {
 			msg.Content = strings.Join(textParts, "\n")
 		}
 		if len(toolCalls) > 0 {
@@ -181,31 +268,51 @@ func (c *OpenAIClient) convertMessages(system string, messages []Message) []oaiM
 	return out
 }
 
-func (c *OpenAIClient) doRequest(body []byte) (*http.Response, error) {
+// newRequest builds the chat completions request body for this model.
+func (c *OpenAIClient) newRequest(system string, messages []Message, stream bool) oaiRequest {
+	req := oaiRequest{
+		Model:    c.model.Model,
+		Messages: c.convertMessages(system, messages),
+		Tools:    c.convertTools(),
+		Stream:   stream,
+	}
+	if stream {
+		req.StreamOptions = &oaiStreamOptions{IncludeUsage: true}
+	}
+	if c.model.ReasoningEffort != "" {
+		req.ReasoningEffort = c.model.ReasoningEffort
+		req.MaxCompletionTokens = c.model.ClampOutput(c.model.MaxTokens)
+	} else {
+		req.MaxTokens = c.model.ClampOutput(c.model.MaxTokens)
+	}
+	return req
+}
+
+func (c *OpenAIClient) doRequest(ctx context.Context, body []byte) (*http.Response, error) {
 	url := strings.TrimRight(c.model.BaseURL, "/") + "/v1/chat/completions"
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+c.model.APIKey)
-	return c.http.Do(req)
+	return doHTTP(c.http, req)
 }
 
 func (c *OpenAIClient) parseResponse(oaiResp *oaiResponse) *Response {
 	resp := &Response{
-		ID:   oaiResp.ID,
-		Role: RoleAssistant,
-		Usage: Usage{
-			InputTokens:  oaiResp.Usage.PromptTokens,
-			OutputTokens: oaiResp.Usage.CompletionTokens,
-		},
+		ID:    oaiResp.ID,
+		Role:  RoleAssistant,
+		Usage: oaiResp.Usage.toUsage(),
 	}
 	if len(oaiResp.Choices) == 0 {
 		return resp
 	}
 	ch := oaiResp.Choices[0]
 	resp.StopReason = convertStopReason(ch.FinishReason)
+	if ch.Message.ReasoningContent != "" {
+		resp.Content = append(resp.Content, ContentBlock{Type: "thinking", Thinking: ch.Message.ReasoningContent})
+	}
 	if ch.Message.Content != "" {
 		resp.Content = append(resp.Content, ContentBlock{Type: "text", Text: ch.Message.Content})
 	}
@@ -235,83 +342,75 @@ func convertStopReason(reason string) string {
 	}
 }
 
-func (c *OpenAIClient) Send(system string, messages []Message) (*Response, error) {
-	reqBody := oaiRequest{
-		Model:     c.model.Model,
-		Messages:  c.convertMessages(system, messages),
-		Tools:     c.convertTools(),
-		MaxTokens: c.model.MaxTokens,
+// checkVision refuses to send images to a model known not to take them,
+// which some APIs would otherwise reject obscurely or silently ignore; see
+// visionMessages.
+func (c *OpenAIClient) checkVision(messages []Message) ([]Message, error) {
+	return visionMessages(c.model.Model, c.model.SupportsVision(), messages)
+}
+
+func (c *OpenAIClient) Send(ctx context.Context, system string, messages []Message) (*Response, error) {
+	messages, err := c.checkVision(messages)
+	if err != nil {
+		return nil, err
 	}
+	if c.model.UsesResponses() {
+		return c.sendResponses(ctx, system, messages)
+	}
+	reqBody := c.newRequest(system, messages, false)
 	body, err := json.Marshal(reqBody)
 	if err != nil {
 		return nil, fmt.Errorf("marshal request: %w", err)
 	}
 
-	resp, err := c.doRequest(body)
-	if err != nil {
-		return nil, fmt.Errorf("send request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("read response: %w", err)
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API error (%d): %s", resp.StatusCode, string(data))
-	}
+	return retryCall(ctx, c.retry, c.model.Model, nil, func() (*Response, error) {
+		resp, err := c.doRequest(ctx, body)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
 
-	var oaiResp oaiResponse
-	if err := json.Unmarshal(data, &oaiResp); err != nil {
-		return nil, fmt.Errorf("parse response: %w", err)
-	}
-	return c.parseResponse(&oaiResp), nil
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, networkError("read response", err)
+		}
+		var oaiResp oaiResponse
+		if err := json.Unmarshal(data, &oaiResp); err != nil {
+			return nil, fmt.Errorf("parse response: %w", err)
+		}
+		return c.parseResponse(&oaiResp), nil
+	})
 }
 
-func (c *OpenAIClient) SendStream(system string, messages []Message, cb StreamCallbacks) (*Response, error) {
-	reqBody := oaiRequest{
-		Model:     c.model.Model,
-		Messages:  c.convertMessages(system, messages),
-		Tools:     c.convertTools(),
-		MaxTokens: c.model.MaxTokens,
-		Stream:    true,
+func (c *OpenAIClient) SendStream(ctx context.Context, system string, messages []Message, cb StreamCallbacks) (*Response, error) {
+	messages, err := c.checkVision(messages)
+	if err != nil {
+		return nil, err
 	}
+	if c.model.UsesResponses() {
+		return c.streamResponses(ctx, system, messages, cb)
+	}
+	reqBody := c.newRequest(system, messages, true)
 	body, err := json.Marshal(reqBody)
 	if err != nil {
 		return nil, fmt.Errorf("marshal request: %w", err)
 	}
 
-	resp, err := c.doRequest(body)
-	if err != nil {
-		return nil, fmt.Errorf("send request: %w", err)
-	}
-
-	if resp.StatusCode == 429 || resp.StatusCode == 500 || resp.StatusCode == 529 {
-		resp.Body.Close()
-		for retry := 0; retry < 3; retry++ {
-			wait := time.Duration(2<<retry) * time.Second
-			fmt.Fprintf(os.Stderr, "⏳ API %d, retrying in %s...\n", resp.StatusCode, wait)
-			time.Sleep(wait)
-			resp, err = c.doRequest(body)
-			if err != nil {
-				return nil, fmt.Errorf("send request: %w", err)
-			}
-			if resp.StatusCode == 200 {
-				break
-			}
-			resp.Body.Close()
+	cb, started := watchStream(cb)
+	return retryCall(ctx, c.retry, c.model.Model, started, func() (*Response, error) {
+		resp, err := c.doRequest(ctx, body)
+		if err != nil {
+			return nil, err
 		}
-		if resp.StatusCode != 200 {
-			return nil, fmt.Errorf("API error (%d) after retries", resp.StatusCode)
-		}
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		data, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API error (%d): %s", resp.StatusCode, string(data))
-	}
+		defer resp.Body.Close()
+		return c.readStream(resp.Body, cb)
+	})
+}
 
+// readStream assembles a response from chat completion chunks. A stream
+// that ends without [DONE] or a finish reason was cut off; the partial
+// response is returned with the error.
+func (c *OpenAIClient) readStream(body io.Reader, cb StreamCallbacks) (*Response, error) {
 	result := &Response{Role: RoleAssistant}
 	// track tool call accumulation: index -> {id, name, arguments}
 	type toolAcc struct {
@@ -322,8 +421,10 @@ func (c *OpenAIClient) SendStream(system string, messages []Message, cb StreamCa
 	toolAccs := map[int]*toolAcc{}
 	hasText := false
 	textBlockIdx := -1
+	thinkingIdx := -1
+	done := false
 
-	scanner := bufio.NewScanner(resp.Body)
+	scanner := bufio.NewScanner(body)
 	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
 
 	for scanner.Scan() {
@@ -333,8 +434,12 @@ func (c *OpenAIClient) SendStream(system string, messages []Message, cb StreamCa
 		}
 		payload := strings.TrimPrefix(line, "data: ")
 		if payload == "[DONE]" {
+			done = true
 			break
 		}
+		if err := streamError([]byte(payload)); err != nil {
+			return result, err
+		}
 
 		var chunk oaiStreamChunk
 		if json.Unmarshal([]byte(payload), &chunk) != nil {
@@ -345,17 +450,35 @@ func (c *OpenAIClient) SendStream(system string, messages []Message, cb StreamCa
 			result.ID = chunk.ID
 		}
 		if chunk.Usage != nil {
-			result.Usage.InputTokens = chunk.Usage.PromptTokens
-			result.Usage.OutputTokens = chunk.Usage.CompletionTokens
+			result.Usage = chunk.Usage.toUsage()
 		}
 
 		for _, ch := range chunk.Choices {
 			if ch.FinishReason != nil {
 				result.StopReason = convertStopReason(*ch.FinishReason)
+				done = true
+			}
+
+			// reasoning delta (DeepSeek-style reasoning_content)
+			if ch.Delta.ReasoningContent != "" {
+				if thinkingIdx < 0 {
+					thinkingIdx = len(result.Content)
+					result.Content = append(result.Content, ContentBlock{Type: "thinking"})
+					if cb.OnBlockStart != nil {
+						cb.OnBlockStart(thinkingIdx, result.Content[thinkingIdx])
+					}
+				}
+				result.Content[thinkingIdx].Thinking += ch.Delta.ReasoningContent
+				if cb.OnThinkingDelta != nil {
+					cb.OnThinkingDelta(ch.Delta.ReasoningContent)
+				}
 			}
 
 			// text content delta
 			if ch.Delta.Content != "" {
+				if thinkingIdx >= 0 && !hasText && cb.OnBlockStop != nil {
+					cb.OnBlockStop(thinkingIdx)
+				}
 				if !hasText {
 					hasText = true
 					textBlockIdx = len(result.Content)
@@ -386,11 +509,8 @@ func (c *OpenAIClient) SendStream(system string, messages []Message, cb StreamCa
 				if tc.Function.Arguments != "" {
 					acc.args += tc.Function.Arguments
 					if cb.OnInputJSONDelta != nil {
-						// use a content index offset: text block (if any) + tool index
-						contentIdx := tc.Index
-						if hasText {
-							contentIdx = textBlockIdx + 1 + tc.Index
-						}
+						// tool blocks are appended after the thinking/text blocks
+						contentIdx := len(result.Content) + tc.Index
 						cb.OnInputJSONDelta(contentIdx, tc.Function.Arguments)
 					}
 				}
@@ -399,12 +519,17 @@ func (c *OpenAIClient) SendStream(system string, messages []Message, cb StreamCa
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("read stream: %w", err)
+		return result, networkError("read stream", err)
+	}
+	if !done {
+		return result, truncated()
 	}
 
 	// finalize text block
 	if hasText && cb.OnBlockStop != nil {
 		cb.OnBlockStop(textBlockIdx)
+	} else if thinkingIdx >= 0 && cb.OnBlockStop != nil {
+		cb.OnBlockStop(thinkingIdx)
 	}
 
 	// build tool_use content blocks from accumulated deltas
@@ -0,0 +1,106 @@
+package llm
+
+import (
+	"context"
+	"strings"
+)
+
+// continuePrompt asks the model to pick up a response that broke off. It
+// follows the text the user has already seen, sent back as an assistant turn.
+const continuePrompt = "[Your response above was interrupted. Continue exactly where it stopped, without repeating any of it.]"
+
+// streamFrom streams a response from the provider at idx, continuing after
+// kept when an earlier stream broke off. If this stream breaks off after
+// passing output on, it is recovered once on the same provider: text that
+// was passed on is added to kept and the model asked to continue from it.
+// Without any text to continue from, the output (thinking, a tool call in
+// progress) is discarded with cb.OnReset and the request started over. A
+// second break is returned for the caller to fall back, and kept carries
+// the text to the next provider.
+func (c *Client) streamFrom(ctx context.Context, idx int, system string, messages []Message, kept *[]ContentBlock, cb StreamCallbacks) (*Response, error) {
+	p := c.providers[idx]
+	for recovered := false; ; recovered = true {
+		msgs := messages
+		if len(*kept) > 0 {
+			msgs = continuation(messages, *kept)
+		}
+		watched, started := watchStream(cb)
+		resp, err := p.SendStream(ctx, system, msgs, watched)
+		if err == nil {
+			resp.Content = resumed(*kept, resp.Content)
+			return resp, nil
+		}
+		if resp != nil && resp.Usage != (Usage{}) && (*started || ctx.Err() != nil) {
+			// the tokens were generated and are billed, also when the
+			// user interrupted the stream
+			c.record(idx, resp)
+		}
+		if !*started || ctx.Err() != nil || !canFallBack(err) {
+			return nil, err
+		}
+		if text := salvage(resp); text != "" {
+			*kept = resumed(*kept, []ContentBlock{{Type: "text", Text: text}})
+		}
+		resume := len(*kept) > 0
+		if !resume && cb.OnReset != nil {
+			cb.OnReset()
+		}
+		if recovered {
+			return nil, err
+		}
+		c.recovered(RecoveryEvent{Model: p.ModelName(), Resumed: resume, Err: err})
+	}
+}
+
+// salvage returns the text of a response that broke off, which the user has
+// seen and the model can continue from. Thinking and tool calls are dropped:
+// a continuation redoes them.
+func salvage(partial *Response) string {
+	if partial == nil {
+		return ""
+	}
+	var sb strings.Builder
+	for _, b := range partial.Content {
+		if b.Type == "text" {
+			sb.WriteString(b.Text)
+		}
+	}
+	if strings.TrimSpace(sb.String()) == "" {
+		return ""
+	}
+	return sb.String()
+}
+
+// continuation is messages followed by the kept text and a request to go on
+// from it. The text goes in its own assistant turn rather than as a prefill,
+// which thinking models reject.
+func continuation(messages []Message, kept []ContentBlock) []Message {
+	out := make([]Message, len(messages), len(messages)+2)
+	copy(out, messages)
+	return append(out,
+		Message{Role: RoleAssistant, Content: kept},
+		Message{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: continuePrompt}}},
+	)
+}
+
+// resumed puts the kept text in front of the content that continued it,
+// joining the text where it broke off. Thinking stays first, where the
+// Anthropic API expects it in a tool loop.
+func resumed(kept, content []ContentBlock) []ContentBlock {
+	if len(kept) == 0 {
+		return content
+	}
+	n := 0
+	for n < len(content) && (isThinking(content[n].Type) || content[n].Type == "reasoning") {
+		n++
+	}
+	out := make([]ContentBlock, 0, len(kept)+len(content))
+	out = append(out, content[:n]...)
+	out = append(out, kept...)
+	rest := content[n:]
+	if len(rest) > 0 && rest[0].Type == "text" {
+		out[len(out)-1].Text += rest[0].Text
+		rest = rest[1:]
+	}
+	return append(out, rest...)
+}
@@ -0,0 +1,137 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Lewis-404/axe/internal/config"
+)
+
+// scriptedSSE answers the n-th request with the n-th list of events and
+// records the request bodies.
+func scriptedSSE(t *testing.T, bodies *[]map[string]any, script ...[]string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		*bodies = append(*bodies, body)
+		if len(*bodies) > len(script) {
+			t.Errorf("unexpected request #%d", len(*bodies))
+			return
+		}
+		for _, e := range script[len(*bodies)-1] {
+			fmt.Fprintf(w, "data: %s\n\n", e)
+		}
+	}))
+}
+
+func TestStreamResumesAfterBreak(t *testing.T) {
+	var bodies []map[string]any
+	srv := scriptedSSE(t, &bodies,
+		// the connection closes mid-answer
+		[]string{
+			`{"type":"message_start","message":{"id":"m1","role":"assistant","usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello, wor"}}`,
+		},
+		[]string{
+			`{"type":"message_start","message":{"id":"m2","role":"assistant","usage":{"input_tokens":20,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"ld!"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`,
+			`{"type":"message_stop"}`,
+		},
+	)
+	defer srv.Close()
+
+	c := NewClient([]config.ModelConfig{{Provider: "anthropic", APIKey: "k", BaseURL: srv.URL, Model: "claude-sonnet-4", MaxTokens: 100}}, nil)
+	var events []RecoveryEvent
+	c.OnRecover(func(e RecoveryEvent) { events = append(events, e) })
+	var shown string
+	msgs := []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "greet"}}}}
+	resp, err := c.SendStream(context.Background(), "", msgs, StreamCallbacks{
+		OnTextDelta: func(s string) { shown += s },
+		OnReset:     func() { t.Error("kept text was discarded") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shown != "Hello, world!" || len(resp.Content) != 1 || resp.Content[0].Text != "Hello, world!" {
+		t.Errorf("shown %q, content %+v", shown, resp.Content)
+	}
+	if len(events) != 1 || !events[0].Resumed {
+		t.Errorf("recovery events = %+v", events)
+	}
+	sent := bodies[1]["messages"].([]any)
+	if len(sent) != 3 {
+		t.Fatalf("continuation sent %d messages, want 3", len(sent))
+	}
+	kept := sent[1].(map[string]any)["content"].([]any)[0].(map[string]any)
+	if sent[1].(map[string]any)["role"] != "assistant" || kept["text"] != "Hello, wor" {
+		t.Errorf("kept turn = %v", sent[1])
+	}
+	if got := c.Usage()["claude-sonnet-4"]; got.InputTokens != 30 {
+		t.Errorf("usage = %+v, want both requests billed", got)
+	}
+}
+
+func TestStreamRestartsWithoutText(t *testing.T) {
+	var bodies []map[string]any
+	srv := scriptedSSE(t, &bodies,
+		// an error event while the tool input is half written
+		[]string{
+			`{"type":"message_start","message":{"id":"m1","role":"assistant","usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"t1","name":"read_file","input":{}}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"path\":\"go"}}`,
+			`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+		},
+		[]string{
+			`{"type":"message_start","message":{"id":"m2","role":"assistant","usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"t2","name":"read_file","input":{}}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"path\":\"go.mod\"}"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":9}}`,
+			`{"type":"message_stop"}`,
+		},
+	)
+	defer srv.Close()
+
+	c := NewClient([]config.ModelConfig{{Provider: "anthropic", APIKey: "k", BaseURL: srv.URL, Model: "claude-sonnet-4", MaxTokens: 100}}, nil)
+	var events []RecoveryEvent
+	c.OnRecover(func(e RecoveryEvent) { events = append(events, e) })
+	resets := 0
+	msgs := []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "read go.mod"}}}}
+	resp, err := c.SendStream(context.Background(), "", msgs, StreamCallbacks{OnReset: func() { resets++ }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resets != 1 || len(events) != 1 || events[0].Resumed {
+		t.Errorf("resets = %d, events = %+v", resets, events)
+	}
+	if call := resp.Content[0]; call.ID != "t2" || call.Input.(map[string]any)["path"] != "go.mod" {
+		t.Errorf("tool call = %+v", call)
+	}
+	if sent := bodies[1]["messages"].([]any); len(sent) != 1 {
+		t.Errorf("restart sent %d messages, want the original request", len(sent))
+	}
+}
+
+func TestResumedKeepsThinkingFirst(t *testing.T) {
+	kept := []ContentBlock{{Type: "text", Text: "Let me "}}
+	got := resumed(kept, []ContentBlock{
+		{Type: "thinking", Thinking: "hm", Signature: "s"},
+		{Type: "text", Text: "check."},
+		{Type: "tool_use", ID: "t1", Name: "read_file"},
+	})
+	if len(got) != 3 || got[0].Type != "thinking" || got[1].Text != "Let me check." || got[2].Type != "tool_use" {
+		t.Errorf("resumed = %+v", got)
+	}
+	if kept[0].Text != "Let me " {
+		t.Errorf("kept modified: %+v", kept)
+	}
+}
@@ -0,0 +1,481 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Responses API wire types. Input items are built from the structs below;
+// output items all decode into respOutputItem.
+
+type respRequest struct {
+	Model              string         `json:"model"`
+	Instructions       string         `json:"instructions,omitempty"`
+	Input              []any          `json:"input"`
+	Tools              []respTool     `json:"tools,omitempty"`
+	MaxOutputTokens    int            `json:"max_output_tokens,omitempty"`
+	Reasoning          *respReasoning `json:"reasoning,omitempty"`
+	Include            []string       `json:"include,omitempty"`
+	Store              bool           `json:"store"`
+	Stream             bool           `json:"stream,omitempty"`
+	PreviousResponseID string         `json:"previous_response_id,omitempty"`
+}
+
+type respReasoning struct {
+	Effort  string `json:"effort,omitempty"`
+	Summary string `json:"summary,omitempty"`
+}
+
+type respTool struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  any    `json:"parameters"`
+}
+
+type respMessage struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"` // string or []respPart
+}
+
+type respPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+}
+
+type respFunctionCall struct {
+	Type      string `json:"type"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type respFunctionOutput struct {
+	Type   string `json:"type"`
+	CallID string `json:"call_id"`
+	Output string `json:"output"`
+}
+
+// respReasoningItem echoes a reasoning item back. The summary is required,
+// even if empty.
+type respReasoningItem struct {
+	Type             string     `json:"type"`
+	ID               string     `json:"id"`
+	Summary          []respPart `json:"summary"`
+	EncryptedContent string     `json:"encrypted_content,omitempty"`
+}
+
+type respOutputItem struct {
+	Type             string     `json:"type"`
+	ID               string     `json:"id"`
+	Content          []respPart `json:"content"`
+	CallID           string     `json:"call_id"`
+	Name             string     `json:"name"`
+	Arguments        string     `json:"arguments"`
+	Summary          []respPart `json:"summary"`
+	EncryptedContent string     `json:"encrypted_content"`
+}
+
+type respUsage struct {
+	InputTokens        int `json:"input_tokens"`
+	OutputTokens       int `json:"output_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	OutputTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+}
+
+// toUsage converts to Usage, splitting cached tokens out of input_tokens as
+// for chat completions.
+func (u respUsage) toUsage() Usage {
+	cached := u.InputTokensDetails.CachedTokens
+	return Usage{
+		InputTokens:          u.InputTokens - cached,
+		OutputTokens:         u.OutputTokens,
+		CacheReadInputTokens: cached,
+		ReasoningTokens:      u.OutputTokensDetails.ReasoningTokens,
+	}
+}
+
+type respResponse struct {
+	ID                string           `json:"id"`
+	Status            string           `json:"status"`
+	Output            []respOutputItem `json:"output"`
+	Usage             respUsage        `json:"usage"`
+	IncompleteDetails *struct {
+		Reason string `json:"reason"`
+	} `json:"incomplete_details"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type respEvent struct {
+	Type        string          `json:"type"`
+	Response    *respResponse   `json:"response"`
+	OutputIndex int             `json:"output_index"`
+	Item        *respOutputItem `json:"item"`
+	Delta       string          `json:"delta"`
+	Code        string          `json:"code"`
+	Message     string          `json:"message"`
+}
+
+// responsesChain remembers the last response, so a request that only
+// appends to the conversation it answered can send just the new messages
+// with previous_response_id instead of the whole history.
+type responsesChain struct {
+	mu     sync.Mutex
+	id     string
+	n      int // messages the response answered
+	digest [32]byte
+}
+
+// next returns the response to chain from and the messages still to send.
+func (ch *responsesChain) next(messages []Message) (string, []Message) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	n := ch.n
+	if ch.id == "" || len(messages) <= n+1 || messages[n].Role != RoleAssistant || historyDigest(messages[:n]) != ch.digest {
+		return "", messages
+	}
+	return ch.id, messages[n+1:]
+}
+
+func (ch *responsesChain) set(id string, messages []Message) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.id, ch.n, ch.digest = id, len(messages), historyDigest(messages)
+}
+
+func (ch *responsesChain) reset() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.id = ""
+}
+
+// historyDigest hashes what a provider sees of messages, ignoring local
+// bookkeeping.
+func historyDigest(messages []Message) [32]byte {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for _, m := range messages {
+		enc.Encode(m.Role)
+		enc.Encode(m.Content)
+	}
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+func (c *OpenAIClient) respTools() []respTool {
+	out := make([]respTool, len(c.tools))
+	for i, t := range c.tools {
+		out[i] = respTool{Type: "function", Name: t.Name, Description: t.Description, Parameters: t.InputSchema}
+	}
+	return out
+}
+
+// respInput maps the history onto input items. Assistant turns become their
+// reasoning, message and function_call items in order; tool results become
+// function_call_output items, with any images in a user message after them.
+func respInput(messages []Message) []any {
+	var out []any
+	for _, m := range messages {
+		if m.Role == RoleAssistant {
+			for _, b := range m.Content {
+				switch b.Type {
+				case "reasoning":
+					item := respReasoningItem{Type: "reasoning", ID: b.ID, Summary: []respPart{}, EncryptedContent: b.Data}
+					if b.Thinking != "" {
+						item.Summary = []respPart{{Type: "summary_text", Text: b.Thinking}}
+					}
+					out = append(out, item)
+				case "text":
+					if b.Text != "" {
+						out = append(out, respMessage{Role: "assistant", Content: b.Text})
+					}
+				case "tool_use":
+					args, _ := json.Marshal(b.Input)
+					out = append(out, respFunctionCall{Type: "function_call", CallID: b.ID, Name: b.Name, Arguments: string(args)})
+				}
+			}
+			continue
+		}
+		var parts, images []respPart
+		for _, b := range m.Content {
+			switch b.Type {
+			case "text":
+				if b.Text != "" {
+					parts = append(parts, respPart{Type: "input_text", Text: b.Text})
+				}
+			case "image":
+				if b.Source != nil {
+					parts = append(parts, respPart{Type: "input_image", ImageURL: b.Source.DataURL()})
+				}
+			case "tool_result":
+				out = append(out, respFunctionOutput{Type: "function_call_output", CallID: b.ToolID, Output: b.Content})
+				for _, p := range b.Parts {
+					if p.Type == "image" && p.Source != nil {
+						images = append(images, respPart{Type: "input_text", Text: "Image from tool call " + b.ToolID + ":"}, respPart{Type: "input_image", ImageURL: p.Source.DataURL()})
+					}
+				}
+			}
+		}
+		if parts = append(parts, images...); len(parts) > 0 {
+			out = append(out, respMessage{Role: "user", Content: parts})
+		}
+	}
+	return out
+}
+
+// respBlock converts a finished output item. ok is false for item types
+// axe has no use for.
+func respBlock(item respOutputItem) (ContentBlock, bool) {
+	switch item.Type {
+	case "message":
+		var text strings.Builder
+		for _, p := range item.Content {
+			text.WriteString(p.Text) // output_text, or refusal
+		}
+		return ContentBlock{Type: "text", Text: text.String()}, true
+	case "reasoning":
+		var summary []string
+		for _, p := range item.Summary {
+			summary = append(summary, p.Text)
+		}
+		return ContentBlock{Type: "reasoning", ID: item.ID, Thinking: strings.Join(summary, "\n\n"), Data: item.EncryptedContent}, true
+	case "function_call":
+		var input any
+		json.Unmarshal([]byte(item.Arguments), &input)
+		return ContentBlock{Type: "tool_use", ID: item.CallID, Name: item.Name, Input: input}, true
+	}
+	return ContentBlock{}, false
+}
+
+// respStopReason derives a Messages API stop reason, which the Responses
+// API does not report directly.
+func respStopReason(r *respResponse, content []ContentBlock) string {
+	if r.IncompleteDetails != nil && r.IncompleteDetails.Reason == "max_output_tokens" {
+		return "max_tokens"
+	}
+	for _, b := range content {
+		if b.Type == "tool_use" {
+			return "tool_use"
+		}
+	}
+	return "end_turn"
+}
+
+// newResponsesRequest builds the request body. It chains from the previous
+// response when it can; full is set to send the whole history regardless.
+// The encrypted reasoning is always requested, so the history stays usable
+// when the chain breaks (compaction, a model switch, an expired response).
+func (c *OpenAIClient) newResponsesRequest(system string, messages []Message, stream, full bool) respRequest {
+	prev, input := "", messages
+	if !full {
+		prev, input = c.chain.next(messages)
+	}
+	req := respRequest{
+		Model:              c.model.Model,
+		Instructions:       system,
+		Input:              respInput(input),
+		Tools:              c.respTools(),
+		MaxOutputTokens:    c.model.ClampOutput(c.model.MaxTokens),
+		Include:            []string{"reasoning.encrypted_content"},
+		Store:              true,
+		Stream:             stream,
+		PreviousResponseID: prev,
+	}
+	if c.model.ReasoningEffort != "" {
+		req.Reasoning = &respReasoning{Effort: c.model.ReasoningEffort, Summary: "auto"}
+	}
+	return req
+}
+
+// postResponses sends a request, and resends it with the whole history if
+// the previous response it chains from is gone.
+func (c *OpenAIClient) postResponses(ctx context.Context, system string, messages []Message, stream bool) (*http.Response, error) {
+	req := c.newResponsesRequest(system, messages, stream, false)
+	for {
+		body, err := json.Marshal(req)
+		if err != nil {
+			return nil, fmt.Errorf("marshal request: %w", err)
+		}
+		url := strings.TrimRight(c.model.BaseURL, "/") + "/v1/responses"
+		httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		httpReq.Header.Set("Authorization", "Bearer "+c.model.APIKey)
+		resp, err := doHTTP(c.http, httpReq)
+		var apiErr *APIError
+		if req.PreviousResponseID == "" || !errors.As(err, &apiErr) || (apiErr.Status != http.StatusBadRequest && apiErr.Status != http.StatusNotFound) {
+			return resp, err
+		}
+		c.chain.reset()
+		req = c.newResponsesRequest(system, messages, stream, true)
+	}
+}
+
+func (c *OpenAIClient) sendResponses(ctx context.Context, system string, messages []Message) (*Response, error) {
+	return retryCall(ctx, c.retry, c.model.Model, nil, func() (*Response, error) {
+		resp, err := c.postResponses(ctx, system, messages, false)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, networkError("read response", err)
+		}
+		var r respResponse
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, fmt.Errorf("parse response: %w", err)
+		}
+		if r.Error != nil {
+			return nil, &APIError{Class: classify(0, r.Error.Code, r.Error.Message), Message: r.Error.Message}
+		}
+		result := &Response{ID: r.ID, Role: RoleAssistant, Usage: r.Usage.toUsage()}
+		for _, item := range r.Output {
+			if b, ok := respBlock(item); ok {
+				result.Content = append(result.Content, b)
+			}
+		}
+		result.StopReason = respStopReason(&r, result.Content)
+		c.chain.set(r.ID, messages)
+		return result, nil
+	})
+}
+
+func (c *OpenAIClient) streamResponses(ctx context.Context, system string, messages []Message, cb StreamCallbacks) (*Response, error) {
+	cb, started := watchStream(cb)
+	return retryCall(ctx, c.retry, c.model.Model, started, func() (*Response, error) {
+		resp, err := c.postResponses(ctx, system, messages, true)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return c.readResponsesStream(resp.Body, messages, cb)
+	})
+}
+
+// readResponsesStream assembles a response from Responses API stream events.
+// A stream that ends without a final response event was cut off; the partial
+// response is returned with the error.
+func (c *OpenAIClient) readResponsesStream(body io.Reader, messages []Message, cb StreamCallbacks) (*Response, error) {
+	result := &Response{Role: RoleAssistant}
+	blocks := map[int]int{} // output_index -> content index
+	var final *respResponse
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ev respEvent
+		if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev) != nil {
+			continue
+		}
+		idx, open := blocks[ev.OutputIndex]
+
+		switch ev.Type {
+		case "response.created":
+			if ev.Response != nil {
+				result.ID = ev.Response.ID
+			}
+		case "response.output_item.added":
+			if ev.Item == nil {
+				continue
+			}
+			b, ok := respBlock(*ev.Item)
+			if !ok {
+				continue
+			}
+			idx = len(result.Content)
+			blocks[ev.OutputIndex] = idx
+			result.Content = append(result.Content, b)
+			if cb.OnBlockStart != nil {
+				cb.OnBlockStart(idx, b)
+			}
+		case "response.output_text.delta", "response.refusal.delta":
+			if open {
+				result.Content[idx].Text += ev.Delta
+				if cb.OnTextDelta != nil {
+					cb.OnTextDelta(ev.Delta)
+				}
+			}
+		case "response.reasoning_summary_part.added":
+			// separate the summary's sections as respBlock does
+			if open && result.Content[idx].Thinking != "" {
+				result.Content[idx].Thinking += "\n\n"
+				if cb.OnThinkingDelta != nil {
+					cb.OnThinkingDelta("\n\n")
+				}
+			}
+		case "response.reasoning_summary_text.delta":
+			if open {
+				result.Content[idx].Thinking += ev.Delta
+				if cb.OnThinkingDelta != nil {
+					cb.OnThinkingDelta(ev.Delta)
+				}
+			}
+		case "response.function_call_arguments.delta":
+			if open && cb.OnInputJSONDelta != nil {
+				cb.OnInputJSONDelta(idx, ev.Delta)
+			}
+		case "response.output_item.done":
+			if !open || ev.Item == nil {
+				continue
+			}
+			// the finished item is complete, including the encrypted reasoning
+			if b, ok := respBlock(*ev.Item); ok {
+				result.Content[idx] = b
+			}
+			if cb.OnBlockStop != nil {
+				cb.OnBlockStop(idx)
+			}
+		case "response.completed", "response.incomplete":
+			final = ev.Response
+		case "response.failed":
+			if ev.Response != nil && ev.Response.Error != nil {
+				e := ev.Response.Error
+				return result, &APIError{Class: classify(0, e.Code, e.Message), Message: e.Message}
+			}
+			return result, &APIError{Class: ClassOverloaded, Message: "response failed"}
+		case "error":
+			return result, &APIError{Class: classify(0, ev.Code, ev.Message), Message: ev.Message}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, networkError("read stream", err)
+	}
+	if final == nil {
+		return result, truncated()
+	}
+
+	result.ID = final.ID
+	result.Usage = final.Usage.toUsage()
+	result.StopReason = respStopReason(final, result.Content)
+	c.chain.set(final.ID, messages)
+	if cb.OnMessageDone != nil {
+		cb.OnMessageDone(result)
+	}
+	return result, nil
+}
@@ -0,0 +1,154 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Lewis-404/axe/internal/config"
+)
+
+func TestResponsesToolLoop(t *testing.T) {
+	var bodies []map[string]any
+	replies := [][]string{
+		{
+			`{"type":"response.created","response":{"id":"resp_1"}}`,
+			`{"type":"response.output_item.added","output_index":0,"item":{"type":"reasoning","id":"rs_1","summary":[]}}`,
+			`{"type":"response.reasoning_summary_part.added","output_index":0}`,
+			`{"type":"response.reasoning_summary_text.delta","output_index":0,"delta":"need the file"}`,
+			`{"type":"response.output_item.done","output_index":0,"item":{"type":"reasoning","id":"rs_1","summary":[{"type":"summary_text","text":"need the file"}],"encrypted_content":"enc1"}}`,
+			`{"type":"response.output_item.added","output_index":1,"item":{"type":"function_call","id":"fc_1","call_id":"call_1","name":"read_file","arguments":""}}`,
+			`{"type":"response.function_call_arguments.delta","output_index":1,"delta":"{\"path\":\"go.mod\"}"}`,
+			`{"type":"response.output_item.done","output_index":1,"item":{"type":"function_call","id":"fc_1","call_id":"call_1","name":"read_file","arguments":"{\"path\":\"go.mod\"}"}}`,
+			`{"type":"response.completed","response":{"id":"resp_1","status":"completed","usage":{"input_tokens":100,"output_tokens":30,"input_tokens_details":{"cached_tokens":40},"output_tokens_details":{"reasoning_tokens":20}}}}`,
+		},
+		{
+			`{"type":"response.created","response":{"id":"resp_2"}}`,
+			`{"type":"response.output_item.added","output_index":0,"item":{"type":"message","role":"assistant","content":[]}}`,
+			`{"type":"response.output_text.delta","output_index":0,"delta":"A Go module."}`,
+			`{"type":"response.output_item.done","output_index":0,"item":{"type":"message","content":[{"type":"output_text","text":"A Go module."}]}}`,
+			`{"type":"response.completed","response":{"id":"resp_2","status":"completed","usage":{"input_tokens":50,"output_tokens":5}}}`,
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/responses" {
+			http.NotFound(w, r)
+			return
+		}
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+		for _, e := range replies[min(len(bodies), len(replies))-1] {
+			fmt.Fprintf(w, "event: x\ndata: %s\n\n", e)
+		}
+	}))
+	defer srv.Close()
+
+	tools := []ToolDef{{Name: "read_file", Description: "Read a file", InputSchema: map[string]any{"type": "object"}}}
+	m := &config.ModelConfig{Provider: "openai", API: config.APIResponses, APIKey: "k", BaseURL: srv.URL, Model: "o4-mini", MaxTokens: 100, ReasoningEffort: "high"}
+	c := NewOpenAIClient(m, tools)
+	var thinking string
+	msgs := []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "what is this?"}}}}
+	resp, err := c.SendStream(context.Background(), "sys", msgs, StreamCallbacks{OnThinkingDelta: func(s string) { thinking += s }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thinking != "need the file" || resp.StopReason != "tool_use" || len(resp.Content) != 2 {
+		t.Fatalf("thinking = %q, response = %+v", thinking, resp)
+	}
+	if r := resp.Content[0]; r.Type != "reasoning" || r.ID != "rs_1" || r.Data != "enc1" {
+		t.Errorf("reasoning = %+v", r)
+	}
+	if call := resp.Content[1]; call.Type != "tool_use" || call.ID != "call_1" || call.Input.(map[string]any)["path"] != "go.mod" {
+		t.Errorf("tool_use = %+v", call)
+	}
+	if want := (Usage{InputTokens: 60, OutputTokens: 30, CacheReadInputTokens: 40, ReasoningTokens: 20}); resp.Usage != want {
+		t.Errorf("usage = %+v, want %+v", resp.Usage, want)
+	}
+	first := bodies[0]
+	if first["instructions"] != "sys" || first["store"] != true || first["reasoning"].(map[string]any)["effort"] != "high" || first["previous_response_id"] != nil {
+		t.Errorf("first request = %v", first)
+	}
+	if tool := first["tools"].([]any)[0].(map[string]any); tool["name"] != "read_file" || tool["type"] != "function" {
+		t.Errorf("tool = %v", tool)
+	}
+
+	// the tool loop continues from the previous response
+	msgs = append(msgs,
+		Message{Role: RoleAssistant, Content: resp.Content},
+		Message{Role: RoleUser, Content: []ContentBlock{{Type: "tool_result", ToolID: "call_1", Content: "module x"}}},
+	)
+	resp, err = c.SendStream(context.Background(), "sys", msgs, StreamCallbacks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content[0].Text != "A Go module." || resp.StopReason != "end_turn" {
+		t.Errorf("response = %+v", resp)
+	}
+	if bodies[1]["previous_response_id"] != "resp_1" {
+		t.Errorf("previous_response_id = %v", bodies[1]["previous_response_id"])
+	}
+	input := bodies[1]["input"].([]any)
+	if len(input) != 1 || input[0].(map[string]any)["type"] != "function_call_output" || input[0].(map[string]any)["output"] != "module x" {
+		t.Errorf("chained input = %v", input)
+	}
+
+	// without the chain, the whole history goes, reasoning included
+	fresh := NewOpenAIClient(m, tools)
+	if _, err := fresh.SendStream(context.Background(), "sys", msgs, StreamCallbacks{}); err != nil {
+		t.Fatal(err)
+	}
+	input = bodies[2]["input"].([]any)
+	if len(input) != 4 {
+		t.Fatalf("full input = %v", input)
+	}
+	if r := input[1].(map[string]any); r["type"] != "reasoning" || r["id"] != "rs_1" || r["encrypted_content"] != "enc1" {
+		t.Errorf("reasoning item = %v", r)
+	}
+	if call := input[2].(map[string]any); call["type"] != "function_call" || call["call_id"] != "call_1" || call["arguments"] != `{"path":"go.mod"}` {
+		t.Errorf("function_call item = %v", call)
+	}
+}
+
+func TestResponsesChainFallback(t *testing.T) {
+	var inputs []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		inputs = append(inputs, len(body["input"].([]any)))
+		if body["previous_response_id"] != nil {
+			http.Error(w, `{"error":{"message":"Previous response with id 'resp_1' not found."}}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"id":"resp_1","status":"completed","output":[{"type":"message","content":[{"type":"output_text","text":"ok"}]}],"usage":{"input_tokens":5,"output_tokens":1}}`)
+	}))
+	defer srv.Close()
+
+	c := NewOpenAIClient(&config.ModelConfig{Provider: "openai", API: config.APIResponses, APIKey: "k", BaseURL: srv.URL, Model: "gpt-5", MaxTokens: 100}, nil)
+	msgs := []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hi"}}}}
+	resp, err := c.Send(context.Background(), "", msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs = append(msgs, Message{Role: RoleAssistant, Content: resp.Content}, Message{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "again"}}})
+	if _, err := c.Send(context.Background(), "", msgs); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(inputs) != "[1 1 3]" {
+		t.Errorf("input sizes = %v, want the chained request resent in full", inputs)
+	}
+}
+
+func TestAnthropicDropsReasoningItems(t *testing.T) {
+	msgs := []Message{{Role: RoleAssistant, Content: []ContentBlock{
+		{Type: "reasoning", ID: "rs_1", Data: "enc"},
+		{Type: "text", Text: "hi"},
+	}}}
+	out := wireMessages(msgs)
+	if len(out[0].Content) != 1 || out[0].Content[0].Type != "text" {
+		t.Errorf("wire blocks = %+v", out[0].Content)
+	}
+}
@@ -0,0 +1,368 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/config"
+)
+
+// ErrorClass is the kind of failure an APIError is, which decides whether it
+// is retried and whether the client falls back to another model.
+type ErrorClass string
+
+const (
+	ClassRateLimit      ErrorClass = "rate_limit"
+	ClassOverloaded     ErrorClass = "overloaded" // 5xx, 529, overloaded_error events
+	ClassNetwork        ErrorClass = "network"    // the request or stream broke off
+	ClassAuth           ErrorClass = "auth"
+	ClassInvalidRequest ErrorClass = "invalid_request"
+	ClassContextLength  ErrorClass = "context_length"
+)
+
+// APIError is a failed request to a provider.
+type APIError struct {
+	Class   ErrorClass
+	Status  int // HTTP status, 0 for network and stream errors
+	Message string
+	// RetryAfter is how long the server asked to wait, 0 if it didn't say.
+	RetryAfter time.Duration
+	Err        error // the network error, if any
+}
+
+func (e *APIError) Error() string {
+	switch {
+	case e.Status > 0:
+		return fmt.Sprintf("API error (%d): %s", e.Status, e.Message)
+	case e.Err != nil:
+		return e.Message + ": " + e.Err.Error()
+	}
+	return "API error: " + e.Message
+}
+
+func (e *APIError) Unwrap() error { return e.Err }
+
+// Retryable reports whether the same request may succeed later.
+func (e *APIError) Retryable() bool {
+	switch e.Class {
+	case ClassRateLimit, ClassOverloaded, ClassNetwork:
+		return true
+	}
+	return false
+}
+
+// networkError wraps a failure to send a request or read its response.
+func networkError(op string, err error) *APIError {
+	return &APIError{Class: ClassNetwork, Message: op, Err: err}
+}
+
+// truncated is the error for a stream that ended before the response did,
+// without the connection reporting a failure.
+func truncated() *APIError {
+	return networkError("read stream", io.ErrUnexpectedEOF)
+}
+
+// newAPIError builds the error for a response with a failing status from
+// its headers and body, whichever provider's error format that is.
+func newAPIError(status int, header http.Header, body []byte) *APIError {
+	kind, msg, delay := parseErrorBody(body)
+	e := &APIError{Status: status, Message: msg, RetryAfter: retryAfter(header, time.Now())}
+	if msg == "" {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	if e.RetryAfter == 0 {
+		e.RetryAfter = delay
+	}
+	e.Class = classify(status, kind, e.Message)
+	return e
+}
+
+// streamError returns the error an in-stream event carries, or nil if data
+// is not an error event: {"type":"error","error":{...}} from Anthropic, or
+// {"error":{...}} from OpenAI-compatible servers and Gemini.
+func streamError(data []byte) *APIError {
+	var ev struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(data, &ev) != nil || len(ev.Error) == 0 || string(ev.Error) == "null" {
+		return nil
+	}
+	kind, msg, delay := parseErrorBody(data)
+	if kind != "" {
+		msg = kind + ": " + msg
+	}
+	return &APIError{Class: classify(0, kind, msg), Message: msg, RetryAfter: delay}
+}
+
+// parseErrorBody extracts the error kind (a type, code or status name), the
+// message and any retry delay from the error formats of the providers.
+func parseErrorBody(body []byte) (kind, msg string, delay time.Duration) {
+	var resp struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"` // Bedrock
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return "", "", 0
+	}
+	var text string
+	if json.Unmarshal(resp.Error, &text) == nil { // Ollama
+		return "", text, 0
+	}
+	var e struct {
+		Type    string          `json:"type"`
+		Code    json.RawMessage `json:"code"`
+		Status  string          `json:"status"`
+		Message string          `json:"message"`
+		Details []struct {
+			RetryDelay string `json:"retryDelay"`
+		} `json:"details"`
+	}
+	if json.Unmarshal(resp.Error, &e) != nil {
+		return "", resp.Message, 0
+	}
+	var code string
+	json.Unmarshal(e.Code, &code)
+	for _, k := range []string{code, e.Type, e.Status} {
+		if k != "" {
+			kind = k
+			break
+		}
+	}
+	for _, d := range e.Details {
+		if v, err := time.ParseDuration(d.RetryDelay); err == nil {
+			delay = v
+		}
+	}
+	if e.Message == "" {
+		e.Message = resp.Message
+	}
+	return kind, e.Message, delay
+}
+
+// contextLengthHints are how the providers say a prompt is too long.
+var contextLengthHints = []string{
+	"context_length_exceeded", "prompt is too long", "input is too long",
+	"maximum context length", "context window", "exceeds the maximum number of tokens",
+	"input token count",
+}
+
+// classify decides an error's class from its kind if that is a known one,
+// then its HTTP status. Errors inside a stream (status 0) of unknown kind
+// count as overloaded: the request itself was accepted.
+func classify(status int, kind, msg string) ErrorClass {
+	lower := strings.ToLower(kind + " " + msg)
+	for _, h := range contextLengthHints {
+		if strings.Contains(lower, h) {
+			return ClassContextLength
+		}
+	}
+	k := strings.ToLower(kind)
+	switch {
+	case k == "":
+	case strings.Contains(k, "overloaded"), strings.Contains(k, "unavailable"), k == "api_error", k == "server_error",
+		k == "internal", strings.Contains(k, "internalserver"), strings.Contains(k, "modelstreamerror"):
+		return ClassOverloaded
+	case strings.Contains(k, "rate_limit"), strings.Contains(k, "throttl"), k == "resource_exhausted":
+		return ClassRateLimit
+	case strings.Contains(k, "authentication"), strings.Contains(k, "permission"), strings.Contains(k, "accessdenied"),
+		k == "unauthenticated", k == "invalid_api_key":
+		return ClassAuth
+	case strings.Contains(k, "invalid"), strings.Contains(k, "validation"), k == "not_found_error":
+		return ClassInvalidRequest
+	}
+	switch {
+	case status == 0:
+		return ClassOverloaded
+	case status == http.StatusTooManyRequests:
+		return ClassRateLimit
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ClassAuth
+	case status == http.StatusRequestTimeout || status == http.StatusConflict || status >= 500:
+		return ClassOverloaded
+	}
+	return ClassInvalidRequest
+}
+
+// retryAfter reads how long the server asked to wait: Retry-After (seconds
+// or a date), OpenAI's retry-after-ms, or the reset time of an exhausted
+// anthropic-ratelimit-* or x-ratelimit-* limit.
+func retryAfter(h http.Header, now time.Time) time.Duration {
+	if ms, err := strconv.Atoi(h.Get("retry-after-ms")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	if v := h.Get("retry-after"); v != "" {
+		if s, err := strconv.ParseFloat(v, 64); err == nil && s > 0 {
+			return time.Duration(s * float64(time.Second))
+		}
+		if t, err := http.ParseTime(v); err == nil && t.After(now) {
+			return t.Sub(now)
+		}
+	}
+	var wait time.Duration
+	for _, limit := range []string{"requests", "tokens", "input-tokens", "output-tokens"} {
+		if h.Get("anthropic-ratelimit-"+limit+"-remaining") == "0" {
+			if t, err := time.Parse(time.RFC3339, h.Get("anthropic-ratelimit-"+limit+"-reset")); err == nil && t.Sub(now) > wait {
+				wait = t.Sub(now)
+			}
+		}
+		if h.Get("x-ratelimit-remaining-"+limit) == "0" {
+			if d, err := time.ParseDuration(h.Get("x-ratelimit-reset-" + limit)); err == nil && d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// Defaults for config.RetryPolicy fields left at zero.
+const (
+	defaultMaxRetries = 3
+	defaultBaseDelay  = 2 * time.Second
+	defaultMaxDelay   = time.Minute
+	defaultJitter     = 0.2
+)
+
+// retrier applies the retry policy to provider requests and reports each
+// retry. A client's providers share one; a nil retrier uses the defaults and
+// reports nothing.
+type retrier struct {
+	mu     sync.Mutex
+	policy config.RetryPolicy
+	report func(RetryEvent)
+}
+
+func (r *retrier) setPolicy(p config.RetryPolicy) {
+	r.mu.Lock()
+	r.policy = p
+	r.mu.Unlock()
+}
+
+// settings returns the policy with defaults filled in, and the report hook.
+func (r *retrier) settings() (config.RetryPolicy, func(RetryEvent)) {
+	var p config.RetryPolicy
+	var report func(RetryEvent)
+	if r != nil {
+		r.mu.Lock()
+		p, report = r.policy, r.report
+		r.mu.Unlock()
+	}
+	switch {
+	case p.MaxRetries == 0:
+		p.MaxRetries = defaultMaxRetries
+	case p.MaxRetries < 0:
+		p.MaxRetries = 0
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultMaxDelay
+	}
+	switch {
+	case p.Jitter == 0:
+		p.Jitter = defaultJitter
+	case p.Jitter < 0:
+		p.Jitter = 0
+	}
+	return p, report
+}
+
+// backoff returns the wait before retry number attempt (1-based): the
+// server's Retry-After if it gave one, else exponential backoff, both with
+// jitter so clients that failed together don't retry together. ok is false
+// if the server asks for longer than the policy's MaxDelay.
+func backoff(p config.RetryPolicy, attempt int, after time.Duration) (wait time.Duration, ok bool) {
+	if after > 0 {
+		if after > p.MaxDelay {
+			return 0, false
+		}
+		// only ever later: earlier would hit the limit again
+		return after + time.Duration(float64(after)*p.Jitter*rand.Float64()), true
+	}
+	wait = p.MaxDelay
+	if shift := attempt - 1; shift < 30 && p.BaseDelay<<shift < p.MaxDelay {
+		wait = p.BaseDelay << shift
+	}
+	return time.Duration(float64(wait) * (1 + p.Jitter*(2*rand.Float64()-1))), true
+}
+
+// retryCall calls fn until it succeeds or fails with an error the policy
+// won't retry: one that isn't retryable, or any error once the stream
+// behind started has passed output on (nil for requests without one).
+func retryCall[T any](ctx context.Context, r *retrier, model string, started *bool, fn func() (T, error)) (T, error) {
+	p, report := r.settings()
+	for attempt := 1; ; attempt++ {
+		v, err := fn()
+		if err == nil || ctx.Err() != nil {
+			return v, err
+		}
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || !apiErr.Retryable() || attempt > p.MaxRetries || started != nil && *started {
+			return v, err
+		}
+		wait, ok := backoff(p, attempt, apiErr.RetryAfter)
+		if !ok {
+			return v, err
+		}
+		if report != nil {
+			report(RetryEvent{Model: model, Attempt: attempt, Status: apiErr.Status, Class: apiErr.Class, Wait: wait})
+		}
+		if err := sleepCtx(ctx, wait); err != nil {
+			return v, err
+		}
+	}
+}
+
+// watchStream wraps cb to note when the stream first passes output on, after
+// which a failed attempt can't be repeated without repeating that output.
+func watchStream(cb StreamCallbacks) (StreamCallbacks, *bool) {
+	started := new(bool)
+	text, thinking, input, stop := cb.OnTextDelta, cb.OnThinkingDelta, cb.OnInputJSONDelta, cb.OnBlockStop
+	cb.OnTextDelta = func(s string) {
+		*started = true
+		if text != nil {
+			text(s)
+		}
+	}
+	cb.OnThinkingDelta = func(s string) {
+		*started = true
+		if thinking != nil {
+			thinking(s)
+		}
+	}
+	cb.OnInputJSONDelta = func(i int, s string) {
+		*started = true
+		if input != nil {
+			input(i, s)
+		}
+	}
+	cb.OnBlockStop = func(i int) {
+		*started = true
+		if stop != nil {
+			stop(i)
+		}
+	}
+	return cb, started
+}
+
+// canFallBack reports whether another model might succeed where one failed.
+// Auth, invalid-request and context-length errors are about the request or
+// the account, and would only fail again or hide the problem; errors that
+// aren't APIErrors (missing credentials, a model without vision) are local
+// to the provider that raised them.
+func canFallBack(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	return true
+}
@@ -0,0 +1,187 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/config"
+)
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		status int
+		header http.Header
+		body   string
+		class  ErrorClass
+		after  time.Duration
+	}{
+		{529, nil, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, ClassOverloaded, 0},
+		{429, http.Header{"Retry-After": {"7"}}, `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`, ClassRateLimit, 7 * time.Second},
+		{429, http.Header{"Retry-After-Ms": {"1500"}}, `{"error":{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}}`, ClassRateLimit, 1500 * time.Millisecond},
+		{401, nil, `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`, ClassAuth, 0},
+		{400, nil, `{"error":{"message":"This model's maximum context length is 128000 tokens.","type":"invalid_request_error","code":"context_length_exceeded"}}`, ClassContextLength, 0},
+		{400, nil, `{"type":"error","error":{"type":"invalid_request_error","message":"prompt is too long: 210000 tokens > 200000 maximum"}}`, ClassContextLength, 0},
+		{400, nil, `{"type":"error","error":{"type":"invalid_request_error","message":"messages: field required"}}`, ClassInvalidRequest, 0},
+		{429, nil, `{"error":{"code":429,"message":"Quota exceeded","status":"RESOURCE_EXHAUSTED","details":[{"retryDelay":"12s"}]}}`, ClassRateLimit, 12 * time.Second},
+		{503, nil, `<html>bad gateway</html>`, ClassOverloaded, 0},
+	}
+	for _, tt := range tests {
+		e := newAPIError(tt.status, tt.header, []byte(tt.body))
+		if e.Class != tt.class || e.RetryAfter != tt.after {
+			t.Errorf("%d %s: class %s, retry after %s; want %s, %s", tt.status, tt.body, e.Class, e.RetryAfter, tt.class, tt.after)
+		}
+	}
+}
+
+func TestRetryAfterRateLimitHeaders(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	h := http.Header{}
+	h.Set("anthropic-ratelimit-requests-remaining", "12")
+	h.Set("anthropic-ratelimit-requests-reset", now.Add(50*time.Second).Format(time.RFC3339))
+	h.Set("anthropic-ratelimit-input-tokens-remaining", "0")
+	h.Set("anthropic-ratelimit-input-tokens-reset", now.Add(20*time.Second).Format(time.RFC3339))
+	if got := retryAfter(h, now); got != 20*time.Second {
+		t.Errorf("anthropic reset = %s, want 20s from the exhausted limit", got)
+	}
+	h = http.Header{}
+	h.Set("x-ratelimit-remaining-tokens", "0")
+	h.Set("x-ratelimit-reset-tokens", "6m0s")
+	if got := retryAfter(h, now); got != 6*time.Minute {
+		t.Errorf("x-ratelimit reset = %s", got)
+	}
+	h.Set("Retry-After", now.Add(3*time.Second).Format(http.TimeFormat))
+	if got := retryAfter(h, now); got != 3*time.Second {
+		t.Errorf("Retry-After date = %s", got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p, _ := (*retrier)(nil).settings()
+	for i, base := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		attempt := i + 1
+		for range 20 {
+			wait, ok := backoff(p, attempt, 0)
+			if !ok || wait < base*8/10 || wait > base*12/10 {
+				t.Fatalf("attempt %d: wait %s outside %s ± 20%%", attempt, wait, base)
+			}
+		}
+	}
+	if wait, _ := backoff(p, 20, 0); wait > p.MaxDelay*12/10 {
+		t.Errorf("wait %s not capped at %s", wait, p.MaxDelay)
+	}
+	if wait, ok := backoff(p, 1, 5*time.Second); !ok || wait < 5*time.Second || wait > 6*time.Second {
+		t.Errorf("Retry-After 5s: wait %s", wait)
+	}
+	if _, ok := backoff(p, 1, 2*time.Minute); ok {
+		t.Error("Retry-After beyond max_delay should not be retried")
+	}
+}
+
+// fastRetry retries at once so tests don't wait.
+var fastRetry = config.RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Jitter: -1}
+
+func TestAnthropicRetriesOverloaded(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch calls {
+		case 1:
+			http.Error(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, 529)
+		case 2:
+			// the request was accepted, then the stream failed before any output
+			fmt.Fprint(w, "event: message_start\ndata: "+cloudEvents[0]+"\n\n")
+			fmt.Fprint(w, "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n")
+		default:
+			for _, e := range cloudEvents {
+				fmt.Fprintf(w, "data: %s\n\n", e)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	c := NewClient([]config.ModelConfig{{Provider: "anthropic", APIKey: "k", BaseURL: srv.URL, Model: "claude-sonnet-4", MaxTokens: 100}}, nil)
+	c.SetRetryPolicy(fastRetry)
+	var retries []RetryEvent
+	c.OnRetry(func(e RetryEvent) { retries = append(retries, e) })
+	msgs := []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hi"}}}}
+	resp, err := c.SendStream(context.Background(), "", msgs, StreamCallbacks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content[0].Text != "hi" || calls != 3 {
+		t.Errorf("response %+v after %d calls", resp, calls)
+	}
+	if len(retries) != 2 || retries[0].Status != 529 || retries[1].Status != 0 || retries[1].Class != ClassOverloaded {
+		t.Errorf("retries = %+v", retries)
+	}
+}
+
+func TestStreamErrorAfterOutputNotRetried(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		for _, e := range cloudEvents[:3] {
+			fmt.Fprintf(w, "data: %s\n\n", e)
+		}
+		fmt.Fprint(w, "data: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n")
+	}))
+	defer srv.Close()
+
+	c := NewAnthropicClient(&config.ModelConfig{APIKey: "k", BaseURL: srv.URL, Model: "claude-sonnet-4", MaxTokens: 100}, nil)
+	c.retry = &retrier{policy: fastRetry}
+	msgs := []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hi"}}}}
+	_, err := c.SendStream(context.Background(), "", msgs, StreamCallbacks{})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Class != ClassOverloaded || calls != 1 {
+		t.Errorf("err = %v after %d calls, want one overloaded attempt", err, calls)
+	}
+}
+
+func TestOpenAISendRetriesRateLimit(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After-Ms", "1")
+			http.Error(w, `{"error":{"message":"Rate limit reached","code":"rate_limit_exceeded"}}`, http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"id":"c1","choices":[{"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1}}`)
+	}))
+	defer srv.Close()
+
+	c := NewOpenAIClient(&config.ModelConfig{Provider: "openai", APIKey: "k", BaseURL: srv.URL, Model: "gpt-4o", MaxTokens: 100}, nil)
+	c.retry = &retrier{policy: fastRetry}
+	resp, err := c.Send(context.Background(), "", []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hi"}}}})
+	if err != nil || calls != 2 || resp.Content[0].Text != "ok" {
+		t.Errorf("Send = %+v, %v after %d calls", resp, err, calls)
+	}
+}
+
+func TestNoFallbackOnAuthError(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`, http.StatusUnauthorized)
+	}))
+	defer bad.Close()
+	var reached bool
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+	defer good.Close()
+
+	c := NewClient([]config.ModelConfig{
+		{Provider: "anthropic", APIKey: "k", BaseURL: bad.URL, Model: "claude-sonnet-4", MaxTokens: 100},
+		{Provider: "openai", APIKey: "k", BaseURL: good.URL, Model: "gpt-4o", MaxTokens: 100},
+	}, nil)
+	_, err := c.Send(context.Background(), "", []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hi"}}}})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Class != ClassAuth {
+		t.Errorf("err = %v, want an auth APIError", err)
+	}
+	if reached {
+		t.Error("fell back to another model on an auth error")
+	}
+}
@@ -0,0 +1,394 @@
+package llm
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/config"
+	"github.com/Lewis-404/axe/internal/pricing"
+)
+
+// Task is what a request is for. Routing rules can send a task to its own
+// model, e.g. compaction summaries to a cheap one.
+type Task string
+
+const (
+	TaskChat    Task = "chat"    // the agent loop
+	TaskEdit    Task = "edit"    // the agent loop once the turn has changed something
+	TaskCompact Task = "compact" // history summaries
+	TaskInit    Task = "init"    // /init
+)
+
+var tasks = []Task{TaskChat, TaskEdit, TaskCompact, TaskInit}
+
+type taskKey struct{}
+
+// WithTask marks the requests made with ctx as being for t.
+func WithTask(ctx context.Context, t Task) context.Context {
+	return context.WithValue(ctx, taskKey{}, t)
+}
+
+// TaskOf returns the task ctx was marked with, or "" if none.
+func TaskOf(ctx context.Context) Task {
+	t, _ := ctx.Value(taskKey{}).(Task)
+	return t
+}
+
+// Defaults for config.BreakerConfig fields left at zero.
+const (
+	defaultBreakerFailures = 3
+	defaultBreakerCooldown = time.Minute
+)
+
+// router holds the routing policy and how each model has been doing. A
+// client's sub-clients share it, so a model failing for one is skipped by
+// all of them.
+type router struct {
+	mu     sync.Mutex
+	cfg    config.RoutingConfig
+	next   int                 // round-robin position
+	health map[string]*health  // by model
+	last   map[Task]RouteEvent // the latest decision per task
+}
+
+// PromptSizer counts the tokens a request's prompt takes, locally.
+type PromptSizer func(system string, messages []Message) int
+
+// health is a model's circuit breaker and average latency.
+type health struct {
+	failures  int // in a row
+	openUntil time.Time
+	latency   time.Duration
+}
+
+func newRouter() *router {
+	return &router{health: map[string]*health{}, last: map[Task]RouteEvent{}}
+}
+
+func (r *router) of(model string) *health {
+	h := r.health[model]
+	if h == nil {
+		h = &health{}
+		r.health[model] = h
+	}
+	return h
+}
+
+// breaker returns the breaker settings with defaults filled in; failures is
+// 0 when the breaker is off.
+func (r *router) breaker() (failures int, cooldown time.Duration) {
+	failures, cooldown = r.cfg.Breaker.Failures, r.cfg.Breaker.Cooldown
+	switch {
+	case failures == 0:
+		failures = defaultBreakerFailures
+	case failures < 0:
+		failures = 0
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return failures, cooldown
+}
+
+// SetRouting sets the routing policy, rules and circuit breaker. Problems
+// (an unknown policy, task or model) are returned; the rest still applies.
+func (c *Client) SetRouting(cfg config.RoutingConfig) error {
+	var errs []error
+	switch cfg.Policy {
+	case "", config.RouteFallback, config.RouteCheapestCapable, config.RouteRoundRobin:
+	default:
+		errs = append(errs, fmt.Errorf("unknown routing policy %q, using %s", cfg.Policy, config.RouteFallback))
+		cfg.Policy = ""
+	}
+	rules := map[string]string{}
+	for task, model := range cfg.Rules {
+		switch {
+		case !slices.Contains(tasks, Task(task)):
+			errs = append(errs, fmt.Errorf("routing rule for unknown task %q (tasks: chat, edit, compact, init)", task))
+		case c.ConfigOf(model) == nil:
+			errs = append(errs, fmt.Errorf("routing rule %s: model %q is not configured", task, model))
+		default:
+			rules[task] = model
+		}
+	}
+	cfg.Rules = rules
+	c.router.mu.Lock()
+	c.router.cfg = cfg
+	c.router.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// SetPromptSizer sets how the cheapest-capable policy sizes this client's
+// prompts against context windows, normally with the tokenizer compaction
+// uses. It is per client, not shared through the router, since a sub-agent
+// sends a different tool list.
+func (c *Client) SetPromptSizer(fn PromptSizer) { c.sizer = fn }
+
+// route returns the order to try the providers in for a request, and
+// whether the one that serves it becomes the active model, which it doesn't
+// when a rule picked it. A decision other than the active model is reported
+// when it differs from the last one for the task.
+func (c *Client) route(ctx context.Context, system string, messages []Message) (order []int, sticky bool) {
+	task := TaskOf(ctx)
+	if task == "" {
+		task = TaskChat
+	}
+	r := c.router
+	// the prompt is sized outside the lock, and only when the policy needs it
+	size := 0
+	if c.sizesPrompts() {
+		sizer := c.sizer
+		if sizer == nil {
+			sizer = approxTokens
+		}
+		size = sizer(system, messages)
+	}
+	r.mu.Lock()
+	order, sticky, report := c.decide(task, messages, size)
+	r.mu.Unlock()
+	if report != nil {
+		c.routed(*report)
+	}
+	return order, sticky
+}
+
+// sizesPrompts reports whether the cheapest-capable policy is in effect, so
+// prompts are sized to pick a model, and a model whose context window turns
+// out too small falls back to the next one.
+func (c *Client) sizesPrompts() bool {
+	c.router.mu.Lock()
+	defer c.router.mu.Unlock()
+	return c.router.cfg.Policy == config.RouteCheapestCapable && !c.pinned
+}
+
+// decide is route with the router locked; size is the prompt's tokens. A
+// sub-client pinned to a model ignores the policy and rules.
+func (c *Client) decide(task Task, messages []Message, size int) (order []int, sticky bool, report *RouteEvent) {
+	n := len(c.providers)
+	r := c.router
+
+	policy := r.cfg.Policy
+	if policy == "" || c.pinned {
+		policy = config.RouteFallback
+	}
+	reason := ""
+	switch policy {
+	case config.RouteRoundRobin:
+		start := r.next % n
+		r.next++
+		for i := range n {
+			order = append(order, (start+i)%n)
+		}
+		reason = policy
+	case config.RouteCheapestCapable:
+		order = c.cheapest(messages, size)
+		reason = "cheapest"
+	default:
+		for i := range n {
+			order = append(order, (c.activeIdx+i)%n)
+		}
+	}
+	sticky = true
+	if model, ok := r.cfg.Rules[string(task)]; ok && !c.pinned {
+		if i := slices.IndexFunc(order, func(i int) bool { return c.providers[i].ModelName() == model }); i >= 0 {
+			order = append(append([]int{order[i]}, order[:i]...), order[i+1:]...)
+			reason, sticky = "rule", false
+		}
+	}
+
+	// models behind an open breaker go last, in case all of them are
+	var ready, open []int
+	var skipped []string
+	now := time.Now()
+	for _, i := range order {
+		if h := r.health[c.providers[i].ModelName()]; h != nil && now.Before(h.openUntil) {
+			open = append(open, i)
+			skipped = append(skipped, c.providers[i].ModelName())
+		} else {
+			ready = append(ready, i)
+		}
+	}
+	order = append(ready, open...)
+	if order[0] != c.activeIdx || len(skipped) > 0 {
+		e := RouteEvent{Task: task, Model: c.providers[order[0]].ModelName(), Reason: reason, Skipped: skipped}
+		if e.Reason == "" {
+			e.Reason = "breaker"
+		}
+		if prev, ok := r.last[task]; !ok || prev.Model != e.Model || prev.Reason != e.Reason || !slices.Equal(prev.Skipped, e.Skipped) {
+			report = &e
+		}
+		r.last[task] = e
+	} else {
+		delete(r.last, task)
+	}
+	return order, sticky, report
+}
+
+// cheapest orders the providers by price, those that can't take the
+// request (new images for a model without vision, a prompt beyond its
+// context window) last. Equal prices go to the faster model.
+func (c *Client) cheapest(messages []Message, size int) []int {
+	images := newImages(messages)
+	type option struct {
+		idx     int
+		capable bool
+		price   float64
+		latency time.Duration
+	}
+	var opts []option
+	for i, m := range c.configs {
+		o := option{idx: i, capable: (!images || m.SupportsVision()) && size < m.ContextLimit(), price: priceOf(m)}
+		if h := c.router.health[m.Model]; h != nil {
+			o.latency = h.latency
+		}
+		opts = append(opts, o)
+	}
+	slices.SortStableFunc(opts, func(a, b option) int {
+		switch {
+		case a.capable != b.capable:
+			if a.capable {
+				return -1
+			}
+			return 1
+		case a.price != b.price:
+			return cmp.Compare(a.price, b.price)
+		}
+		return cmp.Compare(a.latency, b.latency)
+	})
+	order := make([]int, len(opts))
+	for i, o := range opts {
+		order[i] = o.idx
+	}
+	return order
+}
+
+// priceOf is a model's list price, input plus output per million tokens.
+// Local models are free; unknown ones go after every known price.
+func priceOf(m *config.ModelConfig) float64 {
+	if m.IsOllama() {
+		return 0
+	}
+	if p, ok := pricing.Lookup(m.Model); ok {
+		return p.Input + p.Output
+	}
+	return math.Inf(1)
+}
+
+// approxTokens is a rough prompt size for clients without a PromptSizer:
+// the recorded size of messages that have one, about four bytes a token for
+// the rest.
+func approxTokens(system string, messages []Message) int {
+	n := len(system) / 4
+	for _, m := range messages {
+		if m.Tokens > 0 {
+			n += m.Tokens
+			continue
+		}
+		for _, b := range m.Content {
+			n += approxBlockTokens(b)
+		}
+	}
+	return n
+}
+
+// approxImageTokens is about what the largest image the APIs accept costs.
+const approxImageTokens = 1600
+
+func approxBlockTokens(b ContentBlock) int {
+	switch b.Type {
+	case "image":
+		return approxImageTokens
+	case "tool_use":
+		input, _ := json.Marshal(b.Input)
+		return (len(b.Name) + len(input)) / 4
+	}
+	n := (len(b.Text) + len(b.Content) + len(b.Thinking)) / 4
+	for _, p := range b.Parts {
+		n += approxBlockTokens(p)
+	}
+	return n
+}
+
+// served records a request the model at idx answered in d.
+func (c *Client) served(idx int, d time.Duration) {
+	r := c.router
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := r.of(c.providers[idx].ModelName())
+	h.failures, h.openUntil = 0, time.Time{}
+	if h.latency == 0 {
+		h.latency = d
+	} else {
+		h.latency = (h.latency*3 + d) / 4
+	}
+}
+
+// failed records a failed request to the model at idx. Only failures that
+// say something about the model's health count: those that could be
+// retried.
+func (c *Client) failed(idx int, err error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.Retryable() {
+		return
+	}
+	r := c.router
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	limit, cooldown := r.breaker()
+	h := r.of(c.providers[idx].ModelName())
+	h.failures++
+	if limit > 0 && h.failures >= limit {
+		h.openUntil = time.Now().Add(cooldown)
+	}
+}
+
+// ModelStatus is how a model has been doing, for /model.
+type ModelStatus struct {
+	Model     string
+	Price     float64       // input plus output $ per million tokens, +Inf if unknown
+	Latency   time.Duration // average time to answer, 0 before the first
+	Failures  int           // in a row
+	OpenUntil time.Time     // when the breaker closes, zero if it isn't open
+}
+
+// RouteStatus is the routing policy and state, for /model.
+type RouteStatus struct {
+	Policy string
+	Rules  map[string]string
+	Models []ModelStatus
+	Recent []RouteEvent // the latest decision per task that didn't go to the active model
+}
+
+func (c *Client) RouteStatus() RouteStatus {
+	r := c.router
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := RouteStatus{Policy: r.cfg.Policy, Rules: r.cfg.Rules}
+	if s.Policy == "" {
+		s.Policy = config.RouteFallback
+	}
+	now := time.Now()
+	for _, m := range c.configs {
+		ms := ModelStatus{Model: m.Model, Price: priceOf(m)}
+		if h := r.health[m.Model]; h != nil {
+			ms.Latency, ms.Failures = h.latency, h.failures
+			if now.Before(h.openUntil) {
+				ms.OpenUntil = h.openUntil
+			}
+		}
+		s.Models = append(s.Models, ms)
+	}
+	for _, t := range tasks {
+		if e, ok := r.last[t]; ok {
+			s.Recent = append(s.Recent, e)
+		}
+	}
+	return s
+}
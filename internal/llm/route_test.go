@@ -0,0 +1,236 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/config"
+)
+
+// countingServer answers every chat completion with "ok", streamed or not, counting requests.
+func countingServer(t *testing.T, hits *int) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*hits++
+		var body struct{ Stream bool }
+		json.NewDecoder(r.Body).Decode(&body)
+		if !body.Stream {
+			fmt.Fprint(w, `{"id":"c1","choices":[{"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`)
+			return
+		}
+		fmt.Fprint(w, "data: {\"id\":\"c1\",\"choices\":[{\"delta\":{\"content\":\"ok\"},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n")
+	}))
+}
+
+var hi = []Message{{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "hi"}}}}
+
+func TestRuleRoutesTaskWithoutSwitching(t *testing.T) {
+	var strong, cheap int
+	s1, s2 := countingServer(t, &strong), countingServer(t, &cheap)
+	defer s1.Close()
+	defer s2.Close()
+	c := NewClient([]config.ModelConfig{
+		{Provider: "openai", APIKey: "k", BaseURL: s1.URL, Model: "gpt-4o", MaxTokens: 100},
+		{Provider: "openai", APIKey: "k", BaseURL: s2.URL, Model: "gpt-4o-mini", MaxTokens: 100},
+	}, nil)
+	if err := c.SetRouting(config.RoutingConfig{Rules: map[string]string{"compact": "gpt-4o-mini"}}); err != nil {
+		t.Fatal(err)
+	}
+	var events []RouteEvent
+	c.OnRoute(func(e RouteEvent) { events = append(events, e) })
+
+	ctx := WithTask(context.Background(), TaskCompact)
+	for range 2 {
+		if _, err := c.Send(ctx, "", hi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.SendStream(context.Background(), "", hi, StreamCallbacks{}); err != nil {
+		t.Fatal(err)
+	}
+	if cheap != 2 || strong != 1 {
+		t.Errorf("cheap served %d, strong %d", cheap, strong)
+	}
+	if c.ModelName() != "gpt-4o" {
+		t.Errorf("active model = %s, want it unchanged by the rule", c.ModelName())
+	}
+	if len(events) != 1 || events[0].Task != TaskCompact || events[0].Model != "gpt-4o-mini" || events[0].Reason != "rule" {
+		t.Errorf("route events = %+v, want one for the repeated decision", events)
+	}
+	if s := c.RouteStatus(); len(s.Recent) != 1 || s.Models[1].Latency == 0 {
+		t.Errorf("status = %+v", s)
+	}
+}
+
+func TestSetRoutingRejectsUnknown(t *testing.T) {
+	c := NewClient([]config.ModelConfig{{Provider: "openai", APIKey: "k", Model: "gpt-4o"}}, nil)
+	err := c.SetRouting(config.RoutingConfig{Policy: "fastest", Rules: map[string]string{"review": "gpt-4o", "edit": "o3"}})
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if s := c.RouteStatus(); s.Policy != config.RouteFallback || len(s.Rules) != 0 {
+		t.Errorf("status = %+v", s)
+	}
+}
+
+func TestCheapestCapable(t *testing.T) {
+	var strong, cheap int
+	s1, s2 := countingServer(t, &strong), countingServer(t, &cheap)
+	defer s1.Close()
+	defer s2.Close()
+	noVision := false
+	c := NewClient([]config.ModelConfig{
+		{Provider: "openai", APIKey: "k", BaseURL: s1.URL, Model: "gpt-4o", MaxTokens: 100},
+		{Provider: "openai", APIKey: "k", BaseURL: s2.URL, Model: "gpt-4o-mini", MaxTokens: 100, Vision: &noVision},
+	}, nil)
+	c.SetRouting(config.RoutingConfig{Policy: config.RouteCheapestCapable})
+
+	if _, err := c.Send(context.Background(), "", hi); err != nil {
+		t.Fatal(err)
+	}
+	image := []Message{{Role: RoleUser, Content: []ContentBlock{
+		{Type: "image", Source: &ImageSource{Type: "url", URL: "https://example.com/a.png"}},
+		{Type: "text", Text: "what is this?"},
+	}}}
+	if _, err := c.Send(context.Background(), "", image); err != nil {
+		t.Fatal(err)
+	}
+	if cheap != 1 || strong != 1 {
+		t.Errorf("cheap served %d, strong %d; want the image on the vision model", cheap, strong)
+	}
+	// once the image is behind, the cheap model takes the session back
+	followUp := append(image, Message{Role: RoleAssistant, Content: []ContentBlock{{Type: "text", Text: "a cat"}}}, hi[0])
+	if _, err := c.Send(context.Background(), "", followUp); err != nil {
+		t.Fatal(err)
+	}
+	if cheap != 2 {
+		t.Errorf("cheap served %d, want the follow-up without an image", cheap)
+	}
+}
+
+func TestCheapestSizesPrompt(t *testing.T) {
+	var strong, cheap int
+	s1, s2 := countingServer(t, &strong), countingServer(t, &cheap)
+	defer s1.Close()
+	defer s2.Close()
+	c := NewClient([]config.ModelConfig{
+		{Provider: "openai", APIKey: "k", BaseURL: s1.URL, Model: "gpt-4o", MaxTokens: 100},
+		{Provider: "openai", APIKey: "k", BaseURL: s2.URL, Model: "gpt-4o-mini", MaxTokens: 100, ContextWindow: 1000},
+	}, nil)
+	c.SetRouting(config.RoutingConfig{Policy: config.RouteCheapestCapable})
+
+	// without a sizer, a large tool input still counts against the window
+	call := []Message{
+		{Role: RoleUser, Content: []ContentBlock{{Type: "text", Text: "write it"}}},
+		{Role: RoleAssistant, Content: []ContentBlock{{Type: "tool_use", ID: "t1", Name: "write_file", Input: map[string]any{"content": strings.Repeat("x", 8000)}}}},
+		{Role: RoleUser, Content: []ContentBlock{{Type: "tool_result", ToolID: "t1", Content: "ok"}}},
+	}
+	if _, err := c.Send(context.Background(), "", call); err != nil {
+		t.Fatal(err)
+	}
+	var sized []string
+	c.SetPromptSizer(func(system string, messages []Message) int {
+		sized = append(sized, system)
+		return 5000
+	})
+	if _, err := c.Send(context.Background(), "sys", hi); err != nil {
+		t.Fatal(err)
+	}
+	if cheap != 0 || strong != 2 {
+		t.Errorf("cheap served %d, strong %d; want both prompts on the larger window", cheap, strong)
+	}
+	if len(sized) != 1 || sized[0] != "sys" {
+		t.Errorf("sizer called with %q", sized)
+	}
+}
+
+func TestCheapestFallsBackOnContextLength(t *testing.T) {
+	var strong, cheap int
+	s1 := countingServer(t, &strong)
+	s2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cheap++
+		http.Error(w, `{"error":{"message":"This model's maximum context length is 128000 tokens.","type":"invalid_request_error","code":"context_length_exceeded"}}`, http.StatusBadRequest)
+	}))
+	defer s1.Close()
+	defer s2.Close()
+	c := NewClient([]config.ModelConfig{
+		{Provider: "openai", APIKey: "k", BaseURL: s1.URL, Model: "gpt-4o", MaxTokens: 100},
+		{Provider: "openai", APIKey: "k", BaseURL: s2.URL, Model: "gpt-4o-mini", MaxTokens: 100},
+	}, nil)
+	c.SetRouting(config.RoutingConfig{Policy: config.RouteCheapestCapable})
+	if _, err := c.Send(context.Background(), "", hi); err != nil {
+		t.Fatal(err)
+	}
+	if cheap != 1 || strong != 1 {
+		t.Errorf("cheap tried %d times, strong %d; want the prompt moved on", cheap, strong)
+	}
+
+	// the fallback policy keeps treating it as a problem with the request
+	c.SetRouting(config.RoutingConfig{Rules: map[string]string{"chat": "gpt-4o-mini"}})
+	if _, err := c.Send(context.Background(), "", hi); err == nil {
+		t.Error("context length error fell back under the fallback policy")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	var a, b int
+	s1, s2 := countingServer(t, &a), countingServer(t, &b)
+	defer s1.Close()
+	defer s2.Close()
+	c := NewClient([]config.ModelConfig{
+		{Provider: "openai", APIKey: "k", BaseURL: s1.URL, Model: "gpt-4o", MaxTokens: 100},
+		{Provider: "openai", APIKey: "k", BaseURL: s2.URL, Model: "gpt-4o-mini", MaxTokens: 100},
+	}, nil)
+	c.SetRouting(config.RoutingConfig{Policy: config.RouteRoundRobin})
+	for range 4 {
+		if _, err := c.Send(context.Background(), "", hi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a != 2 || b != 2 {
+		t.Errorf("served %d and %d, want 2 each", a, b)
+	}
+}
+
+func TestBreakerSkipsFailingModel(t *testing.T) {
+	var bad, good int
+	s1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bad++
+		http.Error(w, `{"error":{"message":"overloaded"}}`, http.StatusServiceUnavailable)
+	}))
+	s2 := countingServer(t, &good)
+	defer s1.Close()
+	defer s2.Close()
+	c := NewClient([]config.ModelConfig{
+		{Provider: "openai", APIKey: "k", BaseURL: s1.URL, Model: "gpt-4o", MaxTokens: 100},
+		{Provider: "openai", APIKey: "k", BaseURL: s2.URL, Model: "gpt-4o-mini", MaxTokens: 100},
+	}, nil)
+	c.SetRetryPolicy(config.RetryPolicy{MaxRetries: -1})
+	c.SetRouting(config.RoutingConfig{
+		Rules:   map[string]string{"chat": "gpt-4o"},
+		Breaker: config.BreakerConfig{Failures: 2, Cooldown: time.Hour},
+	})
+	var events []RouteEvent
+	c.OnRoute(func(e RouteEvent) { events = append(events, e) })
+	for range 4 {
+		if _, err := c.Send(context.Background(), "", hi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bad != 2 || good != 4 {
+		t.Errorf("failing model tried %d times, want 2 before the breaker opened", bad)
+	}
+	last := events[len(events)-1]
+	if last.Model != "gpt-4o-mini" || len(last.Skipped) != 1 || last.Skipped[0] != "gpt-4o" {
+		t.Errorf("route events = %+v", events)
+	}
+	if m := c.RouteStatus().Models[0]; m.OpenUntil.IsZero() || m.Failures != 2 {
+		t.Errorf("status = %+v", m)
+	}
+}
@@ -1,11 +1,16 @@
 package llm
 
+import "encoding/json"
+
 type Role string
 
+// ImageSource is an image inlined as base64 (Type "base64") or referenced by
+// URL (Type "url").
 type ImageSource struct {
 	Type      string `json:"type"`
-	MediaType string `json:"media_type"`
-	Data      string `json:"data"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
 }
 
 const (
@@ -14,48 +19,226 @@ const (
 )
 
 type ContentBlock struct {
-	Type    string    `json:"type"`
-	Text    string    `json:"text,omitempty"`
-	ID      string    `json:"id,omitempty"`
-	Name    string    `json:"name,omitempty"`
-	Input   any       `json:"input,omitempty"`
-	ToolID  string    `json:"tool_use_id,omitempty"`
-	Content string    `json:"content,omitempty"`
-	IsError bool      `json:"is_error,omitempty"`
-	Source  *ImageSource `json:"source,omitempty"`
+	Type    string `json:"type"`
+	Text    string `json:"text,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Input   any    `json:"input,omitempty"`
+	ToolID  string `json:"tool_use_id,omitempty"`
+	Content string `json:"content,omitempty"`
+	// Parts are the non-text parts of a tool_result (images), sent after
+	// Content. See MarshalJSON.
+	Parts   []ContentBlock `json:"-"`
+	IsError bool           `json:"is_error,omitempty"`
+	Source  *ImageSource   `json:"source,omitempty"`
+	// thinking / redacted_thinking blocks. They are kept in history because
+	// the API requires them to be echoed back verbatim within a tool loop.
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Data      string `json:"data,omitempty"`
+	// CacheControl marks a prompt-cache breakpoint. It is only set on the
+	// copies sent to the Anthropic API, never on stored history.
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+}
+
+// contentBlockJSON has ContentBlock's fields without its JSON methods.
+type contentBlockJSON ContentBlock
+
+// MarshalJSON writes a tool_result with Parts in the structured form,
+// "content": [{"type":"text",...}, {"type":"image",...}], a thinking block
+// with its required "thinking" field even when empty (a signature-only
+// block), and everything else as is.
+func (b ContentBlock) MarshalJSON() ([]byte, error) {
+	if b.Type == "thinking" {
+		return json.Marshal(struct {
+			contentBlockJSON
+			Thinking string `json:"thinking"`
+		}{contentBlockJSON(b), b.Thinking})
+	}
+	if b.Type != "tool_result" || len(b.Parts) == 0 {
+		return json.Marshal(contentBlockJSON(b))
+	}
+	parts := make([]ContentBlock, 0, len(b.Parts)+1)
+	if b.Content != "" {
+		parts = append(parts, ContentBlock{Type: "text", Text: b.Content})
+	}
+	parts = append(parts, b.Parts...)
+	return json.Marshal(struct {
+		contentBlockJSON
+		Content []ContentBlock `json:"content"`
+	}{contentBlockJSON(b), parts})
+}
+
+// UnmarshalJSON accepts content as a string or as a list of parts, whose
+// text is joined into Content and the rest kept in Parts.
+func (b *ContentBlock) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		contentBlockJSON
+		Content json.RawMessage `json:"content,omitempty"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*b = ContentBlock(raw.contentBlockJSON)
+	switch {
+	case len(raw.Content) == 0 || string(raw.Content) == "null":
+		return nil
+	case raw.Content[0] == '"':
+		return json.Unmarshal(raw.Content, &b.Content)
+	}
+	var parts []ContentBlock
+	if err := json.Unmarshal(raw.Content, &parts); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if p.Type == "text" {
+			b.Content += p.Text
+		} else {
+			b.Parts = append(b.Parts, p)
+		}
+	}
+	return nil
+}
+
+// CacheControl is an Anthropic prompt-cache breakpoint.
+type CacheControl struct {
+	Type string `json:"type"`
+}
+
+// ephemeral is the only cache type the Anthropic API supports.
+var ephemeral = &CacheControl{Type: "ephemeral"}
+
+// SystemBlock is one text block of a structured system prompt.
+type SystemBlock struct {
+	Type         string        `json:"type"`
+	Text         string        `json:"text"`
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
 }
 
 type Message struct {
 	Role    Role           `json:"role"`
 	Content []ContentBlock `json:"content"`
+	// Tokens is this message's size in the prompt, as far as it is known.
+	// It is bookkeeping saved with history and never sent to a provider.
+	Tokens int `json:"tokens,omitempty"`
+	// Compacted is set on the first message of a compacted history and
+	// holds the history it replaced. Like Tokens it is never sent.
+	Compacted *Compaction `json:"compacted,omitempty"`
+}
+
+// Compaction is the history a compaction replaced, kept so it can be
+// restored.
+type Compaction struct {
+	Messages []Message `json:"messages"`
+	Count    int       `json:"count"` // messages the compaction produced
 }
 
 type ToolDef struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	InputSchema any    `json:"input_schema"`
+	Name         string        `json:"name"`
+	Description  string        `json:"description"`
+	InputSchema  any           `json:"input_schema"`
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
 }
 
 type Request struct {
-	Model     string    `json:"model"`
-	MaxTokens int       `json:"max_tokens"`
-	System    string    `json:"system,omitempty"`
-	Messages  []Message `json:"messages"`
-	Tools     []ToolDef `json:"tools,omitempty"`
+	Model     string          `json:"model"`
+	MaxTokens int             `json:"max_tokens"`
+	System    []SystemBlock   `json:"system,omitempty"`
+	Messages  []Message       `json:"messages"`
+	Tools     []ToolDef       `json:"tools,omitempty"`
+	Thinking  *ThinkingConfig `json:"thinking,omitempty"`
+}
+
+// ThinkingConfig enables Anthropic extended thinking.
+type ThinkingConfig struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
 }
 
 type Response struct {
 	ID         string         `json:"id"`
 	Type       string         `json:"type"`
 	Role       Role           `json:"role"`
+	Model      string         `json:"model,omitempty"`
 	Content    []ContentBlock `json:"content"`
 	StopReason string         `json:"stop_reason"`
 	Usage      Usage          `json:"usage"`
+	// EmulatedTools is set when tools went through the prompt protocol, so
+	// tool calls are still inside the text (see ToolCallOpen).
+	EmulatedTools bool `json:"-"`
 }
 
+// Usage counts tokens for one or more requests. InputTokens excludes cached
+// prompt tokens, which are reported separately so they can be billed at
+// their own rates.
 type Usage struct {
-	InputTokens  int `json:"input_tokens"`
-	OutputTokens int `json:"output_tokens"`
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+	// ReasoningTokens is the part of OutputTokens spent on reasoning. It is
+	// already billed as output and only reported for visibility.
+	ReasoningTokens int `json:"reasoning_tokens,omitempty"`
+}
+
+// Add accumulates o into u.
+func (u *Usage) Add(o Usage) {
+	u.InputTokens += o.InputTokens
+	u.OutputTokens += o.OutputTokens
+	u.CacheCreationInputTokens += o.CacheCreationInputTokens
+	u.CacheReadInputTokens += o.CacheReadInputTokens
+	u.ReasoningTokens += o.ReasoningTokens
+}
+
+// PromptTokens is the full prompt size, cached or not.
+func (u Usage) PromptTokens() int {
+	return u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+}
+
+// UsageByModel attributes usage to the model that produced it, so mixed
+// sessions (fallback, /model, /ask) can be priced per model.
+type UsageByModel map[string]Usage
+
+// Add accumulates u under model.
+func (m UsageByModel) Add(model string, u Usage) {
+	acc := m[model]
+	acc.Add(u)
+	m[model] = acc
+}
+
+// Merge accumulates every entry of o into m.
+func (m UsageByModel) Merge(o UsageByModel) {
+	for model, u := range o {
+		m.Add(model, u)
+	}
+}
+
+// Since returns what was added to m after before was snapshotted.
+func (m UsageByModel) Since(before UsageByModel) UsageByModel {
+	out := UsageByModel{}
+	for model, u := range m {
+		b := before[model]
+		d := Usage{
+			InputTokens:              u.InputTokens - b.InputTokens,
+			OutputTokens:             u.OutputTokens - b.OutputTokens,
+			CacheCreationInputTokens: u.CacheCreationInputTokens - b.CacheCreationInputTokens,
+			CacheReadInputTokens:     u.CacheReadInputTokens - b.CacheReadInputTokens,
+			ReasoningTokens:          u.ReasoningTokens - b.ReasoningTokens,
+		}
+		if d != (Usage{}) {
+			out[model] = d
+		}
+	}
+	return out
+}
+
+// Total sums usage across all models.
+func (m UsageByModel) Total() Usage {
+	var t Usage
+	for _, u := range m {
+		t.Add(u)
+	}
+	return t
 }
 
 type ErrorResponse struct {
@@ -90,24 +273,30 @@ type ContentBlockDeltaEvent struct {
 		Type        string `json:"type"`
 		Text        string `json:"text,omitempty"`
 		PartialJSON string `json:"partial_json,omitempty"`
+		Thinking    string `json:"thinking,omitempty"`
+		Signature   string `json:"signature,omitempty"`
 	} `json:"delta"`
 }
 
+// MessageDeltaEvent carries cumulative usage: output_tokens is always set,
+// the input/cache counts only by some API versions (0 when absent).
 type MessageDeltaEvent struct {
 	Type  string `json:"type"`
 	Delta struct {
 		StopReason string `json:"stop_reason"`
 	} `json:"delta"`
-	Usage struct {
-		OutputTokens int `json:"output_tokens"`
-	} `json:"usage"`
+	Usage Usage `json:"usage"`
 }
 
 // StreamCallbacks holds callbacks for streaming events.
 type StreamCallbacks struct {
 	OnTextDelta      func(text string)
+	OnThinkingDelta  func(text string)
 	OnBlockStart     func(index int, block ContentBlock)
 	OnInputJSONDelta func(index int, partial string)
 	OnBlockStop      func(index int)
 	OnMessageDone    func(resp *Response)
+	// OnReset is called when the output passed on so far is discarded
+	// because the stream broke off, before the request starts over.
+	OnReset func()
 }
@@ -0,0 +1,199 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Lewis-404/axe/internal/config"
+)
+
+const vertexScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// vertexTransport reaches Claude through Vertex AI's rawPredict endpoints,
+// which take the Messages API body and stream the same SSE events. It
+// authenticates with OAuth tokens minted from a service-account key.
+type vertexTransport struct {
+	model *config.ModelConfig
+	http  *http.Client
+
+	mu      sync.Mutex
+	account *serviceAccount
+	token   string
+	expires time.Time
+}
+
+// serviceAccount is the part of a Google service-account JSON key needed
+// to mint tokens.
+type serviceAccount struct {
+	Type        string `json:"type"`
+	ProjectID   string `json:"project_id"`
+	PrivateKey  string `json:"private_key"`
+	ClientEmail string `json:"client_email"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func (t *vertexTransport) request(ctx context.Context, req Request, stream bool) (*http.Request, error) {
+	token, project, err := t.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if t.model.ProjectID != "" {
+		project = t.model.ProjectID
+	}
+	region := t.model.Region
+	if region == "" {
+		return nil, errors.New("vertex: region not set (config region or CLOUD_ML_REGION)")
+	}
+	body, err := platformBody(req, "vertex-2023-10-16", stream)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	action := "rawPredict"
+	if stream {
+		action = "streamRawPredict"
+	}
+	base := strings.TrimRight(t.model.BaseURL, "/")
+	switch {
+	case base != "":
+	case region == "global":
+		base = "https://aiplatform.googleapis.com"
+	default:
+		base = "https://" + region + "-aiplatform.googleapis.com"
+	}
+	u := fmt.Sprintf("%s/v1/projects/%s/locations/%s/publishers/anthropic/models/%s:%s", base, project, region, t.model.Model, action)
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	return httpReq, nil
+}
+
+func (t *vertexTransport) events(r io.Reader, fn func(data []byte) error) error {
+	return sseEvents(r, fn)
+}
+
+// accessToken returns a cached OAuth token, minting a new one a minute
+// before the old one expires, and the service account's project.
+func (t *vertexTransport) accessToken(ctx context.Context) (string, string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.account == nil {
+		sa, err := loadServiceAccount(t.model.CredentialsFile)
+		if err != nil {
+			return "", "", err
+		}
+		t.account = sa
+	}
+	if t.token != "" && time.Now().Before(t.expires) {
+		return t.token, t.account.ProjectID, nil
+	}
+
+	assertion, err := t.account.assertion(time.Now())
+	if err != nil {
+		return "", "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", t.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", fmt.Errorf("create token request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := t.http.Do(httpReq)
+	if err != nil {
+		return "", "", fmt.Errorf("vertex token: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("vertex token (%d): %s", resp.StatusCode, string(data))
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &tok); err != nil || tok.AccessToken == "" {
+		return "", "", fmt.Errorf("vertex token: unexpected response %s", string(data))
+	}
+	t.token = tok.AccessToken
+	t.expires = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return t.token, t.account.ProjectID, nil
+}
+
+func loadServiceAccount(path string) (*serviceAccount, error) {
+	if path == "" {
+		return nil, errors.New("vertex: no credentials file (config credentials_file or GOOGLE_APPLICATION_CREDENTIALS)")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("vertex credentials: %w", err)
+	}
+	var sa serviceAccount
+	if err := json.Unmarshal(data, &sa); err != nil {
+		return nil, fmt.Errorf("vertex credentials: %w", err)
+	}
+	if sa.Type != "service_account" || sa.PrivateKey == "" || sa.ClientEmail == "" {
+		return nil, fmt.Errorf("vertex credentials: %s is not a service-account key", path)
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &sa, nil
+}
+
+// assertion returns the signed JWT exchanged for an access token.
+func (sa *serviceAccount) assertion(now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return "", errors.New("vertex credentials: bad private key")
+	}
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		key, _ = k.(*rsa.PrivateKey)
+	} else if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = k
+	}
+	if key == nil {
+		return "", errors.New("vertex credentials: private key is not RSA")
+	}
+
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   sa.ClientEmail,
+		"scope": vertexScope,
+		"aud":   sa.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("sign token request: %w", err)
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
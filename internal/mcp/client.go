@@ -2,13 +2,18 @@ package mcp
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os/exec"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/Lewis-404/axe/internal/llm"
+	"github.com/Lewis-404/axe/internal/tools"
 )
 
 // Client connects to an MCP server via stdio (JSON-RPC 2.0)
@@ -41,9 +46,20 @@ type rpcError struct {
 }
 
 type ToolInfo struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	InputSchema any    `json:"inputSchema"`
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	InputSchema any              `json:"inputSchema"`
+	Annotations *ToolAnnotations `json:"annotations,omitempty"`
+}
+
+// ToolAnnotations are the optional behaviour hints a server sends with each
+// tool. Absent hints take the spec's defaults, see MCPTool.Annotations.
+type ToolAnnotations struct {
+	Title           string `json:"title,omitempty"`
+	ReadOnlyHint    *bool  `json:"readOnlyHint,omitempty"`
+	DestructiveHint *bool  `json:"destructiveHint,omitempty"`
+	IdempotentHint  *bool  `json:"idempotentHint,omitempty"`
+	OpenWorldHint   *bool  `json:"openWorldHint,omitempty"`
 }
 
 type toolsListResult struct {
@@ -56,8 +72,21 @@ type callToolResult struct {
 }
 
 type contentBlock struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
+	Type     string    `json:"type"`
+	Text     string    `json:"text"`
+	Data     string    `json:"data"`     // image, audio: base64
+	MimeType string    `json:"mimeType"` // image, audio, resource_link
+	URI      string    `json:"uri"`      // resource_link
+	Name     string    `json:"name"`     // resource_link
+	Resource *resource `json:"resource"` // resource
+}
+
+// resource is an embedded resource: text or a base64 blob.
+type resource struct {
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Blob     string `json:"blob"`
 }
 
 func NewClient(command string, args ...string) (*Client, error) {
@@ -76,7 +105,7 @@ func NewClient(command string, args ...string) (*Client, error) {
 	c := &Client{cmd: cmd, stdin: stdin, stdoutRaw: stdout, stdout: bufio.NewReader(stdout)}
 
 	// initialize
-	if _, err := c.call("initialize", map[string]any{
+	if _, err := c.call(context.Background(), "initialize", map[string]any{
 		"protocolVersion": "2024-11-05",
 		"capabilities":    map[string]any{},
 		"clientInfo":      map[string]any{"name": "axe", "version": "0.5.0"},
@@ -90,7 +119,7 @@ func NewClient(command string, args ...string) (*Client, error) {
 }
 
 func (c *Client) ListTools() ([]ToolInfo, error) {
-	raw, err := c.call("tools/list", nil)
+	raw, err := c.call(context.Background(), "tools/list", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -101,28 +130,71 @@ func (c *Client) ListTools() ([]ToolInfo, error) {
 	return result.Tools, nil
 }
 
-func (c *Client) CallTool(name string, args json.RawMessage) (string, error) {
-	raw, err := c.call("tools/call", map[string]any{
+func (c *Client) CallTool(ctx context.Context, name string, args json.RawMessage) (tools.Result, error) {
+	raw, err := c.call(ctx, "tools/call", map[string]any{
 		"name":      name,
 		"arguments": json.RawMessage(args),
 	})
 	if err != nil {
-		return "", err
+		return tools.Result{}, err
 	}
 	var result callToolResult
 	if err := json.Unmarshal(raw, &result); err != nil {
-		return "", err
+		return tools.Result{}, err
+	}
+	res := toolResult(result.Content)
+	if result.IsError {
+		return tools.Result{}, fmt.Errorf("mcp tool error: %s", res.Text)
+	}
+	return res, nil
+}
+
+// toolResult converts MCP content to a tool result. Images, whether inline
+// or embedded resources, become image parts; text resources are inlined
+// under their URI; anything the model cannot take is described in the text.
+func toolResult(content []contentBlock) tools.Result {
+	var res tools.Result
+	var text strings.Builder
+	note := func(format string, args ...any) {
+		if text.Len() > 0 && !strings.HasSuffix(text.String(), "\n") {
+			text.WriteString("\n")
+		}
+		fmt.Fprintf(&text, format, args...)
 	}
-	var text string
-	for _, b := range result.Content {
-		if b.Type == "text" {
-			text += b.Text
+	image := func(mime, data string) bool {
+		if !strings.HasPrefix(mime, "image/") || data == "" {
+			return false
 		}
+		res.Parts = append(res.Parts, llm.ContentBlock{Type: "image", Source: &llm.ImageSource{Type: "base64", MediaType: mime, Data: data}})
+		return true
 	}
-	if result.IsError {
-		return "", fmt.Errorf("mcp tool error: %s", text)
+	for _, b := range content {
+		switch b.Type {
+		case "text":
+			text.WriteString(b.Text)
+		case "image":
+			if !image(b.MimeType, b.Data) {
+				note("[image omitted: unsupported type %q]", b.MimeType)
+			}
+		case "resource":
+			r := b.Resource
+			switch {
+			case r == nil:
+			case r.Text != "":
+				note("[resource %s]\n%s", r.URI, r.Text)
+			case image(r.MimeType, r.Blob):
+				note("[resource %s: image attached]", r.URI)
+			default:
+				note("[resource %s: %s, binary content omitted]", r.URI, r.MimeType)
+			}
+		case "resource_link":
+			note("[resource link %s: %s]", b.Name, b.URI)
+		default:
+			note("[%s content omitted]", b.Type)
+		}
 	}
-	return text, nil
+	res.Text = text.String()
+	return res
 }
 
 func (c *Client) Close() {
@@ -132,9 +204,14 @@ func (c *Client) Close() {
 	c.cmd.Wait()
 }
 
-func (c *Client) call(method string, params any) (json.RawMessage, error) {
+func (c *Client) call(ctx context.Context, method string, params any) (json.RawMessage, error) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	unlock := true
+	defer func() {
+		if unlock {
+			c.mu.Unlock()
+		}
+	}()
 
 	id := c.nextID.Add(1)
 	req := jsonRPCRequest{JSONRPC: "2.0", ID: id, Method: method, Params: params}
@@ -173,14 +250,31 @@ func (c *Client) call(method string, params any) (json.RawMessage, error) {
 		}
 	}()
 
+	timeout := time.NewTimer(30 * time.Second)
+	defer timeout.Stop()
 	select {
 	case r := <-ch:
 		return r.data, r.err
-	case <-time.After(30 * time.Second):
+	case <-timeout.C:
 		// close stdout pipe to unblock the goroutine's ReadBytes
 		c.stdoutRaw.Close()
 		<-ch // wait for goroutine to exit
 		return nil, fmt.Errorf("mcp call %q timed out after 30s", method)
+	case <-ctx.Done():
+		c.notify("notifications/cancelled", map[string]any{"requestId": id, "reason": "user interrupt"})
+		// the reader goroutine still owns stdout; keep the lock until it
+		// drains the (possibly late) response so the next call doesn't race it
+		unlock = false
+		go func() {
+			select {
+			case <-ch:
+			case <-time.After(30 * time.Second):
+				c.stdoutRaw.Close()
+				<-ch
+			}
+			c.mu.Unlock()
+		}()
+		return nil, ctx.Err()
 	}
 }
 
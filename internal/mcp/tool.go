@@ -1,6 +1,11 @@
 package mcp
 
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Lewis-404/axe/internal/tools"
+)
 
 // MCPTool wraps an MCP server tool as an axe Tool
 type MCPTool struct {
@@ -8,13 +13,40 @@ type MCPTool struct {
 	name        string
 	description string
 	schema      any
+	annotations *ToolAnnotations
 }
 
 func (t *MCPTool) Name() string        { return t.name }
 func (t *MCPTool) Description() string { return t.description }
 func (t *MCPTool) Schema() any         { return t.schema }
-func (t *MCPTool) Execute(input json.RawMessage) (string, error) {
-	return t.client.CallTool(t.name, input)
+func (t *MCPTool) Execute(ctx context.Context, input json.RawMessage) (string, error) {
+	res, err := t.client.CallTool(ctx, t.name, input)
+	return res.Text, err
+}
+
+// ExecuteResult keeps the images the server returned.
+func (t *MCPTool) ExecuteResult(ctx context.Context, input json.RawMessage) (tools.Result, error) {
+	return t.client.CallTool(ctx, t.name, input)
+}
+
+// Annotations maps the server's hints onto axe's. Missing hints default as
+// in the MCP spec: not read-only, destructive, not idempotent, open-world.
+func (t *MCPTool) Annotations() tools.ToolAnnotations {
+	a := tools.ToolAnnotations{DestructiveHint: true, OpenWorldHint: true}
+	if t.annotations == nil {
+		return a
+	}
+	hint := func(p *bool, def bool) bool {
+		if p == nil {
+			return def
+		}
+		return *p
+	}
+	a.ReadOnlyHint = hint(t.annotations.ReadOnlyHint, false)
+	a.DestructiveHint = hint(t.annotations.DestructiveHint, true)
+	a.IdempotentHint = hint(t.annotations.IdempotentHint, false)
+	a.OpenWorldHint = hint(t.annotations.OpenWorldHint, true)
+	return a
 }
 
 // Tools returns all MCP server tools as axe-compatible Tool interfaces
@@ -25,7 +57,7 @@ func (c *Client) Tools() []MCPTool {
 	}
 	tools := make([]MCPTool, len(infos))
 	for i, info := range infos {
-		tools[i] = MCPTool{client: c, name: info.Name, description: info.Description, schema: info.InputSchema}
+		tools[i] = MCPTool{client: c, name: info.Name, description: info.Description, schema: info.InputSchema, annotations: info.Annotations}
 	}
 	return tools
 }
@@ -0,0 +1,53 @@
+package mcp
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Lewis-404/axe/internal/tools"
+)
+
+func TestToolAnnotations(t *testing.T) {
+	tests := []struct {
+		json string
+		want tools.ToolAnnotations
+	}{
+		{`{"name":"a"}`, tools.ToolAnnotations{DestructiveHint: true, OpenWorldHint: true}},
+		{`{"name":"b","annotations":{"readOnlyHint":true}}`, tools.ToolAnnotations{ReadOnlyHint: true, DestructiveHint: true, OpenWorldHint: true}},
+		{`{"name":"c","annotations":{"destructiveHint":false,"idempotentHint":true,"openWorldHint":false}}`, tools.ToolAnnotations{IdempotentHint: true}},
+	}
+	for _, tt := range tests {
+		var info ToolInfo
+		if err := json.Unmarshal([]byte(tt.json), &info); err != nil {
+			t.Fatal(err)
+		}
+		tool := MCPTool{name: info.Name, annotations: info.Annotations}
+		if got := tool.Annotations(); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.json, got, tt.want)
+		}
+		if tt.want.ReadOnlyHint && tool.Annotations().NeedsConfirm() {
+			t.Errorf("%s: read-only tool needs confirm", tt.json)
+		}
+	}
+}
+
+func TestToolResultContent(t *testing.T) {
+	var content []contentBlock
+	json.Unmarshal([]byte(`[
+		{"type":"text","text":"screenshot taken"},
+		{"type":"image","data":"aW1n","mimeType":"image/png"},
+		{"type":"resource","resource":{"uri":"file:///a.txt","mimeType":"text/plain","text":"hello"}},
+		{"type":"resource","resource":{"uri":"file:///b.jpg","mimeType":"image/jpeg","blob":"anBn"}},
+		{"type":"resource","resource":{"uri":"file:///c.bin","mimeType":"application/octet-stream","blob":"AAA="}}
+	]`), &content)
+	res := toolResult(content)
+	if len(res.Parts) != 2 || res.Parts[0].Source.MediaType != "image/png" || res.Parts[1].Source.Data != "anBn" {
+		t.Errorf("parts = %+v", res.Parts)
+	}
+	for _, want := range []string{"screenshot taken", "[resource file:///a.txt]\nhello", "file:///b.jpg: image attached", "file:///c.bin: application/octet-stream, binary content omitted"} {
+		if !strings.Contains(res.Text, want) {
+			t.Errorf("text lacks %q:\n%s", want, res.Text)
+		}
+	}
+}
@@ -2,55 +2,163 @@ package pricing
 
 import "strings"
 
-// per million tokens
+// per million tokens. CacheWrite/CacheRead are the prices for prompt tokens
+// written to / served from the provider's prompt cache.
 type ModelPrice struct {
-	Input  float64
-	Output float64
+	Input      float64
+	Output     float64
+	CacheWrite float64
+	CacheRead  float64
 }
 
 var prices = map[string]ModelPrice{
-	"claude-3-5-sonnet":    {3.0, 15.0},
-	"claude-sonnet-4":      {3.0, 15.0},
-	"claude-3-5-haiku":     {0.8, 4.0},
-	"claude-3-haiku":       {0.25, 1.25},
-	"claude-3-opus":        {15.0, 75.0},
-	"claude-opus-4":        {15.0, 75.0},
-	"gpt-4o":               {2.5, 10.0},
-	"gpt-4o-mini":          {0.15, 0.6},
-	"gpt-4-turbo":          {10.0, 30.0},
-	"gpt-4.1":              {2.0, 8.0},
-	"gpt-4.1-mini":         {0.4, 1.6},
-	"gpt-4.1-nano":         {0.1, 0.4},
-	"o1":                   {15.0, 60.0},
-	"o1-mini":              {1.1, 4.4},
-	"o1-pro":               {150.0, 600.0},
-	"o3":                   {2.0, 8.0},
-	"o3-mini":              {1.1, 4.4},
-	"o4-mini":              {1.1, 4.4},
-	"deepseek-chat":        {0.27, 1.10},
-	"deepseek-coder":       {0.14, 0.28},
-	"deepseek-reasoner":    {0.55, 2.19},
+	"claude-3-5-sonnet":    {3.0, 15.0, 3.75, 0.30},
+	"claude-sonnet-4":      {3.0, 15.0, 3.75, 0.30},
+	"claude-3-5-haiku":     {0.8, 4.0, 1.0, 0.08},
+	"claude-3-haiku":       {0.25, 1.25, 0.30, 0.03},
+	"claude-3-opus":        {15.0, 75.0, 18.75, 1.50},
+	"claude-opus-4":        {15.0, 75.0, 18.75, 1.50},
+	"gpt-4o":               {2.5, 10.0, 2.5, 1.25},
+	"gpt-4o-mini":          {0.15, 0.6, 0.15, 0.075},
+	"gpt-4-turbo":          {10.0, 30.0, 10.0, 10.0},
+	"gpt-4.1":              {2.0, 8.0, 2.0, 0.50},
+	"gpt-4.1-mini":         {0.4, 1.6, 0.4, 0.10},
+	"gpt-4.1-nano":         {0.1, 0.4, 0.1, 0.025},
+	"o1":                   {15.0, 60.0, 15.0, 7.50},
+	"o1-mini":              {1.1, 4.4, 1.1, 0.55},
+	"o1-pro":               {150.0, 600.0, 150.0, 150.0},
+	"o3":                   {2.0, 8.0, 2.0, 0.50},
+	"o3-mini":              {1.1, 4.4, 1.1, 0.55},
+	"o4-mini":              {1.1, 4.4, 1.1, 0.275},
+	"deepseek-chat":        {0.27, 1.10, 0.27, 0.07},
+	"deepseek-coder":       {0.14, 0.28, 0.14, 0.014},
+	"deepseek-reasoner":    {0.55, 2.19, 0.55, 0.14},
+	// Gemini caches implicitly: no write surcharge
+	"gemini-2.5-pro":        {1.25, 10.0, 1.25, 0.31},
+	"gemini-2.5-flash":      {0.30, 2.50, 0.30, 0.075},
+	"gemini-2.5-flash-lite": {0.10, 0.40, 0.10, 0.025},
+	"gemini-2.0-flash":      {0.10, 0.40, 0.10, 0.025},
+	"gemini-2.0-flash-lite": {0.075, 0.30, 0.075, 0.075},
+	"gemini-1.5-pro":        {1.25, 5.0, 1.25, 0.3125},
+	"gemini-1.5-flash":      {0.075, 0.30, 0.075, 0.01875},
+}
+
+// ModelLimits are a model's context window and maximum output, in tokens.
+type ModelLimits struct {
+	ContextWindow int
+	MaxOutput     int
+}
+
+var limits = map[string]ModelLimits{
+	"claude-3-5-sonnet": {200000, 8192},
+	"claude-3-7-sonnet": {200000, 64000},
+	"claude-sonnet-4":   {200000, 64000},
+	"claude-3-5-haiku":  {200000, 8192},
+	"claude-3-haiku":    {200000, 4096},
+	"claude-3-opus":     {200000, 4096},
+	"claude-opus-4":     {200000, 32000},
+	"gpt-4o":            {128000, 16384},
+	"gpt-4o-mini":       {128000, 16384},
+	"gpt-4-turbo":       {128000, 4096},
+	"gpt-4.1":           {1047576, 32768},
+	"gpt-4.1-mini":      {1047576, 32768},
+	"gpt-4.1-nano":      {1047576, 32768},
+	"o1":                {200000, 100000},
+	"o1-mini":           {128000, 65536},
+	"o1-pro":            {200000, 100000},
+	"o3":                {200000, 100000},
+	"o3-mini":           {200000, 100000},
+	"o4-mini":           {200000, 100000},
+	"deepseek-chat":     {65536, 8192},
+	"deepseek-coder":    {65536, 8192},
+	"deepseek-reasoner": {65536, 32768},
+	"gemini-2.5-pro":    {1048576, 65536},
+	"gemini-2.5-flash":  {1048576, 65536},
+	"gemini-2.0-flash":  {1048576, 8192},
+	"gemini-1.5-pro":    {2097152, 8192},
+	"gemini-1.5-flash":  {1048576, 8192},
+}
+
+// vision records which model families take image input. More specific
+// prefixes override broader ones, e.g. gpt-4o over gpt-4.
+var vision = map[string]bool{
+	"claude":       true,
+	"gpt-3.5":      false,
+	"gpt-4":        false,
+	"gpt-4-turbo":  true,
+	"gpt-4-vision": true,
+	"gpt-4o":       true,
+	"gpt-4.1":      true,
+	"gpt-4.5":      true,
+	"o1":           true,
+	"o1-mini":      false,
+	"o1-preview":   false,
+	"o3":           true,
+	"o3-mini":      false,
+	"o4-mini":      true,
+	"deepseek":     false,
+	"gemini":       true,
 }
 
 func Lookup(model string) (ModelPrice, bool) {
-	m := strings.ToLower(model)
-	// exact match first
-	if p, ok := prices[m]; ok {
-		return p, true
+	return lookup(prices, model)
+}
+
+// LookupLimits returns the built-in limits for known models.
+func LookupLimits(model string) (ModelLimits, bool) {
+	return lookup(limits, model)
+}
+
+// LookupVision reports whether a known model takes image input. ok is false
+// for unknown models.
+func LookupVision(model string) (supported, ok bool) {
+	return lookup(vision, model)
+}
+
+// lookup matches model exactly, then by the longest key it starts with, so
+// "gpt-4o-mini-2024-07-18" resolves to gpt-4o-mini rather than gpt-4o.
+func lookup[V any](table map[string]V, model string) (V, bool) {
+	m := baseModel(strings.ToLower(model))
+	if v, ok := table[m]; ok {
+		return v, true
 	}
-	// prefix match
-	for k, p := range prices {
-		if strings.HasPrefix(m, k) {
-			return p, true
+	best := ""
+	for k := range table {
+		if strings.HasPrefix(m, k) && len(k) > len(best) {
+			best = k
 		}
 	}
-	return ModelPrice{}, false
+	if best == "" {
+		var zero V
+		return zero, false
+	}
+	return table[best], true
+}
+
+// baseModel strips the Bedrock vendor and cross-region prefixes, so
+// "us.anthropic.claude-sonnet-4-20250514-v1:0" prices as claude-sonnet-4.
+// Vertex IDs ("claude-sonnet-4@20250514") already match by prefix.
+func baseModel(m string) string {
+	for _, p := range []string{"us.", "eu.", "apac.", "global."} {
+		if rest, ok := strings.CutPrefix(m, p); ok && strings.HasPrefix(rest, "anthropic.") {
+			m = rest
+			break
+		}
+	}
+	return strings.TrimPrefix(m, "anthropic.")
 }
 
 func Cost(model string, inputTokens, outputTokens int) float64 {
+	return CostWithCache(model, inputTokens, outputTokens, 0, 0)
+}
+
+// CostWithCache is Cost with prompt-cache writes and reads billed at their
+// own rates. inputTokens must not include the cached tokens.
+func CostWithCache(model string, inputTokens, outputTokens, cacheWrite, cacheRead int) float64 {
 	p, ok := Lookup(model)
 	if !ok {
 		return 0
 	}
-	return float64(inputTokens)/1e6*p.Input + float64(outputTokens)/1e6*p.Output
+	return float64(inputTokens)/1e6*p.Input + float64(outputTokens)/1e6*p.Output +
+		float64(cacheWrite)/1e6*p.CacheWrite + float64(cacheRead)/1e6*p.CacheRead
 }
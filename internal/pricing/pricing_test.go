@@ -37,3 +37,67 @@ func TestCostCalculation(t *testing.T) {
 		t.Errorf("Cost = %f, want ~%f", cost, expected)
 	}
 }
+
+func TestCostWithCache(t *testing.T) {
+	// claude-sonnet-4: $3.75/M cache write, $0.30/M cache read
+	cost := CostWithCache("claude-sonnet-4", 0, 0, 1_000_000, 1_000_000)
+	expected := 3.75 + 0.30
+	if cost < expected-0.01 || cost > expected+0.01 {
+		t.Errorf("CostWithCache = %f, want ~%f", cost, expected)
+	}
+	// cached reads must be cheaper than the same tokens billed as fresh input
+	if CostWithCache("claude-sonnet-4", 0, 0, 0, 1000) >= Cost("claude-sonnet-4", 1000, 0) {
+		t.Error("cache reads should be billed below the input rate")
+	}
+}
+
+func TestLookupLongestPrefix(t *testing.T) {
+	// must not resolve to gpt-4o, whatever the map order
+	for i := 0; i < 20; i++ {
+		p, ok := Lookup("gpt-4o-mini-2024-07-18")
+		if !ok || p.Input != 0.15 {
+			t.Fatalf("Lookup = %+v, %v; want gpt-4o-mini", p, ok)
+		}
+	}
+}
+
+func TestLookupCloudModelIDs(t *testing.T) {
+	want, _ := Lookup("claude-sonnet-4")
+	for _, id := range []string{"anthropic.claude-sonnet-4-20250514-v1:0", "us.anthropic.claude-sonnet-4-20250514-v1:0", "claude-sonnet-4@20250514"} {
+		if p, ok := Lookup(id); !ok || p != want {
+			t.Errorf("Lookup(%q) = %+v, %v", id, p, ok)
+		}
+	}
+}
+
+func TestLookupLimits(t *testing.T) {
+	l, ok := LookupLimits("claude-sonnet-4-20250514")
+	if !ok || l.ContextWindow != 200000 || l.MaxOutput != 64000 {
+		t.Errorf("claude-sonnet-4 limits = %+v, %v", l, ok)
+	}
+	if _, ok := LookupLimits("llama3:8b"); ok {
+		t.Error("unknown model has limits")
+	}
+}
+
+func TestLookupVision(t *testing.T) {
+	tests := []struct {
+		model  string
+		vision bool
+	}{
+		{"gpt-4o-mini", true},
+		{"gpt-4-0613", false},
+		{"gpt-4-turbo-2024-04-09", true},
+		{"o3-mini", false},
+		{"deepseek-chat", false},
+		{"claude-sonnet-4", true},
+	}
+	for _, tt := range tests {
+		if v, ok := LookupVision(tt.model); !ok || v != tt.vision {
+			t.Errorf("LookupVision(%s) = %v, %v; want %v", tt.model, v, ok, tt.vision)
+		}
+	}
+	if _, ok := LookupVision("llama3:8b"); ok {
+		t.Error("unknown model has a vision entry")
+	}
+}
@@ -0,0 +1,224 @@
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	_ "embed"
+	"encoding/base64"
+	"strconv"
+	"sync"
+	"unicode"
+)
+
+// cl100kRanks is OpenAI's cl100k_base encoding as published with tiktoken
+// (MIT licensed): one base64 token and its rank per line.
+//
+//go:embed cl100k_base.tiktoken
+var cl100kRanks []byte
+
+var (
+	ranksOnce sync.Once
+	ranks     map[string]int
+)
+
+// loadRanks parses the embedded encoding on first use.
+func loadRanks() map[string]int {
+	ranksOnce.Do(func() {
+		ranks = make(map[string]int, 100256)
+		sc := bufio.NewScanner(bytes.NewReader(cl100kRanks))
+		for sc.Scan() {
+			tok, rank, ok := bytes.Cut(sc.Bytes(), []byte(" "))
+			if !ok {
+				continue
+			}
+			b, err := base64.StdEncoding.DecodeString(string(tok))
+			if err != nil {
+				continue
+			}
+			if r, err := strconv.Atoi(string(rank)); err == nil {
+				ranks[string(b)] = r
+			}
+		}
+	})
+	return ranks
+}
+
+// encode returns the cl100k_base token ids of s.
+func encode(s string) []int {
+	r := loadRanks()
+	var ids []int
+	for _, piece := range split(s) {
+		ids = append(ids, bytePairEncode([]byte(piece), r)...)
+	}
+	return ids
+}
+
+// bytePairEncode merges the bytes of piece the way tiktoken does: starting
+// from single bytes, the adjacent pair whose concatenation has the lowest
+// rank (the leftmost of equal ones) is merged until no pair is in the
+// vocabulary. Candidate pairs wait in a heap, so long pieces such as runs
+// of spaces stay fast.
+func bytePairEncode(piece []byte, ranks map[string]int) []int {
+	if r, ok := ranks[string(piece)]; ok {
+		return []int{r}
+	}
+	n := len(piece)
+	// a part is known by its first byte i: it ends at next[i] and follows
+	// the part at prev[i]
+	next, prev := make([]int, n), make([]int, n)
+	dead := make([]bool, n)
+	for i := range n {
+		next[i], prev[i] = i+1, i-1
+	}
+	var pairs pairHeap
+	push := func(start, end int) {
+		if r, ok := ranks[string(piece[start:end])]; ok {
+			heap.Push(&pairs, pair{rank: r, start: start, end: end})
+		}
+	}
+	for i := 0; i+1 < n; i++ {
+		push(i, i+2)
+	}
+	for pairs.Len() > 0 {
+		p := heap.Pop(&pairs).(pair)
+		m := next[p.start]
+		// stale: a part of the pair was merged with something else since
+		if dead[p.start] || m == n || next[m] != p.end {
+			continue
+		}
+		next[p.start], dead[m] = next[m], true
+		if p.end < n {
+			prev[p.end] = p.start
+			push(p.start, next[p.end])
+		}
+		if q := prev[p.start]; q >= 0 {
+			push(q, p.end)
+		}
+	}
+	var ids []int
+	for i := 0; i < n; i = next[i] {
+		ids = append(ids, ranks[string(piece[i:next[i]])])
+	}
+	return ids
+}
+
+// pair is a candidate merge of the parts spanning piece[start:end].
+type pair struct{ rank, start, end int }
+
+// pairHeap orders pairs by rank, then position.
+type pairHeap []pair
+
+func (h pairHeap) Len() int { return len(h) }
+func (h pairHeap) Less(i, j int) bool {
+	return h[i].rank < h[j].rank || h[i].rank == h[j].rank && h[i].start < h[j].start
+}
+func (h pairHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *pairHeap) Push(x any)   { *h = append(*h, x.(pair)) }
+func (h *pairHeap) Pop() any {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
+
+// split is cl100k_base's pre-tokenizer, the regular expression
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}|
+//	 ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// written out by hand, since Go's regexp has no lookahead.
+func split(s string) []string {
+	rs := []rune(s)
+	var pieces []string
+	for i := 0; i < len(rs); {
+		n := matchAt(rs, i)
+		pieces = append(pieces, string(rs[i:i+n]))
+		i += n
+	}
+	return pieces
+}
+
+// matchAt returns the length of the piece starting at rs[i], trying the
+// alternatives of the pattern in order.
+func matchAt(rs []rune, i int) int {
+	at := func(j int) rune {
+		if j < len(rs) {
+			return rs[j]
+		}
+		return -1
+	}
+	letters := func(j int) int {
+		k := j
+		for k < len(rs) && unicode.IsLetter(rs[k]) {
+			k++
+		}
+		return k - j
+	}
+
+	// 's 't 're 've 'm 'll 'd
+	if rs[i] == '\'' {
+		a, b := unicode.ToLower(at(i+1)), unicode.ToLower(at(i+2))
+		switch {
+		case a == 's' || a == 't' || a == 'm' || a == 'd':
+			return 2
+		case (a == 'r' || a == 'v') && b == 'e', a == 'l' && b == 'l':
+			return 3
+		}
+	}
+	// [^\r\n\p{L}\p{N}]?\p{L}+
+	if n := letters(i); n > 0 {
+		return n
+	}
+	if r := rs[i]; r != '\r' && r != '\n' && !isLetterOrNumber(r) {
+		if n := letters(i + 1); n > 0 {
+			return 1 + n
+		}
+	}
+	// \p{N}{1,3}
+	if unicode.IsNumber(rs[i]) {
+		n := 1
+		for n < 3 && unicode.IsNumber(at(i+n)) {
+			n++
+		}
+		return n
+	}
+	// ' ?[^\s\p{L}\p{N}]+[\r\n]*'
+	j := i
+	if rs[j] == ' ' {
+		j++
+	}
+	if k := j; isPunct(at(k)) {
+		for isPunct(at(k)) {
+			k++
+		}
+		for at(k) == '\r' || at(k) == '\n' {
+			k++
+		}
+		return k - i
+	}
+	// the rest are whitespace runs
+	end := i
+	for end < len(rs) && unicode.IsSpace(rs[end]) {
+		end++
+	}
+	// \s*[\r\n]+: up to the last line break of the run
+	for k := end - 1; k >= i; k-- {
+		if rs[k] == '\r' || rs[k] == '\n' {
+			return k + 1 - i
+		}
+	}
+	// \s+(?!\S): leave the last space to the word that follows
+	if end < len(rs) && end-i > 1 {
+		return end - 1 - i
+	}
+	// \s+
+	return max(end-i, 1)
+}
+
+func isLetterOrNumber(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }
+
+// isPunct matches [^\s\p{L}\p{N}].
+func isPunct(r rune) bool {
+	return r >= 0 && !unicode.IsSpace(r) && !isLetterOrNumber(r)
+}
@@ -0,0 +1,100 @@
+// Package tokenizer counts tokens offline with a byte-pair encoder and
+// OpenAI's cl100k_base vocabulary. Counts are exact for GPT-4-class models
+// and close for Claude, whose tokenizer is not published. Counts from the
+// provider (usage, count_tokens) are preferred whenever available.
+package tokenizer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/Lewis-404/axe/internal/llm"
+)
+
+// Count returns the number of cl100k_base tokens in s.
+func Count(s string) int {
+	if s == "" {
+		return 0
+	}
+	return len(encode(s))
+}
+
+// perMessage is the framing overhead of a message (role markers etc.).
+const perMessage = 4
+
+// defaultImageTokens is charged for images whose size can't be read.
+const defaultImageTokens = 1600
+
+// Message returns the approximate number of tokens m takes in a prompt.
+func Message(m llm.Message) int {
+	n := perMessage
+	for _, b := range m.Content {
+		n += Block(b)
+	}
+	return n
+}
+
+// Block returns the approximate number of tokens of one content block.
+func Block(b llm.ContentBlock) int {
+	switch b.Type {
+	case "image":
+		return Image(b.Source)
+	case "tool_use":
+		input, _ := json.Marshal(b.Input)
+		return Count(b.Name) + Count(string(input)) + perMessage
+	case "tool_result":
+		n := Count(b.Content) + perMessage
+		for _, p := range b.Parts {
+			n += Block(p)
+		}
+		return n
+	case "redacted_thinking":
+		return len(b.Data) / 4
+	}
+	return Count(b.Text) + Count(b.Thinking)
+}
+
+// Image estimates an image's cost with Anthropic's rule of thumb,
+// width*height/750, capped where the API downscales.
+func Image(src *llm.ImageSource) int {
+	if src == nil || src.Data == "" {
+		return defaultImageTokens
+	}
+	data, err := base64.StdEncoding.DecodeString(src.Data)
+	if err != nil {
+		return defaultImageTokens
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return defaultImageTokens
+	}
+	n := cfg.Width * cfg.Height / 750
+	if n > defaultImageTokens {
+		n = defaultImageTokens
+	}
+	return max(n, 1)
+}
+
+// Tools returns the approximate prompt cost of the tool definitions.
+func Tools(defs []llm.ToolDef) int {
+	n := 0
+	for _, d := range defs {
+		schema, _ := json.Marshal(d.InputSchema)
+		n += Count(d.Name) + Count(d.Description) + Count(string(schema)) + perMessage
+	}
+	return n
+}
+
+// Messages sums Message over msgs.
+func Messages(msgs []llm.Message) int {
+	n := 0
+	for _, m := range msgs {
+		n += Message(m)
+	}
+	return n
+}
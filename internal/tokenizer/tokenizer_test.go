@@ -0,0 +1,83 @@
+package tokenizer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"slices"
+	"testing"
+
+	"github.com/Lewis-404/axe/internal/llm"
+)
+
+func TestCount(t *testing.T) {
+	// reference counts from tiktoken's cl100k_base
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"hello world", 2},
+		{"The quick brown fox jumps over the lazy dog.", 10},
+		{"func main() {\n\tfmt.Println(\"hi\")\n}", 10},
+		{"    if err != nil {\n        return err\n    }\n", 12},
+		{"你好，世界", 6},
+		{"お誕生日おめでとう", 9},
+		{"1234567890", 4},
+		{"antidisestablishmentarianism", 6},
+	}
+	for _, tt := range tests {
+		if got := Count(tt.text); got != tt.want {
+			t.Errorf("Count(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		text string
+		want []int
+	}{
+		{"hello world", []int{15339, 1917}},
+		{"tiktoken is great!", []int{83, 1609, 5963, 374, 2294, 0}},
+		{"2 + 2 = 4", []int{17, 489, 220, 17, 284, 220, 19}},
+		{"你好，世界", []int{57668, 53901, 3922, 3574, 244, 98220}},
+		{"func main() {\n\tfmt.Println(\"hi\")\n}", []int{2900, 1925, 368, 341, 11254, 12701, 446, 6151, 1158, 92}},
+	}
+	for _, tt := range tests {
+		if got := encode(tt.text); !slices.Equal(got, tt.want) {
+			t.Errorf("encode(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	got := split("I'm  here:\n\n  x = 12345;\r\n")
+	want := []string{"I", "'m", " ", " here", ":\n\n", " ", " x", " =", " ", "123", "45", ";\r\n"}
+	if !slices.Equal(got, want) {
+		t.Errorf("split = %q, want %q", got, want)
+	}
+}
+
+func TestImage(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 300, 250)))
+	src := &llm.ImageSource{Type: "base64", MediaType: "image/png", Data: base64.StdEncoding.EncodeToString(buf.Bytes())}
+	if got := Image(src); got != 100 {
+		t.Errorf("Image(300x250) = %d, want 100", got)
+	}
+	if got := Image(&llm.ImageSource{Data: "not base64!"}); got != defaultImageTokens {
+		t.Errorf("unreadable image = %d, want %d", got, defaultImageTokens)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	m := llm.Message{Role: llm.RoleUser, Content: []llm.ContentBlock{
+		{Type: "tool_result", ToolID: "t1", Content: "ok"},
+		{Type: "text", Text: "hello world"},
+	}}
+	if got, want := Message(m), perMessage+(1+perMessage)+2; got != want {
+		t.Errorf("Message = %d, want %d", got, want)
+	}
+}
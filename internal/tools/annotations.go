@@ -0,0 +1,128 @@
+package tools
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+)
+
+// ToolAnnotations describes how a tool behaves so confirmation, scheduling
+// and plan mode can be decided without hardcoding tool names. The hints
+// mirror MCP's tool annotations.
+type ToolAnnotations struct {
+	ReadOnlyHint    bool // never modifies its environment
+	DestructiveHint bool // may overwrite or delete (only meaningful if not read-only)
+	IdempotentHint  bool // repeating a call with the same input has no extra effect
+	OpenWorldHint   bool // reaches outside the workspace (shell, network, ...)
+}
+
+// defaultAnnotations is assumed for tools that don't declare any: like MCP,
+// expect the worst.
+var defaultAnnotations = ToolAnnotations{DestructiveHint: true, OpenWorldHint: true}
+
+// NeedsConfirm reports whether a call should be approved by the user first.
+func (a ToolAnnotations) NeedsConfirm() bool {
+	return !a.ReadOnlyHint && a.DestructiveHint
+}
+
+// Annotated is implemented by tools that declare their behaviour.
+type Annotated interface {
+	Annotations() ToolAnnotations
+}
+
+// selfConfirming is implemented by built-in tools that ask for confirmation
+// inside Execute, where they can show a diff or the exact command. Other
+// tools that need confirmation are confirmed by the registry.
+type selfConfirming interface {
+	confirmsItself()
+}
+
+// Resource is something a tool call touches. Two calls conflict when they
+// share a key (or either key is AnyResource, or FilesResource and the other
+// a file) and at least one writes.
+type Resource struct {
+	Key   string
+	Write bool
+}
+
+// AnyResource conflicts with every other resource.
+const AnyResource = "*"
+
+// ShellResource is shared by all shell-executing tools.
+const ShellResource = "shell"
+
+// FilesResource stands for every file, for calls such as shell commands
+// that may touch any of them.
+const FilesResource = "file:*"
+
+// IsFile reports whether r is a file, FilesResource included.
+func (r Resource) IsFile() bool { return strings.HasPrefix(r.Key, "file:") }
+
+// shellResources is what a shell command that may change things touches:
+// the shell, and any file.
+var shellResources = []Resource{{Key: ShellResource, Write: true}, {Key: FilesResource, Write: true}}
+
+// ResourceDeclarer is implemented by tools that can tell which resources a
+// call with the given input touches.
+type ResourceDeclarer interface {
+	Resources(input json.RawMessage) []Resource
+}
+
+// fileResource keys a path so different spellings of the same file conflict.
+func fileResource(path string, write bool) Resource {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return Resource{Key: "file:" + filepath.Clean(path), Write: write}
+}
+
+// pathResources decodes a {"path": ...} input into a single file resource.
+func pathResources(input json.RawMessage, write bool) []Resource {
+	var p struct {
+		Path string `json:"path"`
+	}
+	if json.Unmarshal(input, &p) != nil || p.Path == "" {
+		return []Resource{{Key: AnyResource, Write: write}}
+	}
+	return []Resource{fileResource(p.Path, write)}
+}
+
+var readOnly = ToolAnnotations{ReadOnlyHint: true, IdempotentHint: true}
+
+func (t *ReadFile) Annotations() ToolAnnotations    { return readOnly }
+func (t *ListDir) Annotations() ToolAnnotations     { return readOnly }
+func (t *SearchFiles) Annotations() ToolAnnotations { return readOnly }
+func (g *Glob) Annotations() ToolAnnotations        { return readOnly }
+func (t *Think) Annotations() ToolAnnotations       { return readOnly }
+
+func (t *WriteFile) Annotations() ToolAnnotations {
+	return ToolAnnotations{DestructiveHint: true, IdempotentHint: true}
+}
+func (t *EditFile) Annotations() ToolAnnotations { return ToolAnnotations{DestructiveHint: true} }
+func (t *ExecCmd) Annotations() ToolAnnotations {
+	return ToolAnnotations{DestructiveHint: true, OpenWorldHint: true}
+}
+func (t *BgCommand) Annotations() ToolAnnotations {
+	return ToolAnnotations{DestructiveHint: true, OpenWorldHint: true}
+}
+
+func (t *WriteFile) confirmsItself() {}
+func (t *EditFile) confirmsItself()  {}
+func (t *ExecCmd) confirmsItself()   {}
+func (t *BgCommand) confirmsItself() {}
+
+func (t *ReadFile) Resources(input json.RawMessage) []Resource  { return pathResources(input, false) }
+func (t *WriteFile) Resources(input json.RawMessage) []Resource { return pathResources(input, true) }
+func (t *EditFile) Resources(input json.RawMessage) []Resource  { return pathResources(input, true) }
+func (t *ExecCmd) Resources(json.RawMessage) []Resource         { return shellResources }
+
+func (t *BgCommand) Resources(input json.RawMessage) []Resource {
+	var p struct {
+		Action string `json:"action"`
+	}
+	json.Unmarshal(input, &p)
+	if p.Action == "status" || p.Action == "logs" {
+		return []Resource{{Key: ShellResource}}
+	}
+	return shellResources
+}
@@ -2,6 +2,7 @@ package tools
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os/exec"
@@ -55,7 +56,7 @@ var (
 )
 
 type BgCommand struct {
-	confirm func(string) bool
+	confirm func(context.Context, string) bool
 }
 
 func (t *BgCommand) Name() string { return "bg_command" }
@@ -74,7 +75,7 @@ func (t *BgCommand) Schema() any {
 	}
 }
 
-func (t *BgCommand) Execute(input json.RawMessage) (string, error) {
+func (t *BgCommand) Execute(ctx context.Context, input json.RawMessage) (string, error) {
 	var p struct {
 		Action  string `json:"action"`
 		Command string `json:"command"`
@@ -94,9 +95,14 @@ func (t *BgCommand) Execute(input json.RawMessage) (string, error) {
 				return "", fmt.Errorf("blocked dangerous command: %s", p.Command)
 			}
 		}
-		if t.confirm != nil && !t.confirm(p.Command) {
+		if t.confirm != nil && !t.confirm(ctx, p.Command) {
 			return "", fmt.Errorf("command rejected by user")
 		}
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		// background processes deliberately outlive the turn's context;
+		// they are only killed by action=stop
 		buf := &cappedBuffer{maxSize: maxBgOutput}
 		cmd := exec.Command("sh", "-c", p.Command)
 		cmd.Stdout = buf
@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -8,7 +9,7 @@ import (
 )
 
 type EditFile struct {
-	confirm func(path, oldText, newText string) bool
+	confirm func(ctx context.Context, path, oldText, newText string) bool
 }
 
 func (t *EditFile) Name() string        { return "edit_file" }
@@ -25,7 +26,7 @@ func (t *EditFile) Schema() any {
 	}
 }
 
-func (t *EditFile) Execute(input json.RawMessage) (string, error) {
+func (t *EditFile) Execute(ctx context.Context, input json.RawMessage) (string, error) {
 	var p struct {
 		Path    string `json:"path"`
 		OldText string `json:"old_text"`
@@ -42,7 +43,7 @@ func (t *EditFile) Execute(input json.RawMessage) (string, error) {
 	if !strings.Contains(content, p.OldText) {
 		return "", fmt.Errorf("old_text not found in %s", p.Path)
 	}
-	if t.confirm != nil && !t.confirm(p.Path, p.OldText, p.NewText) {
+	if t.confirm != nil && !t.confirm(ctx, p.Path, p.OldText, p.NewText) {
 		return "用户取消", nil
 	}
 	content = strings.Replace(content, p.OldText, p.NewText, 1)
@@ -1,10 +1,12 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os/exec"
 	"strings"
+	"time"
 )
 
 var dangerousPrefixes = []string{
@@ -15,7 +17,7 @@ var dangerousPrefixes = []string{
 }
 
 type ExecCmd struct {
-	confirm func(string) bool
+	confirm func(context.Context, string) bool
 }
 
 func (t *ExecCmd) Name() string        { return "execute_command" }
@@ -30,7 +32,7 @@ func (t *ExecCmd) Schema() any {
 	}
 }
 
-func (t *ExecCmd) Execute(input json.RawMessage) (string, error) {
+func (t *ExecCmd) Execute(ctx context.Context, input json.RawMessage) (string, error) {
 	var p struct{ Command string `json:"command"` }
 	if err := json.Unmarshal(input, &p); err != nil {
 		return "", err
@@ -42,13 +44,19 @@ func (t *ExecCmd) Execute(input json.RawMessage) (string, error) {
 		}
 	}
 
-	if t.confirm != nil && !t.confirm(p.Command) {
+	if t.confirm != nil && !t.confirm(ctx, p.Command) {
 		return "", fmt.Errorf("command rejected by user")
 	}
 
-	cmd := exec.Command("sh", "-c", p.Command)
+	cmd := exec.CommandContext(ctx, "sh", "-c", p.Command)
+	killGroupOnCancel(cmd)
+	// don't wait forever on pipes held open by anything that escaped the group
+	cmd.WaitDelay = 2 * time.Second
 	out, err := cmd.CombinedOutput()
 	result := string(out)
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("command cancelled: %w", ctx.Err())
+	}
 	if err != nil {
 		return result, fmt.Errorf("command failed: %w\noutput: %s", err, result)
 	}
@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -23,7 +24,7 @@ func (g *Glob) Schema() any {
 	}
 }
 
-func (g *Glob) Execute(input json.RawMessage) (string, error) {
+func (g *Glob) Execute(ctx context.Context, input json.RawMessage) (string, error) {
 	var p struct {
 		Pattern string `json:"pattern"`
 		Path    string `json:"path"`
@@ -38,6 +39,9 @@ func (g *Glob) Execute(input json.RawMessage) (string, error) {
 
 	var matches []string
 	filepath.WalkDir(base, func(path string, d os.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
 			return nil
 		}
@@ -70,6 +74,9 @@ func (g *Glob) Execute(input json.RawMessage) (string, error) {
 		return nil
 	})
 
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
 	if len(matches) == 0 {
 		return "No files matched.", nil
 	}
@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -22,7 +23,7 @@ func (t *ListDir) Schema() any {
 	}
 }
 
-func (t *ListDir) Execute(input json.RawMessage) (string, error) {
+func (t *ListDir) Execute(ctx context.Context, input json.RawMessage) (string, error) {
 	var p struct{ Path string `json:"path"` }
 	if err := json.Unmarshal(input, &p); err != nil {
 		return "", err
@@ -30,6 +31,9 @@ func (t *ListDir) Execute(input json.RawMessage) (string, error) {
 
 	var lines []string
 	err := filepath.WalkDir(p.Path, func(path string, d os.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
 			return nil
 		}
@@ -0,0 +1,185 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Step statuses for PlanStep.Status. The zero value means pending.
+const (
+	StepPending    = ""
+	StepInProgress = "in_progress"
+	StepDone       = "done"
+	StepSkipped    = "skipped"
+)
+
+type PlanStep struct {
+	Title    string   `json:"title"`
+	Files    []string `json:"files,omitempty"`
+	Commands []string `json:"commands,omitempty"`
+	Status   string   `json:"status,omitempty"`
+}
+
+// Plan is what the agent proposes in plan mode. Step statuses change
+// under mu, since update_plan may run while the plan is being rendered.
+type Plan struct {
+	Summary string     `json:"summary"`
+	Steps   []PlanStep `json:"steps"`
+
+	mu sync.Mutex
+}
+
+// Done returns how many steps are finished (done or skipped).
+func (p *Plan) Done() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done()
+}
+
+func (p *Plan) done() int {
+	n := 0
+	for _, s := range p.Steps {
+		if s.Status == StepDone || s.Status == StepSkipped {
+			n++
+		}
+	}
+	return n
+}
+
+// String renders the plan as a numbered checklist.
+func (p *Plan) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var b strings.Builder
+	if p.Summary != "" {
+		b.WriteString(p.Summary + "\n\n")
+	}
+	marks := map[string]string{StepPending: "[ ]", StepInProgress: "[~]", StepDone: "[x]", StepSkipped: "[-]"}
+	for i, s := range p.Steps {
+		fmt.Fprintf(&b, "%d. %s %s\n", i+1, marks[s.Status], s.Title)
+		if len(s.Files) > 0 {
+			fmt.Fprintf(&b, "   files: %s\n", strings.Join(s.Files, ", "))
+		}
+		for _, c := range s.Commands {
+			fmt.Fprintf(&b, "   $ %s\n", c)
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// setStatus marks step i (from 0) and returns how many steps are finished.
+func (p *Plan) setStatus(i int, status string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Steps[i].Status = status
+	return p.done()
+}
+
+// planResource is written by the plan tools, so two plan calls in one turn
+// run one after the other.
+var planResource = []Resource{{Key: "plan", Write: true}}
+
+// SubmitPlan is offered in plan mode so the agent can hand in its plan as
+// structured data instead of prose.
+type SubmitPlan struct {
+	OnSubmit func(*Plan)
+}
+
+func (t *SubmitPlan) Name() string { return "submit_plan" }
+func (t *SubmitPlan) Description() string {
+	return "Submit your implementation plan for the user's approval. Call this once you have investigated enough; list concrete steps with the files each step will touch and the commands it will run. After calling it, stop and wait for the user."
+}
+func (t *SubmitPlan) Schema() any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"summary": map[string]any{
+				"type":        "string",
+				"description": "One or two sentences on the approach",
+			},
+			"steps": map[string]any{
+				"type": "array",
+				"items": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"title":    map[string]any{"type": "string", "description": "What this step does"},
+						"files":    map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "description": "Files to create or modify"},
+						"commands": map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "description": "Commands to run"},
+					},
+					"required": []string{"title"},
+				},
+			},
+		},
+		"required": []string{"summary", "steps"},
+	}
+}
+func (t *SubmitPlan) Annotations() ToolAnnotations         { return readOnly }
+func (t *SubmitPlan) Resources(json.RawMessage) []Resource { return planResource }
+
+func (t *SubmitPlan) Execute(ctx context.Context, input json.RawMessage) (string, error) {
+	p := &Plan{}
+	if err := json.Unmarshal(input, p); err != nil {
+		return "", fmt.Errorf("invalid input: %w", err)
+	}
+	if len(p.Steps) == 0 {
+		return "", fmt.Errorf("plan has no steps")
+	}
+	for i := range p.Steps {
+		p.Steps[i].Status = StepPending
+	}
+	if t.OnSubmit != nil {
+		t.OnSubmit(p)
+	}
+	return "Plan submitted. Stop here and wait for the user to approve, revise or reject it.", nil
+}
+
+// UpdatePlan lets the agent report progress on the approved plan.
+type UpdatePlan struct {
+	Plan *Plan
+}
+
+func (t *UpdatePlan) Name() string { return "update_plan" }
+func (t *UpdatePlan) Description() string {
+	return "Report progress on the approved plan: mark a step in_progress when you start it and done (or skipped) when it is finished."
+}
+func (t *UpdatePlan) Schema() any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"step": map[string]any{
+				"type":        "integer",
+				"description": "Step number, starting at 1",
+			},
+			"status": map[string]any{
+				"type": "string",
+				"enum": []string{StepInProgress, StepDone, StepSkipped},
+			},
+		},
+		"required": []string{"step", "status"},
+	}
+}
+func (t *UpdatePlan) Annotations() ToolAnnotations         { return readOnly }
+func (t *UpdatePlan) Resources(json.RawMessage) []Resource { return planResource }
+
+func (t *UpdatePlan) Execute(ctx context.Context, input json.RawMessage) (string, error) {
+	var p struct {
+		Step   int    `json:"step"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(input, &p); err != nil {
+		return "", fmt.Errorf("invalid input: %w", err)
+	}
+	if p.Step < 1 || p.Step > len(t.Plan.Steps) {
+		return "", fmt.Errorf("step %d out of range (1-%d)", p.Step, len(t.Plan.Steps))
+	}
+	switch p.Status {
+	case StepInProgress, StepDone, StepSkipped:
+	default:
+		return "", fmt.Errorf("invalid status %q", p.Status)
+	}
+	done := t.Plan.setStatus(p.Step-1, p.Status)
+	return fmt.Sprintf("Step %d marked %s (%d/%d finished).", p.Step, p.Status, done, len(t.Plan.Steps)), nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package tools
+
+import "os/exec"
+
+// killGroupOnCancel leaves the default cancel, which kills only cmd itself.
+func killGroupOnCancel(cmd *exec.Cmd) {}
@@ -1,16 +1,19 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+
+	"github.com/Lewis-404/axe/internal/llm"
 )
 
 type ReadFile struct{}
 
 func (t *ReadFile) Name() string        { return "read_file" }
-func (t *ReadFile) Description() string { return "Read the contents of a file. Use offset and limit to read specific line ranges for large files." }
+func (t *ReadFile) Description() string { return "Read the contents of a file. Use offset and limit to read specific line ranges for large files. Image files (png, jpg, gif, webp) are returned as images." }
 func (t *ReadFile) Schema() any {
 	return map[string]any{
 		"type": "object",
@@ -25,18 +28,34 @@ func (t *ReadFile) Schema() any {
 
 const maxReadLines = 2000
 
-func (t *ReadFile) Execute(input json.RawMessage) (string, error) {
+func (t *ReadFile) Execute(ctx context.Context, input json.RawMessage) (string, error) {
+	res, err := t.ExecuteResult(ctx, input)
+	return res.Text, err
+}
+
+// ExecuteResult returns image files as an image the model can see, and
+// everything else as text.
+func (t *ReadFile) ExecuteResult(ctx context.Context, input json.RawMessage) (Result, error) {
 	var p struct {
 		Path   string `json:"path"`
 		Offset int    `json:"offset"`
 		Limit  int    `json:"limit"`
 	}
 	if err := json.Unmarshal(input, &p); err != nil {
-		return "", err
+		return Result{}, err
 	}
 	data, err := os.ReadFile(p.Path)
 	if err != nil {
-		return "", fmt.Errorf("read %s: %w", p.Path, err)
+		return Result{}, fmt.Errorf("read %s: %w", p.Path, err)
+	}
+	if mime, ok := llm.ImageMediaType(p.Path); ok {
+		if len(data) > llm.MaxImageBytes {
+			return Result{}, fmt.Errorf("image %s is %d bytes, over the %d byte limit", p.Path, len(data), llm.MaxImageBytes)
+		}
+		return Result{
+			Text:  fmt.Sprintf("Image %s (%s, %d bytes)", p.Path, mime, len(data)),
+			Parts: []llm.ContentBlock{llm.ImageBlock(mime, data)},
+		}, nil
 	}
 	lines := strings.Split(string(data), "\n")
 	total := len(lines)
@@ -64,5 +83,5 @@ func (t *ReadFile) Execute(input json.RawMessage) (string, error) {
 	if end < total {
 		result += fmt.Sprintf("\n... (%d more lines, use offset=%d to continue)", total-end, end+1)
 	}
-	return result, nil
+	return Result{Text: result}, nil
 }
@@ -1,17 +1,35 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/Lewis-404/axe/internal/llm"
 )
 
+// Tool is a capability exposed to the LLM. Execute must return promptly once
+// ctx is cancelled so an interrupted turn does not hang on a slow tool.
 type Tool interface {
 	Name() string
 	Description() string
 	Schema() any
-	Execute(input json.RawMessage) (string, error)
+	Execute(ctx context.Context, input json.RawMessage) (string, error)
+}
+
+// Result is a tool's output: text, plus images for tools that return them.
+type Result struct {
+	Text  string
+	Parts []llm.ContentBlock
+}
+
+// MultimodalTool is implemented by tools whose output can include images.
+// The registry calls ExecuteResult instead of Execute.
+type MultimodalTool interface {
+	Tool
+	ExecuteResult(ctx context.Context, input json.RawMessage) (Result, error)
 }
 
 // BatchConfirmItem represents a tool call pending batch confirmation.
@@ -24,47 +42,43 @@ type Registry struct {
 	tools        map[string]Tool
 	confirm      func(cmd string) bool
 	batchConfirm func(toolName string, items []BatchConfirmItem) bool
+	confirmTool  func(name string, input json.RawMessage) bool
 	postHook     PostExecHook
-	skipConfirm  map[string]bool // tools to skip individual confirm (batch-approved)
+	confirmMu    sync.Mutex // one interactive prompt at a time
+	planMode     bool       // only read-only tools are offered and allowed
 }
 
 type RegistryOpts struct {
 	Confirm          func(string) bool
 	ConfirmOverwrite func(path string, oldLines, newLines int) bool
 	ConfirmEdit      func(path, oldText, newText string) bool
+	// ConfirmTool approves calls to tools (e.g. MCP) whose annotations ask
+	// for confirmation but which can't prompt themselves.
+	ConfirmTool func(name string, input json.RawMessage) bool
 }
 
 // PostExecHook is called after a tool executes successfully. name is the tool name, result is the output.
-type PostExecHook func(name string, input json.RawMessage, result string) string
+type PostExecHook func(ctx context.Context, name string, input json.RawMessage, result string) string
 
 func NewRegistry(opts RegistryOpts) *Registry {
-	r := &Registry{tools: make(map[string]Tool), confirm: opts.Confirm}
-	// wrap confirm callbacks to respect batch-approved skipConfirm
-	var wrappedConfirm func(string) bool
+	r := &Registry{tools: make(map[string]Tool), confirm: opts.Confirm, confirmTool: opts.ConfirmTool}
+	// wrap confirm callbacks to respect batch approval and ordering gates
+	var wrappedConfirm func(context.Context, string) bool
 	if opts.Confirm != nil {
-		wrappedConfirm = func(cmd string) bool {
-			if r.IsSkipConfirm("execute_command") || r.IsSkipConfirm("bg_command") {
-				return true
-			}
-			return opts.Confirm(cmd)
+		wrappedConfirm = func(ctx context.Context, cmd string) bool {
+			return r.gatedConfirm(ctx, func() bool { return opts.Confirm(cmd) })
 		}
 	}
-	var wrappedOverwrite func(string, int, int) bool
+	var wrappedOverwrite func(context.Context, string, int, int) bool
 	if opts.ConfirmOverwrite != nil {
-		wrappedOverwrite = func(path string, old, new int) bool {
-			if r.IsSkipConfirm("write_file") {
-				return true
-			}
-			return opts.ConfirmOverwrite(path, old, new)
+		wrappedOverwrite = func(ctx context.Context, path string, old, new int) bool {
+			return r.gatedConfirm(ctx, func() bool { return opts.ConfirmOverwrite(path, old, new) })
 		}
 	}
-	var wrappedEdit func(string, string, string) bool
+	var wrappedEdit func(context.Context, string, string, string) bool
 	if opts.ConfirmEdit != nil {
-		wrappedEdit = func(path, oldText, newText string) bool {
-			if r.IsSkipConfirm("edit_file") {
-				return true
-			}
-			return opts.ConfirmEdit(path, oldText, newText)
+		wrappedEdit = func(ctx context.Context, path, oldText, newText string) bool {
+			return r.gatedConfirm(ctx, func() bool { return opts.ConfirmEdit(path, oldText, newText) })
 		}
 	}
 	r.Register(&ReadFile{})
@@ -82,48 +96,157 @@ func NewRegistry(opts RegistryOpts) *Registry {
 func (r *Registry) SetPostExecHook(h PostExecHook)                          { r.postHook = h }
 func (r *Registry) SetBatchConfirm(fn func(string, []BatchConfirmItem) bool) { r.batchConfirm = fn }
 
-// SetSkipConfirm marks a tool to skip individual confirmation (batch-approved).
-func (r *Registry) SetSkipConfirm(name string, skip bool) {
-	if r.skipConfirm == nil {
-		r.skipConfirm = map[string]bool{}
+type confirmKey struct{}
+
+// confirmState travels with a single call's context.
+type confirmState struct {
+	approved bool            // batch-approved: skip the individual prompt
+	wait     <-chan struct{} // closed once the previous call has been confirmed
+	release  func()          // signals that this call's confirmation is over
+}
+
+// WithApproved marks a call as already approved (e.g. by BatchConfirm).
+func WithApproved(ctx context.Context) context.Context {
+	return context.WithValue(ctx, confirmKey{}, &confirmState{approved: true})
+}
+
+// WithConfirmGate orders the confirmation prompt of a call that may run
+// concurrently with others: the prompt waits until wait is closed, and
+// release is called once the user has answered.
+func WithConfirmGate(ctx context.Context, wait <-chan struct{}, release func()) context.Context {
+	return context.WithValue(ctx, confirmKey{}, &confirmState{wait: wait, release: release})
+}
+
+func (r *Registry) gatedConfirm(ctx context.Context, ask func() bool) bool {
+	st, _ := ctx.Value(confirmKey{}).(*confirmState)
+	if st != nil && st.approved {
+		return true
 	}
-	if skip {
-		r.skipConfirm[name] = true
-	} else {
-		delete(r.skipConfirm, name)
+	if st != nil && st.wait != nil {
+		select {
+		case <-st.wait:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	if st != nil && st.release != nil {
+		defer st.release()
 	}
+	if ctx.Err() != nil {
+		return false
+	}
+	r.confirmMu.Lock()
+	defer r.confirmMu.Unlock()
+	return ask()
+}
+
+// Annotations returns the declared behaviour of a tool, or conservative
+// defaults (destructive, open-world) for tools that don't declare any.
+func (r *Registry) Annotations(name string) ToolAnnotations {
+	if a, ok := r.tools[name].(Annotated); ok {
+		return a.Annotations()
+	}
+	return defaultAnnotations
+}
+
+// ReadOnly reports whether a tool never modifies its environment.
+func (r *Registry) ReadOnly(name string) bool {
+	return r.Annotations(name).ReadOnlyHint
 }
 
-// IsSkipConfirm returns true if the tool should skip individual confirmation.
-func (r *Registry) IsSkipConfirm(name string) bool {
-	return r.skipConfirm != nil && r.skipConfirm[name]
+// Resources returns what a call touches. Read-only tools that don't say
+// otherwise touch nothing; undeclared mutating tools conflict with everything.
+func (r *Registry) Resources(name string, input json.RawMessage) []Resource {
+	if d, ok := r.tools[name].(ResourceDeclarer); ok {
+		return d.Resources(input)
+	}
+	if r.Annotations(name).ReadOnlyHint {
+		return nil
+	}
+	return []Resource{{Key: AnyResource, Write: true}}
 }
 
 // NeedsConfirm returns true if the tool requires user confirmation.
 func (r *Registry) NeedsConfirm(name string) bool {
-	switch name {
-	case "write_file", "edit_file", "execute_command", "bg_command":
-		return true
+	if _, ok := r.tools[name]; !ok {
+		return false
 	}
-	return false
+	return r.Annotations(name).NeedsConfirm()
 }
 
 func (r *Registry) Register(t Tool) {
 	r.tools[t.Name()] = t
 }
 
-func (r *Registry) Execute(name string, input json.RawMessage) (string, error) {
+func (r *Registry) Unregister(name string) {
+	delete(r.tools, name)
+}
+
+// Has reports whether a tool is registered.
+func (r *Registry) Has(name string) bool {
+	_, ok := r.tools[name]
+	return ok
+}
+
+// Subset returns a registry offering only the named tools. It shares the
+// tool instances, confirmation callbacks and post-exec hook with r.
+func (r *Registry) Subset(names []string) *Registry {
+	s := &Registry{
+		tools:        make(map[string]Tool),
+		confirm:      r.confirm,
+		batchConfirm: r.batchConfirm,
+		confirmTool:  r.confirmTool,
+		postHook:     r.postHook,
+	}
+	for _, n := range names {
+		if t, ok := r.tools[n]; ok {
+			s.tools[n] = t
+		}
+	}
+	return s
+}
+
+// SetPlanMode restricts the registry to read-only tools (on) or lifts the
+// restriction (off).
+func (r *Registry) SetPlanMode(on bool) { r.planMode = on }
+func (r *Registry) PlanMode() bool      { return r.planMode }
+
+func (r *Registry) Execute(ctx context.Context, name string, input json.RawMessage) (string, error) {
+	res, err := r.ExecuteResult(ctx, name, input)
+	return res.Text, err
+}
+
+// ExecuteResult is Execute keeping the non-text parts (images) of results
+// from multimodal tools.
+func (r *Registry) ExecuteResult(ctx context.Context, name string, input json.RawMessage) (Result, error) {
 	t, ok := r.tools[name]
 	if !ok {
-		return "", fmt.Errorf("unknown tool: %s", name)
+		return Result{}, fmt.Errorf("unknown tool: %s", name)
+	}
+	if r.planMode && !r.ReadOnly(name) {
+		return Result{}, fmt.Errorf("%s is not available in plan mode; submit a plan first", name)
 	}
-	result, err := t.Execute(input)
-	if err == nil && r.postHook != nil {
-		if extra := r.postHook(name, input, result); extra != "" {
-			result += "\n\n" + extra
+	if _, ok := t.(selfConfirming); !ok && r.confirmTool != nil && r.NeedsConfirm(name) {
+		if !r.gatedConfirm(ctx, func() bool { return r.confirmTool(name, input) }) {
+			if ctx.Err() != nil {
+				return Result{}, ctx.Err()
+			}
+			return Result{Text: "用户取消"}, nil
 		}
 	}
-	return result, err
+	var res Result
+	var err error
+	if mt, ok := t.(MultimodalTool); ok {
+		res, err = mt.ExecuteResult(ctx, input)
+	} else {
+		res.Text, err = t.Execute(ctx, input)
+	}
+	if err == nil && r.postHook != nil && ctx.Err() == nil {
+		if extra := r.postHook(ctx, name, input, res.Text); extra != "" {
+			res.Text += "\n\n" + extra
+		}
+	}
+	return res, err
 }
 
 // BatchConfirm asks user to confirm a group of same-type tool calls at once.
@@ -135,14 +258,21 @@ func (r *Registry) BatchConfirm(toolName string, items []BatchConfirmItem) bool
 	return r.batchConfirm(toolName, items)
 }
 
+// Definitions returns tool definitions sorted by name. The stable order keeps
+// the tool list byte-identical across requests so it can be prompt-cached.
+// In plan mode only read-only tools are listed.
 func (r *Registry) Definitions() []llm.ToolDef {
 	var defs []llm.ToolDef
 	for _, t := range r.tools {
+		if r.planMode && !r.ReadOnly(t.Name()) {
+			continue
+		}
 		defs = append(defs, llm.ToolDef{
 			Name:        t.Name(),
 			Description: t.Description(),
 			InputSchema: t.Schema(),
 		})
 	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
 	return defs
 }
@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"os/exec"
 	"strings"
@@ -21,7 +22,7 @@ func (t *SearchFiles) Schema() any {
 	}
 }
 
-func (t *SearchFiles) Execute(input json.RawMessage) (string, error) {
+func (t *SearchFiles) Execute(ctx context.Context, input json.RawMessage) (string, error) {
 	var p struct {
 		Pattern string `json:"pattern"`
 		Path    string `json:"path"`
@@ -29,12 +30,15 @@ func (t *SearchFiles) Execute(input json.RawMessage) (string, error) {
 	if err := json.Unmarshal(input, &p); err != nil {
 		return "", err
 	}
-	cmd := exec.Command("grep", "-rn", "--include=*.go", "--include=*.yaml", "--include=*.yml",
+	cmd := exec.CommandContext(ctx, "grep", "-rn", "--include=*.go", "--include=*.yaml", "--include=*.yml",
 		"--include=*.json", "--include=*.md", "--include=*.txt", "--include=*.mod",
 		"--include=*.py", "--include=*.js", "--include=*.ts", "--include=*.tsx", "--include=*.jsx",
 		"--include=*.rs", "--include=*.toml", "--include=*.cfg", "--include=*.sh",
 		"-I", p.Pattern, p.Path)
 	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
 	result := strings.TrimSpace(string(out))
 	if err != nil {
 		if result == "" {
@@ -0,0 +1,66 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// TaskRequest is the input of the task tool.
+type TaskRequest struct {
+	Description string   `json:"description"`
+	Prompt      string   `json:"prompt"`
+	Tools       []string `json:"tools,omitempty"` // read-only tools to allow, all of them if empty
+	Model       string   `json:"model,omitempty"` // configured model to use, the current one if empty
+}
+
+// Task delegates a self-contained job to a sub-agent with its own history
+// and read-only tools. Only the sub-agent's final answer comes back, so
+// large explorations don't fill the caller's context with raw tool output.
+type Task struct {
+	Run func(ctx context.Context, req TaskRequest) (string, error)
+}
+
+func (t *Task) Name() string { return "task" }
+func (t *Task) Description() string {
+	return "Delegate a self-contained research job (e.g. \"find all callers of X\", \"how is config loaded?\") to a sub-agent with its own context and read-only tools. Only its final report is returned, so use it for exploration that would otherwise flood the conversation with raw search and file output. Several task calls in one response run in parallel. The sub-agent cannot see this conversation: put everything it needs in the prompt."
+}
+func (t *Task) Schema() any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"description": map[string]any{
+				"type":        "string",
+				"description": "Short label for the task (3-5 words)",
+			},
+			"prompt": map[string]any{
+				"type":        "string",
+				"description": "Complete instructions, including what to report back",
+			},
+			"tools": map[string]any{
+				"type":        "array",
+				"items":       map[string]any{"type": "string"},
+				"description": "Read-only tools the sub-agent may use (default: all of them)",
+			},
+			"model": map[string]any{
+				"type":        "string",
+				"description": "Configured model to run the sub-agent on (default: the current model)",
+			},
+		},
+		"required": []string{"description", "prompt"},
+	}
+}
+
+// Annotations: the sub-agent only gets read-only tools.
+func (t *Task) Annotations() ToolAnnotations { return readOnly }
+
+func (t *Task) Execute(ctx context.Context, input json.RawMessage) (string, error) {
+	var req TaskRequest
+	if err := json.Unmarshal(input, &req); err != nil {
+		return "", fmt.Errorf("invalid input: %w", err)
+	}
+	if req.Prompt == "" {
+		return "", fmt.Errorf("prompt is required")
+	}
+	return t.Run(ctx, req)
+}
@@ -1,6 +1,9 @@
 package tools
 
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+)
 
 // Think is a no-op tool that lets the LLM plan before acting.
 type Think struct{}
@@ -20,6 +23,6 @@ func (t *Think) Schema() any {
 	}
 }
 
-func (t *Think) Execute(input json.RawMessage) (string, error) {
+func (t *Think) Execute(ctx context.Context, input json.RawMessage) (string, error) {
 	return "Plan noted. Proceed with execution.", nil
 }
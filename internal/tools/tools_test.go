@@ -1,11 +1,13 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSkipDir(t *testing.T) {
@@ -98,7 +100,7 @@ func TestReadFileOffsetLimit(t *testing.T) {
 
 	// basic read
 	input, _ := json.Marshal(map[string]any{"path": path})
-	result, err := rf.Execute(input)
+	result, err := rf.Execute(context.Background(), input)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -108,7 +110,7 @@ func TestReadFileOffsetLimit(t *testing.T) {
 
 	// offset + limit
 	input, _ = json.Marshal(map[string]any{"path": path, "offset": 5, "limit": 3})
-	result, err = rf.Execute(input)
+	result, err = rf.Execute(context.Background(), input)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -122,3 +124,92 @@ func TestReadFileOffsetLimit(t *testing.T) {
 		t.Errorf("offset/limit read got %d content lines, want 3", len(contentLines))
 	}
 }
+
+func TestReadFileImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shot.png")
+	os.WriteFile(path, []byte("\x89PNG\r\n\x1a\n"), 0644)
+
+	input, _ := json.Marshal(map[string]any{"path": path})
+	res, err := (&ReadFile{}).ExecuteResult(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Parts) != 1 || res.Parts[0].Type != "image" || res.Parts[0].Source.MediaType != "image/png" {
+		t.Errorf("parts = %+v, want one png image", res.Parts)
+	}
+	if strings.Contains(res.Text, "PNG") {
+		t.Errorf("text should describe the image, not contain it: %q", res.Text)
+	}
+}
+
+func TestExecCmdCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	input, _ := json.Marshal(map[string]any{"command": "sleep 10"})
+	start := time.Now()
+	_, err := (&ExecCmd{}).Execute(ctx, input)
+	if err == nil {
+		t.Fatal("expected error for cancelled command")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled command took %s, want prompt return", elapsed)
+	}
+}
+
+type fakeTool struct {
+	name  string
+	ann   *ToolAnnotations
+	calls int
+}
+
+func (f *fakeTool) Name() string        { return f.name }
+func (f *fakeTool) Description() string { return "" }
+func (f *fakeTool) Schema() any         { return nil }
+func (f *fakeTool) Execute(context.Context, json.RawMessage) (string, error) {
+	f.calls++
+	return "ok", nil
+}
+
+type annotatedTool struct{ fakeTool }
+
+func (a *annotatedTool) Annotations() ToolAnnotations { return *a.ann }
+
+func TestAnnotationsDriveConfirm(t *testing.T) {
+	var asked []string
+	r := NewRegistry(RegistryOpts{ConfirmTool: func(name string, _ json.RawMessage) bool {
+		asked = append(asked, name)
+		return false
+	}})
+	plain := &fakeTool{name: "plain"}
+	reader := &annotatedTool{fakeTool{name: "reader", ann: &ToolAnnotations{ReadOnlyHint: true}}}
+	additive := &annotatedTool{fakeTool{name: "additive", ann: &ToolAnnotations{}}}
+	r.Register(plain)
+	r.Register(reader)
+	r.Register(additive)
+
+	for name, want := range map[string]bool{
+		"write_file": true, "edit_file": true, "execute_command": true, "bg_command": true,
+		"read_file": false, "glob": false, "think": false,
+		"plain": true, "reader": false, "additive": false, "missing": false,
+	} {
+		if got := r.NeedsConfirm(name); got != want {
+			t.Errorf("NeedsConfirm(%s) = %v, want %v", name, got, want)
+		}
+	}
+
+	ctx := context.Background()
+	if out, _ := r.Execute(ctx, "plain", nil); out != "用户取消" || plain.calls != 0 {
+		t.Errorf("rejected call ran: %q, calls=%d", out, plain.calls)
+	}
+	r.Execute(ctx, "reader", nil)
+	r.Execute(ctx, "additive", nil)
+	if reader.calls != 1 || additive.calls != 1 {
+		t.Errorf("non-destructive tools not run: %d %d", reader.calls, additive.calls)
+	}
+	if _, err := r.Execute(WithApproved(ctx), "plain", nil); err != nil || plain.calls != 1 {
+		t.Errorf("batch-approved call not run: %v, calls=%d", err, plain.calls)
+	}
+	if len(asked) != 1 || asked[0] != "plain" {
+		t.Errorf("asked = %v, want [plain]", asked)
+	}
+}
@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -9,7 +10,7 @@ import (
 )
 
 type WriteFile struct {
-	confirm func(path string, oldLines, newLines int) bool
+	confirm func(ctx context.Context, path string, oldLines, newLines int) bool
 }
 
 func (t *WriteFile) Name() string        { return "write_file" }
@@ -25,7 +26,7 @@ func (t *WriteFile) Schema() any {
 	}
 }
 
-func (t *WriteFile) Execute(input json.RawMessage) (string, error) {
+func (t *WriteFile) Execute(ctx context.Context, input json.RawMessage) (string, error) {
 	var p struct {
 		Path    string `json:"path"`
 		Content string `json:"content"`
@@ -39,7 +40,7 @@ func (t *WriteFile) Execute(input json.RawMessage) (string, error) {
 	if existing, err := os.ReadFile(p.Path); err == nil && t.confirm != nil {
 		oldLines := strings.Count(string(existing), "\n") + 1
 		newLines := strings.Count(p.Content, "\n") + 1
-		if !t.confirm(p.Path, oldLines, newLines) {
+		if !t.confirm(ctx, p.Path, oldLines, newLines) {
 			return "用户取消", nil
 		}
 	}
@@ -29,7 +29,7 @@ var slashCommands = []slashCmd{
 	{"/init", "为当前项目生成 CLAUDE.md"},
 	{"/list", "查看最近对话记录"},
 	{"/resume", "恢复对话（可加编号）"},
-	{"/model", "查看/切换模型"},
+	{"/model", "查看/切换模型（list/pull 管理 Ollama 模型）"},
 	{"/ask", "临时用另一个模型回答"},
 	{"/search", "搜索历史对话"},
 	{"/undo", "撤销上一次 git commit"},
@@ -39,7 +39,9 @@ var slashCommands = []slashCmd{
 	{"/git", "快捷 git 操作 (status/log/branch)"},
 	{"/context", "查看上下文 token 用量"},
 	{"/skills", "查看已加载的技能"},
-	{"/skill", "激活技能 (/skill <name>)"},
+	{"/skill", "激活技能 (/skill <name>，/skill off <name> 停用)"},
+	{"/note", "会话笔记，加入系统提示 (/note <text>|clear)"},
+	{"/plan", "计划模式 (/plan status|off)"},
 	{"/budget", "设置费用上限"},
 	{"/cost", "显示累计 token 用量和费用"},
 	{"/help", "显示帮助"},
@@ -150,6 +152,7 @@ func ConfirmEdit(path, oldText, newText string) bool {
 
 var streamStarted bool
 var streamBuf strings.Builder
+var thinkingStarted bool
 
 func getTermWidth() int {
 	w, _, err := term.GetSize(int(os.Stdout.Fd()))
@@ -182,7 +185,21 @@ func PrintTextDelta(text string) {
 	fmt.Print(text)
 }
 
+// PrintThinkingDelta streams model reasoning in dim text. It is not
+// markdown-rendered and is closed by the next PrintBlockDone.
+func PrintThinkingDelta(text string) {
+	if !thinkingStarted {
+		fmt.Print("\n\033[90m💭 ")
+		thinkingStarted = true
+	}
+	fmt.Print("\033[90m" + text + "\033[0m")
+}
+
 func PrintBlockDone() {
+	if thinkingStarted {
+		fmt.Print("\033[0m\n")
+		thinkingStarted = false
+	}
 	if streamStarted {
 		raw := streamBuf.String()
 		rendered := RenderMarkdown(raw)
@@ -208,8 +225,26 @@ func PrintTool(name, input string) {
 	fmt.Printf("  🔧 %s(%s)\n", name, truncate(input, 80))
 }
 
-func PrintUsage(roundIn, roundOut, totalIn, totalOut int) {
-	fmt.Printf("📊 本轮: ↑%s ↓%s | 累计: ↑%s ↓%s\n", FmtTokens(roundIn), FmtTokens(roundOut), FmtTokens(totalIn), FmtTokens(totalOut))
+func PrintUsage(round, total llm.Usage) {
+	fmt.Printf("📊 本轮: ↑%s ↓%s%s | 累计: ↑%s ↓%s\n",
+		FmtTokens(round.PromptTokens()), FmtTokens(round.OutputTokens), FmtUsageDetail(round),
+		FmtTokens(total.PromptTokens()), FmtTokens(total.OutputTokens))
+}
+
+// FmtUsageDetail formats prompt-cache reads/writes and reasoning tokens, or ""
+// when there are none.
+func FmtUsageDetail(u llm.Usage) string {
+	var parts []string
+	if u.CacheReadInputTokens > 0 || u.CacheCreationInputTokens > 0 {
+		parts = append(parts, fmt.Sprintf("缓存 读%s 写%s", FmtTokens(u.CacheReadInputTokens), FmtTokens(u.CacheCreationInputTokens)))
+	}
+	if u.ReasoningTokens > 0 {
+		parts = append(parts, "推理 "+FmtTokens(u.ReasoningTokens))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
 }
 
 func FmtTokens(n int) string {
@@ -219,8 +254,8 @@ func FmtTokens(n int) string {
 	return fmt.Sprintf("%d", n)
 }
 
-func PrintTotalUsage(totalIn, totalOut int) {
-	fmt.Printf("📊 累计: ↑%s ↓%s\n", FmtTokens(totalIn), FmtTokens(totalOut))
+func PrintTotalUsage(total llm.Usage) {
+	fmt.Printf("📊 累计: ↑%s ↓%s%s\n", FmtTokens(total.PromptTokens()), FmtTokens(total.OutputTokens), FmtUsageDetail(total))
 }
 
 func PrintError(err error) {